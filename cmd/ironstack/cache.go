@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/phpstatus"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/site"
+)
+
+// Number of sites listed on the cache screen
+const cacheScreenSites = 10
+
+// cacheStatsMsg delivers statistics loaded in the background
+type cacheStatsMsg struct {
+	stats *cache.Stats
+	err   error
+}
+
+// loadCacheStats reads cache statistics without blocking the UI
+func loadCacheStats(cfg *config.Settings) tea.Cmd {
+	return func() tea.Msg {
+		stats, err := cache.New(cfg, runner.NewExec()).GetStats()
+		return cacheStatsMsg{stats: stats, err: err}
+	}
+}
+
+// sitePHPStatus is the PHP status of one registered site
+type sitePHPStatus struct {
+	domain string
+	status *phpstatus.Status
+	err    error
+}
+
+// phpStatusMsg delivers the PHP status of every site
+type phpStatusMsg struct {
+	sites []sitePHPStatus
+	err   error
+}
+
+// phpResetMsg reports a reset of a site's OPcache or realpath cache
+type phpResetMsg struct {
+	domain, which string
+	err           error
+}
+
+// loadPHPStatus asks every registered site's status script in the
+// background
+func loadPHPStatus(cfg *config.Settings) tea.Cmd {
+	return func() tea.Msg {
+		sm := site.NewManager(cfg, runner.NewExec())
+		domains, err := sm.List()
+		if err != nil {
+			return phpStatusMsg{err: err}
+		}
+		sites := make([]sitePHPStatus, 0, len(domains))
+		for _, domain := range domains {
+			st, err := sm.PHPStatus(domain)
+			sites = append(sites, sitePHPStatus{domain: domain, status: st, err: err})
+		}
+		return phpStatusMsg{sites: sites}
+	}
+}
+
+// resetPHP resets a cache of the PHP processes serving domain
+func resetPHP(cfg *config.Settings, domain, which string) tea.Cmd {
+	return func() tea.Msg {
+		err := site.NewManager(cfg, runner.NewExec()).ResetPHPCache(domain, which)
+		return phpResetMsg{domain: domain, which: which, err: err}
+	}
+}
+
+func (m model) openCacheScreen() (tea.Model, tea.Cmd) {
+	m.state = stateCache
+	m.cacheSite = 0
+	m.phpSite = 0
+	m.phpMessage = ""
+	return m.reloadCache()
+}
+
+// reloadCache loads what the current view of the cache screen shows
+func (m model) reloadCache() (tea.Model, tea.Cmd) {
+	m.cacheLoading = true
+	if m.cachePHP {
+		return m, tea.Batch(m.spinner.Tick, loadPHPStatus(m.cfg))
+	}
+	return m, tea.Batch(m.spinner.Tick, loadCacheStats(m.cfg))
+}
+
+func (m model) updateCache(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.cacheLoading && msg.String() != "esc" && msg.String() != "q" {
+		return m, nil
+	}
+	switch msg.String() {
+	case "esc", "q":
+		m.state = stateMenu
+	case "r":
+		m.phpMessage = ""
+		return m.reloadCache()
+	case "p":
+		m.cachePHP = !m.cachePHP
+		m.phpMessage = ""
+		return m.reloadCache()
+	case "o", "c":
+		if m.cachePHP && m.phpSite < len(m.phpSites) {
+			which := phpstatus.ResetOPcache
+			if msg.String() == "c" {
+				which = phpstatus.ResetRealpath
+			}
+			m.cacheLoading = true
+			return m, tea.Batch(m.spinner.Tick, resetPHP(m.cfg, m.phpSites[m.phpSite].domain, which))
+		}
+	case "up", "k":
+		if m.cachePHP && m.phpSite > 0 {
+			m.phpSite--
+		} else if !m.cachePHP && m.cacheSite > 0 {
+			m.cacheSite--
+		}
+	case "down", "j":
+		if m.cachePHP && m.phpSite < len(m.phpSites)-1 {
+			m.phpSite++
+		} else if !m.cachePHP && m.cacheStats != nil && m.cacheSite < min(len(m.cacheStats.Sites), cacheScreenSites)-1 {
+			m.cacheSite++
+		}
+	}
+	return m, nil
+}
+
+// handlePHPReset shows the outcome of a reset and reloads the statuses
+func (m model) handlePHPReset(msg phpResetMsg) (tea.Model, tea.Cmd) {
+	name := "OPcache"
+	if msg.which == phpstatus.ResetRealpath {
+		name = "Realpath cache"
+	}
+	if msg.err != nil {
+		m.phpMessage = errorStyle.Render(fmt.Sprintf("%s reset failed: %v", name, msg.err))
+	} else {
+		m.phpMessage = successStyle.Render(fmt.Sprintf("%s of %s reset", name, msg.domain))
+	}
+	return m.reloadCache()
+}
+
+func (m model) viewCache() string {
+	title := titleStyle.Render("  Cache Management  ")
+	footer := infoStyle.Render("↑/↓ Select site • p PHP status • r Refresh • ESC Back")
+	if m.cachePHP {
+		footer = infoStyle.Render("↑/↓ Select site • o Reset OPcache • c Clear realpath cache • p Varnish • r Refresh • ESC Back")
+	}
+
+	var body string
+	switch {
+	case m.cacheLoading && m.cachePHP:
+		body = m.spinner.View() + " Asking the sites' PHP processes..."
+	case m.cacheLoading:
+		body = m.spinner.View() + " Reading cache statistics..."
+	case m.cachePHP:
+		body = m.viewPHPStatus()
+	case m.cacheErr != nil:
+		body = errorStyle.Render("Error: " + m.cacheErr.Error())
+	default:
+		body = m.viewCacheStats()
+	}
+
+	content := lipgloss.JoinVertical(lipgloss.Left, title, "", body, "", footer)
+	return docStyle.Render(boxStyle.Render(content))
+}
+
+func (m model) viewCacheStats() string {
+	s := m.cacheStats
+	var b strings.Builder
+	fmt.Fprintf(&b, "Varnish hit rate:   %.1f%% (%d hits, %d misses)\n", s.VarnishHitRate, s.VarnishHits, s.VarnishMisses)
+	fmt.Fprintf(&b, "DragonflyDB:        %s, %d keys, %.1f%% hit rate\n", s.DragonflyMemory, s.DragonflyKeys, s.DragonflyHitRate)
+
+	if len(s.Sites) == 0 {
+		b.WriteString("\n" + infoStyle.Render("No requests in the Varnish log"))
+		return b.String()
+	}
+
+	b.WriteString("\n" + infoStyle.Render(fmt.Sprintf("  %-32s %9s %7s %7s %10s", "HOST", "REQUESTS", "HIT", "PASSES", "CACHED")) + "\n")
+	sites := s.Sites[:min(len(s.Sites), cacheScreenSites)]
+	for i, site := range sites {
+		line := fmt.Sprintf("%-32s %9d %6.1f%% %7d %10s", site.Host, site.Requests, site.HitRate, site.Passes, formatSize(site.BytesFromCache))
+		if i == m.cacheSite {
+			b.WriteString(selectedStyle.Render("> "+line) + "\n")
+		} else {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+
+	selected := sites[min(m.cacheSite, len(sites)-1)]
+	b.WriteString("\n" + subtitleStyle.Render(" "+selected.Host+" ") + "\n")
+	if len(selected.PassReasons) > 0 {
+		b.WriteString("Pass reasons: " + formatCounts(selected.PassReasons) + "\n")
+	}
+	if len(selected.TopMisses) == 0 {
+		b.WriteString(successStyle.Render("Every request was served from cache"))
+		return b.String()
+	}
+	b.WriteString("Top uncached URLs:\n")
+	for _, u := range selected.TopMisses {
+		fmt.Fprintf(&b, "  %5d miss %5d pass  %s\n", u.Misses, u.Passes, u.URL)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func (m model) viewPHPStatus() string {
+	if m.phpErr != nil {
+		return errorStyle.Render("Error: " + m.phpErr.Error())
+	}
+	if len(m.phpSites) == 0 {
+		return infoStyle.Render("No sites registered")
+	}
+
+	var b strings.Builder
+	b.WriteString(infoStyle.Render(fmt.Sprintf("  %-32s %8s %10s %8s", "SITE", "OPCACHE", "MEMORY", "SCRIPTS")) + "\n")
+	for i, s := range m.phpSites {
+		var line string
+		switch {
+		case s.err != nil:
+			line = fmt.Sprintf("%-32s %s", s.domain, "unavailable")
+		case s.status.OPcache == nil || !s.status.OPcache.Enabled:
+			line = fmt.Sprintf("%-32s %8s", s.domain, "off")
+		default:
+			o := s.status.OPcache
+			line = fmt.Sprintf("%-32s %7.1f%% %10s %8d", s.domain, o.Stats.HitRate, formatSize(o.Memory.Used), o.Stats.CachedScripts)
+		}
+		if i == m.phpSite {
+			b.WriteString(selectedStyle.Render("> "+line) + "\n")
+		} else {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+
+	selected := m.phpSites[min(m.phpSite, len(m.phpSites)-1)]
+	b.WriteString("\n" + subtitleStyle.Render(" "+selected.domain+" ") + "\n")
+	if selected.err != nil {
+		b.WriteString(errorStyle.Render(selected.err.Error()) + "\n")
+	} else {
+		writePHPStatus(&b, selected.status)
+	}
+	if m.phpMessage != "" {
+		b.WriteString("\n" + m.phpMessage)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,1160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/backup"
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/installer"
+	"github.com/maxaatest/ironstack/internal/monitoring"
+	"github.com/maxaatest/ironstack/internal/output"
+	"github.com/maxaatest/ironstack/internal/phpstatus"
+	"github.com/maxaatest/ironstack/internal/purge"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/security"
+	"github.com/maxaatest/ironstack/internal/site"
+	"github.com/maxaatest/ironstack/internal/wordpress"
+)
+
+// Exit codes returned by non-interactive commands
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// usageError marks errors caused by invalid command-line input
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// command is a single CLI action such as "site create"
+type command struct {
+	usage string
+	desc  string
+	run   func(args []string) error
+}
+
+// commandGroups maps a group ("site") to its subcommands ("create", "list", ...)
+var commandGroups = map[string]map[string]command{
+	"site": {
+		"create":  {"site create <domain> [--no-varnish [--page-cache]] [--keep-on-failure]", "Create a WordPress site", cmdSiteCreate},
+		"delete":  {"site delete <domain> [--keep-db]", "Delete a site, its database and its Caddy config", cmdSiteDelete},
+		"clone":   {"site clone <source> <target> [--keep-on-failure]", "Clone a site to a new domain", cmdSiteClone},
+		"list":    {"site list", "List all sites", cmdSiteList},
+		"info":    {"site info <domain>", "Show a site's settings and history", cmdSiteInfo},
+		"import":  {"site import <domain>", "Register a site created before the site registry", cmdSiteImport},
+		"isolate": {"site isolate <domain>", "Give a site sharing database 0 an object cache of its own", cmdSiteIsolate},
+		"caddy":   {"site caddy <domain> [--print]", "Regenerate a site's Caddy config from the registry", cmdSiteCaddy},
+		"staging": {"site staging <domain> [--keep-on-failure]", "Create staging.<domain> from a site", cmdSiteStaging},
+		"push":    {"site push <domain>", "Push staging.<domain> to production", cmdSitePush},
+		"certs":   {"site certs", "List managed SSL certificates", cmdSiteCerts},
+	},
+	"wp": {
+		"tune":   {"wp tune <domain>", "Apply WordPress performance tuning", cmdWPTune},
+		"update": {"wp update <domain>", "Update core, plugins and themes", cmdWPUpdate},
+		"harden": {"wp harden <domain>", "Apply WordPress security hardening", cmdWPHarden},
+	},
+	"cache": {
+		"purge":     {"cache purge [--site <domain>] [--tag <keys>] [--url <url>] [--pattern <re>]", "Purge caches", cmdCachePurge},
+		"stats":     {"cache stats", "Show cache statistics", cmdCacheStats},
+		"vcl":       {"cache vcl [--print]", "Regenerate the Varnish VCL from the site registry", cmdCacheVCL},
+		"warm":      {"cache warm <domain> [--mobile] [--local] [--limit <n>]", "Fetch the pages in a site's sitemap to fill the cache", cmdCacheWarm},
+		"autopurge": {"cache autopurge <domain> [--disable]", "Purge a site's changed posts from its page cache automatically", cmdCacheAutoPurge},
+		"serve":     {"cache serve", "Run the local endpoint the purge plugin notifies", cmdCacheServe},
+	},
+	"php": {
+		"status": {"php status <domain>", "Show the OPcache and runtime status of a site's PHP processes", cmdPHPStatus},
+		"reset":  {"php reset <domain> [--realpath]", "Reset the OPcache of a site's PHP processes", cmdPHPReset},
+		"enable": {"php enable <domain>", "Install a site's PHP status script", cmdPHPEnable},
+	},
+	"backup": {
+		"create":  {"backup create <domain> [--type full|db|files]", "Create a backup", cmdBackupCreate},
+		"restore": {"backup restore <domain> <backup-file>", "Restore a backup", cmdBackupRestore},
+		"list":    {"backup list <domain>", "List backups for a site", cmdBackupList},
+	},
+	"security": {
+		"block":   {"security block <ip> [--reason <text>]", "Block an IP address", cmdSecurityBlock},
+		"unblock": {"security unblock <ip>", "Unblock an IP address", cmdSecurityUnblock},
+		"status":  {"security status", "Show firewall and Fail2ban status", cmdSecurityStatus},
+	},
+	"secrets": {
+		"show":   {"secrets show <domain> [--name <name>]", "Show a site's stored credentials", cmdSecretsShow},
+		"rotate": {"secrets rotate <domain>", "Rotate a site's database password", cmdSecretsRotate},
+		"set":    {"secrets set <domain> <name>", "Store a secret read from stdin, e.g. an API token", cmdSecretsSet},
+	},
+	"analytics": {
+		"report": {"analytics report <domain>", "Generate a GoAccess report", cmdAnalyticsReport},
+	},
+}
+
+// topCommands are commands without a subcommand
+var topCommands = map[string]command{
+	"install": {"install", "Install the full stack", cmdInstall},
+	"status":  {"status", "Show server resources and service status", cmdStatus},
+}
+
+// Global options shared by every command
+var (
+	outputFormat = output.Table
+	configPath   = defaultConfigPath()
+	dryRun       bool
+	cfg          *config.Settings
+	cmdRunner    runner.Runner
+)
+
+// defaultConfigPath honours IRONSTACK_CONFIG before the standard location
+func defaultConfigPath() string {
+	if path := os.Getenv("IRONSTACK_CONFIG"); path != "" {
+		return path
+	}
+	return config.DefaultPath
+}
+
+// runCLI executes a non-interactive command and returns the process exit code
+func runCLI(args []string) int {
+	err := dispatch(args)
+	if err == nil {
+		return exitOK
+	}
+
+	printError(os.Stderr, err)
+	var uerr *usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintln(os.Stderr, "Run 'ironstack --help' for usage.")
+		return exitUsage
+	}
+	return exitError
+}
+
+// printError reports err on w. Partial failures list every failed step, and
+// failed commands show the end of their stderr.
+func printError(w io.Writer, err error) {
+	var errs *runner.Errors
+	if errors.As(err, &errs) && len(errs.Steps) > 1 {
+		fmt.Fprintf(w, "Error: %d steps failed\n", len(errs.Steps))
+		for _, s := range errs.Steps {
+			fmt.Fprintf(w, "  ✗ %v\n", s)
+			printStderr(w, s.Err, "      ")
+		}
+		return
+	}
+	fmt.Fprintf(w, "Error: %v\n", err)
+	printStderr(w, err, "  ")
+}
+
+// printStderr prints the stderr tail of a failed command if it has more
+// than the single line already included in the error message
+func printStderr(w io.Writer, err error, indent string) {
+	var cerr *runner.CommandError
+	if !errors.As(err, &cerr) || !strings.Contains(cerr.Stderr, "\n") {
+		return
+	}
+	for _, line := range strings.Split(cerr.Stderr, "\n") {
+		fmt.Fprintf(w, "%s| %s\n", indent, line)
+	}
+}
+
+func dispatch(args []string) error {
+	// Global options may precede the command
+	global := newFlagSet("ironstack")
+	if err := global.Parse(args); err != nil {
+		return usagef("%v", err)
+	}
+	args = global.Args()
+	if len(args) == 0 {
+		return usagef("no command given")
+	}
+
+	name := args[0]
+	if cmd, ok := topCommands[name]; ok {
+		return cmd.run(args[1:])
+	}
+
+	group, ok := commandGroups[name]
+	if !ok {
+		return usagef("unknown command %q", name)
+	}
+	if len(args) < 2 {
+		return usagef("%s requires a subcommand: %s", name, strings.Join(subcommandNames(group), ", "))
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		return usagef("unknown %s subcommand %q", name, args[1])
+	}
+	return cmd.run(args[2:])
+}
+
+func subcommandNames(group map[string]command) []string {
+	var names []string
+	for n := range group {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printUsage writes the full command reference
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "IronStack WP - WordPress VPS Control Panel")
+	fmt.Fprintln(w, "\nUsage: ironstack [options]")
+	fmt.Fprintln(w, "       ironstack <command> [arguments]")
+	fmt.Fprintln(w, "\nOptions:")
+	fmt.Fprintln(w, "  -v, --version  Show version")
+	fmt.Fprintln(w, "  -h, --help     Show help")
+	fmt.Fprintln(w, "  -o, --output   Output format for list/status commands: table, json, yaml")
+	fmt.Fprintf(w, "  --config       Configuration file (default %s)\n", config.DefaultPath)
+	fmt.Fprintln(w, "  --dry-run      Print commands and file writes instead of executing them")
+	fmt.Fprintln(w, "\nCommands:")
+
+	var lines [][2]string
+	for _, cmd := range topCommands {
+		lines = append(lines, [2]string{cmd.usage, cmd.desc})
+	}
+	for _, group := range commandGroups {
+		for _, cmd := range group {
+			lines = append(lines, [2]string{cmd.usage, cmd.desc})
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][0] < lines[j][0] })
+	for _, l := range lines {
+		fmt.Fprintf(w, "  %-74s %s\n", l[0], l[1])
+	}
+	fmt.Fprintln(w, "\nRun without arguments to start the interactive UI.")
+}
+
+// newFlagSet creates a subcommand flag set that also accepts the global options
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var(&outputFormat, "output", "output format: table, json or yaml")
+	fs.Var(&outputFormat, "o", "shorthand for --output")
+	fs.StringVar(&configPath, "config", configPath, "configuration file")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "print commands and file writes instead of executing them")
+	return fs
+}
+
+// render writes a command result in the selected output format
+func render(kind string, data interface{}, table func(w io.Writer)) error {
+	return output.Write(os.Stdout, outputFormat, kind, data, table)
+}
+
+// parseArgs parses flags, checks the number of positional arguments,
+// loads the configuration file selected by --config and selects the runner
+func parseArgs(fs *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	// Flags may appear before or after positional arguments
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usagef("%s: %v", fs.Name(), err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+	if len(rest) != len(names) {
+		return nil, usagef("%s expects %d argument(s): %s", fs.Name(), len(names), strings.Join(names, " "))
+	}
+
+	loaded, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg = loaded
+
+	cmdRunner = runner.NewExec()
+	if dryRun {
+		// Dry-run output goes to stderr so --output json stays parseable
+		cmdRunner = runner.NewDryRun(os.Stderr)
+	}
+	return rest, nil
+}
+
+// sitePath returns the site directory for a domain, failing if the site is
+// not in the registry
+func sitePath(domain string) (string, error) {
+	s, err := getSite(domain)
+	if err != nil {
+		return "", err
+	}
+	return s.Path, nil
+}
+
+// getSite looks up a registered site, pointing at site import for sites
+// created before the registry
+func getSite(domain string) (*site.Site, error) {
+	s, err := site.NewManager(cfg, cmdRunner).Get(domain)
+	if errors.Is(err, site.ErrNotRegistered) {
+		return nil, fmt.Errorf("site %s not found (sites created before the registry can be added with 'ironstack site import %s')", domain, domain)
+	}
+	return s, err
+}
+
+// recordHistory adds an entry to a site's history. The operation itself has
+// already succeeded, so a failure is only reported as a warning.
+func recordHistory(domain, action, detail string) {
+	m := site.NewManager(cfg, cmdRunner)
+	s, err := m.Get(domain)
+	if err == nil {
+		err = m.Registry.Record(s.Domain, action, detail)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record %s in site history: %v\n", action, err)
+	}
+}
+
+// --- Stack ---
+
+func cmdInstall(args []string) error {
+	if _, err := parseArgs(newFlagSet("install"), args); err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := installer.CheckRequirements(); err != nil {
+			return err
+		}
+	}
+	return installer.New(cfg, cmdRunner).InstallAll(func(e installer.Event) {
+		switch e.Type {
+		case installer.EventStarted:
+			fmt.Printf("==> Installing %s\n", e.Component)
+		case installer.EventOutput:
+			fmt.Printf("    %s\n", e.Line)
+		case installer.EventSucceeded:
+			fmt.Printf("✓ %s installed\n", e.Component)
+		case installer.EventFailed:
+			fmt.Printf("✗ %s failed\n", e.Component)
+		}
+	})
+}
+
+func cmdStatus(args []string) error {
+	if _, err := parseArgs(newFlagSet("status"), args); err != nil {
+		return err
+	}
+
+	srv := monitoring.NewServer(cfg, cmdRunner)
+	stats, err := srv.GetStats()
+	if err != nil {
+		return err
+	}
+	report := statusReport{
+		Server:   stats,
+		Services: srv.GetServiceStatus(),
+		Alerts:   srv.CheckAlerts(stats),
+	}
+	if report.Alerts == nil {
+		report.Alerts = []monitoring.Alert{}
+	}
+
+	return render("status", report, func(w io.Writer) {
+		fmt.Fprintf(w, "Host:      %s\n", stats.Hostname)
+		fmt.Fprintf(w, "Uptime:    %s\n", stats.Uptime)
+		fmt.Fprintf(w, "CPU:       %.1f%% (%d cores)\n", stats.CPU.Usage, stats.CPU.Cores)
+		fmt.Fprintf(w, "Memory:    %.1f%%\n", stats.Memory.UsagePercent)
+		fmt.Fprintf(w, "Disk:      %.1f%%\n", stats.Disk.UsagePercent)
+		fmt.Fprintf(w, "Load:      %.2f %.2f %.2f\n", stats.Load.Load1, stats.Load.Load5, stats.Load.Load15)
+		fmt.Fprintln(w, "\nServices:")
+		for _, svc := range report.Services {
+			state := "inactive"
+			if svc.Active {
+				state = "active"
+			}
+			fmt.Fprintf(w, "  %-12s %-9s %s\n", svc.Name, state, svc.Memory)
+		}
+		if len(report.Alerts) > 0 {
+			fmt.Fprintln(w, "\nAlerts:")
+			for _, a := range report.Alerts {
+				fmt.Fprintf(w, "  [%s] %s: %s\n", strings.ToUpper(a.Level), a.Service, a.Message)
+			}
+		}
+	})
+}
+
+// statusReport is the "status" output document
+type statusReport struct {
+	Server   *monitoring.Stats          `json:"server"`
+	Services []monitoring.ServiceStatus `json:"services"`
+	Alerts   []monitoring.Alert         `json:"alerts"`
+}
+
+// --- Sites ---
+
+func cmdSiteCreate(args []string) error {
+	fs := newFlagSet("site create")
+	noVarnish := fs.Bool("no-varnish", false, "serve PHP directly without Varnish")
+	pageCache := fs.Bool("page-cache", false, "with --no-varnish, cache pages in Caddy (requires the cache-handler module)")
+	keep := fs.Bool("keep-on-failure", false, "keep partially created files and database for debugging")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if *pageCache && !*noVarnish {
+		return usagef("site create: --page-cache requires --no-varnish")
+	}
+
+	s := &site.Site{Domain: rest[0], EnableSSL: true, UseVarnish: !*noVarnish}
+	if *pageCache {
+		s.Caddy.PageCache = &config.PageCache{}
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	m.KeepOnFailure = *keep
+	if err := m.Create(s); err != nil {
+		return err
+	}
+	fmt.Printf("Site %s created\n", s.Domain)
+	fmt.Printf("  Path:     %s\n", s.Path)
+	fmt.Printf("  Database: %s (user %s)\n", s.DBName, s.DBUser)
+	return nil
+}
+
+func cmdSiteDelete(args []string) error {
+	fs := newFlagSet("site delete")
+	keepDB := fs.Bool("keep-db", false, "keep the site's database and database user")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if _, err := sitePath(rest[0]); err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	m.KeepDatabase = *keepDB
+	if err := m.Delete(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Site %s deleted\n", rest[0])
+	return nil
+}
+
+func cmdSiteClone(args []string) error {
+	fs := newFlagSet("site clone")
+	keep := fs.Bool("keep-on-failure", false, "keep partially cloned files and database for debugging")
+	rest, err := parseArgs(fs, args, "<source>", "<target>")
+	if err != nil {
+		return err
+	}
+	if _, err := sitePath(rest[0]); err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	m.KeepOnFailure = *keep
+	if err := m.Clone(rest[0], rest[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Site %s cloned to %s\n", rest[0], rest[1])
+	return nil
+}
+
+func cmdSiteList(args []string) error {
+	if _, err := parseArgs(newFlagSet("site list"), args); err != nil {
+		return err
+	}
+	domains, err := site.NewManager(cfg, cmdRunner).ListDomains()
+	if err != nil {
+		return err
+	}
+	if domains == nil {
+		domains = []site.DomainInfo{}
+	}
+
+	return render("site.list", domains, func(w io.Writer) {
+		for _, d := range domains {
+			flags := []string{}
+			if d.HasWordPress {
+				flags = append(flags, "wordpress")
+			}
+			if d.HasSSL {
+				flags = append(flags, "ssl")
+			}
+			if d.IsStaging {
+				flags = append(flags, "staging")
+			}
+			fmt.Fprintf(w, "%-40s %s\n", d.Domain, strings.Join(flags, ","))
+		}
+	})
+}
+
+func cmdSiteInfo(args []string) error {
+	rest, err := parseArgs(newFlagSet("site info"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	s, err := site.NewManager(cfg, cmdRunner).Get(rest[0])
+	if err != nil {
+		return err
+	}
+
+	return render("site", s, func(w io.Writer) {
+		fmt.Fprintf(w, "Domain:     %s\n", s.Domain)
+		fmt.Fprintf(w, "Path:       %s\n", s.Path)
+		fmt.Fprintf(w, "Database:   %s (user %s)\n", s.DBName, s.DBUser)
+		fmt.Fprintf(w, "Varnish:    %t\n", s.UseVarnish)
+		fmt.Fprintf(w, "Page cache: %s\n", s.PageCache())
+		if len(s.Aliases) > 0 {
+			fmt.Fprintf(w, "Aliases:    %s\n", strings.Join(s.Aliases, ", "))
+		}
+		if s.StagingOf != "" {
+			fmt.Fprintf(w, "Staging of: %s\n", s.StagingOf)
+		}
+		fmt.Fprintf(w, "PHP:        memory %s, uploads %s, max execution %ds\n",
+			s.PHP.MemoryLimit, s.PHP.UploadMaxSize, s.PHP.MaxExecutionTime)
+		fmt.Fprintf(w, "Created:    %s\n", s.Created.Local().Format("2006-01-02 15:04"))
+		if len(s.History) > 0 {
+			fmt.Fprintln(w, "\nHistory:")
+			for _, h := range s.History {
+				fmt.Fprintf(w, "  %s  %-14s %s\n", h.Time.Local().Format("2006-01-02 15:04"), h.Action, h.Detail)
+			}
+		}
+	})
+}
+
+func cmdSiteImport(args []string) error {
+	rest, err := parseArgs(newFlagSet("site import"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	s, err := site.NewManager(cfg, cmdRunner).Import(rest[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Site %s registered (database %s)\n", s.Domain, s.DBName)
+	return nil
+}
+
+func cmdSiteIsolate(args []string) error {
+	rest, err := parseArgs(newFlagSet("site isolate"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	oc, err := site.NewManager(cfg, cmdRunner).IsolateObjectCache(rest[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Site %s now uses object cache database %d with prefix %s\n", rest[0], oc.Database, oc.Prefix)
+	return nil
+}
+
+func cmdSiteCaddy(args []string) error {
+	fs := newFlagSet("site caddy")
+	printOnly := fs.Bool("print", false, "print the generated config instead of installing it")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	if *printOnly {
+		data, err := m.CaddyConfig(rest[0])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := m.UpdateCaddyConfig(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Caddy config of %s updated\n", rest[0])
+	return nil
+}
+
+func cmdSiteCerts(args []string) error {
+	if _, err := parseArgs(newFlagSet("site certs"), args); err != nil {
+		return err
+	}
+	certs, err := site.NewSSL(cfg, cmdRunner).ListCertificates()
+	if err != nil {
+		return err
+	}
+	if certs == nil {
+		certs = []site.CertInfo{}
+	}
+
+	return render("site.certs", certs, func(w io.Writer) {
+		for _, c := range certs {
+			fmt.Fprintf(w, "%-40s %4d days  %s\n", c.Domain, c.DaysLeft, c.Issuer)
+		}
+	})
+}
+
+func cmdSiteStaging(args []string) error {
+	fs := newFlagSet("site staging")
+	keep := fs.Bool("keep-on-failure", false, "keep partially cloned files and database for debugging")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if _, err := sitePath(rest[0]); err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	m.KeepOnFailure = *keep
+	if err := m.CreateStaging(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Staging site staging.%s created\n", rest[0])
+	return nil
+}
+
+func cmdSitePush(args []string) error {
+	rest, err := parseArgs(newFlagSet("site push"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if _, err := sitePath("staging." + rest[0]); err != nil {
+		return err
+	}
+	if err := site.NewManager(cfg, cmdRunner).PushToProduction(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("staging.%s pushed to %s\n", rest[0], rest[0])
+	return nil
+}
+
+// --- WordPress ---
+
+// runWordPress runs action against the site named in args and records it in
+// the site's history
+func runWordPress(args []string, name string, action func(wp *wordpress.WordPress) error) error {
+	rest, err := parseArgs(newFlagSet(name), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	s, err := getSite(rest[0])
+	if err != nil {
+		return err
+	}
+	wp := wordpress.New(s.Path, cfg, cmdRunner)
+	wp.ObjectCache = s.ObjectCache
+	if err := action(wp); err != nil {
+		return err
+	}
+	recordHistory(rest[0], name, "")
+	return nil
+}
+
+func cmdWPTune(args []string) error {
+	return runWordPress(args, "wp tune", (*wordpress.WordPress).AutoTune)
+}
+
+func cmdWPUpdate(args []string) error {
+	return runWordPress(args, "wp update", (*wordpress.WordPress).UpdateAll)
+}
+
+func cmdWPHarden(args []string) error {
+	return runWordPress(args, "wp harden", (*wordpress.WordPress).Harden)
+}
+
+// --- Cache ---
+
+func cmdCachePurge(args []string) error {
+	fs := newFlagSet("cache purge")
+	domain := fs.String("site", "", "purge all caches for a site")
+	url := fs.String("url", "", "purge a single URL from Varnish")
+	pattern := fs.String("pattern", "", "purge URLs matching a regex from Varnish")
+	tags := fs.String("tag", "", "with --site, purge the pages tagged with these comma-separated keys, e.g. post-12")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if *tags != "" && *domain == "" {
+		return usagef("cache purge: --tag requires --site")
+	}
+
+	m := cache.New(cfg, cmdRunner)
+	switch {
+	case *url != "":
+		return m.PurgeVarnishURL(*url)
+	case *pattern != "":
+		return m.PurgeVarnish(*pattern)
+	case *domain != "":
+		s, err := getSite(*domain)
+		if err != nil {
+			return err
+		}
+		if *tags != "" {
+			return m.PurgeTags(s.CacheSite(), strings.Split(*tags, ",")...)
+		}
+		return site.NewManager(cfg, cmdRunner).PurgeCaches(s.Domain)
+	default:
+		return m.PurgeVarnishAll()
+	}
+}
+
+func cmdCacheStats(args []string) error {
+	if _, err := parseArgs(newFlagSet("cache stats"), args); err != nil {
+		return err
+	}
+	stats, err := cache.New(cfg, cmdRunner).GetStats()
+	if err != nil {
+		return err
+	}
+
+	return render("cache.stats", stats, func(w io.Writer) {
+		fmt.Fprintf(w, "Varnish hit rate:   %.1f%% (%d hits, %d misses)\n", stats.VarnishHitRate, stats.VarnishHits, stats.VarnishMisses)
+		fmt.Fprintf(w, "DragonflyDB memory: %s\n", stats.DragonflyMemory)
+		fmt.Fprintf(w, "DragonflyDB keys:   %d\n", stats.DragonflyKeys)
+		if l := stats.DragonflyLatency; l != nil {
+			fmt.Fprintf(w, "DragonflyDB PING:   %s avg (%s min, %s max)\n", l.Avg, l.Min, l.Max)
+		}
+		if len(stats.Sites) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "\nSites (requests in the Varnish log):")
+		fmt.Fprintf(w, "  %-32s %9s %7s %7s %10s  %s\n", "HOST", "REQUESTS", "HIT", "PASSES", "CACHED", "PASS REASONS")
+		for _, site := range stats.Sites {
+			fmt.Fprintf(w, "  %-32s %9d %6.1f%% %7d %10s  %s\n", site.Host, site.Requests, site.HitRate, site.Passes,
+				formatSize(site.BytesFromCache), formatCounts(site.PassReasons))
+			for _, u := range site.TopMisses[:min(len(site.TopMisses), 3)] {
+				fmt.Fprintf(w, "      %5d miss %5d pass  %s\n", u.Misses, u.Passes, u.URL)
+			}
+		}
+	})
+}
+
+func cmdCacheVCL(args []string) error {
+	fs := newFlagSet("cache vcl")
+	printOnly := fs.Bool("print", false, "print the generated VCL instead of loading it")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	if *printOnly {
+		data, err := m.VCL()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := m.UpdateVCL(); err != nil {
+		return err
+	}
+	fmt.Println("Varnish VCL updated")
+	return nil
+}
+
+func cmdCacheWarm(args []string) error {
+	fs := newFlagSet("cache warm")
+	mobile := fs.Bool("mobile", false, "also fetch every page as a mobile browser")
+	local := fs.Bool("local", false, "connect to this server instead of resolving the domain")
+	concurrency := fs.Int("concurrency", 4, "parallel requests")
+	rate := fs.Float64("rate", 10, "requests per second, 0 for no limit")
+	limit := fs.Int("limit", 0, "fetch at most this many pages, 0 for all")
+	sitemap := fs.String("sitemap", "", "sitemap URL (default: discovered from the site)")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *rate < 0 || *limit < 0 {
+		return usagef("cache warm: --concurrency must be at least 1, --rate and --limit must not be negative")
+	}
+	s, err := getSite(rest[0])
+	if err != nil {
+		return err
+	}
+
+	w := cache.NewWarmer(cmdRunner)
+	w.Concurrency = *concurrency
+	w.Rate = *rate
+	w.MaxURLs = *limit
+	if *mobile {
+		w.Variants = []cache.Variant{cache.Desktop, cache.Mobile}
+	}
+	scheme, port := "http", "80"
+	if s.EnableSSL {
+		scheme, port = "https", "443"
+	}
+	if *local {
+		w.Connect("127.0.0.1:" + port)
+	}
+
+	var urls []string
+	if *sitemap != "" {
+		urls, err = w.Sitemap(*sitemap)
+	} else {
+		urls, err = w.Discover(scheme + "://" + s.Domain)
+	}
+	if err != nil {
+		return err
+	}
+	report := w.Warm(urls)
+
+	return render("cache.warm", report, func(w io.Writer) {
+		for _, r := range report.Results {
+			status := "-"
+			if r.Status != 0 {
+				status = strconv.Itoa(r.Status)
+			}
+			fmt.Fprintf(w, "%-3s %-4s %-7s %8s  %s", status, r.Cache, r.Variant, r.Latency.Round(time.Millisecond), r.URL)
+			if r.Error != "" {
+				fmt.Fprintf(w, " (%s)", r.Error)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "\n%d pages, %d requests in %s: %d OK, %d errors, %d hits, %d misses\n",
+			report.URLs, report.Requests, report.Duration.Round(time.Millisecond), report.OK, report.Errors, report.Hits, report.Misses)
+		fmt.Fprintf(w, "Latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			report.P50.Round(time.Millisecond), report.P90.Round(time.Millisecond), report.P99.Round(time.Millisecond), report.Max.Round(time.Millisecond))
+	})
+}
+
+func cmdCacheAutoPurge(args []string) error {
+	fs := newFlagSet("cache autopurge")
+	disable := fs.Bool("disable", false, "remove the purge plugin instead of installing it")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if _, err := sitePath(rest[0]); err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	if *disable {
+		if err := m.DisableAutoPurge(rest[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Automatic purging of %s disabled\n", rest[0])
+		return nil
+	}
+	if err := m.EnableAutoPurge(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Automatic purging of %s enabled\n", rest[0])
+	return nil
+}
+
+func cmdCacheServe(args []string) error {
+	if _, err := parseArgs(newFlagSet("cache serve"), args); err != nil {
+		return err
+	}
+	srv := &purge.Server{
+		Addr:   fmt.Sprintf("127.0.0.1:%d", cfg.Ports.Purge),
+		Lookup: site.NewManager(cfg, cmdRunner).PurgeSite,
+		Cache:  cache.New(cfg, cmdRunner),
+		Log:    os.Stderr,
+	}
+	return srv.ListenAndServe()
+}
+
+// --- PHP ---
+
+func cmdPHPStatus(args []string) error {
+	rest, err := parseArgs(newFlagSet("php status"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	st, err := site.NewManager(cfg, cmdRunner).PHPStatus(rest[0])
+	if err != nil {
+		return err
+	}
+	return render("php.status", st, func(w io.Writer) { writePHPStatus(w, st) })
+}
+
+// writePHPStatus prints a PHP status as the table output of "php status"
+func writePHPStatus(w io.Writer, st *phpstatus.Status) {
+	fmt.Fprintf(w, "PHP:              %s (%s, pid %d)\n", st.PHPVersion, st.SAPI, st.PID)
+	fmt.Fprintf(w, "Request memory:   %s, peak %s, limit %s\n", formatSize(st.Memory.Usage), formatSize(st.Memory.Peak), st.Memory.Limit)
+	rc := st.RealpathCache
+	fmt.Fprintf(w, "Realpath cache:   %s of %s, %d entries, ttl %ds\n", formatSize(rc.Used), rc.Limit, rc.Entries, rc.TTL)
+	o := st.OPcache
+	if o == nil || !o.Enabled {
+		fmt.Fprintln(w, "OPcache:          disabled")
+		return
+	}
+	fmt.Fprintf(w, "OPcache:          %.1f%% hit rate (%d hits, %d misses), %d scripts\n", o.Stats.HitRate, o.Stats.Hits, o.Stats.Misses, o.Stats.CachedScripts)
+	fmt.Fprintf(w, "OPcache memory:   %s used, %s free, %s wasted (%.1f%%)\n", formatSize(o.Memory.Used), formatSize(o.Memory.Free), formatSize(o.Memory.Wasted), o.Memory.WastedPercent)
+	is := o.InternedStrings
+	fmt.Fprintf(w, "Interned strings: %s of %s, %d strings\n", formatSize(is.Used), formatSize(is.BufferSize), is.Strings)
+	fmt.Fprintf(w, "Restarts:         %d out of memory, %d hash, %d manual\n", o.Stats.OOMRestarts, o.Stats.HashRestarts, o.Stats.ManualRestarts)
+	if o.CacheFull {
+		fmt.Fprintln(w, "                  cache is full")
+	}
+	if j := o.JIT; j != nil && j.Enabled {
+		fmt.Fprintf(w, "JIT buffer:       %s free of %s\n", formatSize(j.BufferFree), formatSize(j.BufferSize))
+	} else {
+		fmt.Fprintln(w, "JIT:              disabled")
+	}
+}
+
+func cmdPHPReset(args []string) error {
+	fs := newFlagSet("php reset")
+	realpath := fs.Bool("realpath", false, "clear the realpath cache of the answering process instead")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	what, name := phpstatus.ResetOPcache, "OPcache"
+	if *realpath {
+		what, name = phpstatus.ResetRealpath, "Realpath cache"
+	}
+	if err := site.NewManager(cfg, cmdRunner).ResetPHPCache(rest[0], what); err != nil {
+		return err
+	}
+	fmt.Printf("%s of %s reset\n", name, rest[0])
+	return nil
+}
+
+func cmdPHPEnable(args []string) error {
+	rest, err := parseArgs(newFlagSet("php enable"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if err := site.NewManager(cfg, cmdRunner).EnablePHPStatus(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("PHP status script of %s installed\n", rest[0])
+	return nil
+}
+
+// --- Backups ---
+
+func cmdBackupCreate(args []string) error {
+	fs := newFlagSet("backup create")
+	kind := fs.String("type", "full", "backup type: full, db or files")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	path, err := sitePath(rest[0])
+	if err != nil {
+		return err
+	}
+
+	m := backup.New(cfg, cmdRunner)
+	var b *backup.Backup
+	switch *kind {
+	case "full":
+		b, err = m.CreateFull(path, rest[0])
+	case "db":
+		b, err = m.CreateDBOnly(path, rest[0])
+	case "files":
+		b, err = m.CreateFilesOnly(path, rest[0])
+	default:
+		return usagef("unknown backup type %q", *kind)
+	}
+	if err != nil {
+		return err
+	}
+	recordHistory(rest[0], "backup", b.Path)
+
+	return render("backup", b, func(w io.Writer) {
+		fmt.Fprintf(w, "Backup created: %s (%s)\n", b.Path, formatSize(b.Size))
+	})
+}
+
+func cmdBackupRestore(args []string) error {
+	rest, err := parseArgs(newFlagSet("backup restore"), args, "<domain>", "<backup-file>")
+	if err != nil {
+		return err
+	}
+	path, err := sitePath(rest[0])
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(rest[1]); err != nil {
+		return fmt.Errorf("backup %s not found", rest[1])
+	}
+	if err := backup.New(cfg, cmdRunner).Restore(rest[1], path); err != nil {
+		return err
+	}
+	recordHistory(rest[0], "restore", rest[1])
+	fmt.Printf("Backup %s restored to %s\n", filepath.Base(rest[1]), rest[0])
+	return nil
+}
+
+func cmdBackupList(args []string) error {
+	rest, err := parseArgs(newFlagSet("backup list"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	backups, err := backup.New(cfg, cmdRunner).List(rest[0])
+	if err != nil {
+		return err
+	}
+	if backups == nil {
+		backups = []backup.Backup{}
+	}
+
+	return render("backup.list", backups, func(w io.Writer) {
+		for _, b := range backups {
+			fmt.Fprintf(w, "%-6s %-10s %s  %s\n", b.Type, formatSize(b.Size), b.Created.Format("2006-01-02 15:04"), b.Path)
+		}
+	})
+}
+
+// --- Security ---
+
+func cmdSecurityBlock(args []string) error {
+	fs := newFlagSet("security block")
+	reason := fs.String("reason", "Blocked by IronStack", "comment stored with the block")
+	rest, err := parseArgs(fs, args, "<ip>")
+	if err != nil {
+		return err
+	}
+	if err := security.New(cmdRunner).BlockIP(rest[0], *reason); err != nil {
+		return err
+	}
+	fmt.Printf("Blocked %s\n", rest[0])
+	return nil
+}
+
+func cmdSecurityUnblock(args []string) error {
+	rest, err := parseArgs(newFlagSet("security unblock"), args, "<ip>")
+	if err != nil {
+		return err
+	}
+	if err := security.New(cmdRunner).UnblockIP(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Unblocked %s\n", rest[0])
+	return nil
+}
+
+func cmdSecurityStatus(args []string) error {
+	if _, err := parseArgs(newFlagSet("security status"), args); err != nil {
+		return err
+	}
+	sec := security.New(cmdRunner)
+	if outputFormat == output.Table {
+		fmt.Print(sec.GenerateSecurityReport())
+		return nil
+	}
+	return render("security.status", sec.GetSummary(), nil)
+}
+
+// --- Secrets ---
+
+func cmdSecretsShow(args []string) error {
+	fs := newFlagSet("secrets show")
+	only := fs.String("name", "", "show only this secret")
+	rest, err := parseArgs(fs, args, "<domain>")
+	if err != nil {
+		return err
+	}
+	values, err := site.NewManager(cfg, cmdRunner).Secrets(rest[0])
+	if err != nil {
+		return err
+	}
+	if *only != "" {
+		name := *only
+		value, ok := values[name]
+		if !ok {
+			return fmt.Errorf("%s has no secret %q", rest[0], name)
+		}
+		values = map[string]string{name: value}
+	}
+
+	return render("secrets", values, func(w io.Writer) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%-20s %s\n", name, values[name])
+		}
+	})
+}
+
+func cmdSecretsRotate(args []string) error {
+	rest, err := parseArgs(newFlagSet("secrets rotate"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	if err := site.NewManager(cfg, cmdRunner).RotateDBPassword(rest[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Database password for %s rotated\n", rest[0])
+	return nil
+}
+
+func cmdSecretsSet(args []string) error {
+	rest, err := parseArgs(newFlagSet("secrets set"), args, "<domain>", "<name>")
+	if err != nil {
+		return err
+	}
+	m := site.NewManager(cfg, cmdRunner)
+	s, err := m.Get(rest[0])
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return usagef("no value on stdin")
+	}
+	if err := m.Vault.Set(s.Domain, rest[1], value); err != nil {
+		return err
+	}
+	fmt.Printf("Secret %s stored for %s\n", rest[1], s.Domain)
+	return nil
+}
+
+// --- Analytics ---
+
+func cmdAnalyticsReport(args []string) error {
+	rest, err := parseArgs(newFlagSet("analytics report"), args, "<domain>")
+	if err != nil {
+		return err
+	}
+	goaccess := monitoring.NewGoAccess(cfg, cmdRunner)
+	if err := goaccess.GenerateReport(rest[0], goaccess.LogPath(rest[0])); err != nil {
+		return err
+	}
+	fmt.Printf("Report written for %s\n", rest[0])
+	return nil
+}
+
+// formatCounts formats a map of counts as "a 3, b 1", largest first
+func formatCounts(counts map[string]int64) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s %d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
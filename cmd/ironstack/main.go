@@ -3,12 +3,19 @@ package main
 import (
 	"fmt"
 	"os"
-	"time"
+	"strings"
 
+	"github.com/charmbracelet/bubbles/cursor"
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/installer"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/site"
 )
 
 const version = "1.0.0"
@@ -58,7 +65,7 @@ var menuDescs = []string{
 	"Caddy + Varnish + MariaDB + DragonflyDB + More",
 	"Create new site with auto SSL & DB",
 	"Performance tuning, plugins, updates",
-	"Varnish + DragonflyDB cache controls",
+	"Varnish, DragonflyDB and OPcache controls",
 	"MariaDB database management",
 	"CSF + Fail2ban configuration",
 	"GoAccess real-time web analytics",
@@ -67,17 +74,8 @@ var menuDescs = []string{
 	"Close IronStack",
 }
 
-// Components for installation
-var installComponents = []string{
-	"Caddy Server",
-	"Varnish Cache",
-	"MariaDB",
-	"DragonflyDB",
-	"WP-CLI",
-	"CSF Firewall",
-	"Fail2ban",
-	"GoAccess",
-}
+// Number of output lines shown under the component being installed
+const installOutputLines = 8
 
 type state int
 
@@ -86,19 +84,51 @@ const (
 	stateInstalling
 	stateAddSite
 	stateMessage
+	stateCache
+)
+
+type componentStatus int
+
+const (
+	componentPending componentStatus = iota
+	componentRunning
+	componentDone
+	componentFailed
 )
 
 type model struct {
+	cfg         *config.Settings
 	cursor      int
 	spinner     spinner.Model
 	textInput   textinput.Model
 	state       state
-	progress    int
 	message     string
 	messageType string
+
+	// Installation progress
+	installEvents <-chan installer.Event
+	components    []string
+	statuses      map[string]componentStatus
+	output        []string
+	installErr    error
+	installDone   bool
+
+	// Add site screen
+	creatingSite bool
+
+	// Cache screen
+	cacheStats   *cache.Stats
+	cacheErr     error
+	cacheLoading bool
+	cacheSite    int  // index of the selected site
+	cachePHP     bool // PHP status instead of the Varnish statistics
+	phpSites     []sitePHPStatus
+	phpErr       error
+	phpSite      int // index of the selected site
+	phpMessage   string
 }
 
-func initialModel() model {
+func initialModel(cfg *config.Settings) model {
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(purple)
@@ -110,6 +140,7 @@ func initialModel() model {
 	ti.Width = 40
 
 	return model{
+		cfg:       cfg,
 		spinner:   s,
 		textInput: ti,
 		state:     stateMenu,
@@ -125,9 +156,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case stateMenu:
 			return m.updateMenu(msg)
 		case stateInstalling:
-			if msg.String() == "esc" {
+			// A running installation cannot be interrupted safely
+			if m.installDone && (msg.String() == "esc" || msg.String() == "enter") {
 				m.state = stateMenu
-				m.progress = 0
 			}
 			return m, nil
 		case stateAddSite:
@@ -137,26 +168,46 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.state = stateMenu
 			}
 			return m, nil
+		case stateCache:
+			return m.updateCache(msg)
 		}
 
 	case spinner.TickMsg:
-		if m.state == stateInstalling {
+		if m.state == stateInstalling && !m.installDone || m.state == stateCache && m.cacheLoading || m.state == stateAddSite && m.creatingSite {
 			var cmd tea.Cmd
 			m.spinner, cmd = m.spinner.Update(msg)
 			return m, cmd
 		}
 
-	case installProgressMsg:
-		m.progress++
-		if m.progress >= len(installComponents) {
+	case cacheStatsMsg:
+		m.cacheLoading = false
+		m.cacheStats, m.cacheErr = msg.stats, msg.err
+		return m, nil
+
+	case phpStatusMsg:
+		m.cacheLoading = false
+		m.phpSites, m.phpErr = msg.sites, msg.err
+		return m, nil
+
+	case phpResetMsg:
+		return m.handlePHPReset(msg)
+
+	case siteCreatedMsg:
+		return m.handleSiteCreated(msg)
+
+	case installEventMsg:
+		return m.handleInstallEvent(installer.Event(msg))
+
+	case installDoneMsg:
+		m.installDone = true
+		if m.installErr == nil {
 			m.state = stateMessage
 			m.message = "Stack installation complete!"
 			m.messageType = "success"
-			return m, nil
 		}
-		return m, tea.Batch(m.spinner.Tick, tickInstall())
+		return m, nil
 
-	case textinput.BlinkMsg:
+	case cursor.BlinkMsg:
 		var cmd tea.Cmd
 		m.textInput, cmd = m.textInput.Update(msg)
 		return m, cmd
@@ -165,6 +216,57 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+func (m model) startInstall() (tea.Model, tea.Cmd) {
+	m.state = stateInstalling
+	m.installDone = false
+	m.installErr = nil
+	m.output = nil
+
+	if err := installer.CheckRequirements(); err != nil {
+		m.state = stateMessage
+		m.message = err.Error()
+		m.messageType = "error"
+		return m, nil
+	}
+
+	inst := installer.New(m.cfg, runner.NewExec())
+	m.components = nil
+	m.statuses = make(map[string]componentStatus)
+	for _, c := range inst.Components() {
+		m.components = append(m.components, c.Name)
+		m.statuses[c.Name] = componentPending
+	}
+
+	events := make(chan installer.Event)
+	go func() {
+		inst.InstallAll(func(e installer.Event) { events <- e })
+		close(events)
+	}()
+	m.installEvents = events
+
+	return m, tea.Batch(m.spinner.Tick, waitForInstallEvent(events))
+}
+
+func (m model) handleInstallEvent(e installer.Event) (tea.Model, tea.Cmd) {
+	switch e.Type {
+	case installer.EventStarted:
+		m.statuses[e.Component] = componentRunning
+		m.output = nil
+	case installer.EventOutput:
+		m.output = append(m.output, e.Line)
+		if len(m.output) > installOutputLines {
+			m.output = m.output[len(m.output)-installOutputLines:]
+		}
+	case installer.EventSucceeded:
+		m.statuses[e.Component] = componentDone
+	case installer.EventFailed:
+		m.statuses[e.Component] = componentFailed
+		m.installErr = e.Err
+		m.output = tailLines(e.Output, installOutputLines)
+	}
+	return m, waitForInstallEvent(m.installEvents)
+}
+
 func (m model) updateMenu(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.String() {
 	case "q", "ctrl+c":
@@ -180,49 +282,93 @@ func (m model) updateMenu(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "enter":
 		switch m.cursor {
 		case 0: // Install
-			m.state = stateInstalling
-			m.progress = 0
-			return m, tea.Batch(m.spinner.Tick, tickInstall())
+			return m.startInstall()
 		case 1: // Add Site
 			m.state = stateAddSite
 			m.textInput.SetValue("")
 			return m, textinput.Blink
+		case 3: // Cache
+			return m.openCacheScreen()
 		case 9: // Exit
 			return m, tea.Quit
-		default:
-			m.state = stateMessage
-			m.message = fmt.Sprintf("%s - Coming in Phase 3+", menuItems[m.cursor])
-			m.messageType = "info"
 		}
 	}
 	return m, nil
 }
 
 func (m model) updateAddSite(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.creatingSite {
+		// A site being created cannot be interrupted safely
+		return m, nil
+	}
 	switch msg.String() {
 	case "esc":
 		m.state = stateMenu
 		return m, nil
 	case "enter":
-		domain := m.textInput.Value()
-		if domain != "" {
-			m.state = stateMessage
-			m.message = fmt.Sprintf("Site '%s' created successfully!\n\nPath: /var/www/%s\nSSL: Auto-enabled\nCache: Varnish active", domain, domain)
-			m.messageType = "success"
+		domain := strings.TrimSpace(m.textInput.Value())
+		if domain == "" {
+			return m, nil
 		}
-		return m, nil
+		m.creatingSite = true
+		return m, tea.Batch(m.spinner.Tick, createSite(m.cfg, domain))
 	}
 	var cmd tea.Cmd
 	m.textInput, cmd = m.textInput.Update(msg)
 	return m, cmd
 }
 
-type installProgressMsg struct{}
+// siteCreatedMsg reports the outcome of creating a site
+type siteCreatedMsg struct {
+	site *site.Site
+	err  error
+}
+
+// createSite creates a site with Varnish and SSL in the background, like
+// `ironstack site create` does
+func createSite(cfg *config.Settings, domain string) tea.Cmd {
+	return func() tea.Msg {
+		s := &site.Site{Domain: domain, EnableSSL: true, UseVarnish: true}
+		err := site.NewManager(cfg, runner.NewExec()).Create(s)
+		return siteCreatedMsg{site: s, err: err}
+	}
+}
+
+func (m model) handleSiteCreated(msg siteCreatedMsg) (tea.Model, tea.Cmd) {
+	m.creatingSite = false
+	m.state = stateMessage
+	if msg.err != nil {
+		m.message = fmt.Sprintf("Failed to create %s: %v", msg.site.Domain, msg.err)
+		m.messageType = "error"
+		return m, nil
+	}
+	m.message = fmt.Sprintf("Site '%s' created successfully!\n\nPath: %s\nDatabase: %s (user %s)\nSSL: Auto-enabled\nCache: Varnish active",
+		msg.site.Domain, msg.site.Path, msg.site.DBName, msg.site.DBUser)
+	m.messageType = "success"
+	return m, nil
+}
+
+type installEventMsg installer.Event
+
+type installDoneMsg struct{}
+
+// waitForInstallEvent delivers the next installer event to the program
+func waitForInstallEvent(events <-chan installer.Event) tea.Cmd {
+	return func() tea.Msg {
+		e, ok := <-events
+		if !ok {
+			return installDoneMsg{}
+		}
+		return installEventMsg(e)
+	}
+}
 
-func tickInstall() tea.Cmd {
-	return tea.Tick(500*time.Millisecond, func(_ time.Time) tea.Msg {
-		return installProgressMsg{}
-	})
+func tailLines(s string, n int) []string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
 }
 
 func (m model) View() string {
@@ -233,6 +379,8 @@ func (m model) View() string {
 		return m.viewAddSite()
 	case stateMessage:
 		return m.viewMessage()
+	case stateCache:
+		return m.viewCache()
 	default:
 		return m.viewMenu()
 	}
@@ -265,22 +413,38 @@ func (m model) viewMenu() string {
 
 func (m model) viewInstalling() string {
 	var progress string
-	for i, comp := range installComponents {
-		if i < m.progress {
+	for _, comp := range m.components {
+		switch m.statuses[comp] {
+		case componentDone:
 			progress += successStyle.Render("  ✓ "+comp) + "\n"
-		} else if i == m.progress {
+		case componentFailed:
+			progress += errorStyle.Render("  ✗ "+comp) + "\n"
+		case componentRunning:
 			progress += m.spinner.View() + " Installing " + comp + "...\n"
-		} else {
+		default:
 			progress += infoStyle.Render("  ○ "+comp) + "\n"
 		}
 	}
 
+	var output string
+	for _, line := range m.output {
+		output += infoStyle.Render("    "+line) + "\n"
+	}
+
+	footer := infoStyle.Render("Installation in progress...")
+	if m.installErr != nil {
+		output = errorStyle.Render("Error: "+m.installErr.Error()) + "\n\n" + output
+	}
+	if m.installDone {
+		footer = infoStyle.Render("Press Enter to continue")
+	}
+
 	content := lipgloss.JoinVertical(lipgloss.Left,
 		titleStyle.Render("  Installing Full Stack  "),
 		"",
 		progress,
-		"",
-		infoStyle.Render("Press ESC to cancel"),
+		output,
+		footer,
 	)
 
 	return docStyle.Render(boxStyle.Render(content))
@@ -298,12 +462,19 @@ func (m model) viewAddSite() string {
 		infoStyle.Render("• Varnish cache enabled"),
 		infoStyle.Render("• Database auto-created"),
 		"",
-		infoStyle.Render("Enter to create • ESC to cancel"),
+		m.addSiteFooter(),
 	)
 
 	return docStyle.Render(boxStyle.Render(content))
 }
 
+func (m model) addSiteFooter() string {
+	if m.creatingSite {
+		return m.spinner.View() + " Creating " + strings.TrimSpace(m.textInput.Value()) + "..."
+	}
+	return infoStyle.Render("Enter to create • ESC to cancel")
+}
+
 func (m model) viewMessage() string {
 	style := successStyle
 	icon := "✓"
@@ -330,17 +501,21 @@ func main() {
 		case "--version", "-v":
 			fmt.Printf("IronStack WP v%s\n", version)
 			return
-		case "--help", "-h":
-			fmt.Println("IronStack WP - WordPress VPS Control Panel")
-			fmt.Println("\nUsage: ironstack [options]")
-			fmt.Println("\nOptions:")
-			fmt.Println("  -v, --version  Show version")
-			fmt.Println("  -h, --help     Show help")
+		case "--help", "-h", "help":
+			printUsage(os.Stdout)
 			return
+		default:
+			os.Exit(runCLI(os.Args[1:]))
 		}
 	}
 
-	p := tea.NewProgram(initialModel(), tea.WithAltScreen())
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := tea.NewProgram(initialModel(cfg), tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
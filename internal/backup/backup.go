@@ -1,32 +1,33 @@
 package backup
 
 import (
-	"compress/gzip"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Manager handles backup operations
 type Manager struct {
 	BackupDir string
+	Runner    runner.Runner
 }
 
 // New creates a backup manager
-func New() *Manager {
-	return &Manager{BackupDir: "/backups"}
+func New(cfg *config.Settings, r runner.Runner) *Manager {
+	return &Manager{BackupDir: cfg.BackupDir, Runner: r}
 }
 
 // Backup represents a backup file
 type Backup struct {
-	Name      string
-	Path      string
-	Size      int64
-	Created   time.Time
-	Type      string // "full", "db", "files"
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size_bytes"`
+	Created time.Time `json:"created"`
+	Type    string    `json:"type"` // "full", "db", "files"
 }
 
 // CreateFull creates a full backup (files + database)
@@ -36,30 +37,26 @@ func (m *Manager) CreateFull(sitePath, domain string) (*Backup, error) {
 	backupPath := filepath.Join(m.BackupDir, domain, backupName+".tar.gz")
 
 	// Create backup directory
-	os.MkdirAll(filepath.Dir(backupPath), 0755)
+	m.Runner.MkdirAll(filepath.Dir(backupPath), 0755)
 
 	// First, export the database
 	dbBackup := filepath.Join(sitePath, "database.sql")
-	if err := exec.Command("wp", "db", "export", dbBackup, "--path="+sitePath+"/public").Run(); err != nil {
+	if err := m.Runner.Run("wp", "db", "export", dbBackup, "--path="+sitePath+"/public"); err != nil {
 		return nil, fmt.Errorf("database export failed: %w", err)
 	}
 
 	// Create tar.gz of entire site
-	cmd := exec.Command("tar", "-czf", backupPath, "-C", filepath.Dir(sitePath), filepath.Base(sitePath))
-	if err := cmd.Run(); err != nil {
+	if err := m.Runner.Run("tar", "-czf", backupPath, "-C", filepath.Dir(sitePath), filepath.Base(sitePath)); err != nil {
 		return nil, fmt.Errorf("tar failed: %w", err)
 	}
 
 	// Clean up SQL file
-	os.Remove(dbBackup)
-
-	// Get file info
-	info, _ := os.Stat(backupPath)
+	m.Runner.Remove(dbBackup)
 
 	return &Backup{
 		Name:    backupName,
 		Path:    backupPath,
-		Size:    info.Size(),
+		Size:    fileSize(backupPath),
 		Created: time.Now(),
 		Type:    "full",
 	}, nil
@@ -72,28 +69,23 @@ func (m *Manager) CreateDBOnly(sitePath, domain string) (*Backup, error) {
 	backupPath := filepath.Join(m.BackupDir, domain, backupName+".sql.gz")
 
 	// Create backup directory
-	os.MkdirAll(filepath.Dir(backupPath), 0755)
+	m.Runner.MkdirAll(filepath.Dir(backupPath), 0755)
 
 	// Export database
 	sqlPath := filepath.Join(m.BackupDir, domain, backupName+".sql")
-	if err := exec.Command("wp", "db", "export", sqlPath, "--path="+sitePath+"/public").Run(); err != nil {
+	if err := m.Runner.Run("wp", "db", "export", sqlPath, "--path="+sitePath+"/public"); err != nil {
 		return nil, fmt.Errorf("database export failed: %w", err)
 	}
 
-	// Compress
-	if err := gzipFile(sqlPath, backupPath); err != nil {
+	// Compress (replaces the .sql file with .sql.gz)
+	if err := m.Runner.Run("gzip", "-f", sqlPath); err != nil {
 		return nil, fmt.Errorf("compression failed: %w", err)
 	}
 
-	// Clean up uncompressed
-	os.Remove(sqlPath)
-
-	info, _ := os.Stat(backupPath)
-
 	return &Backup{
 		Name:    backupName,
 		Path:    backupPath,
-		Size:    info.Size(),
+		Size:    fileSize(backupPath),
 		Created: time.Now(),
 		Type:    "db",
 	}, nil
@@ -106,22 +98,20 @@ func (m *Manager) CreateFilesOnly(sitePath, domain string) (*Backup, error) {
 	backupPath := filepath.Join(m.BackupDir, domain, backupName+".tar.gz")
 
 	// Create backup directory
-	os.MkdirAll(filepath.Dir(backupPath), 0755)
+	m.Runner.MkdirAll(filepath.Dir(backupPath), 0755)
 
 	// Create tar.gz excluding uploads (large files)
-	cmd := exec.Command("tar", "-czf", backupPath,
+	err := m.Runner.Run("tar", "-czf", backupPath,
 		"--exclude=wp-content/uploads",
 		"-C", filepath.Dir(sitePath), filepath.Base(sitePath))
-	if err := cmd.Run(); err != nil {
+	if err != nil {
 		return nil, fmt.Errorf("tar failed: %w", err)
 	}
 
-	info, _ := os.Stat(backupPath)
-
 	return &Backup{
 		Name:    backupName,
 		Path:    backupPath,
-		Size:    info.Size(),
+		Size:    fileSize(backupPath),
 		Created: time.Now(),
 		Type:    "files",
 	}, nil
@@ -133,16 +123,16 @@ func (m *Manager) Restore(backupPath, sitePath string) error {
 	case filepath.Ext(backupPath) == ".gz" && filepath.Ext(backupPath[:len(backupPath)-3]) == ".sql":
 		// Database-only restore
 		sqlPath := backupPath[:len(backupPath)-3]
-		if err := gunzipFile(backupPath, sqlPath); err != nil {
+		if err := m.Runner.Run("gzip", "-d", "-k", "-f", backupPath); err != nil {
 			return fmt.Errorf("decompress failed: %w", err)
 		}
-		if err := exec.Command("wp", "db", "import", sqlPath, "--path="+sitePath+"/public").Run(); err != nil {
+		if err := m.Runner.Run("wp", "db", "import", sqlPath, "--path="+sitePath+"/public"); err != nil {
 			return fmt.Errorf("import failed: %w", err)
 		}
-		os.Remove(sqlPath)
+		m.Runner.Remove(sqlPath)
 	default:
 		// Full restore
-		if err := exec.Command("tar", "-xzf", backupPath, "-C", filepath.Dir(sitePath)).Run(); err != nil {
+		if err := m.Runner.Run("tar", "-xzf", backupPath, "-C", filepath.Dir(sitePath)); err != nil {
 			return fmt.Errorf("extract failed: %w", err)
 		}
 	}
@@ -189,50 +179,16 @@ func (m *Manager) List(domain string) ([]Backup, error) {
 
 // Delete removes a backup
 func (m *Manager) Delete(backupPath string) error {
-	return os.Remove(backupPath)
+	return m.Runner.Remove(backupPath)
 }
 
 // helpers
 
-func gzipFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
-
-	_, err = io.Copy(gw, in)
-	return err
-}
-
-func gunzipFile(src, dst string) error {
-	in, err := os.Open(src)
+// fileSize returns the size of path, or 0 if it does not exist (e.g. in dry-run mode)
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
 	if err != nil {
-		return err
+		return 0
 	}
-	defer in.Close()
-
-	gr, err := gzip.NewReader(in)
-	if err != nil {
-		return err
-	}
-	defer gr.Close()
-
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, gr)
-	return err
+	return info.Size()
 }
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+func TestCreateFull(t *testing.T) {
+	fake := runner.NewFake()
+	m := &Manager{BackupDir: "/backups", Runner: fake}
+	b, err := m.CreateFull("/var/www/example.com", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Type != "full" || filepath.Dir(b.Path) != "/backups/example.com" || !strings.HasSuffix(b.Path, ".tar.gz") {
+		t.Errorf("backup = %+v", b)
+	}
+	want := []string{
+		"mkdir -p /backups/example.com",
+		"wp db export /var/www/example.com/database.sql --path=/var/www/example.com/public",
+		"tar -czf " + b.Path + " -C /var/www example.com",
+		"rm /var/www/example.com/database.sql",
+	}
+	if got := strings.Join(fake.Calls, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestCreateFullExportFails(t *testing.T) {
+	fake := runner.NewFake()
+	fake.On("wp db export", "", errors.New("exit status 1"))
+	m := &Manager{BackupDir: "/backups", Runner: fake}
+	if _, err := m.CreateFull("/var/www/example.com", "example.com"); err == nil || !strings.HasPrefix(err.Error(), "database export failed") {
+		t.Fatalf("CreateFull error = %v", err)
+	}
+	if fake.Ran("tar") {
+		t.Error("archive created without a database export")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		backup string
+		want   []string
+	}{
+		{
+			"/backups/example.com/example.com_db_2026-01-01_00-00-00.sql.gz",
+			[]string{
+				"gzip -d -k -f /backups/example.com/example.com_db_2026-01-01_00-00-00.sql.gz",
+				"wp db import /backups/example.com/example.com_db_2026-01-01_00-00-00.sql --path=/var/www/example.com/public",
+				"rm /backups/example.com/example.com_db_2026-01-01_00-00-00.sql",
+			},
+		},
+		{
+			"/backups/example.com/example.com_full_2026-01-01_00-00-00.tar.gz",
+			[]string{"tar -xzf /backups/example.com/example.com_full_2026-01-01_00-00-00.tar.gz -C /var/www"},
+		},
+	}
+	for _, tt := range tests {
+		fake := runner.NewFake()
+		m := &Manager{BackupDir: "/backups", Runner: fake}
+		if err := m.Restore(tt.backup, "/var/www/example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(fake.Calls, "\n"); got != strings.Join(tt.want, "\n") {
+			t.Errorf("Restore(%s) calls:\n%s\nwant:\n%s", filepath.Base(tt.backup), got, strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"example.com_full_2026-01-01_00-00-00.tar.gz",
+		"example.com_db_2026-01-01_00-00-00.sql.gz",
+		"example.com_files_2026-01-01_00-00-00.tar.gz",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, "example.com"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "example.com", name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &Manager{BackupDir: dir, Runner: runner.NewFake()}
+	backups, err := m.List("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]string)
+	for _, b := range backups {
+		types[b.Name] = b.Type
+	}
+	want := map[string]string{
+		"example.com_full_2026-01-01_00-00-00.tar.gz":  "full",
+		"example.com_db_2026-01-01_00-00-00.sql.gz":    "db",
+		"example.com_files_2026-01-01_00-00-00.tar.gz": "files",
+	}
+	for name, typ := range want {
+		if types[name] != typ {
+			t.Errorf("%s type = %q, want %q", name, types[name], typ)
+		}
+	}
+}
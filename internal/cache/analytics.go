@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"sort"
+
+	"github.com/maxaatest/ironstack/internal/varnishadm"
+)
+
+// topMisses is how many uncached URLs are reported per site
+const topMisses = 10
+
+// SiteStats are the cache statistics of one hostname, taken from the
+// requests still in the Varnish log
+type SiteStats struct {
+	Host           string           `json:"host"`
+	Requests       int64            `json:"requests"`
+	Hits           int64            `json:"hits"`
+	Misses         int64            `json:"misses"`
+	Passes         int64            `json:"passes"`
+	HitRate        float64          `json:"hit_rate"` // hits as a percentage of hits, misses and passes
+	BytesServed    int64            `json:"bytes_served"`
+	BytesFromCache int64            `json:"bytes_from_cache"`
+	PassReasons    map[string]int64 `json:"pass_reasons"` // cookie, method, admin, woocommerce, bypass_path, bypass_cookie or other
+	TopMisses      []URLStats       `json:"top_misses"`   // URLs most often fetched from the backend
+}
+
+// URLStats counts the uncached requests for one URL
+type URLStats struct {
+	URL    string `json:"url"`
+	Misses int64  `json:"misses"`
+	Passes int64  `json:"passes"`
+}
+
+// SiteStats returns per-host cache statistics from the Varnish log
+func (m *Manager) SiteStats() ([]SiteStats, error) {
+	entries, err := varnishadm.ReadLog(m.Runner)
+	if err != nil {
+		return nil, err
+	}
+	return GroupByHost(entries), nil
+}
+
+// GroupByHost computes the statistics of every host in entries, busiest
+// host first. Purges, bans and requests without a Host header are ignored.
+func GroupByHost(entries []varnishadm.LogEntry) []SiteStats {
+	sites := make(map[string]*SiteStats)
+	urls := make(map[string]map[string]*URLStats)
+	for _, e := range entries {
+		if e.Host == "" || e.Method == "PURGE" || e.Method == "BAN" {
+			continue
+		}
+		s := sites[e.Host]
+		if s == nil {
+			s = &SiteStats{Host: e.Host, PassReasons: make(map[string]int64)}
+			sites[e.Host] = s
+			urls[e.Host] = make(map[string]*URLStats)
+		}
+		s.Requests++
+		s.BytesServed += e.Bytes
+
+		switch e.Handling {
+		case varnishadm.HandlingHit:
+			s.Hits++
+			s.BytesFromCache += e.Bytes
+			continue
+		case varnishadm.HandlingMiss:
+			s.Misses++
+		case varnishadm.HandlingPass:
+			s.Passes++
+			reason := e.PassReason
+			if reason == "" {
+				reason = "other"
+			}
+			s.PassReasons[reason]++
+		default:
+			continue
+		}
+		u := urls[e.Host][e.URL]
+		if u == nil {
+			u = &URLStats{URL: e.URL}
+			urls[e.Host][e.URL] = u
+		}
+		if e.Handling == varnishadm.HandlingMiss {
+			u.Misses++
+		} else {
+			u.Passes++
+		}
+	}
+
+	result := make([]SiteStats, 0, len(sites))
+	for host, s := range sites {
+		if n := s.Hits + s.Misses + s.Passes; n > 0 {
+			s.HitRate = float64(s.Hits) / float64(n) * 100
+		}
+		s.TopMisses = topURLs(urls[host], topMisses)
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// topURLs returns the n URLs with the most uncached requests
+func topURLs(urls map[string]*URLStats, n int) []URLStats {
+	top := make([]URLStats, 0, len(urls))
+	for _, u := range urls {
+		top = append(top, *u)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i].Misses+top[i].Passes, top[j].Misses+top[j].Passes
+		if a != b {
+			return a > b
+		}
+		return top[i].URL < top[j].URL
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
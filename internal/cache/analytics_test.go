@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/varnishadm"
+)
+
+// ncsaLine is a varnishncsa line in the format ReadLog asks for
+func ncsaLine(host, method, url, handling, reason string, bytes int) string {
+	return fmt.Sprintf("%s\t%s\t%s\t200\t%d\t%s\t%s\n", host, method, url, bytes, handling, reason)
+}
+
+func TestGroupByHost(t *testing.T) {
+	var log strings.Builder
+	for i := 0; i < 6; i++ {
+		log.WriteString(ncsaLine("example.com", "GET", "/", "hit", "-", 1000))
+	}
+	log.WriteString(ncsaLine("example.com", "GET", "/feed/", "miss", "-", 500))
+	log.WriteString(ncsaLine("example.com", "GET", "/feed/", "miss", "-", 500))
+	log.WriteString(ncsaLine("example.com", "GET", "/cart/", "pass", "woocommerce", 300))
+	log.WriteString(ncsaLine("example.com", "GET", "/cart/", "pass", "cookie", 300))
+	log.WriteString(ncsaLine("example.com", "POST", "/wp-admin/admin-ajax.php", "pass", "-", 100))
+	log.WriteString(ncsaLine("example.com", "GET", "/health", "synth", "-", 0))
+	// Purges and requests without a Host header are not site traffic
+	log.WriteString(ncsaLine("example.com", "PURGE", "/", "synth", "-", 0))
+	log.WriteString(ncsaLine("-", "GET", "/", "miss", "-", 10))
+	log.WriteString(ncsaLine("blog.example.org", "GET", "/", "miss", "-", 2000))
+
+	got := GroupByHost(varnishadm.ParseLog(log.String()))
+	want := []SiteStats{
+		{
+			Host: "example.com", Requests: 12, Hits: 6, Misses: 2, Passes: 3,
+			HitRate:     float64(6) / 11 * 100,
+			BytesServed: 7700, BytesFromCache: 6000,
+			PassReasons: map[string]int64{"woocommerce": 1, "cookie": 1, "other": 1},
+			TopMisses: []URLStats{
+				{URL: "/cart/", Passes: 2},
+				{URL: "/feed/", Misses: 2},
+				{URL: "/wp-admin/admin-ajax.php", Passes: 1},
+			},
+		},
+		{
+			Host: "blog.example.org", Requests: 1, Misses: 1, BytesServed: 2000,
+			PassReasons: map[string]int64{},
+			TopMisses:   []URLStats{{URL: "/", Misses: 1}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupByHost =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestGroupByHostTopMisses(t *testing.T) {
+	var log strings.Builder
+	for i := 0; i < topMisses+5; i++ {
+		// /page-0 misses once, /page-1 twice and so on
+		for j := 0; j <= i; j++ {
+			log.WriteString(ncsaLine("example.com", "GET", fmt.Sprintf("/page-%02d", i), "miss", "-", 10))
+		}
+	}
+	sites := GroupByHost(varnishadm.ParseLog(log.String()))
+	if len(sites) != 1 {
+		t.Fatalf("GroupByHost = %+v", sites)
+	}
+	top := sites[0].TopMisses
+	if len(top) != topMisses {
+		t.Fatalf("%d top misses, want %d", len(top), topMisses)
+	}
+	if top[0] != (URLStats{URL: "/page-14", Misses: 15}) || top[topMisses-1] != (URLStats{URL: "/page-05", Misses: 6}) {
+		t.Errorf("top misses = %+v", top)
+	}
+	if sites[0].HitRate != 0 {
+		t.Errorf("HitRate = %v, want 0", sites[0].HitRate)
+	}
+}
@@ -1,58 +1,100 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/phpstatus"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/varnishadm"
 )
 
 // Manager handles all caching operations
-type Manager struct{}
+type Manager struct {
+	Redis       *Redis
+	Varnish     *varnishadm.Client
+	VarnishAddr string             // host:port of the Varnish frontend, for xkey purges
+	Caddy       *caddyadmin.Client // for purging Caddy's page cache
+	PHP         *phpstatus.Client  // for resetting the web server's OPcache
+	HTTP        *http.Client
+	Runner      runner.Runner
+}
 
 // New creates a new cache manager
-func New() *Manager {
-	return &Manager{}
+func New(cfg *config.Settings, r runner.Runner) *Manager {
+	return &Manager{
+		Redis:       NewRedis(cfg.RedisAddr(), cfg.Redis.Password),
+		Varnish:     varnishadm.New(cfg.Varnish.Admin, cfg.Varnish.Secret),
+		VarnishAddr: fmt.Sprintf("127.0.0.1:%d", cfg.Ports.Varnish),
+		Caddy:       caddyadmin.New(cfg.Caddy.Admin),
+		PHP:         phpstatus.New(cfg.Ports.PHPStatus, r),
+		HTTP:        &http.Client{Timeout: 30 * time.Second},
+		Runner:      r,
+	}
 }
 
 // Stats represents cache statistics
 type Stats struct {
-	VarnishHitRate    float64
-	DragonflyHitRate  float64
-	VarnishHits       int64
-	VarnishMisses     int64
-	DragonflyMemory   string
-	DragonflyKeys     int64
+	VarnishHitRate   float64          `json:"varnish_hit_rate"`
+	DragonflyHitRate float64          `json:"dragonfly_hit_rate"`
+	VarnishHits      int64            `json:"varnish_hits"`
+	VarnishMisses    int64            `json:"varnish_misses"`
+	DragonflyMemory  string           `json:"dragonfly_memory"`
+	DragonflyKeys    int64            `json:"dragonfly_keys"`
+	DragonflyLatency *Latency         `json:"dragonfly_latency,omitempty"` // PING round trips; nil if unreachable
+	Varnish          *varnishadm.Main `json:"varnish,omitempty"`           // nil if varnishstat failed
+	Dragonfly        *Info            `json:"dragonfly,omitempty"`         // nil if DragonflyDB is unreachable
+	Sites            []SiteStats      `json:"sites"`                       // per host, from the Varnish log
 }
 
+// latencySamples is how many PINGs GetStats measures DragonflyDB with
+const latencySamples = 5
+
 // GetStats retrieves cache statistics
 func (m *Manager) GetStats() (*Stats, error) {
-	stats := &Stats{}
+	stats := &Stats{Sites: []SiteStats{}}
 
 	// Get Varnish stats
-	if out, err := exec.Command("varnishstat", "-1", "-f", "MAIN.cache_hit", "-f", "MAIN.cache_miss").Output(); err == nil {
-		fmt.Sscanf(string(out), "MAIN.cache_hit %d\nMAIN.cache_miss %d", &stats.VarnishHits, &stats.VarnishMisses)
-		if stats.VarnishHits+stats.VarnishMisses > 0 {
-			stats.VarnishHitRate = float64(stats.VarnishHits) / float64(stats.VarnishHits+stats.VarnishMisses) * 100
-		}
+	if counters, err := varnishadm.ReadStats(m.Runner); err == nil {
+		v := counters.Main()
+		stats.Varnish = &v
+		stats.VarnishHits = int64(v.CacheHit)
+		stats.VarnishMisses = int64(v.CacheMiss)
+		stats.VarnishHitRate = v.HitRate()
 	}
 
-	// Get DragonflyDB stats
-	if out, err := exec.Command("redis-cli", "INFO", "memory").Output(); err == nil {
-		fmt.Sscanf(string(out), "used_memory_human:%s", &stats.DragonflyMemory)
+	// Get per-site stats
+	if sites, err := m.SiteStats(); err == nil {
+		stats.Sites = sites
 	}
 
-	if out, err := exec.Command("redis-cli", "DBSIZE").Output(); err == nil {
-		fmt.Sscanf(string(out), "(integer) %d", &stats.DragonflyKeys)
+	// Get DragonflyDB stats
+	if info, err := m.Redis.Info(); err == nil {
+		stats.Dragonfly = info
+		stats.DragonflyMemory = info.Memory.UsedHuman
+		stats.DragonflyKeys = info.Keys()
+		stats.DragonflyHitRate = info.Stats.HitRate()
+		if l, err := m.Redis.Latency(latencySamples); err == nil {
+			stats.DragonflyLatency = l
+		}
 	}
 
 	return stats, nil
 }
 
-// PurgeVarnish purges Varnish cache
+// PurgeVarnish bans every URL matching a regex from Varnish
 func (m *Manager) PurgeVarnish(pattern string) error {
 	if pattern == "" {
 		pattern = "."
 	}
-	return exec.Command("varnishadm", "ban", fmt.Sprintf("req.url ~ %s", pattern)).Run()
+	return m.ban("req.url", "~", pattern)
 }
 
 // PurgeVarnishAll purges entire Varnish cache
@@ -62,48 +104,162 @@ func (m *Manager) PurgeVarnishAll() error {
 
 // PurgeVarnishURL purges a specific URL
 func (m *Manager) PurgeVarnishURL(url string) error {
-	return exec.Command("varnishadm", "ban", fmt.Sprintf("req.url == %s", url)).Run()
+	return m.ban("req.url", "==", url)
+}
+
+// PurgeVarnishPaths bans the given paths of one site, including their
+// paginated pages ("page/2/") and query string variants. hosts are the
+// site's domain and aliases.
+func (m *Manager) PurgeVarnishPaths(hosts, paths []string) error {
+	if len(hosts) == 0 || len(paths) == 0 {
+		return nil
+	}
+	return m.ban(
+		"obj.http.X-Host", "~", "^(?:"+quoteAll(hosts)+")$",
+		"&&",
+		"obj.http.X-Url", "~", "^(?:"+quoteAll(paths)+`)(?:page/[0-9]+/)?(?:\?.*)?$`,
+	)
 }
 
-// FlushDragonfly flushes DragonflyDB
-func (m *Manager) FlushDragonfly() error {
-	return exec.Command("redis-cli", "FLUSHALL").Run()
+// PurgeByTag removes every page of a site tagged with one of the surrogate
+// keys WordPress sent, e.g. "post-12" or "term-5", using vmod_xkey. site is
+// the site's domain; the VCL scopes keys to it.
+func (m *Manager) PurgeByTag(site string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys, err := scopeTags(site, tags)
+	if err != nil {
+		return err
+	}
+	header := strings.Join(keys, " ")
+	if runner.IsDryRun(m.Runner) {
+		// Show the equivalent command instead of connecting
+		return m.Runner.Run("curl", "-s", "-X", "PURGE", "-H", "Host: "+site, "-H", "X-Xkey-Purge: "+header, "http://"+m.VarnishAddr+"/")
+	}
+	req, err := http.NewRequest("PURGE", "http://"+m.VarnishAddr+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Host = site
+	req.Header.Set("X-Xkey-Purge", header)
+	resp, err := m.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("Varnish unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("varnish xkey purge: %s", resp.Status)
+	}
+	return nil
+}
+
+// scopeTags prefixes surrogate keys with the site's domain, the way the VCL
+// scopes the keys pages are stored with
+func scopeTags(site string, tags []string) ([]string, error) {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, " \t\r\n,") {
+			return nil, fmt.Errorf("invalid cache tag %q", tag)
+		}
+		keys[i] = site + ":" + tag
+	}
+	return keys, nil
+}
+
+// quoteAll returns a regex alternation matching any of values literally
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// ban adds a Varnish ban through the management port
+func (m *Manager) ban(expr ...string) error {
+	if runner.IsDryRun(m.Runner) {
+		// Show the equivalent command instead of connecting
+		return m.Runner.Run("varnishadm", append([]string{"ban"}, expr...)...)
+	}
+	return m.Varnish.Ban(expr...)
 }
 
 // FlushDragonflyDB flushes a specific database
 func (m *Manager) FlushDragonflyDB(db int) error {
-	return exec.Command("redis-cli", "-n", fmt.Sprintf("%d", db), "FLUSHDB").Run()
+	if runner.IsDryRun(m.Runner) {
+		// Show the equivalent command instead of connecting
+		return m.Runner.Run("redis-cli", "-n", strconv.Itoa(db), "FLUSHDB")
+	}
+	return m.Redis.FlushDB(db)
 }
 
-// PurgeOPCache purges PHP OPCache via WP-CLI
-func (m *Manager) PurgeOPCache(sitePath string) error {
-	return exec.Command("wp", "eval", "opcache_reset();", "--path="+sitePath+"/public").Run()
+// FlushDragonflyPrefix removes the keys in db starting with prefix
+func (m *Manager) FlushDragonflyPrefix(db int, prefix string) error {
+	if runner.IsDryRun(m.Runner) {
+		// Show the keys that would be removed
+		return m.Runner.Run("redis-cli", "-n", strconv.Itoa(db), "--scan", "--pattern", globEscape(prefix)+"*")
+	}
+	_, err := m.Redis.DeletePrefix(db, prefix)
+	return err
 }
 
-// PurgeAll purges all caches
-func (m *Manager) PurgeAll(sitePath string) error {
-	m.PurgeVarnishAll()
-	m.FlushDragonfly()
-	m.PurgeOPCache(sitePath)
-	return nil
+// ErrSharedObjectCache is returned for an object cache in database 0
+// without a key prefix, which cannot be flushed without flushing every
+// other site's
+var ErrSharedObjectCache = errors.New("object cache shares database 0 with other sites and has no key prefix")
+
+// FlushObjectCache removes a site's WordPress object cache. A site with a
+// database of its own has it flushed; a site sharing database 0 has the keys
+// with its prefix removed. Sites created before isolation have neither and
+// are refused with ErrSharedObjectCache.
+func (m *Manager) FlushObjectCache(oc config.ObjectCache) error {
+	switch {
+	case oc.Shared():
+		return ErrSharedObjectCache
+	case oc.Database == 0:
+		return m.FlushDragonflyPrefix(0, oc.Prefix)
+	}
+	return m.FlushDragonflyDB(oc.Database)
 }
 
-// WarmCache warms the cache by visiting key pages
-func (m *Manager) WarmCache(urls []string) error {
-	for _, url := range urls {
-		exec.Command("curl", "-s", "-o", "/dev/null", url).Run()
+// PurgeOPCache resets the OPcache of the PHP processes serving a site
+// through its PHP status script. `wp eval` would only reset the CLI's.
+func (m *Manager) PurgeOPCache(s Site) error {
+	if s.StatusToken == "" {
+		return fmt.Errorf("site %s has no PHP status script; run 'ironstack php enable %s'", s.Domain, s.Domain)
 	}
-	return nil
+	return m.PHP.Reset(s.Domain, s.StatusToken, phpstatus.ResetOPcache)
+}
+
+// PurgeAll purges all caches of a site: its pages in Varnish or Caddy, its
+// object cache and OPcache. Each cache is purged even if another one fails;
+// failures are returned together as *runner.Errors.
+func (m *Manager) PurgeAll(s Site, oc config.ObjectCache) error {
+	var errs runner.Errors
+	errs.Add("purge page cache", m.PurgePageCache(s))
+	err := m.FlushObjectCache(oc)
+	if errors.Is(err, ErrSharedObjectCache) {
+		err = fmt.Errorf("%w; run 'ironstack site isolate %s' first", err, s.Domain)
+	}
+	errs.Add("flush object cache", err)
+	errs.Add("reset OPcache", m.PurgeOPCache(s))
+	return errs.Err()
+}
+
+// WarmCache fetches urls with the default warmer settings
+func (m *Manager) WarmCache(urls []string) *WarmReport {
+	return NewWarmer(m.Runner).Warm(urls)
 }
 
 // VarnishStatus returns Varnish service status
 func (m *Manager) VarnishStatus() (bool, error) {
-	err := exec.Command("systemctl", "is-active", "--quiet", "varnish").Run()
+	err := m.Runner.Run("systemctl", "is-active", "--quiet", "varnish")
 	return err == nil, nil
 }
 
 // DragonflyStatus returns DragonflyDB status
 func (m *Manager) DragonflyStatus() (bool, error) {
-	out, err := exec.Command("docker", "ps", "--filter", "name=dragonfly", "-q").Output()
+	out, err := m.Runner.Output("docker", "ps", "--filter", "name=dragonfly", "-q")
 	return len(out) > 0, err
 }
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+const varnishstat = `{
+  "version": 1,
+  "timestamp": "2026-01-01T00:00:00",
+  "counters": {
+    "MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 3600},
+    "MAIN.cache_hit": {"description": "Cache hits", "flag": "c", "format": "i", "value": 90},
+    "MAIN.cache_miss": {"description": "Cache misses", "flag": "c", "format": "i", "value": 10}
+  }
+}`
+
+func TestGetStats(t *testing.T) {
+	f, redis := newFakeRedis(t, "")
+	f.set(0, "a", "b")
+	f.set(2, "c")
+	fake := runner.NewFake()
+	fake.On("varnishstat -j", varnishstat, nil)
+	m := &Manager{Redis: redis, Runner: fake}
+
+	stats, err := m.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.VarnishHits != 90 || stats.VarnishMisses != 10 || stats.VarnishHitRate != 90 {
+		t.Errorf("Varnish stats = %d hits, %d misses, %.1f%%", stats.VarnishHits, stats.VarnishMisses, stats.VarnishHitRate)
+	}
+	if stats.DragonflyKeys != 3 || stats.DragonflyMemory != "1.50M" || stats.DragonflyHitRate != 75 {
+		t.Errorf("DragonflyDB stats = %d keys, %s, %.1f%%", stats.DragonflyKeys, stats.DragonflyMemory, stats.DragonflyHitRate)
+	}
+	if stats.DragonflyLatency == nil || stats.DragonflyLatency.Samples != latencySamples {
+		t.Errorf("DragonflyLatency = %+v", stats.DragonflyLatency)
+	}
+	if !fake.Ran("varnishncsa -d") {
+		t.Errorf("per-site stats not read from the Varnish log:\n%s", strings.Join(fake.Calls, "\n"))
+	}
+}
+
+func TestGetStatsUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	fake := runner.NewFake()
+	fake.On("varnishstat", "", errors.New("exit status 1"))
+	m := &Manager{Redis: NewRedis(addr, ""), Runner: fake}
+
+	stats, err := m.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Varnish != nil || stats.Dragonfly != nil || stats.DragonflyLatency != nil || stats.Sites == nil {
+		t.Errorf("GetStats with nothing running = %+v", stats)
+	}
+}
+
+func TestPurgeCommands(t *testing.T) {
+	varnish := Site{Domain: "example.com", Hosts: []string{"example.com", "www.example.com"}, Backend: BackendVarnish}
+	caddy := Site{Domain: "example.org", Hosts: []string{"example.org"}, Backend: BackendCaddy}
+	tests := []struct {
+		name  string
+		purge func(m *Manager) error
+		want  string
+	}{
+		{
+			"varnish site",
+			func(m *Manager) error { return m.PurgePageCache(varnish) },
+			`varnishadm ban obj.http.X-Host '~' '^(?:example\.com|www\.example\.com)$'`,
+		},
+		{
+			"varnish pages",
+			func(m *Manager) error { return m.PurgePages(varnish, []string{"/blog/"}) },
+			`varnishadm ban obj.http.X-Host '~' '^(?:example\.com|www\.example\.com)$' '&&' obj.http.X-Url '~' '^(?:/blog/)(?:page/[0-9]+/)?(?:\?.*)?$'`,
+		},
+		{
+			"varnish tags",
+			func(m *Manager) error { return m.PurgeTags(varnish, "post-1", "term-2") },
+			`curl -s -X PURGE -H 'Host: example.com' -H 'X-Xkey-Purge: example.com:post-1 example.com:term-2' http://127.0.0.1:6081/`,
+		},
+		{
+			"caddy site",
+			func(m *Manager) error { return m.PurgePageCache(caddy) },
+			`curl -s -X PURGE http://localhost:2019/souin-api/souin/%5E%5BA-Z%5D+-https%3F-%28%3F:example%5C.org%29-`,
+		},
+		{
+			"caddy tags",
+			func(m *Manager) error { return m.PurgeTags(caddy, "post-1") },
+			`curl -s -X PURGE -H 'Surrogate-Key: example.org:post-1' http://localhost:2019/souin-api/souin`,
+		},
+		{
+			"site without page cache",
+			func(m *Manager) error {
+				return m.PurgePageCache(Site{Domain: "example.net", Hosts: []string{"example.net"}, Backend: BackendNone})
+			},
+			"",
+		},
+		{
+			"object cache database",
+			func(m *Manager) error {
+				return m.FlushObjectCache(config.ObjectCache{Database: 4, Prefix: "example_com:"})
+			},
+			"redis-cli -n 4 FLUSHDB",
+		},
+		{
+			"object cache prefix",
+			func(m *Manager) error { return m.FlushObjectCache(config.ObjectCache{Prefix: "ex*ample:"}) },
+			`redis-cli -n 0 --scan --pattern 'ex\*ample:*'`,
+		},
+		{
+			"opcache",
+			func(m *Manager) error { return m.PurgeOPCache(Site{Domain: "example.com", StatusToken: "secret"}) },
+			`curl -s -X POST -H 'Host: example.com' -H 'X-IronStack-Token: <example.com status_token>' 'http://127.0.0.1:6091/?reset=opcache'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := New(config.Default(), runner.NewDryRun(&buf))
+			if err := tt.purge(m); err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.want != "" {
+				want = "[dry-run] $ " + tt.want + "\n"
+			}
+			if got := buf.String(); got != want {
+				t.Errorf("got:\n%swant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestServiceStatus(t *testing.T) {
+	fake := runner.NewFake()
+	fake.On("systemctl is-active", "", errors.New("exit status 3"))
+	fake.On("docker ps", "3f2a9c1d\n", nil)
+	m := &Manager{Runner: fake}
+
+	if up, _ := m.VarnishStatus(); up {
+		t.Error("VarnishStatus reported an inactive unit as running")
+	}
+	if up, err := m.DragonflyStatus(); !up || err != nil {
+		t.Errorf("DragonflyStatus = %v, %v", up, err)
+	}
+	want := []string{
+		"systemctl is-active --quiet varnish",
+		"docker ps --filter name=dragonfly -q",
+	}
+	if strings.Join(fake.Calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s", strings.Join(fake.Calls, "\n"))
+	}
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Info is the parsed output of the INFO command. Sections that were not
+// requested are left empty.
+type Info struct {
+	Server   InfoServer       `json:"server"`
+	Clients  InfoClients      `json:"clients"`
+	Memory   InfoMemory       `json:"memory"`
+	Stats    InfoStats        `json:"stats"`
+	Keyspace map[int]Keyspace `json:"keyspace"`
+
+	// Sections has every field by lower-case section name, including
+	// fields not modelled above
+	Sections map[string]map[string]string `json:"-"`
+}
+
+// InfoServer is the server section
+type InfoServer struct {
+	RedisVersion     string `json:"redis_version"`
+	DragonflyVersion string `json:"dragonfly_version,omitempty"`
+	Mode             string `json:"mode"`
+	UptimeSeconds    int64  `json:"uptime_seconds"`
+}
+
+// InfoClients is the clients section
+type InfoClients struct {
+	Connected int64 `json:"connected"`
+	Blocked   int64 `json:"blocked"`
+}
+
+// InfoMemory is the memory section. Sizes are in bytes.
+type InfoMemory struct {
+	Used      int64  `json:"used"`
+	UsedHuman string `json:"used_human"`
+	Peak      int64  `json:"peak"`
+	RSS       int64  `json:"rss"`
+	MaxMemory int64  `json:"max_memory"` // 0: no limit
+}
+
+// InfoStats is the stats section
+type InfoStats struct {
+	ConnectionsReceived int64 `json:"connections_received"`
+	CommandsProcessed   int64 `json:"commands_processed"`
+	KeyspaceHits        int64 `json:"keyspace_hits"`
+	KeyspaceMisses      int64 `json:"keyspace_misses"`
+	ExpiredKeys         int64 `json:"expired_keys"`
+	EvictedKeys         int64 `json:"evicted_keys"`
+}
+
+// HitRate returns keyspace hits as a percentage of lookups
+func (s InfoStats) HitRate() float64 {
+	if s.KeyspaceHits+s.KeyspaceMisses == 0 {
+		return 0
+	}
+	return float64(s.KeyspaceHits) / float64(s.KeyspaceHits+s.KeyspaceMisses) * 100
+}
+
+// Keyspace are the key counts of one database
+type Keyspace struct {
+	Keys    int64 `json:"keys"`
+	Expires int64 `json:"expires"` // keys with a TTL
+	AvgTTL  int64 `json:"avg_ttl"` // milliseconds
+}
+
+// Keys returns the number of keys in all databases
+func (i *Info) Keys() int64 {
+	var n int64
+	for _, ks := range i.Keyspace {
+		n += ks.Keys
+	}
+	return n
+}
+
+// ParseInfo parses INFO output: "# Section" headers followed by
+// "field:value" lines
+func ParseInfo(text string) *Info {
+	info := &Info{
+		Keyspace: make(map[int]Keyspace),
+		Sections: make(map[string]map[string]string),
+	}
+	section := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			section = strings.ToLower(strings.TrimSpace(line[1:]))
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if info.Sections[section] == nil {
+			info.Sections[section] = make(map[string]string)
+		}
+		info.Sections[section][key] = value
+
+		// Keyspace lines look like db0:keys=12,expires=3,avg_ttl=0
+		if db, ok := strings.CutPrefix(key, "db"); ok && section == "keyspace" {
+			n, err := strconv.Atoi(db)
+			if err != nil {
+				continue
+			}
+			var ks Keyspace
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				num, _ := strconv.ParseInt(v, 10, 64)
+				switch k {
+				case "keys":
+					ks.Keys = num
+				case "expires":
+					ks.Expires = num
+				case "avg_ttl":
+					ks.AvgTTL = num
+				}
+			}
+			info.Keyspace[n] = ks
+		}
+	}
+
+	server := info.Sections["server"]
+	info.Server = InfoServer{
+		RedisVersion:     server["redis_version"],
+		DragonflyVersion: server["dragonfly_version"],
+		Mode:             server["redis_mode"],
+		UptimeSeconds:    infoInt(server, "uptime_in_seconds"),
+	}
+	clients := info.Sections["clients"]
+	info.Clients = InfoClients{
+		Connected: infoInt(clients, "connected_clients"),
+		Blocked:   infoInt(clients, "blocked_clients"),
+	}
+	memory := info.Sections["memory"]
+	info.Memory = InfoMemory{
+		Used:      infoInt(memory, "used_memory"),
+		UsedHuman: memory["used_memory_human"],
+		Peak:      infoInt(memory, "used_memory_peak"),
+		RSS:       infoInt(memory, "used_memory_rss"),
+		MaxMemory: infoInt(memory, "maxmemory"),
+	}
+	stats := info.Sections["stats"]
+	info.Stats = InfoStats{
+		ConnectionsReceived: infoInt(stats, "total_connections_received"),
+		CommandsProcessed:   infoInt(stats, "total_commands_processed"),
+		KeyspaceHits:        infoInt(stats, "keyspace_hits"),
+		KeyspaceMisses:      infoInt(stats, "keyspace_misses"),
+		ExpiredKeys:         infoInt(stats, "expired_keys"),
+		EvictedKeys:         infoInt(stats, "evicted_keys"),
+	}
+	return info
+}
+
+func infoInt(fields map[string]string, key string) int64 {
+	n, _ := strconv.ParseInt(fields[key], 10, 64)
+	return n
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// Backend is the full-page cache a site is served through
+type Backend string
+
+// Page cache backends
+const (
+	BackendNone    Backend = "none"
+	BackendVarnish Backend = "varnish"
+	BackendCaddy   Backend = "caddy" // Caddy's cache-handler module
+)
+
+// Site is what the purge methods need to know about a site
+type Site struct {
+	Domain      string
+	Hosts       []string // domain and aliases
+	Backend     Backend
+	StatusToken string // authenticates OPcache resets at the site's PHP status script
+}
+
+// PurgePageCache removes every page of a site from its page cache
+func (m *Manager) PurgePageCache(s Site) error {
+	if len(s.Hosts) == 0 {
+		return nil
+	}
+	switch s.Backend {
+	case BackendVarnish:
+		return m.ban("obj.http.X-Host", "~", "^(?:"+quoteAll(s.Hosts)+")$")
+	case BackendCaddy:
+		return m.purgeCaddy(cacheKeys(s.Hosts))
+	}
+	return nil
+}
+
+// PurgePages removes the given paths of a site from its page cache,
+// including their paginated pages ("page/2/") and query string variants
+func (m *Manager) PurgePages(s Site, paths []string) error {
+	if len(s.Hosts) == 0 || len(paths) == 0 {
+		return nil
+	}
+	switch s.Backend {
+	case BackendVarnish:
+		return m.PurgeVarnishPaths(s.Hosts, paths)
+	case BackendCaddy:
+		return m.purgeCaddy(cacheKeys(s.Hosts) + "(?:" + quoteAll(paths) + `)(?:page/[0-9]+/)?(?:\?.*)?$`)
+	}
+	return nil
+}
+
+// PurgeTags removes every page of a site tagged with one of the surrogate
+// keys WordPress sent, e.g. "post-12"
+func (m *Manager) PurgeTags(s Site, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	switch s.Backend {
+	case BackendVarnish:
+		return m.PurgeByTag(s.Domain, tags...)
+	case BackendCaddy:
+		keys, err := scopeTags(s.Domain, tags)
+		if err != nil {
+			return err
+		}
+		if runner.IsDryRun(m.Runner) {
+			// Show the equivalent command instead of connecting
+			return m.Runner.Run("curl", "-s", "-X", "PURGE", "-H", "Surrogate-Key: "+strings.Join(keys, ", "), m.Caddy.BaseURL+caddyadmin.SouinAPI)
+		}
+		return m.Caddy.PurgeSurrogateKeys(keys...)
+	}
+	return nil
+}
+
+// purgeCaddy removes the responses whose cache keys match pattern from
+// Caddy's page cache
+func (m *Manager) purgeCaddy(pattern string) error {
+	if runner.IsDryRun(m.Runner) {
+		// Show the equivalent command instead of connecting
+		return m.Runner.Run("curl", "-s", "-X", "PURGE", m.Caddy.BaseURL+caddyadmin.SouinAPI+"/"+url.PathEscape(pattern))
+	}
+	return m.Caddy.PurgeCache(pattern)
+}
+
+// cacheKeys returns a regex matching the start of the cache-handler keys of
+// hosts, up to the request path
+func cacheKeys(hosts []string) string {
+	return "^[A-Z]+-https?-(?:" + quoteAll(hosts) + ")-"
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanBatch is the COUNT hint for SCAN and the UNLINK batch size
+const scanBatch = 500
+
+// Redis is a client for DragonflyDB speaking the Redis protocol (RESP)
+type Redis struct {
+	Addr     string // host:port
+	Password string
+	Timeout  time.Duration
+}
+
+// NewRedis creates a client for the server at addr
+func NewRedis(addr, password string) *Redis {
+	return &Redis{Addr: addr, Password: password, Timeout: 10 * time.Second}
+}
+
+// RedisError is an error reply from the server
+type RedisError struct {
+	Command string
+	Message string
+}
+
+func (e *RedisError) Error() string {
+	return fmt.Sprintf("dragonfly %s: %s", e.Command, e.Message)
+}
+
+// errNil is returned by readReply for a null reply
+var errNil = errors.New("nil reply")
+
+// RedisConn is a connection with authentication done and a database
+// selected. It is not safe for concurrent use.
+type RedisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// Dial connects, authenticates if a password is set and selects db
+func (c *Redis) Dial(db int) (*RedisConn, error) {
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("DragonflyDB unreachable: %w", err)
+	}
+	rc := &RedisConn{conn: nc, r: bufio.NewReader(nc), timeout: c.Timeout}
+	if c.Password != "" {
+		if _, err := rc.Do("AUTH", c.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := rc.Do("SELECT", strconv.Itoa(db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Close closes the connection
+func (rc *RedisConn) Close() error {
+	return rc.conn.Close()
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, int64 for integers, []interface{} for arrays and nil for null
+// replies. Error replies are returned as *RedisError.
+func (rc *RedisConn) Do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(rc.timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	reply, err := rc.readReply()
+	if errors.Is(err, errNil) {
+		return nil, nil
+	}
+	var rerr *RedisError
+	if errors.As(err, &rerr) {
+		rerr.Command = strings.ToUpper(args[0])
+	}
+	return reply, err
+}
+
+func (rc *RedisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("dragonfly: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &RedisError{Message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("dragonfly: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("dragonfly: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := rc.readReply()
+			if err != nil && !errors.Is(err, errNil) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("dragonfly: unexpected reply %q", line)
+}
+
+// Do runs a single command on database 0
+func (c *Redis) Do(args ...string) (interface{}, error) {
+	rc, err := c.Dial(0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return rc.Do(args...)
+}
+
+// Info returns the given INFO sections, or the default sections if none are
+// given
+func (c *Redis) Info(sections ...string) (*Info, error) {
+	reply, err := c.Do(append([]string{"INFO"}, sections...)...)
+	if err != nil {
+		return nil, err
+	}
+	text, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("dragonfly INFO: unexpected reply %T", reply)
+	}
+	return ParseInfo(text), nil
+}
+
+// scanPrefix calls fn with batches of the keys starting with prefix. Keys
+// added during the scan may be missed.
+func (rc *RedisConn) scanPrefix(prefix string, fn func(keys []string) error) error {
+	pattern := globEscape(prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := rc.Do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(scanBatch))
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("dragonfly SCAN: unexpected reply")
+		}
+		cursor, _ = parts[0].(string)
+		items, _ := parts[1].([]interface{})
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// DeletePrefix removes the keys in db starting with prefix with UNLINK,
+// which frees memory in the background, and returns how many were removed
+func (c *Redis) DeletePrefix(db int, prefix string) (int64, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("refusing to delete with an empty prefix, use FlushDB")
+	}
+	rc, err := c.Dial(db)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	var deleted int64
+	err = rc.scanPrefix(prefix, func(keys []string) error {
+		for len(keys) > 0 {
+			n := min(len(keys), scanBatch)
+			reply, err := rc.Do(append([]string{"UNLINK"}, keys[:n]...)...)
+			if err != nil {
+				return err
+			}
+			count, _ := reply.(int64)
+			deleted += count
+			keys = keys[n:]
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// FlushDB removes every key of one database
+func (c *Redis) FlushDB(db int) error {
+	rc, err := c.Dial(db)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = rc.Do("FLUSHDB")
+	return err
+}
+
+// Latency is the round-trip time of PING
+type Latency struct {
+	Samples int           `json:"samples"`
+	Min     time.Duration `json:"min"`
+	Avg     time.Duration `json:"avg"`
+	Max     time.Duration `json:"max"`
+}
+
+// Latency sends n PINGs over one connection and measures their round trips
+func (c *Redis) Latency(n int) (*Latency, error) {
+	if n < 1 {
+		n = 1
+	}
+	rc, err := c.Dial(0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	l := &Latency{Samples: n}
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		reply, err := rc.Do("PING")
+		if err != nil {
+			return nil, err
+		}
+		if reply != "PONG" {
+			return nil, fmt.Errorf("dragonfly PING: unexpected reply %v", reply)
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if i == 0 || rtt < l.Min {
+			l.Min = rtt
+		}
+		if rtt > l.Max {
+			l.Max = rtt
+		}
+	}
+	l.Avg = total / time.Duration(n)
+	return l, nil
+}
+
+// globEscape escapes the SCAN MATCH wildcards in s
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,406 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+)
+
+// scanPage is how many keys the stand-in returns per SCAN, whatever the
+// COUNT hint, so prefix flushes need several rounds
+const scanPage = 2
+
+// fakeRedis is a small RESP server standing in for DragonflyDB. It keeps
+// string keys per database and records every command it receives.
+type fakeRedis struct {
+	password string
+
+	mu       sync.Mutex
+	dbs      map[int]map[string]string
+	commands []string // "db: COMMAND args..."
+	cursors  []string // last key returned by each SCAN round
+}
+
+// newFakeRedis starts a stand-in on a free local port and returns a client
+// for it
+func newFakeRedis(t *testing.T, password string) (*fakeRedis, *Redis) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{password: password, dbs: make(map[int]map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f, NewRedis(ln.Addr().String(), password)
+}
+
+// set stores keys in db
+func (f *fakeRedis) set(db int, keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dbs[db] == nil {
+		f.dbs[db] = make(map[string]string)
+	}
+	for _, k := range keys {
+		f.dbs[db][k] = "v"
+	}
+}
+
+// keys returns the sorted keys of db
+func (f *fakeRedis) keys(db int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.dbs[db] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ran returns the recorded commands starting with name, e.g. "FLUSHDB"
+func (f *fakeRedis) ran(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, c := range f.commands {
+		if _, cmd, _ := strings.Cut(c, ": "); strings.HasPrefix(cmd, name) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	db := 0
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, fmt.Sprintf("%d: %s", db, strings.Join(args, " ")))
+		reply := f.handle(args, &db, &authed)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// handle runs one command with f.mu held and returns the encoded reply
+func (f *fakeRedis) handle(args []string, db *int, authed *bool) string {
+	cmd := strings.ToUpper(args[0])
+	if !*authed && cmd != "AUTH" {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	switch cmd {
+	case "AUTH":
+		if len(args) != 2 || args[1] != f.password {
+			return "-WRONGPASS invalid username-password pair\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case "SELECT":
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > 15 {
+			return "-ERR DB index is out of range\r\n"
+		}
+		*db = n
+		return "+OK\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "FLUSHDB":
+		delete(f.dbs, *db)
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := f.dbs[*db][args[1]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "SCAN":
+		// SCAN cursor MATCH <escaped prefix>* COUNT n. A cursor stands for the
+		// last key returned, so keys removed between rounds move nothing.
+		after := ""
+		if n, _ := strconv.Atoi(args[1]); n > 0 {
+			after = f.cursors[n-1]
+		}
+		prefix := strings.TrimSuffix(args[3], "*")
+		prefix = strings.NewReplacer(`\*`, "*", `\?`, "?", `\[`, "[", `\]`, "]", `\\`, `\`).Replace(prefix)
+		var all []string
+		for k := range f.dbs[*db] {
+			if k > after {
+				all = append(all, k)
+			}
+		}
+		sort.Strings(all)
+		end := min(scanPage, len(all))
+		var page []string
+		for _, k := range all[:end] {
+			if strings.HasPrefix(k, prefix) {
+				page = append(page, bulk(k))
+			}
+		}
+		next := 0
+		if end < len(all) {
+			f.cursors = append(f.cursors, all[end-1])
+			next = len(f.cursors)
+		}
+		return fmt.Sprintf("*2\r\n%s*%d\r\n%s", bulk(strconv.Itoa(next)), len(page), strings.Join(page, ""))
+	case "UNLINK":
+		var n int
+		for _, k := range args[1:] {
+			if _, ok := f.dbs[*db][k]; ok {
+				delete(f.dbs[*db], k)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "INFO":
+		info := "# Memory\r\nused_memory:1572864\r\nused_memory_human:1.50M\r\n" +
+			"# Stats\r\nkeyspace_hits:30\r\nkeyspace_misses:10\r\n# Keyspace\r\n"
+		for db, keys := range f.dbs {
+			info += fmt.Sprintf("db%d:keys=%d,expires=0,avg_ttl=0\r\n", db, len(keys))
+		}
+		return bulk(info)
+	case "MIXED":
+		// An array of every reply type, including a null and a nested array
+		return "*5\r\n+simple\r\n:-7\r\n$-1\r\n$6\r\nbu\r\nlk\r\n*1\r\n$0\r\n\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisReplies(t *testing.T) {
+	f, c := newFakeRedis(t, "")
+	f.set(0, "present")
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"GET", "present"}, "v"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"UNLINK", "nothing"}, int64(0)},
+		{[]string{"MIXED"}, []interface{}{"simple", int64(-7), nil, "bu\r\nlk", []interface{}{""}}},
+	}
+	for _, tt := range tests {
+		got, err := c.Do(tt.args...)
+		if err != nil {
+			t.Errorf("Do(%v): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Do(%v) = %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRedisErrorReply(t *testing.T) {
+	_, c := newFakeRedis(t, "")
+	rc, err := c.Dial(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	_, err = rc.Do("bogus", "x")
+	var rerr *RedisError
+	if !errors.As(err, &rerr) || rerr.Command != "BOGUS" || rerr.Message != "ERR unknown command 'bogus'" {
+		t.Fatalf("Do(bogus) error = %v", err)
+	}
+	// The connection stays usable after an error reply
+	if got, err := rc.Do("PING"); err != nil || got != "PONG" {
+		t.Errorf("PING after error = %v, %v", got, err)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	f, c := newFakeRedis(t, "s3cret")
+	if _, err := c.Do("PING"); err != nil {
+		t.Fatalf("PING with password: %v", err)
+	}
+	if got := f.ran("AUTH"); len(got) != 1 || got[0] != "0: AUTH s3cret" {
+		t.Errorf("AUTH commands = %v", got)
+	}
+
+	c.Password = "wrong"
+	var rerr *RedisError
+	if _, err := c.Do("PING"); !errors.As(err, &rerr) || rerr.Command != "AUTH" {
+		t.Errorf("PING with wrong password error = %v", err)
+	}
+	c.Password = ""
+	if _, err := c.Do("PING"); !errors.As(err, &rerr) || !strings.HasPrefix(rerr.Message, "NOAUTH") {
+		t.Errorf("PING without password error = %v", err)
+	}
+}
+
+func TestRedisSelect(t *testing.T) {
+	f, c := newFakeRedis(t, "")
+	f.set(3, "a", "b")
+	f.set(4, "c")
+	if err := c.FlushDB(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ran("FLUSHDB"); !reflect.DeepEqual(got, []string{"3: FLUSHDB"}) {
+		t.Errorf("FLUSHDB commands = %v", got)
+	}
+	if len(f.keys(3)) != 0 || len(f.keys(4)) != 1 {
+		t.Errorf("after FlushDB(3): db3 %v, db4 %v", f.keys(3), f.keys(4))
+	}
+	// Database 0 is the default and is not selected
+	if err := c.FlushDB(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ran("SELECT"); !reflect.DeepEqual(got, []string{"0: SELECT 3"}) {
+		t.Errorf("SELECT commands = %v", got)
+	}
+	var rerr *RedisError
+	if err := c.FlushDB(99); !errors.As(err, &rerr) || rerr.Command != "SELECT" {
+		t.Errorf("FlushDB(99) error = %v", err)
+	}
+}
+
+func TestRedisDeletePrefix(t *testing.T) {
+	f, c := newFakeRedis(t, "")
+	f.set(0, "a_com:1", "a_com:2", "a_com:3", "a_com:4", "a_com:5", "a_com_2:1", "b_com:1", "a*com:1")
+	f.set(1, "a_com:other-db")
+	n, err := c.DeletePrefix(0, "a_com:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("DeletePrefix removed %d keys, want 5", n)
+	}
+	if got, want := f.keys(0), []string{"a*com:1", "a_com_2:1", "b_com:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys left in db 0 = %v, want %v", got, want)
+	}
+	if got := f.keys(1); len(got) != 1 {
+		t.Errorf("keys in db 1 = %v, want untouched", got)
+	}
+	if scans := f.ran("SCAN"); len(scans) < 2 {
+		t.Errorf("SCAN ran %d times, want a cursor loop", len(scans))
+	}
+	// Wildcards in the prefix are matched literally
+	if _, err := c.DeletePrefix(0, "a*"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.keys(0), []string{"a_com_2:1", "b_com:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys left after DeletePrefix(a*) = %v, want %v", got, want)
+	}
+	if _, err := c.DeletePrefix(0, ""); err == nil {
+		t.Error("DeletePrefix with an empty prefix succeeded")
+	}
+}
+
+func TestRedisLatency(t *testing.T) {
+	f, c := newFakeRedis(t, "")
+	l, err := c.Latency(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Samples != 3 || l.Min <= 0 || l.Min > l.Avg || l.Avg > l.Max {
+		t.Errorf("Latency(3) = %+v", l)
+	}
+	if got := f.ran("PING"); len(got) != 3 {
+		t.Errorf("PING ran %d times, want 3", len(got))
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := NewRedis(addr, "").Do("PING"); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("Do on a closed port error = %v", err)
+	}
+}
+
+func TestFlushObjectCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		oc    config.ObjectCache
+		err   error
+		left0 []string // keys left in database 0
+		left2 []string // keys left in database 2
+	}{
+		{"own database", config.ObjectCache{Database: 2, Prefix: "a_com:"}, nil, []string{"a_com:1", "b_com:1", "legacy"}, []string{}},
+		{"prefix in database 0", config.ObjectCache{Prefix: "a_com:"}, nil, []string{"b_com:1", "legacy"}, []string{"a_com:2"}},
+		{"shared without prefix", config.ObjectCache{}, ErrSharedObjectCache, []string{"a_com:1", "b_com:1", "legacy"}, []string{"a_com:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newFakeRedis(t, "")
+			f.set(0, "a_com:1", "b_com:1", "legacy")
+			f.set(2, "a_com:2")
+			m := &Manager{Redis: c}
+			if err := m.FlushObjectCache(tt.oc); !errors.Is(err, tt.err) {
+				t.Fatalf("FlushObjectCache error = %v, want %v", err, tt.err)
+			}
+			if got := f.keys(0); !reflect.DeepEqual(got, tt.left0) {
+				t.Errorf("db 0 = %v, want %v", got, tt.left0)
+			}
+			if got := f.keys(2); !reflect.DeepEqual(got, tt.left2) {
+				t.Errorf("db 2 = %v, want %v", got, tt.left2)
+			}
+			if tt.err != nil && len(f.ran("")) != 0 {
+				t.Errorf("refused flush still sent %v", f.ran(""))
+			}
+		})
+	}
+}
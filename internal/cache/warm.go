@@ -0,0 +1,361 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// sitemapDepth limits how deep sitemap indexes are followed
+const sitemapDepth = 3
+
+// sitemapPaths are tried in order when a site's sitemap is discovered:
+// the common name, Yoast and Rank Math, and the WordPress core sitemap
+var sitemapPaths = []string{"/sitemap.xml", "/sitemap_index.xml", "/wp-sitemap.xml"}
+
+// Variant is a kind of client a page is fetched as. Themes and caches that
+// vary on the user agent keep a separate copy per variant.
+type Variant struct {
+	Name      string `json:"name"`
+	UserAgent string `json:"user_agent"`
+}
+
+// Variants fetched by the warmer
+var (
+	Desktop = Variant{Name: "desktop", UserAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 IronStack-Warmer"}
+	Mobile  = Variant{Name: "mobile", UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1 IronStack-Warmer"}
+)
+
+// Warmer fetches pages so that the page cache holds them before visitors
+// ask for them
+type Warmer struct {
+	HTTP        *http.Client
+	Concurrency int       // parallel requests
+	Rate        float64   // requests per second over all workers; 0: unlimited
+	Variants    []Variant // empty: Desktop only
+	MaxURLs     int       // 0: no limit
+	Runner      runner.Runner
+}
+
+// NewWarmer creates a warmer with 4 workers, 10 requests per second and
+// the desktop variant
+func NewWarmer(r runner.Runner) *Warmer {
+	return &Warmer{
+		HTTP:        &http.Client{Timeout: 30 * time.Second},
+		Concurrency: 4,
+		Rate:        10,
+		Runner:      r,
+	}
+}
+
+// Connect makes the warmer dial addr (host:port) for every request instead
+// of resolving the URL's host. Requests keep their Host header and TLS
+// server name, so the local web server can be warmed while DNS points at a
+// CDN or elsewhere.
+func (w *Warmer) Connect(addr string) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	w.HTTP.Transport = transport
+}
+
+// WarmResult is the outcome of fetching one URL as one variant
+type WarmResult struct {
+	URL     string        `json:"url"`
+	Variant string        `json:"variant"`
+	Status  int           `json:"status"`          // 0 if the request failed
+	Cache   string        `json:"cache,omitempty"` // HIT or MISS, from X-Cache or Cache-Status
+	Latency time.Duration `json:"latency"`         // until the body was read
+	Error   string        `json:"error,omitempty"`
+}
+
+// WarmReport summarises a warming run. Latency percentiles are over the
+// requests that got a response.
+type WarmReport struct {
+	URLs     int           `json:"urls"`
+	Requests int           `json:"requests"`
+	OK       int           `json:"ok"` // 2xx responses
+	Hits     int           `json:"hits"`
+	Misses   int           `json:"misses"`
+	Errors   int           `json:"errors"` // failed requests and non-2xx responses
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+	Duration time.Duration `json:"duration"`
+	Results  []WarmResult  `json:"results"`
+}
+
+// Discover returns the page URLs listed in the sitemap of the site at
+// baseURL (scheme://host), trying the usual sitemap locations
+func (w *Warmer) Discover(baseURL string) ([]string, error) {
+	baseURL = strings.TrimRight(baseURL, "/")
+	var lastErr error
+	for _, path := range sitemapPaths {
+		urls, err := w.Sitemap(baseURL + path)
+		if err == nil {
+			return urls, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no sitemap found for %s: %w", baseURL, lastErr)
+}
+
+// Sitemap returns the page URLs of a sitemap, following sitemap indexes.
+// URLs on other hosts than the sitemap's are skipped.
+func (w *Warmer) Sitemap(sitemapURL string) ([]string, error) {
+	u, err := url.Parse(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	if runner.IsDryRun(w.Runner) {
+		// Show the request instead of sending it
+		return nil, w.Runner.Run("curl", "-s", sitemapURL)
+	}
+	var urls []string
+	seen := make(map[string]bool)
+	err = w.sitemap(sitemapURL, u.Host, 0, func(loc string) bool {
+		if !seen[loc] {
+			seen[loc] = true
+			urls = append(urls, loc)
+		}
+		return w.MaxURLs == 0 || len(urls) < w.MaxURLs
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	return urls, err
+}
+
+// errStop ends a sitemap walk once MaxURLs pages have been found
+var errStop = errors.New("enough URLs")
+
+// sitemapDoc is a <urlset> or a <sitemapindex>
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemap calls add for every page of a sitemap until it returns false
+func (w *Warmer) sitemap(sitemapURL, host string, depth int, add func(string) bool) error {
+	data, err := w.fetch(sitemapURL)
+	if err != nil {
+		return err
+	}
+	var doc sitemapDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("sitemap %s: %w", sitemapURL, err)
+	}
+	switch doc.XMLName.Local {
+	case "urlset":
+		for _, u := range doc.URLs {
+			if loc := strings.TrimSpace(u.Loc); sameHost(loc, host) && !add(loc) {
+				return errStop
+			}
+		}
+	case "sitemapindex":
+		if depth >= sitemapDepth {
+			return fmt.Errorf("sitemap %s: indexes nested too deeply", sitemapURL)
+		}
+		for _, s := range doc.Sitemaps {
+			loc := strings.TrimSpace(s.Loc)
+			if !sameHost(loc, host) {
+				continue
+			}
+			if err := w.sitemap(loc, host, depth+1, add); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("sitemap %s: unexpected <%s> document", sitemapURL, doc.XMLName.Local)
+	}
+	return nil
+}
+
+// fetch returns the body of a sitemap, decompressing .xml.gz files
+func (w *Warmer) fetch(rawURL string) ([]byte, error) {
+	resp, err := w.HTTP.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sitemap %s: %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 50<<20))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("sitemap %s: %w", rawURL, err)
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, 50<<20))
+	}
+	return data, nil
+}
+
+func sameHost(rawURL, host string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+// Warm fetches every URL as every variant and reports the results in the
+// order of urls
+func (w *Warmer) Warm(urls []string) *WarmReport {
+	if w.MaxURLs > 0 && len(urls) > w.MaxURLs {
+		urls = urls[:w.MaxURLs]
+	}
+	variants := w.Variants
+	if len(variants) == 0 {
+		variants = []Variant{Desktop}
+	}
+	workers := max(w.Concurrency, 1)
+
+	start := time.Now()
+	results := make([]WarmResult, len(urls)*len(variants))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = w.get(urls[j/len(variants)], variants[j%len(variants)])
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if w.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / w.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for j := range results {
+		if tick != nil && j > 0 {
+			<-tick
+		}
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := summarise(results)
+	report.URLs = len(urls)
+	report.Duration = time.Since(start)
+	return report
+}
+
+// get fetches one URL and reads the whole body, as a browser would, so that
+// the cache stores the complete object
+func (w *Warmer) get(rawURL string, v Variant) WarmResult {
+	res := WarmResult{URL: rawURL, Variant: v.Name}
+	if runner.IsDryRun(w.Runner) {
+		// Show the request instead of sending it
+		w.Runner.Run("curl", "-s", "-o", "/dev/null", "-A", v.UserAgent, rawURL)
+		return res
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Header.Set("User-Agent", v.UserAgent)
+	start := time.Now()
+	resp, err := w.HTTP.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	res.Latency = time.Since(start)
+	res.Status = resp.StatusCode
+	res.Cache = cacheResult(resp.Header)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// cacheResult returns HIT or MISS as told by the X-Cache header Varnish
+// sets or the Cache-Status header (RFC 9211) the Caddy page cache sets
+func cacheResult(h http.Header) string {
+	if v := h.Get("X-Cache"); v != "" {
+		return strings.ToUpper(v)
+	}
+	// Each cache on the way adds a member; the last one is nearest to us
+	members := strings.Split(h.Get("Cache-Status"), ",")
+	for _, param := range strings.Split(members[len(members)-1], ";")[1:] {
+		param = strings.ToLower(strings.TrimSpace(param))
+		switch {
+		case param == "hit":
+			return "HIT"
+		case strings.HasPrefix(param, "fwd="):
+			return "MISS"
+		}
+	}
+	return ""
+}
+
+// summarise counts the results and computes the latency percentiles
+func summarise(results []WarmResult) *WarmReport {
+	report := &WarmReport{Requests: len(results), Results: results}
+	var latencies []time.Duration
+	for _, r := range results {
+		switch {
+		case r.Status >= 200 && r.Status < 300 && r.Error == "":
+			report.OK++
+		case r.Status != 0 || r.Error != "":
+			report.Errors++
+		}
+		switch r.Cache {
+		case "HIT":
+			report.Hits++
+		case "MISS":
+			report.Misses++
+		}
+		if r.Status != 0 {
+			latencies = append(latencies, r.Latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return report
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P99 = percentile(latencies, 99)
+	report.Max = latencies[len(latencies)-1]
+	return report
+}
+
+// percentile returns the p-th percentile of sorted durations using the
+// nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
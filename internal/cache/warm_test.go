@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheResult(t *testing.T) {
+	tests := []struct {
+		header map[string]string
+		want   string
+	}{
+		{map[string]string{"X-Cache": "HIT"}, "HIT"},
+		{map[string]string{"X-Cache": "miss"}, "MISS"},
+		{map[string]string{"Cache-Status": "Souin; hit; ttl=3590; key=GET-https-example.com-/"}, "HIT"},
+		{map[string]string{"Cache-Status": "Souin; fwd=uri-miss; stored; key=GET-https-example.com-/"}, "MISS"},
+		{map[string]string{"Cache-Status": "Souin; fwd=bypass; detail=CACHE-CONTROL-EXTRACTION-ERROR"}, "MISS"},
+		{map[string]string{"Cache-Status": "Origin; fwd=uri-miss, Souin; hit"}, "HIT"},
+		{map[string]string{"Cache-Status": "Souin; hit, CDN; fwd=miss"}, "MISS"},
+		{map[string]string{"Cache-Status": "Souin; detail=DEFAULT-REJECT"}, ""},
+		{map[string]string{"X-Cache": "HIT", "Cache-Status": "Souin; fwd=uri-miss"}, "HIT"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.header {
+			h.Set(k, v)
+		}
+		if got := cacheResult(h); got != tt.want {
+			t.Errorf("cacheResult(%v) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestWarmCacheStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached/" {
+			w.Header().Set("Cache-Status", "Souin; hit; ttl=100")
+		} else {
+			w.Header().Set("Cache-Status", "Souin; fwd=uri-miss; stored")
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	defer srv.Close()
+
+	w := NewWarmer(nil)
+	w.Rate = 0
+	results := []WarmResult{w.get(srv.URL+"/cached/", Desktop), w.get(srv.URL+"/new/", Desktop)}
+	report := summarise(results)
+	if report.Hits != 1 || report.Misses != 1 || report.OK != 2 {
+		t.Errorf("report = %d hits, %d misses, %d ok; results %+v", report.Hits, report.Misses, report.OK, results)
+	}
+}
@@ -0,0 +1,271 @@
+// Package caddyadmin is a client for Caddy's JSON admin API
+package caddyadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client talks to the admin endpoint of a running Caddy
+type Client struct {
+	BaseURL string // e.g. http://localhost:2019
+	HTTP    *http.Client
+}
+
+// New creates a client for the admin API listening on addr (host:port)
+func New(addr string) *Client {
+	return &Client{
+		BaseURL: "http://" + addr,
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is a non-2xx response from the admin API
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string // Caddy's "error" field, or the raw body
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("caddy admin %s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// Server is an HTTP server of the http app
+type Server struct {
+	Listen []string `json:"listen"`
+	Routes []Route  `json:"routes,omitempty"`
+}
+
+// Route is an HTTP route. Handlers are kept as raw JSON since their shape
+// depends on the handler module.
+type Route struct {
+	ID       string            `json:"@id,omitempty"`
+	Group    string            `json:"group,omitempty"`
+	Match    []Match           `json:"match,omitempty"`
+	Handle   []json.RawMessage `json:"handle,omitempty"`
+	Terminal bool              `json:"terminal,omitempty"`
+}
+
+// Match is a request matcher set. Only the matchers IronStack uses are
+// modelled.
+type Match struct {
+	Host []string `json:"host,omitempty"`
+	Path []string `json:"path,omitempty"`
+}
+
+// ReverseProxyRoute returns a terminal route proxying hosts to upstreams
+// (host:port). The id allows removing it again with RemoveRoute.
+func ReverseProxyRoute(id string, hosts []string, upstreams ...string) Route {
+	type upstream struct {
+		Dial string `json:"dial"`
+	}
+	handler := struct {
+		Handler   string     `json:"handler"`
+		Upstreams []upstream `json:"upstreams"`
+	}{Handler: "reverse_proxy"}
+	for _, u := range upstreams {
+		handler.Upstreams = append(handler.Upstreams, upstream{Dial: u})
+	}
+	raw, _ := json.Marshal(handler)
+	return Route{
+		ID:       id,
+		Match:    []Match{{Host: hosts}},
+		Handle:   []json.RawMessage{raw},
+		Terminal: true,
+	}
+}
+
+// Ping checks that the admin API answers
+func (c *Client) Ping() error {
+	return c.do(http.MethodGet, "/config/", nil, "", nil, nil)
+}
+
+// Config decodes the loaded config at path, e.g. "apps/http/servers", into v
+func (c *Client) Config(path string, v interface{}) error {
+	return c.do(http.MethodGet, "/config/"+strings.TrimPrefix(path, "/"), nil, "", nil, v)
+}
+
+// Load replaces the running config with a Caddyfile. Caddy applies it
+// gracefully without a restart and keeps the old config if it is rejected.
+// Unless force is set, loading an unchanged config is a no-op.
+func (c *Client) Load(caddyfile []byte, force bool) error {
+	return c.load(caddyfile, "text/caddyfile", force)
+}
+
+// LoadConfig replaces the running config with a JSON config, e.g. one
+// returned by Adapt
+func (c *Client) LoadConfig(config []byte, force bool) error {
+	return c.load(config, "application/json", force)
+}
+
+// load posts a config of the given content type to /load
+func (c *Client) load(body []byte, contentType string, force bool) error {
+	var header http.Header
+	if force {
+		header = http.Header{"Cache-Control": {"must-revalidate"}}
+	}
+	return c.do(http.MethodPost, "/load", bytes.NewReader(body), contentType, header, nil)
+}
+
+// LoadFile loads the Caddyfile at path. Imports in it are resolved by Caddy,
+// so they should be absolute.
+func (c *Client) LoadFile(path string, force bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.Load(data, force)
+}
+
+// Adapt converts a Caddyfile to JSON without loading it, which validates its
+// syntax
+func (c *Client) Adapt(caddyfile []byte) (json.RawMessage, error) {
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := c.do(http.MethodPost, "/adapt", bytes.NewReader(caddyfile), "text/caddyfile", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Result, nil
+}
+
+// Servers returns the HTTP servers of the loaded config by name
+func (c *Client) Servers() (map[string]Server, error) {
+	servers := make(map[string]Server)
+	if err := c.Config("apps/http/servers", &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// AddRoute inserts r as the first route of server, ahead of catch-all routes
+func (c *Client) AddRoute(server string, r Route) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/config/apps/http/servers/"+server+"/routes/0",
+		bytes.NewReader(body), "application/json", nil, nil)
+}
+
+// Route returns the route with the given @id
+func (c *Client) Route(id string) (*Route, error) {
+	var r Route
+	if err := c.do(http.MethodGet, "/id/"+id, nil, "", nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RemoveRoute deletes the config object with the given @id
+func (c *Client) RemoveRoute(id string) error {
+	return c.do(http.MethodDelete, "/id/"+id, nil, "", nil, nil)
+}
+
+// Hosts returns the hostnames matched by routes of the loaded config. These
+// are the names Caddy manages certificates for.
+func (c *Client) Hosts() ([]string, error) {
+	servers, err := c.Servers()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var hosts []string
+	var walk func(routes []Route)
+	walk = func(routes []Route) {
+		for _, r := range routes {
+			for _, m := range r.Match {
+				for _, h := range m.Host {
+					if !seen[h] {
+						seen[h] = true
+						hosts = append(hosts, h)
+					}
+				}
+			}
+			// Caddyfile sites put their host matcher on a subroute wrapper,
+			// but nested routes may match hosts too
+			for _, h := range r.Handle {
+				var sub struct {
+					Routes []Route `json:"routes"`
+				}
+				if json.Unmarshal(h, &sub) == nil {
+					walk(sub.Routes)
+				}
+			}
+		}
+	}
+	for _, s := range servers {
+		walk(s.Routes)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// SouinAPI is where the cache-handler module serves its API on the admin
+// endpoint. Caddy needs the global option `cache { api { souin } }` for it.
+const SouinAPI = "/souin-api/souin"
+
+// PurgeCache removes the responses whose cache keys match the regex pattern
+// from the cache-handler page cache. Keys look like
+// "GET-https-example.com-/path?query".
+func (c *Client) PurgeCache(pattern string) error {
+	return c.do("PURGE", SouinAPI+"/"+url.PathEscape(pattern), nil, "", nil, nil)
+}
+
+// PurgeSurrogateKeys removes the cached responses tagged with any of keys
+// through their Surrogate-Key header
+func (c *Client) PurgeSurrogateKeys(keys ...string) error {
+	header := http.Header{"Surrogate-Key": {strings.Join(keys, ", ")}}
+	return c.do("PURGE", SouinAPI, nil, "", header, nil)
+}
+
+// do sends a request and decodes a JSON response into out if it is not nil
+func (c *Client) do(method, path string, body io.Reader, contentType string, header http.Header, out interface{}) error {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("caddy admin API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			apiErr.Message = body.Error
+		}
+		return apiErr
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 || bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("caddy admin %s %s: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package caddyadmin
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// request is what the test server received
+type request struct {
+	Method, Path, ContentType, CacheControl, SurrogateKey, Body string
+}
+
+// newServer starts an admin API stand-in that records each request and
+// answers with status and body
+func newServer(t *testing.T, status int, body string) (*Client, *[]request) {
+	t.Helper()
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got = append(got, request{
+			Method:       r.Method,
+			Path:         r.URL.EscapedPath(),
+			ContentType:  r.Header.Get("Content-Type"),
+			CacheControl: r.Header.Get("Cache-Control"),
+			SurrogateKey: r.Header.Get("Surrogate-Key"),
+			Body:         string(data),
+		})
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	c := New("unused")
+	c.BaseURL = srv.URL
+	return c, &got
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		force bool
+		want  request
+	}{
+		{false, request{Method: "POST", Path: "/load", ContentType: "text/caddyfile", Body: "example.com {\n}\n"}},
+		{true, request{Method: "POST", Path: "/load", ContentType: "text/caddyfile", CacheControl: "must-revalidate", Body: "example.com {\n}\n"}},
+	}
+	for _, tt := range tests {
+		c, got := newServer(t, http.StatusOK, "")
+		if err := c.Load([]byte("example.com {\n}\n"), tt.force); err != nil {
+			t.Fatalf("Load(force=%v): %v", tt.force, err)
+		}
+		if len(*got) != 1 || (*got)[0] != tt.want {
+			t.Errorf("Load(force=%v) sent %+v, want %+v", tt.force, *got, tt.want)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Caddyfile")
+	if err := os.WriteFile(path, []byte("import /etc/caddy/sites/*.conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, got := newServer(t, http.StatusOK, "")
+	if err := c.LoadFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 || (*got)[0].Body != "import /etc/caddy/sites/*.conf\n" {
+		t.Errorf("LoadFile sent %+v", *got)
+	}
+	if err := c.LoadFile(filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Error("LoadFile of a missing file succeeded")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	// As adapted from a Caddyfile: each site is a subroute behind a host
+	// matcher, and nested routes may match hosts of their own
+	const servers = `{
+		"srv0": {"listen": [":443"], "routes": [
+			{"match": [{"host": ["example.com", "www.example.com"]}], "handle": [
+				{"handler": "subroute", "routes": [
+					{"match": [{"host": ["shop.example.com"]}], "handle": [{"handler": "static_response"}]}
+				]}
+			]},
+			{"match": [{"host": ["example.com"]}], "handle": [{"handler": "file_server"}]}
+		]},
+		"srv1": {"listen": [":8080"], "routes": [
+			{"match": [{"host": ["blog.example.org"]}]},
+			{"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "127.0.0.1:9000"}]}]}
+		]}
+	}`
+	c, got := newServer(t, http.StatusOK, servers)
+	hosts, err := c.Hosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"blog.example.org", "example.com", "shop.example.com", "www.example.com"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Hosts() = %v, want %v", hosts, want)
+	}
+	if (*got)[0].Method != "GET" || (*got)[0].Path != "/config/apps/http/servers" {
+		t.Errorf("Hosts requested %s %s", (*got)[0].Method, (*got)[0].Path)
+	}
+}
+
+func TestHostsWithoutHTTPApp(t *testing.T) {
+	// Caddy answers null for a config path that does not exist
+	c, _ := newServer(t, http.StatusOK, "null\n")
+	hosts, err := c.Hosts()
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("Hosts() = %v, %v; want none", hosts, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c, got := newServer(t, http.StatusNoContent, "")
+	if err := c.PurgeCache(`^GET-https-(?:example\.com)-/blog/`); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PurgeSurrogateKeys("example.com:post-1", "example.com:term-2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []request{
+		{Method: "PURGE", Path: SouinAPI + "/%5EGET-https-%28%3F:example%5C.com%29-%2Fblog%2F"},
+		{Method: "PURGE", Path: SouinAPI, SurrogateKey: "example.com:post-1, example.com:term-2"},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("purges sent %+v, want %+v", *got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusBadRequest, `{"error":"loading config: adapting config: Caddyfile:3: unrecognized directive: phpp"}`, "loading config: adapting config: Caddyfile:3: unrecognized directive: phpp"},
+		{http.StatusNotFound, "404 page not found\n", "404 page not found"},
+	}
+	for _, tt := range tests {
+		c, _ := newServer(t, tt.status, tt.body)
+		err := c.Load([]byte("x"), false)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Load error = %v, want *Error", err)
+		}
+		if apiErr.StatusCode != tt.status || apiErr.Message != tt.want || apiErr.Method != "POST" || apiErr.Path != "/load" {
+			t.Errorf("Load error = %+v", apiErr)
+		}
+	}
+
+	c := New("127.0.0.1:1")
+	if _, err := c.Hosts(); err == nil {
+		t.Error("Hosts succeeded without a server")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	c, got := newServer(t, http.StatusOK, "")
+	r := ReverseProxyRoute("ironstack:example.com:443", []string{"example.com"}, "127.0.0.1:6081")
+	if err := c.AddRoute("srv0", r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveRoute("ironstack:example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadConfig([]byte(`{"apps":{}}`), true); err != nil {
+		t.Fatal(err)
+	}
+	want := []request{
+		{Method: "PUT", Path: "/config/apps/http/servers/srv0/routes/0", ContentType: "application/json",
+			Body: `{"@id":"ironstack:example.com:443","match":[{"host":["example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"127.0.0.1:6081"}]}],"terminal":true}`},
+		{Method: "DELETE", Path: "/id/ironstack:example.com:443"},
+		{Method: "GET", Path: "/config/"},
+		{Method: "POST", Path: "/load", ContentType: "application/json", CacheControl: "must-revalidate", Body: `{"apps":{}}`},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("requests sent %+v, want %+v", *got, want)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	c, got := newServer(t, http.StatusOK, `{"@id": "ironstack:example.com:443", "match": [{"host": ["example.com"]}], "terminal": true}`)
+	r, err := c.Route("ironstack:example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "ironstack:example.com:443" || !r.Terminal || r.Match[0].Host[0] != "example.com" {
+		t.Errorf("Route() = %+v", r)
+	}
+	if (*got)[0].Method != "GET" || (*got)[0].Path != "/id/ironstack:example.com:443" {
+		t.Errorf("Route requested %s %s", (*got)[0].Method, (*got)[0].Path)
+	}
+
+	c, _ = newServer(t, http.StatusNotFound, `{"error":"unknown object ID 'missing'"}`)
+	var apiErr *Error
+	if _, err := c.Route("missing"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Route(missing) error = %v", err)
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	c, got := newServer(t, http.StatusOK, `{"result": {"apps": {"http": {}}}, "warnings": [{"message": "not formatted"}]}`)
+	adapted, err := c.Adapt([]byte("example.com {\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(adapted) != `{"apps": {"http": {}}}` {
+		t.Errorf("Adapt() = %s", adapted)
+	}
+	want := request{Method: "POST", Path: "/adapt", ContentType: "text/caddyfile", Body: "example.com {\n}\n"}
+	if (*got)[0] != want {
+		t.Errorf("Adapt sent %+v, want %+v", (*got)[0], want)
+	}
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// healthCheckAddr is where Caddy's HTTP listener is probed after a reload
+const healthCheckAddr = "127.0.0.1:80"
+
+// healthCheckTimeout bounds how long a reloaded site may take to answer
+const healthCheckTimeout = 10 * time.Second
+
+// probeInterval is the pause between health check requests
+const probeInterval = 500 * time.Millisecond
+
+// stagedSuffix marks a site config that has been written but not validated.
+// It does not match the *.conf import glob, so Caddy never loads it.
+const stagedSuffix = ".ironstack-new"
+
+// RemoveSite deletes a site's config and removes its routes from the
+// running Caddy
+func (c *Caddy) RemoveSite(domain string) error {
+	return c.Apply(map[string][]byte{domain: nil})
+}
+
+// Apply installs site configs and reloads Caddy. sites maps a domain to its
+// new config; nil removes the site. Every config is written next to its
+// final path and validated before anything is replaced. The full
+// configuration is then validated and loaded, and new sites are
+// health-checked. Removed sites only have their routes deleted from the
+// running config. If any of this fails, the previous files are restored.
+func (c *Caddy) Apply(sites map[string][]byte) error {
+	files := make(map[string][]byte)
+	for domain, data := range sites {
+		files[c.ConfPath(domain)] = data
+	}
+	main, err := c.withImport()
+	if err != nil {
+		return err
+	}
+	if main != nil {
+		files[c.Caddyfile] = main
+	}
+
+	previous, err := snapshot(files)
+	if err != nil {
+		return err
+	}
+	changed := make(map[string][]byte)
+	for path, data := range files {
+		old, existed := previous[path]
+		if data == nil && !existed || data != nil && existed && bytes.Equal(old, data) {
+			continue
+		}
+		changed[path] = data
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if err := c.stage(changed); err != nil {
+		return err
+	}
+	if err := c.swap(changed); err != nil {
+		return c.rollback(err, previous, changed, false)
+	}
+	if err := c.validate(c.Caddyfile); err != nil {
+		return c.rollback(err, previous, changed, false)
+	}
+	if reloaded, err := c.load(sites, main != nil); err != nil {
+		return c.rollback(err, previous, changed, reloaded)
+	}
+
+	var added []string
+	for domain, data := range sites {
+		if data != nil {
+			added = append(added, domain)
+		}
+	}
+	sort.Strings(added)
+	if err := c.healthCheck(added); err != nil {
+		return c.rollback(err, previous, changed, true)
+	}
+	return nil
+}
+
+// withImport returns the main Caddyfile with an import of the sites
+// directory, or nil if it already has one
+func (c *Caddy) withImport() ([]byte, error) {
+	data, err := os.ReadFile(c.Caddyfile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	line := "import " + filepath.Join(c.ConfigDir, "*.conf")
+	if bytes.Contains(data, []byte(line)) {
+		return nil, nil
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	return append(data, line+"\n"...), nil
+}
+
+// snapshot reads the current contents of files. Missing files are left out.
+func snapshot(files map[string][]byte) (map[string][]byte, error) {
+	previous := make(map[string][]byte)
+	for path := range files {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		previous[path] = data
+	}
+	return previous, nil
+}
+
+// stage writes the new site configs next to their final paths and validates
+// each one on its own
+func (c *Caddy) stage(changed map[string][]byte) error {
+	if err := c.Runner.MkdirAll(c.ConfigDir, 0755); err != nil {
+		return err
+	}
+	var staged []string
+	cleanup := func() {
+		for _, path := range staged {
+			c.Runner.Remove(path)
+		}
+	}
+	for _, path := range sortedKeys(changed) {
+		data := changed[path]
+		if data == nil {
+			continue
+		}
+		if err := c.Runner.WriteFile(path+stagedSuffix, data, 0644); err != nil {
+			cleanup()
+			return err
+		}
+		staged = append(staged, path+stagedSuffix)
+		if path == c.Caddyfile {
+			// It imports the live site configs, so it is validated after the swap
+			continue
+		}
+		if err := c.validate(path + stagedSuffix); err != nil {
+			cleanup()
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// swap moves the staged configs into place and removes deleted sites
+func (c *Caddy) swap(changed map[string][]byte) error {
+	for _, path := range sortedKeys(changed) {
+		var err error
+		if changed[path] == nil {
+			err = c.Runner.Remove(path)
+		} else {
+			err = c.Runner.Rename(path+stagedSuffix, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores the previous contents of the changed files. Caddy is
+// reloaded again if it had already loaded the new config.
+func (c *Caddy) rollback(cause error, previous, changed map[string][]byte, reloaded bool) error {
+	var errs runner.Errors
+	for _, path := range sortedKeys(changed) {
+		c.Runner.Remove(path + stagedSuffix)
+		old, existed := previous[path]
+		if !existed {
+			if err := c.Runner.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs.Add("remove "+path, err)
+			}
+			continue
+		}
+		if err := c.Runner.WriteFile(path+stagedSuffix, old, 0644); err != nil {
+			errs.Add("restore "+path, err)
+			continue
+		}
+		errs.Add("restore "+path, c.Runner.Rename(path+stagedSuffix, path))
+	}
+	if reloaded && len(errs.Steps) == 0 {
+		errs.Add("reload Caddy", c.Reload())
+	}
+	if err := errs.Err(); err != nil {
+		return fmt.Errorf("%w; restoring the previous Caddy config failed: %w", cause, err)
+	}
+	return fmt.Errorf("%w; previous Caddy config restored", cause)
+}
+
+// validate checks a Caddyfile with `caddy validate`, which also loads the
+// modules it uses
+func (c *Caddy) validate(path string) error {
+	return c.Runner.Run("caddy", "validate", "--config", path, "--adapter", "caddyfile")
+}
+
+// healthCheck verifies that Caddy loaded the new config and answers for
+// each domain
+func (c *Caddy) healthCheck(domains []string) error {
+	if runner.IsDryRun(c.Runner) {
+		return nil
+	}
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		// Auto-HTTPS answers with a redirect, which is a healthy response
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, domain := range domains {
+		routes, err := c.SiteRoutes(domain)
+		if err != nil {
+			return err
+		}
+		if len(routes) == 0 {
+			return fmt.Errorf("%s is missing from the config Caddy loaded", domain)
+		}
+		if err := probe(client, healthCheckAddr, domain, time.Now().Add(healthCheckTimeout)); err != nil {
+			return fmt.Errorf("%s does not respond after reload: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// probe requests a site from the local listener at addr until it answers
+// with a status below 500 or the deadline passes. A 502 or 503 means Caddy
+// is up but the site's backend is not.
+func probe(client *http.Client, addr, domain string, deadline time.Time) error {
+	for {
+		req, err := http.NewRequest(http.MethodHead, "http://"+addr+"/", nil)
+		if err != nil {
+			return err
+		}
+		req.Host = domain
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil
+			}
+			err = fmt.Errorf("HTTP %s", resp.Status)
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(probeInterval)
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// newTestCaddy returns a Caddy config generator whose files live in a
+// temporary directory
+func newTestCaddy(t *testing.T) (*Caddy, *runner.Fake) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := Default()
+	cfg.Caddy.Caddyfile = filepath.Join(dir, "Caddyfile")
+	cfg.Caddy.SitesDir = filepath.Join(dir, "sites")
+	fake := runner.NewFake()
+	fake.Disk = true
+	return NewCaddy(cfg, fake), fake
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCaddyApplyRejectedSite(t *testing.T) {
+	c, fake := newTestCaddy(t)
+	conf := c.ConfPath("example.com")
+	fake.On("caddy validate --config "+conf+stagedSuffix, "", errors.New("exit status 1"))
+
+	err := c.Apply(map[string][]byte{"example.com": []byte("example.com {\n\tbogus\n}\n")})
+	if err == nil || !strings.HasPrefix(err.Error(), "example.com.conf: ") {
+		t.Fatalf("Apply error = %v", err)
+	}
+	// Nothing was swapped in, so there is nothing to restore or reload
+	for _, path := range []string{conf, conf + stagedSuffix, c.Caddyfile} {
+		if got := readFile(t, path); got != "<missing>" {
+			t.Errorf("%s = %q, want it missing", path, got)
+		}
+	}
+	if fake.Ran("caddy validate --config " + c.Caddyfile) {
+		t.Error("full config validated after a site was rejected")
+	}
+}
+
+func TestCaddyApplyRollback(t *testing.T) {
+	c, fake := newTestCaddy(t)
+	const main = "{\n\tadmin localhost:2019\n}\n"
+	writeFile(t, c.Caddyfile, main)
+	writeFile(t, c.ConfPath("old.example.com"), "old.example.com {\n}\n")
+	writeFile(t, c.ConfPath("example.com"), "example.com {\n\troot * /old\n}\n")
+
+	// Each site is valid alone, but the full config is rejected
+	fake.On("caddy validate --config "+c.Caddyfile, "", errors.New("exit status 1"))
+	err := c.Apply(map[string][]byte{
+		"example.com":     []byte("example.com {\n\troot * /new\n}\n"),
+		"new.example.com": []byte("new.example.com {\n}\n"),
+		"old.example.com": nil,
+	})
+	if err == nil || !strings.Contains(err.Error(), "previous Caddy config restored") {
+		t.Fatalf("Apply error = %v", err)
+	}
+
+	want := map[string]string{
+		c.Caddyfile:                                  main,
+		c.ConfPath("example.com"):                    "example.com {\n\troot * /old\n}\n",
+		c.ConfPath("old.example.com"):                "old.example.com {\n}\n",
+		c.ConfPath("new.example.com"):                "<missing>",
+		c.ConfPath("new.example.com") + stagedSuffix: "<missing>",
+	}
+	for path, data := range want {
+		if got := readFile(t, path); got != data {
+			t.Errorf("%s = %q, want %q", filepath.Base(path), got, data)
+		}
+	}
+}
+
+func TestCaddyApplyUnchanged(t *testing.T) {
+	c, fake := newTestCaddy(t)
+	writeFile(t, c.Caddyfile, "import "+filepath.Join(c.ConfigDir, "*.conf")+"\n")
+	writeFile(t, c.ConfPath("example.com"), "example.com {\n}\n")
+
+	if err := c.Apply(map[string][]byte{"example.com": []byte("example.com {\n}\n"), "gone.example.com": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls) != 0 {
+		t.Errorf("Apply without changes ran:\n%s", strings.Join(fake.Calls, "\n"))
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // answers in order; the last one repeats
+		timeout  time.Duration
+		wantErr  string
+		wantReqs int
+	}{
+		{"healthy", []int{http.StatusOK}, time.Second, "", 1},
+		{"redirect", []int{http.StatusPermanentRedirect}, time.Second, "", 1},
+		{"not found", []int{http.StatusNotFound}, time.Second, "", 1},
+		{"backend starting", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, 5 * time.Second, "", 3},
+		{"backend down", []int{http.StatusBadGateway}, 0, "HTTP 502 Bad Gateway", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var hosts []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				hosts = append(hosts, r.Host)
+				status := tt.statuses[min(len(hosts), len(tt.statuses))-1]
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			err := probe(client, srv.Listener.Addr().String(), "example.com", time.Now().Add(tt.timeout))
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("probe error = %v, want %q", err, tt.wantErr)
+			}
+			if len(hosts) != tt.wantReqs {
+				t.Errorf("probe sent %d requests, want %d", len(hosts), tt.wantReqs)
+			}
+			for _, h := range hosts {
+				if h != "example.com" {
+					t.Errorf("request for host %q", h)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := srv.Listener.Addr().String()
+	srv.Close()
+	if err := probe(http.DefaultClient, addr, "example.com", time.Now()); err == nil {
+		t.Error("probe of a closed port succeeded")
+	}
+}
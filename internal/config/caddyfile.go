@@ -0,0 +1,452 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SiteConfig describes the Caddy configuration of one site
+type SiteConfig struct {
+	Domain     string
+	Aliases    []string // additional hostnames served by the same site
+	Root       string   // document root, default <web_root>/<domain>/public
+	UseVarnish bool     // proxy through Varnish instead of serving PHP directly
+	SiteOptions
+
+	// URL and cookie name regexes the page cache is bypassed for, in
+	// addition to the defaults the VCL uses
+	BypassPaths   []string
+	BypassCookies []string
+
+	// StatusScript is the site's PHP status script, served to IronStack on
+	// 127.0.0.1:<ports.php_status> only. Empty for none.
+	StatusScript string
+}
+
+// SiteOptions are the per-site Caddy settings stored in the site registry
+type SiteOptions struct {
+	PHPBackend   string            `json:"php_backend,omitempty"` // FastCGI address, default 127.0.0.1:<ports.php>
+	Redirects    []Redirect        `json:"redirects,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"` // added to or overriding the security headers
+	BasicAuth    []BasicAuthUser   `json:"basic_auth,omitempty"`
+	RateLimit    *RateLimit        `json:"rate_limit,omitempty"`
+	BlockedPaths []string          `json:"blocked_paths,omitempty"` // answered with 404 in addition to the defaults
+	PageCache    *PageCache        `json:"page_cache,omitempty"`    // only for sites not using Varnish
+}
+
+// PageCache caches full pages in Caddy for sites not using Varnish. It
+// requires Caddy to be built with the cache-handler module.
+type PageCache struct {
+	TTL   string `json:"ttl,omitempty"`   // default 1h
+	Stale string `json:"stale,omitempty"` // how long expired pages may still be served, default 24h
+}
+
+// Redirect sends requests for a path elsewhere
+type Redirect struct {
+	From string `json:"from"` // request path, may end in *
+	To   string `json:"to"`
+	Code int    `json:"code,omitempty"` // 301, 302, 307 or 308; default 301
+}
+
+// BasicAuthUser is an HTTP basic auth account
+type BasicAuthUser struct {
+	User         string `json:"user"`
+	PasswordHash string `json:"password_hash"` // bcrypt, e.g. from `caddy hash-password`
+}
+
+// RateLimit limits requests per client address. It requires Caddy to be
+// built with the caddy-ratelimit module.
+type RateLimit struct {
+	Events int    `json:"events"`
+	Window string `json:"window"` // e.g. 1m
+}
+
+// defaultHeaders are sent by every site
+var defaultHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "SAMEORIGIN",
+	"X-XSS-Protection":       "1; mode=block",
+	"Referrer-Policy":        "strict-origin-when-cross-origin",
+}
+
+// defaultBlockedPaths are never served
+var defaultBlockedPaths = []string{"/wp-config.php", "/.git*", "/readme.html", "/license.txt"}
+
+var (
+	hostLabel  = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	headerName = regexp.MustCompile(`^-?[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+)
+
+var siteTemplate = template.Must(template.New("site").Funcs(template.FuncMap{
+	"join":    strings.Join,
+	"q":       caddyQuote,
+	"deleted": func(name string) bool { return strings.HasPrefix(name, "-") },
+	"dir":     filepath.Dir,
+	"base":    filepath.Base,
+}).Parse(`# Managed by IronStack. Changes are overwritten when the site is updated.
+{{join .Addresses ", "}} {
+	encode gzip zstd
+
+	# Security headers
+	header {
+{{- range .Headers}}
+		{{.Name}}{{if not (deleted .Name)}} {{q .Value}}{{end}}
+{{- end}}
+	}
+
+	# Block sensitive files
+	@blocked {
+		path{{range .Blocked}} {{q .}}{{end}}
+	}
+	respond @blocked 404
+{{- if .Redirects}}
+
+	# Redirects
+{{- range .Redirects}}
+	redir {{q .From}} {{q .To}} {{.Code}}
+{{- end}}
+{{- end}}
+{{- if .BasicAuth}}
+
+	basic_auth {
+{{- range .BasicAuth}}
+		{{q .User}} {{q .PasswordHash}}
+{{- end}}
+	}
+{{- end}}
+{{- with .RateLimit}}
+
+	route {
+		rate_limit {
+			zone per_client {
+				key {remote_host}
+				events {{.Events}}
+				window {{.Window}}
+			}
+		}
+	}
+{{- end}}
+
+{{if .UseVarnish}}	# Only local tools may purge Varnish
+	@purge method PURGE BAN
+	respond @purge 405
+
+	# Full-page cache
+	reverse_proxy {{.Varnish}}
+{{- else}}{{with .PageCache}}	# Full-page cache. Requests Varnish would pass go straight to PHP.
+	@page_cache {
+		method GET HEAD
+		not header_regexp Cookie {{q $.BypassCookie}}
+{{- range $.BypassURLs}}
+		not vars_regexp {uri} {{q .}}
+{{- end}}
+	}
+	route {
+		cache @page_cache {
+			ttl {{.TTL}}
+			stale {{.Stale}}
+		}
+	}
+
+{{end}}{{template "app" .}}
+{{- end}}
+
+	log {
+		output file {{q .LogFile}}
+	}
+}
+{{- if .UseVarnish}}
+
+# Backend Varnish fetches pages from
+{{join .BackendAddresses ", "}} {
+	bind 127.0.0.1
+
+{{template "app" .}}
+}
+{{- end}}
+{{- with .StatusScript}}
+
+# PHP status for IronStack on this machine
+{{$.StatusAddress}} {
+	bind 127.0.0.1
+
+	root * {{q (dir .)}}
+	rewrite * {{q (printf "/%s?{query}" (base .))}}
+	php_fastcgi {{$.PHPBackend}}
+}
+{{- end}}
+{{- define "app"}}	root * {{q .Root}}
+
+	# PHP handling via PHP-FPM
+	php_fastcgi {{.PHPBackend}}
+
+	# Static file serving
+	file_server
+
+	# Cache static assets
+	@static {
+		path *.css *.js *.ico *.gif *.jpg *.jpeg *.png *.svg *.webp *.woff *.woff2
+	}
+	header @static Cache-Control "public, max-age=31536000, immutable"
+{{- end}}
+`))
+
+// caddySite is the data the site template is executed with
+type caddySite struct {
+	*SiteConfig
+	Addresses        []string
+	BackendAddresses []string
+	Headers          []caddyHeader
+	Blocked          []string
+	Varnish          string
+	LogFile          string
+	BypassCookie     string   // Cookie header regex
+	BypassURLs       []string // request URI regexes
+	StatusAddress    string
+}
+
+type caddyHeader struct {
+	Name, Value string
+}
+
+// ConfPath returns the file a site's configuration is written to
+func (c *Caddy) ConfPath(domain string) string {
+	return filepath.Join(c.ConfigDir, domain+".conf")
+}
+
+// RenderSite generates the Caddyfile of a site
+func (c *Caddy) RenderSite(sc *SiteConfig) ([]byte, error) {
+	site := *sc
+	if site.Root == "" {
+		site.Root = filepath.Join(c.WebRoot, site.Domain, "public")
+	}
+	if site.PHPBackend == "" {
+		site.PHPBackend = fmt.Sprintf("127.0.0.1:%d", c.PHPPort)
+	}
+	site.Redirects = append([]Redirect(nil), site.Redirects...)
+	for i := range site.Redirects {
+		if site.Redirects[i].Code == 0 {
+			site.Redirects[i].Code = 301
+		}
+	}
+	if site.PageCache != nil {
+		pc := *site.PageCache
+		if pc.TTL == "" {
+			pc.TTL = "1h"
+		}
+		if pc.Stale == "" {
+			pc.Stale = "24h"
+		}
+		site.PageCache = &pc
+	}
+	if err := site.validate(); err != nil {
+		return nil, err
+	}
+
+	data := caddySite{
+		SiteConfig:   &site,
+		Blocked:      append(append([]string(nil), defaultBlockedPaths...), site.BlockedPaths...),
+		Varnish:      fmt.Sprintf("127.0.0.1:%d", c.VarnishPort),
+		LogFile:      filepath.Join(c.LogDir, site.Domain+"-access.log"),
+		BypassCookie: bypassCookies,
+		BypassURLs:   append([]string{bypassAdmin, bypassShop}, site.BypassPaths...),
+	}
+	if site.StatusScript != "" {
+		data.StatusAddress = fmt.Sprintf("http://%s:%d", site.Domain, c.StatusPort)
+	}
+	if len(site.BypassCookies) > 0 {
+		data.BypassCookie += `|(^|;\s*)(` + strings.Join(site.BypassCookies, "|") + ")="
+	}
+	for _, host := range append([]string{site.Domain}, site.Aliases...) {
+		data.Addresses = append(data.Addresses, host)
+		data.BackendAddresses = append(data.BackendAddresses, fmt.Sprintf("http://%s:%d", host, c.BackendPort))
+	}
+	headers := make(map[string]string)
+	for name, value := range defaultHeaders {
+		headers[name] = value
+	}
+	for name, value := range site.Headers {
+		headers[name] = value
+	}
+	for name, value := range headers {
+		data.Headers = append(data.Headers, caddyHeader{Name: name, Value: value})
+	}
+	sort.Slice(data.Headers, func(i, j int) bool { return data.Headers[i].Name < data.Headers[j].Name })
+
+	var buf bytes.Buffer
+	if err := siteTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// AddSite writes the Caddyfile of a site to <sites_dir>/<domain>.conf and
+// reloads Caddy. See Apply.
+func (c *Caddy) AddSite(sc *SiteConfig) error {
+	data, err := c.RenderSite(sc)
+	if err != nil {
+		return err
+	}
+	return c.Apply(map[string][]byte{sc.Domain: data})
+}
+
+// validate rejects values that would change the structure of the generated
+// Caddyfile or that Caddy would refuse to load
+func (sc *SiteConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, host := range append([]string{sc.Domain}, sc.Aliases...) {
+		if !validHost(host) {
+			return fmt.Errorf("invalid hostname %q", host)
+		}
+		if seen[strings.ToLower(host)] {
+			return fmt.Errorf("hostname %s is listed twice", host)
+		}
+		seen[strings.ToLower(host)] = true
+	}
+	if err := checkToken("root", sc.Root); err != nil {
+		return err
+	}
+	if sc.StatusScript != "" {
+		if err := checkToken("status script", sc.StatusScript); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(sc.PHPBackend, "unix/") {
+		if _, _, err := net.SplitHostPort(sc.PHPBackend); err != nil {
+			return fmt.Errorf("invalid PHP backend %q", sc.PHPBackend)
+		}
+	}
+	if err := checkToken("PHP backend", sc.PHPBackend); err != nil {
+		return err
+	}
+	for _, r := range sc.Redirects {
+		if !strings.HasPrefix(r.From, "/") {
+			return fmt.Errorf("redirect source %q must be a path", r.From)
+		}
+		switch r.Code {
+		case 301, 302, 307, 308:
+		default:
+			return fmt.Errorf("redirect %s: unsupported status %d", r.From, r.Code)
+		}
+		if err := checkToken("redirect", r.From); err != nil {
+			return err
+		}
+		if err := checkToken("redirect target", r.To); err != nil {
+			return err
+		}
+	}
+	for name, value := range sc.Headers {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if err := checkValue("header "+name, value); err != nil {
+			return err
+		}
+	}
+	for _, u := range sc.BasicAuth {
+		if err := checkToken("basic auth user", u.User); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(u.PasswordHash, "$2") {
+			return fmt.Errorf("basic auth user %s: password must be a bcrypt hash", u.User)
+		}
+		if err := checkToken("basic auth hash", u.PasswordHash); err != nil {
+			return err
+		}
+	}
+	if rl := sc.RateLimit; rl != nil {
+		if rl.Events <= 0 {
+			return fmt.Errorf("rate limit: events must be positive")
+		}
+		if d, err := time.ParseDuration(rl.Window); err != nil || d <= 0 {
+			return fmt.Errorf("rate limit: invalid window %q", rl.Window)
+		}
+	}
+	for _, p := range sc.BlockedPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("blocked path %q must start with /", p)
+		}
+		if err := checkToken("blocked path", p); err != nil {
+			return err
+		}
+	}
+	if pc := sc.PageCache; pc != nil && !sc.UseVarnish {
+		for what, value := range map[string]string{"TTL": pc.TTL, "stale": pc.Stale} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("page cache: invalid %s %q, expected e.g. 30m or 2h", what, value)
+			}
+		}
+		for what, values := range map[string][]string{"bypass path": sc.BypassPaths, "bypass cookie": sc.BypassCookies} {
+			for _, re := range values {
+				if _, err := regexp.Compile(re); err != nil || re == "" {
+					return fmt.Errorf("page cache: invalid %s %q", what, re)
+				}
+				if err := checkValue(what, re); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckDomain rejects a site domain that is not a plain hostname. Domains
+// name the site's directory and config files, so this also keeps them
+// inside their parent directories.
+func CheckDomain(domain string) error {
+	if strings.HasPrefix(domain, "*.") || !validHost(domain) {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	return nil
+}
+
+// validHost accepts hostnames and wildcard hostnames such as *.example.com
+func validHost(host string) bool {
+	host = strings.TrimPrefix(host, "*.")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !hostLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkToken requires value to be a single non-empty Caddyfile token
+func checkToken(what, value string) error {
+	if value == "" || strings.ContainsAny(value, " \t") {
+		return fmt.Errorf("invalid %s %q", what, value)
+	}
+	return checkValue(what, value)
+}
+
+// checkValue rejects control characters and a trailing backslash, which
+// would escape the closing quote
+func checkValue(what, value string) error {
+	for _, r := range value {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("%s contains a control character", what)
+		}
+	}
+	if strings.HasSuffix(value, `\`) {
+		return fmt.Errorf("%s must not end with a backslash", what)
+	}
+	return nil
+}
+
+// caddyQuote returns s as a Caddyfile token, quoting it if needed
+func caddyQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'`{}#\\") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
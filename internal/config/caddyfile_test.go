@@ -0,0 +1,79 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRenderSite(t *testing.T) {
+	tests := []struct {
+		name string
+		site SiteConfig
+	}{
+		{"varnish", SiteConfig{Domain: "example.com", UseVarnish: true}},
+		{"no-varnish", SiteConfig{Domain: "example.com"}},
+		{"page-cache", SiteConfig{
+			Domain:        "example.com",
+			SiteOptions:   SiteOptions{PageCache: &PageCache{TTL: "30m"}},
+			BypassPaths:   []string{"^/members/"},
+			BypassCookies: []string{"membership_token"},
+		}},
+		{"aliases", SiteConfig{Domain: "example.com", Aliases: []string{"www.example.com", "*.example.net"}, UseVarnish: true}},
+		{"status-script", SiteConfig{Domain: "example.com", UseVarnish: true, StatusScript: "/var/www/example.com/status/php-status.php"}},
+		{"options", SiteConfig{
+			Domain: "example.com",
+			SiteOptions: SiteOptions{
+				PHPBackend:   "127.0.0.1:9001",
+				Redirects:    []Redirect{{From: "/old/*", To: "/new/"}, {From: "/shop", To: "https://shop.example.com", Code: 302}},
+				Headers:      map[string]string{"X-Frame-Options": "DENY", "X-Robots-Tag": "noindex"},
+				BasicAuth:    []BasicAuthUser{{User: "staff", PasswordHash: "$2a$14$abcdefghijklmnopqrstuuFdXGRlL5xvJ0F6yHnGhTPJWC3KzcCmK"}},
+				RateLimit:    &RateLimit{Events: 30, Window: "1m"},
+				BlockedPaths: []string{"/xmlrpc.php"},
+			},
+		}},
+	}
+	c := NewCaddy(Default(), nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.RenderSite(&tt.site)
+			if err != nil {
+				t.Fatalf("RenderSite: %v", err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("RenderSite output differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestRenderSiteRejectsInvalid(t *testing.T) {
+	tests := map[string]SiteConfig{
+		"domain":        {Domain: "example.com\n}"},
+		"alias":         {Domain: "example.com", Aliases: []string{"bad host"}},
+		"ttl":           {Domain: "example.com", SiteOptions: SiteOptions{PageCache: &PageCache{TTL: "soon"}}},
+		"redirect code": {Domain: "example.com", SiteOptions: SiteOptions{Redirects: []Redirect{{From: "/a", To: "/b", Code: 200}}}},
+	}
+	c := NewCaddy(Default(), nil)
+	for name, site := range tests {
+		site := site
+		if _, err := c.RenderSite(&site); err == nil {
+			t.Errorf("%s: RenderSite accepted an invalid config", name)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// routeIDPrefix starts the @id of every site route IronStack manages in
+// Caddy's running config
+const routeIDPrefix = "ironstack:"
+
+// routeID returns the @id of a site's route on the server listening on
+// port, e.g. "ironstack:example.com:443". Domains cannot contain a colon,
+// so the ids of one site never start with another site's.
+func routeID(domain, port string) string {
+	return routeIDPrefix + strings.ToLower(domain) + ":" + port
+}
+
+// Reload makes Caddy load the configuration on disk through its admin API.
+// The Caddyfile is adapted to JSON and the routes of each site are given
+// their @id, so sites can be found and removed one by one later. Caddy
+// switches over gracefully and keeps the old config if the new one is
+// rejected.
+func (c *Caddy) Reload() error {
+	if runner.IsDryRun(c.Runner) {
+		// Show the equivalent command instead of calling the API
+		return c.Runner.Run("caddy", "reload", "--config", c.Caddyfile, "--adapter", "caddyfile")
+	}
+	tagged, err := c.adapt()
+	if err != nil {
+		return err
+	}
+	return c.Admin.LoadConfig(tagged, false)
+}
+
+// adapt converts the Caddyfile on disk to JSON with the site routes tagged
+func (c *Caddy) adapt() ([]byte, error) {
+	data, err := os.ReadFile(c.Caddyfile)
+	if err != nil {
+		return nil, err
+	}
+	adapted, err := c.Admin.Adapt(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.tagRoutes(adapted)
+}
+
+// tagRoutes sets the @id of the top-level routes matching the domain of a
+// site config in an adapted Caddyfile
+func (c *Caddy) tagRoutes(adapted []byte) ([]byte, error) {
+	confs, err := filepath.Glob(filepath.Join(c.ConfigDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string]bool)
+	for _, conf := range confs {
+		domains[strings.ToLower(strings.TrimSuffix(filepath.Base(conf), ".conf"))] = true
+	}
+
+	var cfg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(adapted))
+	dec.UseNumber()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("adapted Caddyfile: %w", err)
+	}
+	apps, _ := cfg["apps"].(map[string]interface{})
+	httpApp, _ := apps["http"].(map[string]interface{})
+	servers, _ := httpApp["servers"].(map[string]interface{})
+	for _, s := range servers {
+		server, _ := s.(map[string]interface{})
+		listen, _ := server["listen"].([]interface{})
+		if len(listen) == 0 {
+			continue
+		}
+		addr, _ := listen[0].(string)
+		port := addr[strings.LastIndex(addr, ":")+1:]
+		routes, _ := server["routes"].([]interface{})
+		seen := make(map[string]int)
+		for _, r := range routes {
+			route, _ := r.(map[string]interface{})
+			domain := routeDomain(route, domains)
+			if domain == "" {
+				continue
+			}
+			// Ids must be unique, so further routes of a site are numbered
+			id := routeID(domain, port)
+			if seen[id]++; seen[id] > 1 {
+				id += fmt.Sprintf("#%d", seen[id])
+			}
+			route["@id"] = id
+		}
+	}
+	return json.Marshal(cfg)
+}
+
+// routeDomain returns the domain among domains a route of an adapted config
+// matches, or ""
+func routeDomain(route map[string]interface{}, domains map[string]bool) string {
+	matchers, _ := route["match"].([]interface{})
+	for _, m := range matchers {
+		matcher, _ := m.(map[string]interface{})
+		hosts, _ := matcher["host"].([]interface{})
+		for _, h := range hosts {
+			host, _ := h.(string)
+			if domains[strings.ToLower(host)] {
+				return strings.ToLower(host)
+			}
+		}
+	}
+	return ""
+}
+
+// SiteRoutes returns the routes of a site in the running config by server
+// name. A config loaded without IronStack's route ids, e.g. by Caddy starting
+// from the Caddyfile, is reloaded first so the routes can be found.
+func (c *Caddy) SiteRoutes(domain string) (map[string][]caddyadmin.Route, error) {
+	routes, untagged, err := c.findRoutes(domain)
+	if err != nil || !untagged {
+		return routes, err
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	routes, _, err = c.findRoutes(domain)
+	return routes, err
+}
+
+// findRoutes returns the routes with the ids of domain by server name, and
+// whether a top-level route matches domain without an id
+func (c *Caddy) findRoutes(domain string) (map[string][]caddyadmin.Route, bool, error) {
+	servers, err := c.Admin.Servers()
+	if err != nil {
+		return nil, false, err
+	}
+	prefix := routeID(domain, "")
+	routes := make(map[string][]caddyadmin.Route)
+	untagged := false
+	for name, server := range servers {
+		for _, r := range server.Routes {
+			switch {
+			case strings.HasPrefix(r.ID, prefix):
+				routes[name] = append(routes[name], r)
+			case r.ID == "" && matchesHost(r, domain):
+				untagged = true
+			}
+		}
+	}
+	return routes, untagged, nil
+}
+
+// matchesHost reports whether one of a route's matcher sets names host
+func matchesHost(r caddyadmin.Route, host string) bool {
+	for _, m := range r.Match {
+		for _, h := range m.Host {
+			if strings.EqualFold(h, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoveSiteRoutes deletes the routes of a site from the running config by
+// @id and returns them by server name, so AddRoutes can put them back
+func (c *Caddy) RemoveSiteRoutes(domain string) (map[string][]caddyadmin.Route, error) {
+	routes, err := c.SiteRoutes(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range sortedKeys(routes) {
+		for _, r := range routes[server] {
+			if err := c.Admin.RemoveRoute(r.ID); err != nil {
+				return routes, err
+			}
+		}
+	}
+	return routes, nil
+}
+
+// AddRoutes inserts routes into the servers of the running config they are
+// keyed by
+func (c *Caddy) AddRoutes(routes map[string][]caddyadmin.Route) error {
+	for _, server := range sortedKeys(routes) {
+		// Each route is inserted first, so adding in reverse keeps their order
+		for i := len(routes[server]) - 1; i >= 0; i-- {
+			if err := c.Admin.AddRoute(server, routes[server][i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adaptedRoutes returns the tagged routes of domains in the Caddyfile on
+// disk, keyed by the name of the running server listening on the same
+// address. ok is false if the running config has no such server.
+func (c *Caddy) adaptedRoutes(domains []string) (routes map[string][]caddyadmin.Route, ok bool, err error) {
+	tagged, err := c.adapt()
+	if err != nil {
+		return nil, false, err
+	}
+	var adapted struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]caddyadmin.Server `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(tagged, &adapted); err != nil {
+		return nil, false, fmt.Errorf("adapted Caddyfile: %w", err)
+	}
+	running, err := c.Admin.Servers()
+	if err != nil {
+		return nil, false, err
+	}
+	byListen := make(map[string]string)
+	for name, server := range running {
+		byListen[strings.Join(server.Listen, ",")] = name
+	}
+
+	routes = make(map[string][]caddyadmin.Route)
+	for _, server := range adapted.Apps.HTTP.Servers {
+		for _, r := range server.Routes {
+			for _, domain := range domains {
+				if !strings.HasPrefix(r.ID, routeID(domain, "")) {
+					continue
+				}
+				name, found := byListen[strings.Join(server.Listen, ",")]
+				if !found {
+					return nil, false, nil
+				}
+				routes[name] = append(routes[name], r)
+			}
+		}
+	}
+	return routes, true, nil
+}
+
+// load makes Caddy run the configuration on disk after Apply changed the
+// given sites. The routes of each site are replaced by @id, so other sites
+// are not touched; a changed main Caddyfile reloads the full config.
+// reloaded reports whether the running config may have changed.
+func (c *Caddy) load(sites map[string][]byte, mainChanged bool) (reloaded bool, err error) {
+	if mainChanged || runner.IsDryRun(c.Runner) {
+		// A rejected reload leaves Caddy running the old config
+		return false, c.Reload()
+	}
+	var added []string
+	for _, domain := range sortedKeys(sites) {
+		if sites[domain] != nil {
+			added = append(added, domain)
+		}
+	}
+	var routes map[string][]caddyadmin.Route
+	if len(added) > 0 {
+		var ok bool
+		if routes, ok, err = c.adaptedRoutes(added); err != nil {
+			return false, err
+		} else if !ok {
+			// A site on a new address needs a server of its own
+			return false, c.Reload()
+		}
+	}
+	for _, domain := range sortedKeys(sites) {
+		if _, err := c.RemoveSiteRoutes(domain); err != nil {
+			return true, err
+		}
+	}
+	return true, c.AddRoutes(routes)
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+)
+
+// adminStandIn is an admin API keeping a running config of HTTP servers. It
+// answers /adapt with adapted and records the requests it received.
+type adminStandIn struct {
+	servers  map[string]caddyadmin.Server
+	adapted  string
+	requests []string
+}
+
+func (a *adminStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.requests = append(a.requests, r.Method+" "+r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/config/apps/http/servers":
+		json.NewEncoder(w).Encode(a.servers)
+	case r.Method == "POST" && r.URL.Path == "/adapt":
+		io.WriteString(w, `{"result": `+a.adapted+`}`)
+	case r.Method == "POST" && r.URL.Path == "/load":
+		var cfg struct {
+			Apps struct {
+				HTTP struct {
+					Servers map[string]caddyadmin.Server `json:"servers"`
+				} `json:"http"`
+			} `json:"apps"`
+		}
+		if err := json.Unmarshal(body, &cfg); err != nil {
+			http.Error(w, `{"error":"bad config"}`, http.StatusBadRequest)
+			return
+		}
+		a.servers = cfg.Apps.HTTP.Servers
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/id/"):
+		id := strings.TrimPrefix(r.URL.Path, "/id/")
+		for name, server := range a.servers {
+			for i, route := range server.Routes {
+				if route.ID == id {
+					server.Routes = append(server.Routes[:i:i], server.Routes[i+1:]...)
+					a.servers[name] = server
+					return
+				}
+			}
+		}
+		http.Error(w, `{"error":"unknown object ID"}`, http.StatusNotFound)
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/routes/0"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/config/apps/http/servers/"), "/routes/0")
+		var route caddyadmin.Route
+		json.Unmarshal(body, &route)
+		server := a.servers[name]
+		server.Routes = append([]caddyadmin.Route{route}, server.Routes...)
+		a.servers[name] = server
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ids returns the route ids of each running server, "-" for untagged routes
+func (a *adminStandIn) ids() map[string][]string {
+	ids := make(map[string][]string)
+	for name, server := range a.servers {
+		for _, r := range server.Routes {
+			id := r.ID
+			if id == "" {
+				id = "-"
+			}
+			ids[name] = append(ids[name], id)
+		}
+	}
+	return ids
+}
+
+// newRoutesCaddy returns a Caddy config generator talking to admin, with a
+// Caddyfile and site configs for domains on disk
+func newRoutesCaddy(t *testing.T, admin *adminStandIn, domains ...string) *Caddy {
+	t.Helper()
+	c, _ := newTestCaddy(t)
+	srv := httptest.NewServer(admin)
+	t.Cleanup(srv.Close)
+	c.Admin.BaseURL = srv.URL
+	writeFile(t, c.Caddyfile, "import "+c.ConfigDir+"/*.conf\n")
+	for _, domain := range domains {
+		writeFile(t, c.ConfPath(domain), domain+" {\n}\n")
+	}
+	return c
+}
+
+// adaptedServers is an adapted Caddyfile with the given servers
+func adaptedServers(servers string) string {
+	return `{"apps": {"http": {"servers": ` + servers + `}}}`
+}
+
+func TestTagRoutes(t *testing.T) {
+	c := newRoutesCaddy(t, &adminStandIn{}, "example.com", "Blog.example.org")
+	tagged, err := c.tagRoutes([]byte(adaptedServers(`{
+		"srv0": {"listen": [":443"], "routes": [
+			{"match": [{"host": ["example.com"]}], "handle": [{"handler": "subroute"}], "terminal": true},
+			{"match": [{"host": ["www.example.com"]}, {"host": ["blog.example.org"]}], "terminal": true},
+			{"match": [{"host": ["example.com"], "path": ["/api/*"]}], "terminal": true},
+			{"handle": [{"handler": "static_response", "status_code": 404}]}
+		]},
+		"srv1": {"listen": [":8080"], "routes": [
+			{"match": [{"host": ["example.com"]}]}
+		]}
+	}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]caddyadmin.Server `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(tagged, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	admin := &adminStandIn{servers: cfg.Apps.HTTP.Servers}
+	want := map[string][]string{
+		"srv0": {"ironstack:example.com:443", "ironstack:blog.example.org:443", "ironstack:example.com:443#2", "-"},
+		"srv1": {"ironstack:example.com:8080"},
+	}
+	if got := admin.ids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("tagged ids = %v, want %v", got, want)
+	}
+	// Numbers in the original config survive the round trip
+	if !strings.Contains(string(tagged), `"status_code":404`) {
+		t.Errorf("tagged config lost the handler: %s", tagged)
+	}
+}
+
+func TestSiteRoutesReloadsUntagged(t *testing.T) {
+	// Caddy started from the Caddyfile, so its routes have no ids yet
+	admin := &adminStandIn{
+		servers: map[string]caddyadmin.Server{"srv0": {Listen: []string{":443"}, Routes: []caddyadmin.Route{
+			{Match: []caddyadmin.Match{{Host: []string{"example.com"}}}},
+		}}},
+		adapted: adaptedServers(`{"srv0": {"listen": [":443"], "routes": [{"match": [{"host": ["example.com"]}]}]}}`),
+	}
+	c := newRoutesCaddy(t, admin, "example.com")
+
+	routes, err := c.SiteRoutes("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes["srv0"]) != 1 || routes["srv0"][0].ID != "ironstack:example.com:443" {
+		t.Errorf("SiteRoutes = %+v", routes)
+	}
+	want := []string{"GET /config/apps/http/servers", "POST /adapt", "POST /load", "GET /config/apps/http/servers"}
+	if !reflect.DeepEqual(admin.requests, want) {
+		t.Errorf("requests = %v, want %v", admin.requests, want)
+	}
+
+	// Once tagged, a site that is not running has no routes
+	admin.requests = nil
+	if routes, err := c.SiteRoutes("missing.example.com"); err != nil || len(routes) != 0 {
+		t.Errorf("SiteRoutes(missing) = %+v, %v", routes, err)
+	}
+	if len(admin.requests) != 1 {
+		t.Errorf("requests = %v, want a single lookup", admin.requests)
+	}
+}
+
+func TestLoadReplacesSiteRoutes(t *testing.T) {
+	route := func(id, host string) caddyadmin.Route {
+		return caddyadmin.Route{ID: id, Match: []caddyadmin.Match{{Host: []string{host}}}}
+	}
+	admin := &adminStandIn{
+		servers: map[string]caddyadmin.Server{"srv0": {Listen: []string{":443"}, Routes: []caddyadmin.Route{
+			route("ironstack:a.example.com:443", "a.example.com"),
+			route("ironstack:b.example.com:443", "b.example.com"),
+			route("ironstack:c.example.com:443", "c.example.com"),
+			{},
+		}}},
+		// The adapter names servers on its own; they are matched by address
+		adapted: adaptedServers(`{"srv3": {"listen": [":443"], "routes": [
+			{"match": [{"host": ["a.example.com"]}]},
+			{"match": [{"host": ["c.example.com"]}], "terminal": true},
+			{"match": [{"host": ["d.example.com"]}]},
+			{}
+		]}}`),
+	}
+	c := newRoutesCaddy(t, admin, "a.example.com", "c.example.com", "d.example.com")
+
+	reloaded, err := c.load(map[string][]byte{
+		"b.example.com": nil,
+		"c.example.com": []byte("c.example.com {\n}\n"),
+		"d.example.com": []byte("d.example.com {\n}\n"),
+	}, false)
+	if err != nil || !reloaded {
+		t.Fatalf("load = %v, %v", reloaded, err)
+	}
+	want := map[string][]string{"srv0": {
+		"ironstack:c.example.com:443", "ironstack:d.example.com:443", "ironstack:a.example.com:443", "-",
+	}}
+	if got := admin.ids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("running ids = %v, want %v", got, want)
+	}
+	if !admin.servers["srv0"].Routes[0].Terminal {
+		t.Errorf("c.example.com kept its old route: %+v", admin.servers["srv0"].Routes[0])
+	}
+	for _, req := range admin.requests {
+		if req == "POST /load" {
+			t.Errorf("load replaced the full config: %v", admin.requests)
+		}
+	}
+}
+
+func TestLoadNewAddressReloads(t *testing.T) {
+	admin := &adminStandIn{
+		servers: map[string]caddyadmin.Server{"srv0": {Listen: []string{":443"}}},
+		adapted: adaptedServers(`{
+			"srv0": {"listen": [":443"]},
+			"srv1": {"listen": [":8443"], "routes": [{"match": [{"host": ["example.com"]}]}]}
+		}`),
+	}
+	c := newRoutesCaddy(t, admin, "example.com")
+
+	if _, err := c.load(map[string][]byte{"example.com": []byte("example.com:8443 {\n}\n")}, false); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"srv1": {"ironstack:example.com:8443"}}
+	if got := admin.ids(); !reflect.DeepEqual(got, want) {
+		t.Errorf("running ids = %v, want %v", got, want)
+	}
+}
@@ -1,187 +1,145 @@
 package config
 
 import (
-	"fmt"
-	"os"
-	"path/filepath"
+	"strconv"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/varnishadm"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
 )
 
 // Caddy generates Caddyfile configurations
 type Caddy struct {
-	ConfigDir string
+	Caddyfile   string // main config, imports ConfigDir/*.conf
+	ConfigDir   string
+	WebRoot     string
+	LogDir      string
+	PHPPort     int
+	VarnishPort int
+	BackendPort int // listener Varnish fetches from
+	StatusPort  int // listener for the sites' PHP status scripts
+	Admin       *caddyadmin.Client
+	Runner      runner.Runner
 }
 
 // NewCaddy creates Caddy config generator
-func NewCaddy() *Caddy {
-	return &Caddy{ConfigDir: "/etc/caddy/sites"}
-}
-
-// AddSite generates Caddyfile for a domain
-func (c *Caddy) AddSite(domain string, enableVarnish bool) error {
-	os.MkdirAll(c.ConfigDir, 0755)
-	
-	backend := "127.0.0.1:9000" // FrankenPHP
-	if enableVarnish {
-		backend = "127.0.0.1:6081" // Varnish
+func NewCaddy(cfg *Settings, r runner.Runner) *Caddy {
+	return &Caddy{
+		Caddyfile:   cfg.Caddy.Caddyfile,
+		ConfigDir:   cfg.Caddy.SitesDir,
+		WebRoot:     cfg.WebRoot,
+		LogDir:      cfg.Caddy.LogDir,
+		PHPPort:     cfg.Ports.PHP,
+		VarnishPort: cfg.Ports.Varnish,
+		BackendPort: cfg.Ports.VarnishBackend,
+		StatusPort:  cfg.Ports.PHPStatus,
+		Admin:       caddyadmin.New(cfg.Caddy.Admin),
+		Runner:      r,
 	}
-	
-	config := fmt.Sprintf(`%s {
-    root * /var/www/%s/public
-    
-    # PHP handling via FrankenPHP
-    php_fastcgi %s
-    
-    # Static file serving
-    file_server
-    
-    # Compression
-    encode gzip zstd
-    
-    # Security headers
-    header {
-        X-Content-Type-Options "nosniff"
-        X-Frame-Options "SAMEORIGIN"
-        X-XSS-Protection "1; mode=block"
-        Referrer-Policy "strict-origin-when-cross-origin"
-    }
-    
-    # Cache static assets
-    @static {
-        path *.css *.js *.ico *.gif *.jpg *.jpeg *.png *.svg *.woff *.woff2
-    }
-    header @static Cache-Control "public, max-age=31536000, immutable"
-    
-    # Block sensitive files
-    @blocked {
-        path /wp-config.php
-        path /.git*
-        path /readme.html
-        path /license.txt
-    }
-    respond @blocked 404
-    
-    # Logs
-    log {
-        output file /var/log/caddy/%s-access.log
-    }
 }
-`, domain, domain, backend, domain)
 
-	return os.WriteFile(filepath.Join(c.ConfigDir, domain+".conf"), []byte(config), 0644)
+// Varnish generates and loads the VCL of all Varnish-backed sites
+type Varnish struct {
+	VCLPath     string // VCL varnishd is started with
+	BackendPort int    // Caddy backend listener sites are fetched from
+	Admin       *varnishadm.Client
+	Runner      runner.Runner
 }
 
-// Varnish generates VCL configurations
-type Varnish struct{}
-
 // NewVarnish creates Varnish config generator
-func NewVarnish() *Varnish {
-	return &Varnish{}
+func NewVarnish(cfg *Settings, r runner.Runner) *Varnish {
+	return &Varnish{
+		VCLPath:     cfg.Varnish.VCL,
+		BackendPort: cfg.Ports.VarnishBackend,
+		Admin:       varnishadm.New(cfg.Varnish.Admin, cfg.Varnish.Secret),
+		Runner:      r,
+	}
 }
 
-// GenerateVCL creates WordPress-optimized VCL
-func (v *Varnish) GenerateVCL() string {
-	return `vcl 4.1;
+// PHP generates the php.ini overrides and pool of PHP-FPM
+type PHP struct {
+	Settings PHPSettings
+	Port     int // pool listener Caddy's php_fastcgi connects to
+	Runner   runner.Runner
+}
 
-backend default {
-    .host = "127.0.0.1";
-    .port = "8080";
-    .connect_timeout = 5s;
-    .first_byte_timeout = 90s;
-    .between_bytes_timeout = 2s;
+// NewPHP creates PHP-FPM config generator
+func NewPHP(cfg *Settings, r runner.Runner) *PHP {
+	return &PHP{Settings: cfg.PHP, Port: cfg.Ports.PHP, Runner: r}
 }
 
-sub vcl_recv {
-    # Skip cache for logged-in WordPress users
-    if (req.http.Cookie ~ "wordpress_logged_in|wp-postpass|woocommerce_cart_hash|woocommerce_items_in_cart") {
-        return (pass);
-    }
-    
-    # Skip cache for POST requests and admin
-    if (req.method == "POST" || req.url ~ "wp-admin|wp-login|xmlrpc.php|preview=true") {
-        return (pass);
-    }
-    
-    # Skip cache for WooCommerce dynamic pages
-    if (req.url ~ "cart|checkout|my-account|add-to-cart|logout|lost-password") {
-        return (pass);
-    }
-    
-    # Remove cookies for static files
-    if (req.url ~ "\.(css|js|jpg|jpeg|png|gif|ico|svg|woff|woff2|ttf|eot|webp|avif)(\?.*)?$") {
-        unset req.http.Cookie;
-        return (hash);
-    }
-    
-    # Remove tracking cookies
-    set req.http.Cookie = regsuball(req.http.Cookie, "(^|;\s*)(_ga|_gid|_gat|__utm[a-z]+|_fbp|_fbc)[^;]*", "");
-    
-    return (hash);
+// WordPress generates wp-config optimizations
+type WordPress struct {
+	RedisHost     string
+	RedisPort     int
+	RedisPassword string      // DragonflyDB requirepass; empty if none
+	ObjectCache   ObjectCache // the site's object cache location
 }
 
-sub vcl_backend_response {
-    # Cache static files for 30 days
-    if (bereq.url ~ "\.(css|js|jpg|jpeg|png|gif|ico|svg|woff|woff2|ttf|eot|webp|avif)(\?.*)?$") {
-        set beresp.ttl = 30d;
-        unset beresp.http.Set-Cookie;
-    }
-    
-    # Default cache time for HTML
-    if (beresp.http.Content-Type ~ "text/html") {
-        set beresp.ttl = 1h;
-    }
-    
-    # Grace period for stale content
-    set beresp.grace = 24h;
+// ObjectCache is where a site's WordPress object cache lives in DragonflyDB
+type ObjectCache struct {
+	Database int    `json:"database"`         // 0 is shared by sites without a database of their own
+	Prefix   string `json:"prefix,omitempty"` // WP_CACHE_KEY_SALT; empty for sites created before isolation
 }
 
-sub vcl_deliver {
-    # Cache hit/miss header
-    if (obj.hits > 0) {
-        set resp.http.X-Cache = "HIT";
-        set resp.http.X-Cache-Hits = obj.hits;
-    } else {
-        set resp.http.X-Cache = "MISS";
-    }
-    
-    # Remove internal headers
-    unset resp.http.X-Varnish;
-    unset resp.http.Via;
+// Shared reports whether the object cache is database 0 without a key
+// prefix, the layout of sites created before isolation, whose keys cannot
+// be told apart from other sites'
+func (oc ObjectCache) Shared() bool {
+	return oc.Database == 0 && oc.Prefix == ""
 }
-`
+
+// NewWordPress creates WordPress config generator
+func NewWordPress(cfg *Settings) *WordPress {
+	return &WordPress{RedisHost: cfg.Redis.Host, RedisPort: cfg.Ports.Redis, RedisPassword: cfg.Redis.Password}
 }
 
-// WriteVCL saves VCL to default location
-func (v *Varnish) WriteVCL() error {
-	return os.WriteFile("/etc/varnish/default.vcl", []byte(v.GenerateVCL()), 0644)
+// ForSite returns a copy of w for a site with the given object cache
+func (w *WordPress) ForSite(oc ObjectCache) *WordPress {
+	site := *w
+	site.ObjectCache = oc
+	return &site
 }
 
-// WordPress generates wp-config optimizations
-type WordPress struct{}
+// Constants returns the performance, object cache and security constants
+// IronStack sets in wp-config.php
+func (w *WordPress) Constants() []wpconfig.Constant {
+	constants := []wpconfig.Constant{
+		{Name: "WP_MEMORY_LIMIT", Expr: "'256M'"},
+		{Name: "WP_MAX_MEMORY_LIMIT", Expr: "'512M'"},
+		{Name: "WP_POST_REVISIONS", Expr: "5"},
+		{Name: "AUTOSAVE_INTERVAL", Expr: "120"},
+		{Name: "EMPTY_TRASH_DAYS", Expr: "7"},
+		{Name: "DISABLE_WP_CRON", Expr: "true"},
+		{Name: "WP_CACHE", Expr: "true"},
+
+		// Security
+		{Name: "DISALLOW_FILE_EDIT", Expr: "true"},
+		{Name: "FORCE_SSL_ADMIN", Expr: "true"},
+	}
+	return append(constants, w.ObjectCacheConstants()...)
+}
 
-// NewWordPress creates WordPress config generator
-func NewWordPress() *WordPress {
-	return &WordPress{}
+// ObjectCacheConstants returns the constants pointing the Redis object
+// cache at the site's database and key prefix
+func (w *WordPress) ObjectCacheConstants() []wpconfig.Constant {
+	constants := []wpconfig.Constant{
+		{Name: "WP_REDIS_HOST", Expr: wpconfig.Quote(w.RedisHost)},
+		{Name: "WP_REDIS_PORT", Expr: strconv.Itoa(w.RedisPort)},
+		{Name: "WP_REDIS_DATABASE", Expr: strconv.Itoa(w.ObjectCache.Database)},
+	}
+	if w.RedisPassword != "" {
+		constants = append(constants, wpconfig.Constant{Name: "WP_REDIS_PASSWORD", Expr: wpconfig.Quote(w.RedisPassword)})
+	}
+	if w.ObjectCache.Prefix != "" {
+		constants = append(constants, wpconfig.Constant{Name: "WP_CACHE_KEY_SALT", Expr: wpconfig.Quote(w.ObjectCache.Prefix)})
+	}
+	return constants
 }
 
-// OptimizeConfig returns performance constants for wp-config.php
-func (w *WordPress) OptimizeConfig() string {
-	return `
-// IronStack Performance Optimizations
-define('WP_MEMORY_LIMIT', '256M');
-define('WP_MAX_MEMORY_LIMIT', '512M');
-define('WP_POST_REVISIONS', 5);
-define('AUTOSAVE_INTERVAL', 120);
-define('EMPTY_TRASH_DAYS', 7);
-define('DISABLE_WP_CRON', true);
-define('WP_CACHE', true);
-
-// DragonflyDB Object Cache
-define('WP_REDIS_HOST', '127.0.0.1');
-define('WP_REDIS_PORT', 6379);
-define('WP_REDIS_DATABASE', 0);
-
-// Security
-define('DISALLOW_FILE_EDIT', true);
-define('FORCE_SSL_ADMIN', true);
-`
+// OptimizeConfig sets the IronStack constants in a parsed wp-config.php.
+// Running it again on an optimized file changes nothing.
+func (w *WordPress) OptimizeConfig(f *wpconfig.File) error {
+	return f.SetAll(w.Constants())
 }
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// phpINITemplate overrides the php.ini of PHP-FPM. OPcache revalidates
+// scripts so updates apply without a reset, and its API stays open to the
+// sites' status scripts.
+var phpINITemplate = template.Must(template.New("php.ini").Parse(`; IronStack PHP settings. Generated by IronStack; changes are overwritten.
+memory_limit = {{.MemoryLimit}}
+upload_max_filesize = {{.UploadMaxSize}}
+post_max_size = {{.UploadMaxSize}}
+max_execution_time = 300
+max_input_time = 300
+max_input_vars = 5000
+expose_php = Off
+
+opcache.enable = 1
+opcache.memory_consumption = {{.OPcacheMemory}}
+opcache.interned_strings_buffer = 16
+opcache.max_accelerated_files = 20000
+opcache.validate_timestamps = 1
+opcache.revalidate_freq = 2
+opcache.save_comments = 1
+opcache.jit = tracing
+opcache.jit_buffer_size = 64M
+opcache.restrict_api =
+
+realpath_cache_size = 4096K
+realpath_cache_ttl = 600
+`))
+
+// phpPoolTemplate is the pool Caddy's php_fastcgi connects to. It replaces
+// the packaged www pool, which listens on a Unix socket.
+var phpPoolTemplate = template.Must(template.New("pool").Parse(`; IronStack PHP-FPM pool. Generated by IronStack; changes are overwritten.
+[www]
+user = www-data
+group = www-data
+listen = 127.0.0.1:{{.Port}}
+listen.allowed_clients = 127.0.0.1
+
+pm = dynamic
+pm.max_children = {{.MaxChildren}}
+pm.start_servers = {{.StartServers}}
+pm.min_spare_servers = {{.MinSpare}}
+pm.max_spare_servers = {{.MaxSpare}}
+pm.max_requests = 500
+
+request_terminate_timeout = 300s
+catch_workers_output = yes
+`))
+
+// phpPoolData is the data the pool template is executed with
+type phpPoolData struct {
+	Port                                          int
+	MaxChildren, StartServers, MinSpare, MaxSpare int
+}
+
+// INIPath returns the php.ini overrides PHP-FPM loads after the packaged ones
+func (p *PHP) INIPath() string {
+	return filepath.Join("/etc/php", p.Settings.Version, "fpm/conf.d/99-ironstack.ini")
+}
+
+// PoolPath returns the pool config of PHP-FPM
+func (p *PHP) PoolPath() string {
+	return filepath.Join("/etc/php", p.Settings.Version, "fpm/pool.d/www.conf")
+}
+
+// RenderINI generates the php.ini overrides
+func (p *PHP) RenderINI() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := phpINITemplate.Execute(&buf, p.Settings); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderPool generates the pool config. The spare servers are derived from
+// pm.max_children and satisfy PHP-FPM's
+// min_spare <= start <= max_spare <= max_children.
+func (p *PHP) RenderPool() ([]byte, error) {
+	children := p.Settings.MaxChildren
+	start := max(1, children/4)
+	data := phpPoolData{
+		Port:         p.Port,
+		MaxChildren:  children,
+		StartServers: start,
+		MinSpare:     max(1, start/2),
+		MaxSpare:     max(start, children/2),
+	}
+	var buf bytes.Buffer
+	if err := phpPoolTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply installs the php.ini overrides and the pool, tests them with
+// `php-fpm -t` and reloads PHP-FPM. The previous files are restored if the
+// test fails.
+func (p *PHP) Apply() error {
+	ini, err := p.RenderINI()
+	if err != nil {
+		return err
+	}
+	pool, err := p.RenderPool()
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{p.INIPath(): ini, p.PoolPath(): pool}
+
+	previous, err := snapshot(files)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for path, data := range files {
+		if old, existed := previous[path]; !existed || !bytes.Equal(old, data) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	for _, path := range sortedKeys(files) {
+		if err := p.Runner.WriteFile(path, files[path], 0644); err != nil {
+			return p.restore(err, previous, files)
+		}
+	}
+	if err := p.Runner.Run("php-fpm"+p.Settings.Version, "-t"); err != nil {
+		return p.restore(fmt.Errorf("PHP-FPM config test failed: %w", err), previous, files)
+	}
+	return p.Runner.Run("systemctl", "reload-or-restart", p.Settings.FPMService())
+}
+
+// restore puts the previous contents of files back after PHP-FPM rejected
+// the new ones. The running PHP-FPM still uses the previous config.
+func (p *PHP) restore(cause error, previous, files map[string][]byte) error {
+	var errs runner.Errors
+	for _, path := range sortedKeys(files) {
+		old, existed := previous[path]
+		if !existed {
+			if err := p.Runner.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs.Add("remove "+path, err)
+			}
+			continue
+		}
+		errs.Add("restore "+path, p.Runner.WriteFile(path, old, 0644))
+	}
+	if err := errs.Err(); err != nil {
+		return fmt.Errorf("%w; restoring the previous PHP config failed: %w", cause, err)
+	}
+	return fmt.Errorf("%w; previous PHP config restored", cause)
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// newTestPHP returns a PHP config generator recording into a Fake. The
+// files live under /etc/php, so the test is skipped where PHP-FPM is
+// installed.
+func newTestPHP(t *testing.T) (*PHP, *runner.Fake) {
+	t.Helper()
+	fake := runner.NewFake()
+	p := NewPHP(Default(), fake)
+	for _, path := range []string{p.INIPath(), p.PoolPath()} {
+		if _, err := os.Stat(path); err == nil {
+			t.Skipf("%s exists", path)
+		}
+	}
+	return p, fake
+}
+
+func TestPHPApply(t *testing.T) {
+	p, fake := newTestPHP(t)
+	if err := p.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"write /etc/php/8.3/fpm/conf.d/99-ironstack.ini",
+		"write /etc/php/8.3/fpm/pool.d/www.conf",
+		"php-fpm8.3 -t",
+		"systemctl reload-or-restart php8.3-fpm",
+	}
+	if got := strings.Join(fake.Calls, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+	pool := string(fake.Files[p.PoolPath()])
+	for _, line := range []string{
+		"listen = 127.0.0.1:9000",
+		"pm.max_children = 20",
+		"pm.start_servers = 5",
+		"pm.min_spare_servers = 2",
+		"pm.max_spare_servers = 10",
+	} {
+		if !strings.Contains(pool, line+"\n") {
+			t.Errorf("pool is missing %q:\n%s", line, pool)
+		}
+	}
+	if ini := string(fake.Files[p.INIPath()]); !strings.Contains(ini, "memory_limit = 256M\n") || !strings.Contains(ini, "opcache.memory_consumption = 256\n") {
+		t.Errorf("php.ini:\n%s", ini)
+	}
+}
+
+func TestPHPApplyRejected(t *testing.T) {
+	p, fake := newTestPHP(t)
+	fake.On("php-fpm8.3 -t", "", errors.New("exit status 78"))
+	err := p.Apply()
+	if err == nil || !strings.Contains(err.Error(), "previous PHP config restored") {
+		t.Fatalf("Apply error = %v", err)
+	}
+	if fake.Ran("systemctl") {
+		t.Error("PHP-FPM reloaded with a rejected config")
+	}
+	if len(fake.Files) != 0 {
+		t.Errorf("new files left in place: %v", fake.Files)
+	}
+}
+
+func TestPHPPoolSpareServers(t *testing.T) {
+	tests := []struct {
+		children, start, minSpare, maxSpare int
+	}{
+		{1, 1, 1, 1},
+		{4, 1, 1, 2},
+		{20, 5, 2, 10},
+		{100, 25, 12, 50},
+	}
+	for _, tt := range tests {
+		p := NewPHP(Default(), nil)
+		p.Settings.MaxChildren = tt.children
+		data, err := p.RenderPool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := string(data)
+		for name, want := range map[string]int{
+			"pm.start_servers":     tt.start,
+			"pm.min_spare_servers": tt.minSpare,
+			"pm.max_spare_servers": tt.maxSpare,
+		} {
+			if line := fmt.Sprintf("%s = %d\n", name, want); !strings.Contains(pool, line) {
+				t.Errorf("max_children %d: want %q in\n%s", tt.children, line, pool)
+			}
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is where IronStack looks for its configuration file
+const DefaultPath = "/etc/ironstack/config.yaml"
+
+// Settings is the typed contents of /etc/ironstack/config.yaml
+type Settings struct {
+	Version      string `yaml:"version"`
+	WebRoot      string `yaml:"web_root"`
+	BackupDir    string `yaml:"backup_dir"`
+	LogLevel     string `yaml:"log_level"`
+	StateDir     string `yaml:"state_dir"`
+	AnalyticsDir string `yaml:"analytics_dir"`
+
+	Caddy    CaddySettings    `yaml:"caddy"`
+	Varnish  VarnishSettings  `yaml:"varnish"`
+	Ports    Ports            `yaml:"ports"`
+	Database DatabaseSettings `yaml:"database"`
+	Redis    RedisSettings    `yaml:"redis"`
+	PHP      PHPSettings      `yaml:"php"`
+}
+
+// CaddySettings contains Caddy file locations and its admin API address
+type CaddySettings struct {
+	Caddyfile string `yaml:"caddyfile"`
+	SitesDir  string `yaml:"sites_dir"`
+	LogDir    string `yaml:"log_dir"`
+	DataDir   string `yaml:"data_dir"` // Caddy's data directory, where it stores certificates
+	Admin     string `yaml:"admin"`    // host:port of the admin API
+}
+
+// VarnishSettings contains Varnish file locations and its management port
+type VarnishSettings struct {
+	VCL    string `yaml:"vcl"`    // VCL file varnishd loads at startup
+	Admin  string `yaml:"admin"`  // host:port of the management port (varnishd -T)
+	Secret string `yaml:"secret"` // shared secret for the management port (varnishd -S)
+}
+
+// Ports contains the local ports the stack components listen on
+type Ports struct {
+	Varnish        int `yaml:"varnish"`         // Varnish frontend, proxied to by Caddy
+	VarnishBackend int `yaml:"varnish_backend"` // Caddy backend listener Varnish fetches from
+	Redis          int `yaml:"redis"`           // DragonflyDB
+	PHP            int `yaml:"php"`             // PHP-FPM pool, Caddy's php_fastcgi backend
+	Purge          int `yaml:"purge"`           // IronStack purge endpoint on 127.0.0.1
+	PHPStatus      int `yaml:"php_status"`      // Caddy listener for the sites' PHP status scripts on 127.0.0.1
+}
+
+// DatabaseSettings contains MariaDB administrative credentials
+type DatabaseSettings struct {
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// RedisSettings contains DragonflyDB connection details
+type RedisSettings struct {
+	Host      string `yaml:"host"`
+	Password  string `yaml:"password"`
+	Databases int    `yaml:"databases"` // number of databases (dragonfly --dbnum); one per site
+}
+
+// PHPSettings selects the PHP-FPM version the installer sets up and tunes
+// its php.ini and pool
+type PHPSettings struct {
+	Version       string `yaml:"version"`         // e.g. "8.3", packaged as php8.3-fpm
+	MemoryLimit   string `yaml:"memory_limit"`    // memory_limit, e.g. "256M"
+	UploadMaxSize string `yaml:"upload_max_size"` // upload_max_filesize and post_max_size
+	OPcacheMemory int    `yaml:"opcache_memory"`  // opcache.memory_consumption in MB
+	MaxChildren   int    `yaml:"max_children"`    // pm.max_children of the pool
+}
+
+// PHPVersions are the PHP versions IronStack installs
+var PHPVersions = []string{"8.1", "8.2", "8.3", "8.4"}
+
+// FPMService returns the systemd unit of the PHP-FPM version
+func (p PHPSettings) FPMService() string {
+	return "php" + p.Version + "-fpm"
+}
+
+// Default returns the built-in settings used when no config file exists
+func Default() *Settings {
+	return &Settings{
+		Version:      "1.0.0",
+		WebRoot:      "/var/www",
+		BackupDir:    "/backups",
+		LogLevel:     "info",
+		StateDir:     "/var/lib/ironstack",
+		AnalyticsDir: "/var/www/analytics",
+		Caddy: CaddySettings{
+			Caddyfile: "/etc/caddy/Caddyfile",
+			SitesDir:  "/etc/caddy/sites",
+			LogDir:    "/var/log/caddy",
+			DataDir:   "/var/lib/caddy/.local/share/caddy",
+			Admin:     "localhost:2019",
+		},
+		Varnish: VarnishSettings{
+			VCL:    "/etc/varnish/default.vcl",
+			Admin:  "localhost:6082",
+			Secret: "/etc/varnish/secret",
+		},
+		Ports: Ports{
+			Varnish:        6081,
+			VarnishBackend: 8080,
+			Redis:          6379,
+			PHP:            9000,
+			Purge:          6090,
+			PHPStatus:      6091,
+		},
+		Database: DatabaseSettings{Host: "localhost"},
+		Redis:    RedisSettings{Host: "127.0.0.1", Databases: 16},
+		PHP: PHPSettings{
+			Version:       "8.3",
+			MemoryLimit:   "256M",
+			UploadMaxSize: "64M",
+			OPcacheMemory: 256,
+			MaxChildren:   20,
+		},
+	}
+}
+
+// Load reads settings from path, applies IRONSTACK_* environment overrides
+// and validates the result. A missing file is not an error; defaults are used.
+func Load(path string) (*Settings, error) {
+	s := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err == nil {
+		// Settings missing from the file keep their defaults
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(s); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for key, set := range s.fields() {
+		if value, ok := os.LookupEnv(EnvName(key)); ok {
+			if err := set(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", EnvName(key), err)
+			}
+		}
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EnvName returns the environment variable overriding a setting,
+// e.g. "ports.varnish" -> "IRONSTACK_PORTS_VARNISH"
+func EnvName(key string) string {
+	return "IRONSTACK_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Validate checks paths, ports and enumerated values
+func (s *Settings) Validate() error {
+	paths := map[string]string{
+		"web_root":        s.WebRoot,
+		"backup_dir":      s.BackupDir,
+		"state_dir":       s.StateDir,
+		"analytics_dir":   s.AnalyticsDir,
+		"caddy.caddyfile": s.Caddy.Caddyfile,
+		"caddy.sites_dir": s.Caddy.SitesDir,
+		"caddy.log_dir":   s.Caddy.LogDir,
+		"caddy.data_dir":  s.Caddy.DataDir,
+		"varnish.vcl":     s.Varnish.VCL,
+		"varnish.secret":  s.Varnish.Secret,
+	}
+	for _, key := range sortedKeys(paths) {
+		if !filepath.IsAbs(paths[key]) {
+			return fmt.Errorf("%s must be an absolute path, got %q", key, paths[key])
+		}
+	}
+
+	ports := map[string]int{
+		"ports.varnish":         s.Ports.Varnish,
+		"ports.varnish_backend": s.Ports.VarnishBackend,
+		"ports.redis":           s.Ports.Redis,
+		"ports.php":             s.Ports.PHP,
+		"ports.purge":           s.Ports.Purge,
+		"ports.php_status":      s.Ports.PHPStatus,
+	}
+	seen := make(map[int]string)
+	for _, key := range sortedKeys(ports) {
+		port := ports[key]
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%s must be between 1 and 65535, got %d", key, port)
+		}
+		if other, ok := seen[port]; ok {
+			return fmt.Errorf("%s and %s both use port %d", other, key, port)
+		}
+		seen[port] = key
+	}
+
+	switch s.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level must be debug, info, warn or error, got %q", s.LogLevel)
+	}
+
+	if _, _, err := net.SplitHostPort(s.Caddy.Admin); err != nil {
+		return fmt.Errorf("caddy.admin must be host:port, got %q", s.Caddy.Admin)
+	}
+	if _, _, err := net.SplitHostPort(s.Varnish.Admin); err != nil {
+		return fmt.Errorf("varnish.admin must be host:port, got %q", s.Varnish.Admin)
+	}
+	if s.Database.Host == "" {
+		return fmt.Errorf("database.host must not be empty")
+	}
+	if s.Redis.Host == "" {
+		return fmt.Errorf("redis.host must not be empty")
+	}
+	if s.Redis.Databases < 1 {
+		return fmt.Errorf("redis.databases must be at least 1, got %d", s.Redis.Databases)
+	}
+	if !slices.Contains(PHPVersions, s.PHP.Version) {
+		return fmt.Errorf("php.version must be one of %s, got %q", strings.Join(PHPVersions, ", "), s.PHP.Version)
+	}
+	sizes := map[string]string{
+		"php.memory_limit":    s.PHP.MemoryLimit,
+		"php.upload_max_size": s.PHP.UploadMaxSize,
+	}
+	for _, key := range sortedKeys(sizes) {
+		if !isINISize(sizes[key]) {
+			return fmt.Errorf("%s must be a size such as 256M, got %q", key, sizes[key])
+		}
+	}
+	if s.PHP.OPcacheMemory < 8 {
+		return fmt.Errorf("php.opcache_memory must be at least 8 (MB), got %d", s.PHP.OPcacheMemory)
+	}
+	if s.PHP.MaxChildren < 1 {
+		return fmt.Errorf("php.max_children must be at least 1, got %d", s.PHP.MaxChildren)
+	}
+	return nil
+}
+
+// RedisAddr returns the DragonflyDB address as host:port
+func (s *Settings) RedisAddr() string {
+	return fmt.Sprintf("%s:%d", s.Redis.Host, s.Ports.Redis)
+}
+
+// setting stores a raw config value into a field of Settings
+type setting func(value string) error
+
+func stringSetting(p *string) setting {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func intSetting(p *int) setting {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", v)
+		}
+		*p = n
+		return nil
+	}
+}
+
+// fields maps every supported key to the field it sets, for environment
+// overrides
+func (s *Settings) fields() map[string]setting {
+	return map[string]setting{
+		"version":               stringSetting(&s.Version),
+		"web_root":              stringSetting(&s.WebRoot),
+		"backup_dir":            stringSetting(&s.BackupDir),
+		"log_level":             stringSetting(&s.LogLevel),
+		"state_dir":             stringSetting(&s.StateDir),
+		"analytics_dir":         stringSetting(&s.AnalyticsDir),
+		"caddy.caddyfile":       stringSetting(&s.Caddy.Caddyfile),
+		"caddy.sites_dir":       stringSetting(&s.Caddy.SitesDir),
+		"caddy.log_dir":         stringSetting(&s.Caddy.LogDir),
+		"caddy.data_dir":        stringSetting(&s.Caddy.DataDir),
+		"caddy.admin":           stringSetting(&s.Caddy.Admin),
+		"varnish.vcl":           stringSetting(&s.Varnish.VCL),
+		"varnish.admin":         stringSetting(&s.Varnish.Admin),
+		"varnish.secret":        stringSetting(&s.Varnish.Secret),
+		"ports.varnish":         intSetting(&s.Ports.Varnish),
+		"ports.varnish_backend": intSetting(&s.Ports.VarnishBackend),
+		"ports.redis":           intSetting(&s.Ports.Redis),
+		"ports.php":             intSetting(&s.Ports.PHP),
+		"ports.purge":           intSetting(&s.Ports.Purge),
+		"ports.php_status":      intSetting(&s.Ports.PHPStatus),
+		"database.host":         stringSetting(&s.Database.Host),
+		"database.user":         stringSetting(&s.Database.User),
+		"database.password":     stringSetting(&s.Database.Password),
+		"redis.host":            stringSetting(&s.Redis.Host),
+		"redis.password":        stringSetting(&s.Redis.Password),
+		"redis.databases":       intSetting(&s.Redis.Databases),
+		"php.version":           stringSetting(&s.PHP.Version),
+		"php.memory_limit":      stringSetting(&s.PHP.MemoryLimit),
+		"php.upload_max_size":   stringSetting(&s.PHP.UploadMaxSize),
+		"php.opcache_memory":    intSetting(&s.PHP.OPcacheMemory),
+		"php.max_children":      intSetting(&s.PHP.MaxChildren),
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isINISize reports whether v is a php.ini size: digits with an optional
+// K, M or G suffix
+func isINISize(v string) bool {
+	digits := strings.TrimRight(v, "KMGkmg")
+	if digits == "" || len(v)-len(digits) > 1 {
+		return false
+	}
+	_, err := strconv.Atoi(digits)
+	return err == nil
+}
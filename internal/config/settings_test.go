@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want func(s *Settings)
+	}{
+		{"empty", "", func(s *Settings) {}},
+		{"document start and comments", "---\n# IronStack\n\nlog_level: debug # verbose\n", func(s *Settings) { s.LogLevel = "debug" }},
+		{"hash inside plain scalar", "redis:\n  password: pa#ss\n", func(s *Settings) { s.Redis.Password = "pa#ss" }},
+		{"double quoted with comment", "database:\n  host: \"127.0.0.1\" # local\n", func(s *Settings) { s.Database.Host = "127.0.0.1" }},
+		{"double quoted escapes", "database:\n  password: \"a\\\"b # c\\\\\" # comment\n", func(s *Settings) { s.Database.Password = `a"b # c\` }},
+		{"single quoted", "database:\n  password: 'it''s # not a comment' # comment\n", func(s *Settings) { s.Database.Password = "it's # not a comment" }},
+		{"colon in value", "caddy:\n  admin: localhost:2020\n", func(s *Settings) { s.Caddy.Admin = "localhost:2020" }},
+		{"unquoted version", "php:\n  version: 8.2\n", func(s *Settings) { s.PHP.Version = "8.2" }},
+		{"crlf", "php:\r\n  version: '8.4'\r\n", func(s *Settings) { s.PHP.Version = "8.4" }},
+		{
+			"nested",
+			"ports:\n  varnish: 6081 # public\n  redis: 6380\ndatabase: # MariaDB\n  host: db\n  user: root\nlog_level: warn\n",
+			func(s *Settings) {
+				s.Ports.Redis = 6380
+				s.Database.Host, s.Database.User = "db", "root"
+				s.LogLevel = "warn"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Default()
+			tt.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"valid", "database:\n  host: \"127.0.0.1\" # local\nports:\n  redis: 6380\n", ""},
+		{"unknown key", "database:\n  hostname: db\n", "line 2: field hostname not found"},
+		{"bad number", "ports:\n  redis: six\n", "line 2: cannot unmarshal !!str `six` into int"},
+		{"invalid value", "log_level: loud\n", "log_level must be debug, info, warn or error"},
+		{"syntax error", "ports:\n  redis 6380\n", "line 2"},
+		{"tab indentation", "ports:\n\tredis: 6380\n", "line 2"},
+		{"text after quote", "database:\n  host: \"127.0.0.1\" local\n", "did not find expected key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Load(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Load error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Database.Host != "127.0.0.1" || s.Ports.Redis != 6380 {
+				t.Errorf("Load = database.host %q, ports.redis %d", s.Database.Host, s.Ports.Redis)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// VCLSite describes the Varnish configuration of one site
+type VCLSite struct {
+	Domain  string
+	Aliases []string
+	VCLOptions
+}
+
+// VCLOptions are the per-site Varnish settings stored in the site registry
+type VCLOptions struct {
+	Backend       string   `json:"backend,omitempty"`        // host:port pages are fetched from, default 127.0.0.1:<ports.varnish_backend>
+	TTL           string   `json:"ttl,omitempty"`            // HTML pages, default 1h
+	StaticTTL     string   `json:"static_ttl,omitempty"`     // static files, default 30d
+	Grace         string   `json:"grace,omitempty"`          // how long stale pages are served while refetching, default 24h
+	BypassPaths   []string `json:"bypass_paths,omitempty"`   // URL regexes never cached, in addition to the defaults
+	BypassCookies []string `json:"bypass_cookies,omitempty"` // cookie name regexes that disable caching
+}
+
+// staticFiles matches URLs of static assets
+const staticFiles = `\.(css|js|jpg|jpeg|png|gif|ico|svg|woff|woff2|ttf|eot|webp|avif)(\?.*)?$`
+
+// Requests no page cache serves, whether Varnish or Caddy: those with
+// logged-in or WooCommerce session cookies, admin URLs and WooCommerce pages
+const (
+	bypassCookies = `wordpress_logged_in|wp-postpass|woocommerce_cart_hash|woocommerce_items_in_cart`
+	bypassAdmin   = `wp-admin|wp-login|xmlrpc.php|preview=true`
+	bypassShop    = `cart|checkout|my-account|add-to-cart|logout|lost-password`
+)
+
+var (
+	vclDuration = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(ms|s|m|h|d|w|y)$`)
+	vclName     = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+var vclTemplate = template.Must(template.New("vcl").Funcs(template.FuncMap{
+	"hosts": vclHostMatch,
+	"join":  strings.Join,
+}).Parse(`vcl 4.1;
+# Managed by IronStack. Changes are overwritten when sites change.
+# Passes are logged as "pass:<reason>" for the per-site cache analytics.
+
+import std;
+import xkey;
+
+# Clients allowed to send PURGE and BAN. Caddy refuses both methods from
+# outside, so requests it proxies never get this far.
+acl purge {
+    "localhost";
+    "127.0.0.1";
+    "::1";
+}
+
+# Requests for unknown hostnames
+backend default {
+    .host = "127.0.0.1";
+    .port = "{{.BackendPort}}";
+}
+{{range .Sites}}
+backend {{.Name}} {
+    .host = "{{.Host}}";
+    .port = "{{.Port}}";
+    .connect_timeout = 5s;
+    .first_byte_timeout = 90s;
+    .between_bytes_timeout = 2s;
+    .probe = {
+        .request =
+            "HEAD / HTTP/1.1"
+            "Host: {{index .Hosts 0}}"
+            "User-Agent: IronStack health check"
+            "Connection: close";
+        .interval = 5s;
+        .timeout = 2s;
+        .window = 5;
+        .threshold = 3;
+    }
+}
+{{end}}
+sub vcl_recv {
+    # Route by hostname regardless of case and port
+    set req.http.Host = std.tolower(regsub(req.http.Host, ":[0-9]+$", ""));
+
+    # Set below for known hosts; never taken from the client
+    unset req.http.X-Site;
+
+    if (req.method == "PURGE" || req.method == "BAN") {
+        if (!client.ip ~ purge) {
+            return (synth(405, "Not allowed"));
+        }
+        if (req.http.X-Xkey-Purge) {
+            # Invalidate every object tagged with one of the site-scoped keys
+            set req.http.X-Purged = xkey.purge(req.http.X-Xkey-Purge);
+            return (synth(200, "Purged " + req.http.X-Purged));
+        }
+        if (req.method == "BAN") {
+            # Invalidate every URL of the host matching the request path as a regex
+            ban("obj.http.X-Host == " + req.http.Host + " && obj.http.X-Url ~ " + req.url);
+            return (synth(200, "Banned"));
+        }
+        return (purge);
+    }
+{{range .Sites}}
+    if ({{hosts "req" .Hosts}}) {
+        set req.backend_hint = {{.Name}};
+        set req.http.X-Site = "{{.Domain}}";
+{{- range .BypassPaths}}
+        if (req.url ~ "{{.}}") {
+            std.log("pass:bypass_path");
+            return (pass);
+        }
+{{- end}}
+{{- with .BypassCookies}}
+        if (req.http.Cookie ~ "(^|;\s*)({{join . "|"}})=") {
+            std.log("pass:bypass_cookie");
+            return (pass);
+        }
+{{- end}}
+    }
+{{end}}
+    # Only GET and HEAD are cached
+    if (req.method != "GET" && req.method != "HEAD") {
+        std.log("pass:method");
+        return (pass);
+    }
+
+    # Skip cache for logged-in WordPress users
+    if (req.http.Cookie ~ "{{.BypassCookies}}") {
+        std.log("pass:cookie");
+        return (pass);
+    }
+
+    # Skip cache for admin
+    if (req.url ~ "{{.BypassAdmin}}") {
+        std.log("pass:admin");
+        return (pass);
+    }
+
+    # Skip cache for WooCommerce dynamic pages
+    if (req.url ~ "{{.BypassShop}}") {
+        std.log("pass:woocommerce");
+        return (pass);
+    }
+
+    # Remove cookies for static files
+    if (req.url ~ "{{.Static}}") {
+        unset req.http.Cookie;
+        return (hash);
+    }
+
+    # Remove tracking cookies
+    set req.http.Cookie = regsuball(req.http.Cookie, "(^|;\s*)(_ga|_gid|_gat|__utm[a-z]+|_fbp|_fbc)[^;]*", "");
+
+    return (hash);
+}
+
+sub vcl_backend_response {
+    # Stored with the object so the ban lurker can evaluate bans
+    set beresp.http.X-Host = bereq.http.Host;
+    set beresp.http.X-Url = bereq.url;
+
+    # Scope the surrogate keys WordPress sends to the site, so that equal
+    # post IDs of different sites do not collide
+    if (beresp.http.xkey && bereq.http.X-Site) {
+        set beresp.http.xkey = regsuball(beresp.http.xkey, "([^\s,]+)", bereq.http.X-Site + ":\1");
+    } else {
+        unset beresp.http.xkey;
+    }
+
+    # Cache static files for 30 days
+    if (bereq.url ~ "{{.Static}}") {
+        set beresp.ttl = 30d;
+        unset beresp.http.Set-Cookie;
+    }
+
+    # Default cache time for HTML
+    if (beresp.http.Content-Type ~ "text/html") {
+        set beresp.ttl = 1h;
+    }
+
+    # Grace period for stale content
+    set beresp.grace = 24h;
+{{- range .Sites}}
+{{- if or .TTL .StaticTTL .Grace}}
+
+    # {{.Domain}}
+    if ({{hosts "bereq" .Hosts}}) {
+{{- with .StaticTTL}}
+        if (bereq.url ~ "{{$.Static}}") {
+            set beresp.ttl = {{.}};
+        }
+{{- end}}
+{{- with .TTL}}
+        if (beresp.http.Content-Type ~ "text/html") {
+            set beresp.ttl = {{.}};
+        }
+{{- end}}
+{{- with .Grace}}
+        set beresp.grace = {{.}};
+{{- end}}
+    }
+{{- end}}
+{{- end}}
+}
+
+sub vcl_deliver {
+    # Cache hit/miss header
+    if (obj.hits > 0) {
+        set resp.http.X-Cache = "HIT";
+        set resp.http.X-Cache-Hits = obj.hits;
+    } else {
+        set resp.http.X-Cache = "MISS";
+    }
+
+    # Remove internal headers
+    unset resp.http.X-Host;
+    unset resp.http.X-Url;
+    unset resp.http.xkey;
+    unset resp.http.X-Varnish;
+    unset resp.http.Via;
+}
+`))
+
+// vclData is the data the VCL template is executed with
+type vclData struct {
+	BackendPort   int
+	Static        string
+	BypassCookies string
+	BypassAdmin   string
+	BypassShop    string
+	Sites         []vclSite
+}
+
+type vclSite struct {
+	VCLSite
+	Name  string // VCL backend name
+	Hosts []string
+	Host  string
+	Port  string
+}
+
+// RenderVCL generates the VCL for the given sites
+func (v *Varnish) RenderVCL(sites []VCLSite) ([]byte, error) {
+	data := vclData{
+		BackendPort:   v.BackendPort,
+		Static:        staticFiles,
+		BypassCookies: bypassCookies,
+		BypassAdmin:   bypassAdmin,
+		BypassShop:    bypassShop,
+	}
+	names := make(map[string]bool)
+	owners := make(map[string]string)
+
+	sorted := append([]VCLSite(nil), sites...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Domain < sorted[j].Domain })
+	for _, site := range sorted {
+		if site.Backend == "" {
+			site.Backend = fmt.Sprintf("127.0.0.1:%d", v.BackendPort)
+		}
+		if err := site.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", site.Domain, err)
+		}
+		vs := vclSite{VCLSite: site}
+		vs.Host, vs.Port, _ = net.SplitHostPort(site.Backend)
+		for _, host := range append([]string{site.Domain}, site.Aliases...) {
+			host = strings.ToLower(host)
+			if other, ok := owners[host]; ok {
+				return nil, fmt.Errorf("hostname %s is used by both %s and %s", host, other, site.Domain)
+			}
+			owners[host] = site.Domain
+			vs.Hosts = append(vs.Hosts, host)
+		}
+
+		// Backend names must be unique identifiers
+		base := "site_" + strings.Trim(vclName.ReplaceAllString(strings.ToLower(site.Domain), "_"), "_")
+		vs.Name = base
+		for i := 2; names[vs.Name]; i++ {
+			vs.Name = fmt.Sprintf("%s_%d", base, i)
+		}
+		names[vs.Name] = true
+		data.Sites = append(data.Sites, vs)
+	}
+
+	var buf bytes.Buffer
+	if err := vclTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply installs the VCL for sites and makes Varnish use it. The new VCL is
+// compiled with `varnishd -C` before it replaces the file on disk, and the
+// previous file is restored if Varnish does not accept it.
+func (v *Varnish) Apply(sites []VCLSite) error {
+	data, err := v.RenderVCL(sites)
+	if err != nil {
+		return err
+	}
+	previous, err := os.ReadFile(v.VCLPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+	if existed && bytes.Equal(previous, data) {
+		return nil
+	}
+
+	staged := v.VCLPath + stagedSuffix
+	if err := v.Runner.WriteFile(staged, data, 0644); err != nil {
+		return err
+	}
+	if err := v.Runner.Run("varnishd", "-C", "-f", staged); err != nil {
+		v.Runner.Remove(staged)
+		return fmt.Errorf("VCL does not compile: %w", err)
+	}
+	if err := v.Runner.Rename(staged, v.VCLPath); err != nil {
+		v.Runner.Remove(staged)
+		return err
+	}
+	if err := v.load(); err != nil {
+		return v.restore(err, previous, existed)
+	}
+	return nil
+}
+
+// load compiles the VCL file in the running Varnish and switches to it.
+// Cached objects are kept. VCLs loaded by earlier runs are discarded.
+func (v *Varnish) load() error {
+	name := fmt.Sprintf("ironstack_%d", time.Now().UnixNano())
+	if runner.IsDryRun(v.Runner) {
+		// Show the equivalent commands instead of connecting
+		if err := v.Runner.Run("varnishadm", "vcl.load", name, v.VCLPath); err != nil {
+			return err
+		}
+		return v.Runner.Run("varnishadm", "vcl.use", name)
+	}
+	if err := v.Admin.VCLLoad(name, v.VCLPath); err != nil {
+		return err
+	}
+	if err := v.Admin.VCLUse(name); err != nil {
+		v.Admin.VCLDiscard(name)
+		return err
+	}
+
+	// Old VCLs keep their backends and probes running until discarded. One
+	// that is still busy with requests fails and is retried next time.
+	vcls, _ := v.Admin.VCLList()
+	for _, vcl := range vcls {
+		if vcl.Status != "active" && strings.HasPrefix(vcl.Name, "ironstack_") {
+			v.Admin.VCLDiscard(vcl.Name)
+		}
+	}
+	return nil
+}
+
+// restore puts the previous VCL file back after Varnish rejected the new
+// one. Varnish itself still runs the previous VCL.
+func (v *Varnish) restore(cause error, previous []byte, existed bool) error {
+	var err error
+	if existed {
+		if err = v.Runner.WriteFile(v.VCLPath+stagedSuffix, previous, 0644); err == nil {
+			err = v.Runner.Rename(v.VCLPath+stagedSuffix, v.VCLPath)
+		}
+	} else {
+		err = v.Runner.Remove(v.VCLPath)
+	}
+	if err != nil {
+		return fmt.Errorf("%w; restoring the previous VCL failed: %w", cause, err)
+	}
+	return fmt.Errorf("%w; previous VCL restored", cause)
+}
+
+// validate rejects values that would change the structure of the generated
+// VCL
+func (s *VCLSite) validate() error {
+	for _, host := range append([]string{s.Domain}, s.Aliases...) {
+		if !validHost(host) {
+			return fmt.Errorf("invalid hostname %q", host)
+		}
+	}
+	host, port, err := net.SplitHostPort(s.Backend)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid backend %q", s.Backend)
+	}
+	if err := checkVCLString("backend", s.Backend); err != nil {
+		return err
+	}
+	for what, d := range map[string]string{"TTL": s.TTL, "static TTL": s.StaticTTL, "grace": s.Grace} {
+		if d != "" && !vclDuration.MatchString(d) {
+			return fmt.Errorf("invalid %s %q, expected e.g. 30m, 1h or 7d", what, d)
+		}
+	}
+	for _, p := range s.BypassPaths {
+		if err := checkVCLString("bypass path", p); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.BypassCookies {
+		if err := checkVCLString("bypass cookie", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVCLString requires value to fit in a "..." VCL string, which has no
+// escape sequences
+func checkVCLString(what, value string) error {
+	if value == "" || strings.Contains(value, `"`) {
+		return fmt.Errorf("invalid %s %q", what, value)
+	}
+	for _, r := range value {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("%s contains a control character", what)
+		}
+	}
+	return nil
+}
+
+// vclHostMatch returns a VCL condition matching any of hosts on the Host
+// header of req or bereq. Wildcard hosts match a single label.
+func vclHostMatch(obj string, hosts []string) string {
+	conds := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if rest, ok := strings.CutPrefix(host, "*."); ok {
+			conds = append(conds, fmt.Sprintf(`%s.http.Host ~ "^[^.]+\.%s$"`, obj, strings.ReplaceAll(rest, ".", `\.`)))
+			continue
+		}
+		conds = append(conds, fmt.Sprintf(`%s.http.Host == "%s"`, obj, host))
+	}
+	return strings.Join(conds, " || ")
+}
@@ -1,35 +1,76 @@
 package installer
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Component represents an installable component
 type Component struct {
 	Name    string
-	Install func() error
-	Check   func() bool
+	Install func(r runner.Runner, out io.Writer) error
+	Check   func(r runner.Runner) bool
+}
+
+// EventType describes what happened to a component during installation
+type EventType int
+
+const (
+	EventStarted EventType = iota
+	EventOutput
+	EventSucceeded
+	EventFailed
+)
+
+// Event reports installation progress for a single component
+type Event struct {
+	Component string
+	Type      EventType
+	Line      string // set for EventOutput
+	Output    string // combined stdout/stderr, set when the component finishes
+	Err       error  // set for EventFailed
 }
 
 // Installer manages component installation
 type Installer struct {
 	components []Component
+	runner     runner.Runner
 }
 
 // New creates a new installer with all components
-func New() *Installer {
+func New(cfg *config.Settings, r runner.Runner) *Installer {
+	installDragonflyConfigured := func(r runner.Runner, out io.Writer) error {
+		return installDragonfly(r, out, cfg)
+	}
+	installPHPVersion := func(r runner.Runner, out io.Writer) error {
+		return installPHP(r, out, cfg)
+	}
+	checkPHPVersion := func(r runner.Runner) bool {
+		return checkPHP(r, cfg.PHP.Version)
+	}
+
 	return &Installer{
+		runner: r,
 		components: []Component{
 			{Name: "Caddy", Install: installCaddy, Check: checkCaddy},
+			{Name: "PHP", Install: installPHPVersion, Check: checkPHPVersion},
 			{Name: "Varnish", Install: installVarnish, Check: checkVarnish},
 			{Name: "MariaDB", Install: installMariaDB, Check: checkMariaDB},
-			{Name: "DragonflyDB", Install: installDragonfly, Check: checkDragonfly},
+			{Name: "DragonflyDB", Install: installDragonflyConfigured, Check: checkDragonfly},
 			{Name: "WP-CLI", Install: installWPCLI, Check: checkWPCLI},
 			{Name: "CSF", Install: installCSF, Check: checkCSF},
 			{Name: "Fail2ban", Install: installFail2ban, Check: checkFail2ban},
 			{Name: "GoAccess", Install: installGoAccess, Check: checkGoAccess},
+			{Name: "Purge endpoint", Install: installPurgeService, Check: checkPurgeService},
 		},
 	}
 }
@@ -39,14 +80,21 @@ func (i *Installer) Components() []Component {
 	return i.components
 }
 
-// InstallAll installs all components
-func (i *Installer) InstallAll(progress func(name string, done bool)) error {
+// InstallAll installs all components, reporting each step to progress.
+// Installation stops at the first component that fails.
+func (i *Installer) InstallAll(progress func(Event)) error {
 	for _, c := range i.components {
-		progress(c.Name, false)
-		if err := c.Install(); err != nil {
+		progress(Event{Component: c.Name, Type: EventStarted})
+
+		out := &eventWriter{component: c.Name, progress: progress}
+		err := c.Install(i.runner, out)
+		out.flush()
+
+		if err != nil {
+			progress(Event{Component: c.Name, Type: EventFailed, Output: out.buf.String(), Err: err})
 			return fmt.Errorf("failed to install %s: %w", c.Name, err)
 		}
-		progress(c.Name, true)
+		progress(Event{Component: c.Name, Type: EventSucceeded, Output: out.buf.String()})
 	}
 	return nil
 }
@@ -66,7 +114,7 @@ func CheckRequirements() error {
 }
 
 // --- Caddy ---
-func installCaddy() error {
+func installCaddy(r runner.Runner, out io.Writer) error {
 	commands := []string{
 		"apt-get update",
 		"apt-get install -y debian-keyring debian-archive-keyring apt-transport-https curl",
@@ -75,111 +123,290 @@ func installCaddy() error {
 		"apt-get update",
 		"apt-get install -y caddy",
 	}
-	return runCommands(commands)
+	return runCommands(r, out, commands)
 }
 
-func checkCaddy() bool {
+func checkCaddy(r runner.Runner) bool {
 	return commandExists("caddy")
 }
 
+// --- PHP ---
+
+// phpExtensions are the extensions WordPress and IronStack need: the package
+// suffix of each and the module name `php -m` lists it under
+var phpExtensions = []struct{ Package, Module string }{
+	{"mysql", "mysqli"},
+	{"redis", "redis"},
+	{"imagick", "imagick"},
+	{"intl", "intl"},
+	{"zip", "zip"},
+	{"opcache", "Zend OPcache"},
+	{"curl", "curl"},
+	{"gd", "gd"},
+	{"mbstring", "mbstring"},
+	{"xml", "xml"},
+}
+
+// phpRepository adds the repository packaging every supported PHP version:
+// the ondrej/php PPA on Ubuntu, packages.sury.org on Debian
+const phpRepository = `. /etc/os-release && if [ "$ID" = ubuntu ]; then apt-get install -y software-properties-common && add-apt-repository -y ppa:ondrej/php; else curl -sSLo /usr/share/keyrings/deb.sury.org-php.gpg https://packages.sury.org/php/apt.gpg && echo "deb [signed-by=/usr/share/keyrings/deb.sury.org-php.gpg] https://packages.sury.org/php/ $VERSION_CODENAME main" > /etc/apt/sources.list.d/php.list; fi`
+
+func installPHP(r runner.Runner, out io.Writer, cfg *config.Settings) error {
+	v := cfg.PHP.Version
+	packages := []string{"php" + v + "-fpm", "php" + v + "-cli"}
+	for _, ext := range phpExtensions {
+		packages = append(packages, "php"+v+"-"+ext.Package)
+	}
+	commands := []string{
+		"apt-get install -y ca-certificates curl",
+		phpRepository,
+		"apt-get update",
+		"apt-get install -y " + strings.Join(packages, " "),
+		"systemctl enable " + cfg.PHP.FPMService(),
+	}
+	if err := runCommands(r, out, commands); err != nil {
+		return err
+	}
+
+	php := config.NewPHP(cfg, r)
+	fmt.Fprintf(out, "write %s\n", php.INIPath())
+	fmt.Fprintf(out, "write %s\n", php.PoolPath())
+	return php.Apply()
+}
+
+func checkPHP(r runner.Runner, version string) bool {
+	if !commandExists("php-fpm" + version) {
+		return false
+	}
+	missing, err := missingPHPExtensions(r, version)
+	return err == nil && len(missing) == 0
+}
+
+// missingPHPExtensions returns the required extensions PHP version does not
+// load
+func missingPHPExtensions(r runner.Runner, version string) ([]string, error) {
+	out, err := r.Output("php"+version, "-m")
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		loaded[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, ext := range phpExtensions {
+		if !loaded[ext.Module] {
+			missing = append(missing, ext.Module)
+		}
+	}
+	return missing, nil
+}
+
 // --- Varnish ---
-func installVarnish() error {
+func installVarnish(r runner.Runner, out io.Writer) error {
 	commands := []string{
-		"apt-get install -y varnish",
+		"apt-get install -y varnish varnish-modules", // varnish-modules provides vmod_xkey
 		"systemctl enable varnish",
 	}
-	return runCommands(commands)
+	return runCommands(r, out, commands)
 }
 
-func checkVarnish() bool {
+func checkVarnish(r runner.Runner) bool {
 	return commandExists("varnishd")
 }
 
 // --- MariaDB ---
-func installMariaDB() error {
+func installMariaDB(r runner.Runner, out io.Writer) error {
 	commands := []string{
 		"apt-get install -y mariadb-server mariadb-client",
 		"systemctl enable mariadb",
 		"systemctl start mariadb",
 	}
-	return runCommands(commands)
+	return runCommands(r, out, commands)
 }
 
-func checkMariaDB() bool {
+func checkMariaDB(r runner.Runner) bool {
 	return commandExists("mysql")
 }
 
 // --- DragonflyDB ---
-func installDragonfly() error {
+// dragonflyImage is the container image DragonflyDB runs from
+const dragonflyImage = "docker.dragonflydb.io/dragonflydb/dragonfly"
+
+// installDragonfly runs DragonflyDB in Docker with the configured number of
+// databases, one per site, and password
+func installDragonfly(r runner.Runner, out io.Writer, cfg *config.Settings) error {
 	commands := []string{
 		"curl -fsSL https://get.docker.com | sh",
-		"docker pull docker.dragonflydb.io/dragonflydb/dragonfly",
-		"docker run -d --name dragonfly --restart=always -p 6379:6379 docker.dragonflydb.io/dragonflydb/dragonfly",
+		"docker pull " + dragonflyImage,
+	}
+	if err := runCommands(r, out, commands); err != nil {
+		return err
 	}
-	return runCommands(commands)
+	args := []string{"run", "-d", "--name", "dragonfly", "--restart=always",
+		"-p", fmt.Sprintf("127.0.0.1:%d:6379", cfg.Ports.Redis), dragonflyImage,
+		fmt.Sprintf("--dbnum=%d", cfg.Redis.Databases)}
+	if cfg.Redis.Password != "" {
+		args = append(args, "--requirepass="+cfg.Redis.Password)
+	}
+	return runCmd(r, out, runner.Command("docker", args...))
 }
 
-func checkDragonfly() bool {
-	out, _ := exec.Command("docker", "ps", "--filter", "name=dragonfly", "-q").Output()
+func checkDragonfly(r runner.Runner) bool {
+	out, _ := r.Output("docker", "ps", "--filter", "name=dragonfly", "-q")
 	return len(out) > 0
 }
 
 // --- WP-CLI ---
-func installWPCLI() error {
+func installWPCLI(r runner.Runner, out io.Writer) error {
 	commands := []string{
 		"curl -O https://raw.githubusercontent.com/wp-cli/builds/gh-pages/phar/wp-cli.phar",
 		"chmod +x wp-cli.phar",
 		"mv wp-cli.phar /usr/local/bin/wp",
 	}
-	return runCommands(commands)
+	return runCommands(r, out, commands)
 }
 
-func checkWPCLI() bool {
+func checkWPCLI(r runner.Runner) bool {
 	return commandExists("wp")
 }
 
 // --- CSF ---
-func installCSF() error {
+func installCSF(r runner.Runner, out io.Writer) error {
 	commands := []string{
 		"cd /usr/src && curl -O https://download.configserver.com/csf.tgz",
 		"cd /usr/src && tar -xzf csf.tgz",
 		"cd /usr/src/csf && sh install.sh",
 	}
-	return runCommands(commands)
+	return runCommands(r, out, commands)
 }
 
-func checkCSF() bool {
+func checkCSF(r runner.Runner) bool {
 	return commandExists("csf")
 }
 
 // --- Fail2ban ---
-func installFail2ban() error {
-	return runCommands([]string{"apt-get install -y fail2ban", "systemctl enable fail2ban"})
+func installFail2ban(r runner.Runner, out io.Writer) error {
+	return runCommands(r, out, []string{"apt-get install -y fail2ban", "systemctl enable fail2ban"})
 }
 
-func checkFail2ban() bool {
+func checkFail2ban(r runner.Runner) bool {
 	return commandExists("fail2ban-client")
 }
 
 // --- GoAccess ---
-func installGoAccess() error {
-	return runCommands([]string{"apt-get install -y goaccess"})
+func installGoAccess(r runner.Runner, out io.Writer) error {
+	return runCommands(r, out, []string{"apt-get install -y goaccess"})
 }
 
-func checkGoAccess() bool {
+func checkGoAccess(r runner.Runner) bool {
 	return commandExists("goaccess")
 }
 
+// --- Purge endpoint ---
+
+// purgeBinary is where the installer puts the running ironstack binary for
+// the purge unit to run
+const purgeBinary = "/usr/local/bin/ironstack"
+
+// purgeUnit runs the endpoint the purge mu-plugin notifies
+const purgeUnit = `[Unit]
+Description=IronStack cache purge endpoint
+After=network.target varnish.service
+
+[Service]
+ExecStart=` + purgeBinary + ` cache serve
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const purgeUnitPath = "/etc/systemd/system/ironstack-purge.service"
+
+// executable returns the path of the running binary; tests replace it
+var executable = os.Executable
+
+func installPurgeService(r runner.Runner, out io.Writer) error {
+	exe, err := executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the ironstack binary: %w", err)
+	}
+	fmt.Fprintf(out, "write %s\n", purgeUnitPath)
+	if err := r.WriteFile(purgeUnitPath, []byte(purgeUnit), 0644); err != nil {
+		return err
+	}
+	var commands []string
+	if exe != purgeBinary {
+		commands = append(commands, fmt.Sprintf("install -m 0755 %s %s", runner.Quote(exe), purgeBinary))
+	}
+	// Restart rather than start so that a running endpoint picks up a
+	// replaced binary
+	commands = append(commands, "systemctl daemon-reload", "systemctl enable ironstack-purge", "systemctl restart ironstack-purge")
+	return runCommands(r, out, commands)
+}
+
+func checkPurgeService(r runner.Runner) bool {
+	return r.Run("test", "-x", purgeBinary) == nil && r.Run("systemctl", "is-enabled", "--quiet", "ironstack-purge") == nil
+}
+
 // --- Helpers ---
-func runCommands(commands []string) error {
-	for _, cmd := range commands {
-		if err := exec.Command("sh", "-c", cmd).Run(); err != nil {
-			return fmt.Errorf("command failed: %s: %w", cmd, err)
+func runCommands(r runner.Runner, out io.Writer, commands []string) error {
+	for _, c := range commands {
+		fmt.Fprintf(out, "$ %s\n", c)
+		cmd := runner.Shell(c)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := r.RunCmd(cmd); err != nil {
+			// *runner.CommandError already names the command
+			return err
 		}
 	}
 	return nil
 }
 
+// runCmd runs a command like runCommands, showing it with secrets masked
+func runCmd(r runner.Runner, out io.Writer, cmd *runner.Cmd) error {
+	fmt.Fprintf(out, "$ %s\n", cmd.Redacted())
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return r.RunCmd(cmd)
+}
+
+// eventWriter captures command output and forwards it line by line
+type eventWriter struct {
+	mu        sync.Mutex
+	component string
+	progress  func(Event)
+	buf       bytes.Buffer
+	partial   string
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	data := w.partial + string(p)
+	lines := strings.Split(data, "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		w.progress(Event{Component: w.component, Type: EventOutput, Line: strings.TrimRight(line, "\r")})
+	}
+	return len(p), nil
+}
+
+func (w *eventWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.partial != "" {
+		w.progress(Event{Component: w.component, Type: EventOutput, Line: w.partial})
+		w.partial = ""
+	}
+}
+
 func commandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil
@@ -0,0 +1,126 @@
+package installer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+func TestInstallPurgeService(t *testing.T) {
+	tests := []struct {
+		name string
+		exe  string
+		want []string
+	}{
+		{
+			"copies the running binary",
+			"/root/go/bin/iron stack",
+			[]string{
+				"write " + purgeUnitPath,
+				`sh -c 'install -m 0755 '\''/root/go/bin/iron stack'\'' /usr/local/bin/ironstack'`,
+				"sh -c 'systemctl daemon-reload'",
+				"sh -c 'systemctl enable ironstack-purge'",
+				"sh -c 'systemctl restart ironstack-purge'",
+			},
+		},
+		{
+			"already installed",
+			purgeBinary,
+			[]string{
+				"write " + purgeUnitPath,
+				"sh -c 'systemctl daemon-reload'",
+				"sh -c 'systemctl enable ironstack-purge'",
+				"sh -c 'systemctl restart ironstack-purge'",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(orig func() (string, error)) { executable = orig }(executable)
+			executable = func() (string, error) { return tt.exe, nil }
+			fake := runner.NewFake()
+
+			if err := installPurgeService(fake, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(fake.Calls, "\n"); got != strings.Join(tt.want, "\n") {
+				t.Errorf("commands:\n%s\nwant:\n%s", got, strings.Join(tt.want, "\n"))
+			}
+			if unit := string(fake.Files[purgeUnitPath]); !strings.Contains(unit, "\nExecStart="+purgeBinary+" cache serve\n") {
+				t.Errorf("unit:\n%s", unit)
+			}
+		})
+	}
+}
+
+func TestInstallPurgeServiceFailure(t *testing.T) {
+	defer func(orig func() (string, error)) { executable = orig }(executable)
+	executable = func() (string, error) { return "/tmp/ironstack", nil }
+	fake := runner.NewFake()
+	fake.On("sh -c 'install", "", errors.New("exit status 1"))
+
+	if err := installPurgeService(fake, io.Discard); err == nil {
+		t.Fatal("installPurgeService succeeded without the binary")
+	}
+	if fake.Ran("sh -c 'systemctl") {
+		t.Errorf("unit enabled without the binary:\n%s", strings.Join(fake.Calls, "\n"))
+	}
+}
+
+func TestCheckPurgeService(t *testing.T) {
+	tests := []struct {
+		name   string
+		failed string // command prefix that fails
+		want   bool
+	}{
+		{"installed", "", true},
+		{"no binary", "test -x", false},
+		{"unit not enabled", "systemctl is-enabled", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := runner.NewFake()
+			if tt.failed != "" {
+				fake.On(tt.failed, "", errors.New("exit status 1"))
+			}
+			if got := checkPurgeService(fake); got != tt.want {
+				t.Errorf("checkPurgeService = %v, want %v; ran:\n%s", got, tt.want, strings.Join(fake.Calls, "\n"))
+			}
+		})
+	}
+}
+
+func TestInstallDragonfly(t *testing.T) {
+	cfg := config.Default()
+	cfg.Ports.Redis = 6380
+	cfg.Redis.Databases = 64
+	cfg.Redis.Password = "s3cret pass"
+	fake := runner.NewFake()
+	var out bytes.Buffer
+
+	if err := installDragonfly(fake, &out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	run := "docker run -d --name dragonfly --restart=always -p 127.0.0.1:6380:6379 " + dragonflyImage + " --dbnum=64 "
+	if got := fake.Calls[len(fake.Calls)-1]; got != run+"'--requirepass=s3cret pass'" {
+		t.Errorf("ran %s", got)
+	}
+	if strings.Contains(out.String(), "s3cret") || !strings.Contains(out.String(), "$ "+run+"--requirepass=***\n") {
+		t.Errorf("output:\n%s", out.String())
+	}
+
+	// Without a password Dragonfly runs without authentication
+	cfg.Redis.Password = ""
+	fake = runner.NewFake()
+	if err := installDragonfly(fake, io.Discard, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Calls[len(fake.Calls)-1]; got != strings.TrimSuffix(run, " ") {
+		t.Errorf("ran %s", got)
+	}
+}
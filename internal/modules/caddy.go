@@ -1,19 +1,20 @@
 package modules
 
 import (
-	"fmt"
-	"os/exec"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Caddy manages Caddy web server
-type Caddy struct{}
+type Caddy struct {
+	Runner runner.Runner
+}
 
-func NewCaddy() *Caddy {
-	return &Caddy{}
+func NewCaddy(r runner.Runner) *Caddy {
+	return &Caddy{Runner: r}
 }
 
 func (c *Caddy) Install() error {
-	cmd := exec.Command("sh", "-c", `
+	return c.Runner.Run("sh", "-c", `
 		apt-get update && 
 		apt-get install -y debian-keyring debian-archive-keyring apt-transport-https &&
 		curl -1sLf 'https://dl.cloudsmith.io/public/caddy/stable/gpg.key' | gpg --dearmor -o /usr/share/keyrings/caddy-stable-archive-keyring.gpg &&
@@ -21,32 +22,13 @@ func (c *Caddy) Install() error {
 		apt-get update &&
 		apt-get install -y caddy
 	`)
-	return cmd.Run()
-}
-
-func (c *Caddy) AddSite(domain string) error {
-	config := fmt.Sprintf(`
-%s {
-    root * /var/www/%s
-    php_fastcgi 127.0.0.1:9000
-    file_server
-    encode gzip
-    
-    @static {
-        path *.css *.js *.ico *.gif *.jpg *.jpeg *.png *.svg *.woff2
-    }
-    header @static Cache-Control "public, max-age=31536000"
-}
-`, domain, domain)
-
-	return exec.Command("sh", "-c", fmt.Sprintf("echo '%s' >> /etc/caddy/Caddyfile", config)).Run()
 }
 
 func (c *Caddy) Reload() error {
-	return exec.Command("systemctl", "reload", "caddy").Run()
+	return c.Runner.Run("systemctl", "reload", "caddy")
 }
 
 func (c *Caddy) Status() (string, error) {
-	out, err := exec.Command("systemctl", "is-active", "caddy").Output()
+	out, err := c.Runner.Output("systemctl", "is-active", "caddy")
 	return string(out), err
 }
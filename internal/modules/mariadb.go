@@ -1,25 +1,31 @@
 package modules
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
-	"os/exec"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/secrets"
 )
 
 // MariaDB manages MariaDB database
-type MariaDB struct{}
+type MariaDB struct {
+	Runner runner.Runner
+}
 
-func NewMariaDB() *MariaDB {
-	return &MariaDB{}
+func NewMariaDB(r runner.Runner) *MariaDB {
+	return &MariaDB{Runner: r}
 }
 
 func (m *MariaDB) Install() error {
-	return exec.Command("apt-get", "install", "-y", "mariadb-server", "mariadb-client").Run()
+	return m.Runner.Run("apt-get", "install", "-y", "mariadb-server", "mariadb-client")
 }
 
 func (m *MariaDB) CreateDatabase(name string) (user, password string, err error) {
-	password = generatePassword()
+	password, err = secrets.GeneratePassword(16)
+	if err != nil {
+		return "", "", err
+	}
 	user = name + "_user"
 
 	query := fmt.Sprintf(`
@@ -29,22 +35,19 @@ func (m *MariaDB) CreateDatabase(name string) (user, password string, err error)
 		FLUSH PRIVILEGES;
 	`, name, user, password, name, user)
 
-	err = exec.Command("mysql", "-e", query).Run()
+	// The query holds the password, so it is not passed as an argument
+	cmd := runner.Command("mysql")
+	cmd.Stdin = strings.NewReader(query)
+	err = m.Runner.RunCmd(cmd)
 	return user, password, err
 }
 
 func (m *MariaDB) Backup(name, path string) error {
 	cmd := fmt.Sprintf("mysqldump %s | gzip > %s", name, path)
-	return exec.Command("sh", "-c", cmd).Run()
+	return m.Runner.Run("sh", "-c", cmd)
 }
 
 func (m *MariaDB) Status() (string, error) {
-	out, err := exec.Command("systemctl", "is-active", "mariadb").Output()
+	out, err := m.Runner.Output("systemctl", "is-active", "mariadb")
 	return string(out), err
 }
-
-func generatePassword() string {
-	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)[:16]
-}
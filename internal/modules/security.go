@@ -1,15 +1,16 @@
 package modules
 
 import (
-	"os"
-	"os/exec"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Security manages CSF and Fail2ban
-type Security struct{}
+type Security struct {
+	Runner runner.Runner
+}
 
-func NewSecurity() *Security {
-	return &Security{}
+func NewSecurity(r runner.Runner) *Security {
+	return &Security{Runner: r}
 }
 
 func (s *Security) InstallCSF() error {
@@ -18,11 +19,11 @@ func (s *Security) InstallCSF() error {
 		tar -xzf csf.tgz &&
 		cd csf &&
 		sh install.sh`
-	return exec.Command("sh", "-c", cmd).Run()
+	return s.Runner.Run("sh", "-c", cmd)
 }
 
 func (s *Security) InstallFail2ban() error {
-	if err := exec.Command("apt-get", "install", "-y", "fail2ban").Run(); err != nil {
+	if err := s.Runner.Run("apt-get", "install", "-y", "fail2ban"); err != nil {
 		return err
 	}
 
@@ -44,7 +45,7 @@ logpath = /var/log/auth.log
 maxretry = 3
 bantime = 3600
 `
-	if err := os.WriteFile("/etc/fail2ban/jail.local", []byte(jailConfig), 0644); err != nil {
+	if err := s.Runner.WriteFile("/etc/fail2ban/jail.local", []byte(jailConfig), 0644); err != nil {
 		return err
 	}
 
@@ -55,24 +56,24 @@ failregex = ^<HOST> .* "POST /wp-login.php
             ^<HOST> .* "POST /xmlrpc.php
 ignoreregex =
 `
-	if err := os.WriteFile("/etc/fail2ban/filter.d/wordpress.conf", []byte(wpFilter), 0644); err != nil {
+	if err := s.Runner.WriteFile("/etc/fail2ban/filter.d/wordpress.conf", []byte(wpFilter), 0644); err != nil {
 		return err
 	}
 
-	return exec.Command("systemctl", "restart", "fail2ban").Run()
+	return s.Runner.Run("systemctl", "restart", "fail2ban")
 }
 
 func (s *Security) BlockIP(ip string) error {
-	return exec.Command("csf", "-d", ip).Run()
+	return s.Runner.Run("csf", "-d", ip)
 }
 
 func (s *Security) UnblockIP(ip string) error {
-	return exec.Command("csf", "-dr", ip).Run()
+	return s.Runner.Run("csf", "-dr", ip)
 }
 
 func (s *Security) AllowPort(port string) error {
-	if err := exec.Command("csf", "-a", port).Run(); err != nil {
+	if err := s.Runner.Run("csf", "-a", port); err != nil {
 		return err
 	}
-	return exec.Command("csf", "-r").Run()
+	return s.Runner.Run("csf", "-r")
 }
@@ -1,36 +1,45 @@
 package modules
 
 import (
-	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
 )
 
 // WordPress manages WordPress via WP-CLI
-type WordPress struct{}
+type WordPress struct {
+	Runner runner.Runner
+}
 
-func NewWordPress() *WordPress {
-	return &WordPress{}
+func NewWordPress(r runner.Runner) *WordPress {
+	return &WordPress{Runner: r}
 }
 
 func (w *WordPress) InstallCLI() error {
 	cmd := `curl -O https://raw.githubusercontent.com/wp-cli/builds/gh-pages/phar/wp-cli.phar && 
 		chmod +x wp-cli.phar && 
 		mv wp-cli.phar /usr/local/bin/wp`
-	return exec.Command("sh", "-c", cmd).Run()
+	return w.Runner.Run("sh", "-c", cmd)
 }
 
 func (w *WordPress) Install(path, url, dbName, dbUser, dbPass string) error {
 	// Download WordPress
-	if err := exec.Command("wp", "core", "download", "--path="+path).Run(); err != nil {
+	if err := w.Runner.Run("wp", "core", "download", "--path="+path); err != nil {
 		return err
 	}
 
-	// Create config
-	if err := exec.Command("wp", "config", "create",
+	// Create config. The password is answered on standard input to keep it
+	// out of the process list.
+	cmd := runner.Command("wp", "config", "create",
 		"--path="+path,
 		"--dbname="+dbName,
 		"--dbuser="+dbUser,
-		"--dbpass="+dbPass,
-	).Run(); err != nil {
+		"--prompt=dbpass",
+	)
+	cmd.Stdin = strings.NewReader(dbPass + "\n")
+	if err := w.Runner.RunCmd(cmd); err != nil {
 		return err
 	}
 
@@ -38,23 +47,25 @@ func (w *WordPress) Install(path, url, dbName, dbUser, dbPass string) error {
 }
 
 func (w *WordPress) AutoTune(path string) error {
-	settings := []string{
-		"WP_MEMORY_LIMIT='256M'",
-		"WP_MAX_MEMORY_LIMIT='512M'",
-		"WP_POST_REVISIONS=5",
-		"AUTOSAVE_INTERVAL=120",
-		"EMPTY_TRASH_DAYS=7",
-		"DISABLE_WP_CRON=true",
-		"WP_CACHE=true",
+	settings := []wpconfig.Constant{
+		{Name: "WP_MEMORY_LIMIT", Expr: "'256M'"},
+		{Name: "WP_MAX_MEMORY_LIMIT", Expr: "'512M'"},
+		{Name: "WP_POST_REVISIONS", Expr: "5"},
+		{Name: "AUTOSAVE_INTERVAL", Expr: "120"},
+		{Name: "EMPTY_TRASH_DAYS", Expr: "7"},
+		{Name: "DISABLE_WP_CRON", Expr: "true"},
+		{Name: "WP_CACHE", Expr: "true"},
 	}
-
-	for _, setting := range settings {
-		exec.Command("wp", "config", "set", setting, "--path="+path, "--raw").Run()
+	_, err := wpconfig.Edit(w.Runner, filepath.Join(path, "wp-config.php"), func(f *wpconfig.File) error {
+		return f.SetAll(settings)
+	})
+	if err != nil {
+		return err
 	}
 
 	// Install and enable Redis cache
-	exec.Command("wp", "plugin", "install", "redis-cache", "--activate", "--path="+path).Run()
-	exec.Command("wp", "redis", "enable", "--path="+path).Run()
-
-	return nil
+	if err := w.Runner.Run("wp", "plugin", "install", "redis-cache", "--activate", "--path="+path); err != nil {
+		return err
+	}
+	return w.Runner.Run("wp", "redis", "enable", "--path="+path)
 }
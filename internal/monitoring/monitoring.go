@@ -4,61 +4,70 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // GoAccess manages GoAccess analytics
 type GoAccess struct {
 	ReportDir string
+	LogDir    string
+	Runner    runner.Runner
 }
 
 // NewGoAccess creates a GoAccess manager
-func NewGoAccess() *GoAccess {
-	return &GoAccess{ReportDir: "/var/www/analytics"}
+func NewGoAccess(cfg *config.Settings, r runner.Runner) *GoAccess {
+	return &GoAccess{ReportDir: cfg.AnalyticsDir, LogDir: cfg.Caddy.LogDir, Runner: r}
+}
+
+// LogPath returns the Caddy access log for a domain
+func (g *GoAccess) LogPath(domain string) string {
+	return fmt.Sprintf("%s/%s-access.log", g.LogDir, domain)
 }
 
 // Install installs GoAccess
 func (g *GoAccess) Install() error {
-	return exec.Command("apt-get", "install", "-y", "goaccess").Run()
+	return g.Runner.Run("apt-get", "install", "-y", "goaccess")
 }
 
 // GenerateReport generates HTML report for a domain
 func (g *GoAccess) GenerateReport(domain, logPath string) error {
-	os.MkdirAll(g.ReportDir, 0755)
+	g.Runner.MkdirAll(g.ReportDir, 0755)
 	
 	outputPath := fmt.Sprintf("%s/%s.html", g.ReportDir, domain)
 	
-	return exec.Command("goaccess", logPath,
+	return g.Runner.Run("goaccess", logPath,
 		"-o", outputPath,
 		"--log-format=COMBINED",
 		"--real-time-html",
 		"--ws-url=wss://"+domain+":7890",
-	).Run()
+	)
 }
 
 // StartRealtime starts real-time WebSocket server
 func (g *GoAccess) StartRealtime(domain, logPath string) error {
 	outputPath := fmt.Sprintf("%s/%s.html", g.ReportDir, domain)
 	
-	cmd := exec.Command("goaccess", logPath,
+	// --daemonize makes goaccess fork and return immediately
+	return g.Runner.Run("goaccess", logPath,
 		"-o", outputPath,
 		"--log-format=COMBINED",
 		"--real-time-html",
 		"--port=7890",
 		"--daemonize",
 	)
-	return cmd.Start()
 }
 
 // GetStats returns parsed access log statistics
 func (g *GoAccess) GetStats(logPath string) (*AccessStats, error) {
-	out, err := exec.Command("goaccess", logPath,
+	out, err := g.Runner.Output("goaccess", logPath,
 		"--log-format=COMBINED",
 		"-o", "json:-",
-	).Output()
+	)
 	
 	if err != nil {
 		return nil, err
@@ -83,48 +92,54 @@ type AccessStats struct {
 }
 
 // Server monitors server resources
-type Server struct{}
+type Server struct {
+	Services []string // systemd units reported by GetServiceStatus
+	Runner   runner.Runner
+}
 
 // NewServer creates a server monitor
-func NewServer() *Server {
-	return &Server{}
+func NewServer(cfg *config.Settings, r runner.Runner) *Server {
+	return &Server{
+		Services: []string{"caddy", cfg.PHP.FPMService(), "varnish", "mariadb", "fail2ban"},
+		Runner:   r,
+	}
 }
 
 // Stats contains server statistics
 type Stats struct {
-	CPU        CPUStats
-	Memory     MemoryStats
-	Disk       DiskStats
-	Load       LoadStats
-	Uptime     string
-	Hostname   string
-	Processes  int
+	CPU       CPUStats    `json:"cpu"`
+	Memory    MemoryStats `json:"memory"`
+	Disk      DiskStats   `json:"disk"`
+	Load      LoadStats   `json:"load"`
+	Uptime    string      `json:"uptime"`
+	Hostname  string      `json:"hostname"`
+	Processes int         `json:"processes"`
 }
 
 type CPUStats struct {
-	Usage   float64
-	Cores   int
-	Model   string
+	Usage float64 `json:"usage_percent"`
+	Cores int     `json:"cores"`
+	Model string  `json:"model"`
 }
 
 type MemoryStats struct {
-	Total     int64
-	Used      int64
-	Free      int64
-	UsagePercent float64
+	Total        int64   `json:"total_bytes"`
+	Used         int64   `json:"used_bytes"`
+	Free         int64   `json:"free_bytes"`
+	UsagePercent float64 `json:"usage_percent"`
 }
 
 type DiskStats struct {
-	Total     int64
-	Used      int64
-	Free      int64
-	UsagePercent float64
+	Total        int64   `json:"total_bytes"`
+	Used         int64   `json:"used_bytes"`
+	Free         int64   `json:"free_bytes"`
+	UsagePercent float64 `json:"usage_percent"`
 }
 
 type LoadStats struct {
-	Load1  float64
-	Load5  float64
-	Load15 float64
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
 }
 
 // GetStats retrieves current server statistics
@@ -132,25 +147,25 @@ func (s *Server) GetStats() (*Stats, error) {
 	stats := &Stats{}
 	
 	// Hostname
-	out, _ := exec.Command("hostname").Output()
+	out, _ := s.Runner.Output("hostname")
 	stats.Hostname = strings.TrimSpace(string(out))
 	
 	// Uptime
-	out, _ = exec.Command("uptime", "-p").Output()
+	out, _ = s.Runner.Output("uptime", "-p")
 	stats.Uptime = strings.TrimPrefix(strings.TrimSpace(string(out)), "up ")
 	
 	// CPU
-	out, _ = exec.Command("nproc").Output()
+	out, _ = s.Runner.Output("nproc")
 	stats.CPU.Cores, _ = strconv.Atoi(strings.TrimSpace(string(out)))
 	
-	out, _ = exec.Command("sh", "-c", "top -bn1 | grep 'Cpu(s)' | awk '{print $2}'").Output()
+	out, _ = s.Runner.Output("sh", "-c", "top -bn1 | grep 'Cpu(s)' | awk '{print $2}'")
 	stats.CPU.Usage, _ = strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
 	
-	out, _ = exec.Command("sh", "-c", "cat /proc/cpuinfo | grep 'model name' | head -1 | cut -d: -f2").Output()
+	out, _ = s.Runner.Output("sh", "-c", "cat /proc/cpuinfo | grep 'model name' | head -1 | cut -d: -f2")
 	stats.CPU.Model = strings.TrimSpace(string(out))
 	
 	// Memory
-	out, _ = exec.Command("free", "-b").Output()
+	out, _ = s.Runner.Output("free", "-b")
 	lines := strings.Split(string(out), "\n")
 	if len(lines) > 1 {
 		fields := strings.Fields(lines[1])
@@ -165,7 +180,7 @@ func (s *Server) GetStats() (*Stats, error) {
 	}
 	
 	// Disk
-	out, _ = exec.Command("df", "-B1", "/").Output()
+	out, _ = s.Runner.Output("df", "-B1", "/")
 	lines = strings.Split(string(out), "\n")
 	if len(lines) > 1 {
 		fields := strings.Fields(lines[1])
@@ -189,7 +204,7 @@ func (s *Server) GetStats() (*Stats, error) {
 	}
 	
 	// Process count
-	out, _ = exec.Command("sh", "-c", "ps aux | wc -l").Output()
+	out, _ = s.Runner.Output("sh", "-c", "ps aux | wc -l")
 	stats.Processes, _ = strconv.Atoi(strings.TrimSpace(string(out)))
 	
 	return stats, nil
@@ -197,32 +212,31 @@ func (s *Server) GetStats() (*Stats, error) {
 
 // ServiceStatus contains service status
 type ServiceStatus struct {
-	Name    string
-	Active  bool
-	Enabled bool
-	Memory  string
-	CPU     string
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Enabled bool   `json:"enabled"`
+	Memory  string `json:"memory"`
+	CPU     string `json:"cpu"`
 }
 
 // GetServiceStatus returns status of IronStack services
 func (s *Server) GetServiceStatus() []ServiceStatus {
-	services := []string{"caddy", "varnish", "mariadb", "fail2ban"}
 	var statuses []ServiceStatus
 	
-	for _, svc := range services {
+	for _, svc := range s.Services {
 		status := ServiceStatus{Name: svc}
 		
 		// Check if active
-		err := exec.Command("systemctl", "is-active", "--quiet", svc).Run()
+		err := s.Runner.Run("systemctl", "is-active", "--quiet", svc)
 		status.Active = err == nil
 		
 		// Check if enabled
-		err = exec.Command("systemctl", "is-enabled", "--quiet", svc).Run()
+		err = s.Runner.Run("systemctl", "is-enabled", "--quiet", svc)
 		status.Enabled = err == nil
 		
 		// Get memory usage
-		out, _ := exec.Command("sh", "-c", 
-			fmt.Sprintf("systemctl show %s --property=MemoryCurrent | cut -d= -f2", svc)).Output()
+		out, _ := s.Runner.Output("sh", "-c", 
+			fmt.Sprintf("systemctl show %s --property=MemoryCurrent | cut -d= -f2", svc))
 		mem, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
 		status.Memory = formatBytes(mem)
 		
@@ -231,7 +245,7 @@ func (s *Server) GetServiceStatus() []ServiceStatus {
 	
 	// Check Docker (DragonflyDB)
 	dragonStatus := ServiceStatus{Name: "dragonfly"}
-	out, _ := exec.Command("docker", "ps", "--filter", "name=dragonfly", "-q").Output()
+	out, _ := s.Runner.Output("docker", "ps", "--filter", "name=dragonfly", "-q")
 	dragonStatus.Active = len(out) > 0
 	statuses = append(statuses, dragonStatus)
 	
@@ -240,10 +254,10 @@ func (s *Server) GetServiceStatus() []ServiceStatus {
 
 // Alert represents a monitoring alert
 type Alert struct {
-	Level   string // "warning", "critical"
-	Service string
-	Message string
-	Time    time.Time
+	Level   string    `json:"level"` // "warning", "critical"
+	Service string    `json:"service"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
 }
 
 // CheckAlerts checks for any alert conditions
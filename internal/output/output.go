@@ -0,0 +1,99 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is bumped whenever a documented structure changes incompatibly
+const SchemaVersion = 1
+
+// Format selects how command results are rendered
+type Format string
+
+const (
+	Table Format = "table"
+	JSON  Format = "json"
+	YAML  Format = "yaml"
+)
+
+// ParseFormat validates a format name given on the command line
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case Table, JSON, YAML:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (expected table, json or yaml)", s)
+}
+
+// Document is the envelope for every machine-readable result
+type Document struct {
+	SchemaVersion int         `json:"schema_version"`
+	Kind          string      `json:"kind"`
+	Data          interface{} `json:"data"`
+}
+
+// Write renders data in the requested format. Table output is delegated to
+// the table callback; JSON and YAML wrap data in a versioned Document.
+func Write(w io.Writer, f Format, kind string, data interface{}, table func(w io.Writer)) error {
+	doc := Document{SchemaVersion: SchemaVersion, Kind: kind, Data: data}
+
+	switch f {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case YAML:
+		return encodeYAML(w, doc)
+	default:
+		table(w)
+		return nil
+	}
+}
+
+// String implements flag.Value
+func (f *Format) String() string { return string(*f) }
+
+// Set implements flag.Value
+func (f *Format) Set(s string) error {
+	parsed, err := ParseFormat(s)
+	if err != nil {
+		return err
+	}
+	*f = parsed
+	return nil
+}
+
+// encodeYAML writes v as YAML. It goes through encoding/json so the json
+// struct tags name the fields and they keep the order of the JSON output.
+func encodeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML, so yaml.v3 reads it as a document with the keys in order
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	blockStyle(&doc)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle drops the flow and quoting style nodes read from JSON have, so
+// the encoder picks its own and quotes strings only where needed
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
@@ -0,0 +1,143 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+type testSite struct {
+	Domain  string            `json:"domain"`
+	PHP     string            `json:"php"`
+	Aliases []string          `json:"aliases"`
+	Labels  map[string]string `json:"labels"`
+	Cache   *testCache        `json:"cache,omitempty"`
+	Backups []testBackup      `json:"backups"`
+}
+
+type testCache struct {
+	Backend string `json:"backend"`
+	TTL     int    `json:"ttl"`
+	Enabled bool   `json:"enabled"`
+}
+
+type testBackup struct {
+	File  string   `json:"file"`
+	Size  float64  `json:"size"`
+	Parts []string `json:"parts,omitempty"`
+}
+
+// tricky are strings a YAML decoder would read as something else or reject
+// if they were written plain
+var tricky = []string{
+	"", " ", " leading", "trailing ", "true", "False", "NULL", "~", "yes", "No",
+	"on", "OFF", "y", "n", "8.3", "0755", "1e3", "0x1F", ".inf", "-.Inf", ".nan",
+	"-", "- item", "? key", ": value", "localhost:2019", "key: value", "key:",
+	"http://example.com/", "#", "# comment", "a #b", "a#b", "[a]", "{a: b}",
+	"a, b", "*alias", "&anchor", "!tag", "!!str", "|", ">", "'", "\"", "@home",
+	"`cmd`", "%YAML", "---", "...", "a\nb", "tab\there", "ü", "<&>", "\\",
+	"2026-01-01", "12:30", "1_000",
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	labels := make(map[string]string)
+	for _, s := range tricky {
+		labels[s] = s
+	}
+	tests := []struct {
+		name string
+		data interface{}
+	}{
+		{"tricky strings", tricky},
+		{"tricky keys", labels},
+		{"empty slice and map", testSite{Domain: "example.com", PHP: "8.3", Aliases: []string{}, Labels: map[string]string{}, Backups: []testBackup{}}},
+		{"nil slice and map", testSite{Domain: "example.com"}},
+		{
+			"nested structs",
+			testSite{
+				Domain:  "example.com",
+				PHP:     "8.3",
+				Aliases: []string{"www.example.com", "true", "shop:8080"},
+				Labels:  map[string]string{"env": "prod # main", "owner": "null"},
+				Cache:   &testCache{Backend: "varnish", TTL: 3600, Enabled: true},
+				Backups: []testBackup{
+					{File: "/var/backups/example.com-1.tar.gz", Size: 1.5, Parts: []string{"files", "db"}},
+					{File: "no", Size: 0, Parts: []string{}},
+				},
+			},
+		},
+		{"list of lists", [][]interface{}{{}, {1, "2", nil}, {[]string{}, map[string]int{"a": 1}}}},
+		{"list of maps", []map[string]interface{}{{}, {"a": []string{}, "b": map[string]string{}}, {"c": map[string][]int{"d": {1, 2}}}}},
+		{"scalars", []interface{}{0, -1, 2.5, 1e21, true, false, nil}},
+		{"document", Document{SchemaVersion: SchemaVersion, Kind: "sites", Data: []testSite{{Domain: "example.com", Aliases: []string{}}}}},
+		{"empty list", []string{}},
+		{"empty map", map[string]string{}},
+		{"top-level string", "key: value # comment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeYAML(&buf, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			var decoded interface{}
+			if err := yaml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding:\n%s\n%v", buf.String(), err)
+			}
+			// Compare through JSON, which the encoder's output must match
+			if got, want := viaJSON(t, decoded), viaJSON(t, tt.data); !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %#v, want %#v from:\n%s", got, want, buf.String())
+			}
+		})
+	}
+}
+
+// viaJSON returns v as encoding/json decodes it
+func viaJSON(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestYAMLLayout(t *testing.T) {
+	site := testSite{
+		Domain:  "example.com",
+		PHP:     "8.3",
+		Aliases: []string{"www.example.com"},
+		Labels:  map[string]string{},
+		Cache:   &testCache{Backend: "varnish", TTL: 3600},
+		Backups: []testBackup{{File: "a.tar.gz", Size: 2, Parts: []string{"db"}}},
+	}
+	want := `domain: example.com
+php: "8.3"
+aliases:
+  - www.example.com
+labels: {}
+cache:
+  backend: varnish
+  ttl: 3600
+  enabled: false
+backups:
+  - file: a.tar.gz
+    size: 2
+    parts:
+      - db
+`
+	var buf bytes.Buffer
+	if err := encodeYAML(&buf, site); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("got:\n%swant:\n%s", buf.String(), want)
+	}
+}
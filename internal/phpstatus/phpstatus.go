@@ -0,0 +1,238 @@
+// Package phpstatus talks to the PHP status script IronStack installs in
+// every site. The script runs in the PHP processes serving the site, so its
+// OPcache and realpath cache figures, and its resets, are those of the web
+// server rather than of the PHP CLI.
+package phpstatus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// ScriptFile is the name of the status script in a site's status directory
+const ScriptFile = "php-status.php"
+
+// TokenHeader carries a site's status token
+const TokenHeader = "X-IronStack-Token"
+
+// Caches a reset can clear
+const (
+	ResetOPcache  = "opcache"
+	ResetRealpath = "realpath" // only that of the PHP process answering
+)
+
+// Status is what the status script reports about the PHP process serving
+// a request
+type Status struct {
+	PHPVersion    string        `json:"php_version"`
+	SAPI          string        `json:"sapi"`
+	PID           int           `json:"pid"`
+	Memory        Memory        `json:"memory"`
+	OPcache       *OPcache      `json:"opcache"` // nil if OPcache is not loaded or its API is restricted
+	RealpathCache RealpathCache `json:"realpath_cache"`
+}
+
+// Memory is the memory use of the status request's process
+type Memory struct {
+	Usage int64  `json:"usage"`
+	Peak  int64  `json:"peak"`
+	Limit string `json:"limit"` // memory_limit
+}
+
+// OPcache is the result of opcache_get_status(false)
+type OPcache struct {
+	Enabled         bool            `json:"opcache_enabled"`
+	CacheFull       bool            `json:"cache_full"`
+	RestartPending  bool            `json:"restart_pending"`
+	Memory          OPcacheMemory   `json:"memory_usage"`
+	InternedStrings InternedStrings `json:"interned_strings_usage"`
+	Stats           OPcacheStats    `json:"opcache_statistics"`
+	JIT             *JIT            `json:"jit,omitempty"` // PHP 8 and later
+}
+
+// OPcacheMemory is the shared memory of OPcache
+type OPcacheMemory struct {
+	Used          int64   `json:"used_memory"`
+	Free          int64   `json:"free_memory"`
+	Wasted        int64   `json:"wasted_memory"`
+	WastedPercent float64 `json:"current_wasted_percentage"`
+}
+
+// InternedStrings is the interned strings buffer
+type InternedStrings struct {
+	BufferSize int64 `json:"buffer_size"`
+	Used       int64 `json:"used_memory"`
+	Free       int64 `json:"free_memory"`
+	Strings    int64 `json:"number_of_strings"`
+}
+
+// OPcacheStats are the OPcache counters since it last restarted
+type OPcacheStats struct {
+	CachedScripts   int64   `json:"num_cached_scripts"`
+	CachedKeys      int64   `json:"num_cached_keys"`
+	MaxCachedKeys   int64   `json:"max_cached_keys"`
+	Hits            int64   `json:"hits"`
+	Misses          int64   `json:"misses"`
+	HitRate         float64 `json:"opcache_hit_rate"`
+	StartTime       int64   `json:"start_time"`
+	LastRestartTime int64   `json:"last_restart_time"`
+	OOMRestarts     int64   `json:"oom_restarts"`
+	HashRestarts    int64   `json:"hash_restarts"`
+	ManualRestarts  int64   `json:"manual_restarts"`
+}
+
+// JIT is the state of the tracing/function JIT
+type JIT struct {
+	Enabled    bool  `json:"enabled"`
+	On         bool  `json:"on"`
+	Kind       int   `json:"kind"`
+	BufferSize int64 `json:"buffer_size"`
+	BufferFree int64 `json:"buffer_free"`
+}
+
+// RealpathCache is the realpath cache of the status request's process
+type RealpathCache struct {
+	Used    int64  `json:"used"`
+	Limit   string `json:"limit"` // realpath_cache_size
+	Entries int64  `json:"entries"`
+	TTL     int64  `json:"ttl"` // seconds
+}
+
+// Client queries status scripts through the local Caddy listener, which
+// routes by Host to each site's script
+type Client struct {
+	Addr   string // host:port
+	HTTP   *http.Client
+	Runner runner.Runner
+}
+
+// New creates a client for the status listener on port
+func New(port int, r runner.Runner) *Client {
+	return &Client{
+		Addr:   fmt.Sprintf("127.0.0.1:%d", port),
+		HTTP:   &http.Client{Timeout: 10 * time.Second},
+		Runner: r,
+	}
+}
+
+// Status returns the status of the PHP processes serving domain
+func (c *Client) Status(domain, token string) (*Status, error) {
+	var st Status
+	if err := c.do(http.MethodGet, domain, token, "/", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Reset clears a cache of the PHP processes serving domain: ResetOPcache
+// or ResetRealpath
+func (c *Client) Reset(domain, token, cache string) error {
+	if runner.IsDryRun(c.Runner) {
+		// Show the equivalent command instead of connecting
+		return c.Runner.Run("curl", "-s", "-X", "POST", "-H", "Host: "+domain, "-H", TokenHeader+": <"+domain+" status_token>", "http://"+c.Addr+"/?reset="+cache)
+	}
+	return c.do(http.MethodPost, domain, token, "/?reset="+cache, nil)
+}
+
+func (c *Client) do(method, domain, token, path string, out interface{}) error {
+	req, err := http.NewRequest(method, "http://"+c.Addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+	req.Header.Set(TokenHeader, token)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("PHP status of %s unreachable: %w", domain, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			msg = body.Error
+		}
+		return fmt.Errorf("PHP status of %s: %s: %s", domain, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("PHP status of %s: %w", domain, err)
+	}
+	return nil
+}
+
+// Script returns the status script of a site with its token
+func Script(token string) []byte {
+	return []byte(strings.Replace(script, "IRONSTACK_STATUS_TOKEN", wpconfig.Quote(token), 1))
+}
+
+// script is the status script. It answers GET with the status as JSON and
+// POST ?reset=opcache|realpath with a reset. Caddy only serves it on
+// 127.0.0.1, and every request needs the token.
+const script = `<?php
+// IronStack PHP status. Generated by IronStack; changes are overwritten.
+
+header('Content-Type: application/json');
+header('Cache-Control: no-store');
+
+function ironstack_status_fail($code, $message) {
+	http_response_code($code);
+	echo json_encode(array('error' => $message));
+	exit;
+}
+
+$token = IRONSTACK_STATUS_TOKEN;
+$given = isset($_SERVER['HTTP_X_IRONSTACK_TOKEN']) ? (string) $_SERVER['HTTP_X_IRONSTACK_TOKEN'] : '';
+if (!hash_equals($token, $given)) {
+	ironstack_status_fail(403, 'forbidden');
+}
+
+if ('POST' === $_SERVER['REQUEST_METHOD']) {
+	$reset = isset($_GET['reset']) ? $_GET['reset'] : '';
+	if ('opcache' === $reset) {
+		if (!function_exists('opcache_reset') || !opcache_reset()) {
+			ironstack_status_fail(409, 'OPcache is not enabled or its API is restricted');
+		}
+	} elseif ('realpath' === $reset) {
+		clearstatcache(true);
+	} else {
+		ironstack_status_fail(400, 'unknown reset');
+	}
+	echo json_encode(array('reset' => $reset));
+	exit;
+}
+
+$opcache = function_exists('opcache_get_status') ? @opcache_get_status(false) : false;
+echo json_encode(array(
+	'php_version'    => PHP_VERSION,
+	'sapi'           => PHP_SAPI,
+	'pid'            => getmypid(),
+	'memory'         => array(
+		'usage' => memory_get_usage(true),
+		'peak'  => memory_get_peak_usage(true),
+		'limit' => ini_get('memory_limit'),
+	),
+	'opcache'        => $opcache ? $opcache : null,
+	'realpath_cache' => array(
+		'used'    => realpath_cache_size(),
+		'limit'   => ini_get('realpath_cache_size'),
+		'entries' => count(realpath_cache_get()),
+		'ttl'     => (int) ini_get('realpath_cache_ttl'),
+	),
+));
+`
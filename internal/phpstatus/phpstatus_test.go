@@ -0,0 +1,190 @@
+package phpstatus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// statusJSON is what the status script answers under PHP-FPM with OPcache
+const statusJSON = `{
+  "php_version": "8.3.6", "sapi": "fpm-fcgi", "pid": 4242,
+  "memory": {"usage": 2097152, "peak": 4194304, "limit": "256M"},
+  "opcache": {
+    "opcache_enabled": true, "cache_full": false, "restart_pending": false, "restart_in_progress": false,
+    "memory_usage": {"used_memory": 25000000, "free_memory": 109000000, "wasted_memory": 217728, "current_wasted_percentage": 0.16},
+    "interned_strings_usage": {"buffer_size": 8388608, "used_memory": 3000000, "free_memory": 5388608, "number_of_strings": 41000},
+    "opcache_statistics": {"num_cached_scripts": 1500, "num_cached_keys": 2900, "max_cached_keys": 16229, "hits": 990000, "start_time": 1700000000, "last_restart_time": 0, "oom_restarts": 0, "hash_restarts": 0, "manual_restarts": 2, "misses": 1500, "blacklist_misses": 0, "blacklist_miss_ratio": 0, "opcache_hit_rate": 99.85},
+    "jit": {"enabled": true, "on": true, "kind": 5, "opt_level": 4, "opt_flags": 6, "buffer_size": 67108848, "buffer_free": 66000000}
+  },
+  "realpath_cache": {"used": 81920, "limit": "4096K", "entries": 312, "ttl": 120}
+}`
+
+// standIn plays the local Caddy listener with the status script of one site
+type standIn struct {
+	domain, token string
+	status        string // body of GET answers
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newStandIn(t *testing.T, s *standIn) *Client {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c := New(0, runner.NewFake())
+	c.Addr = srv.Listener.Addr().String()
+	return c
+}
+
+// ServeHTTP answers like the status script, including its error bodies
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.Host+" "+r.URL.RequestURI())
+	s.mu.Unlock()
+	fail := func(code int, msg string) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":%q}`, msg)
+	}
+	if r.Host != s.domain {
+		// Caddy has no site for the Host
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get(TokenHeader) != s.token {
+		fail(http.StatusForbidden, "forbidden")
+		return
+	}
+	if r.Method == http.MethodPost {
+		switch reset := r.URL.Query().Get("reset"); reset {
+		case ResetOPcache:
+			fail(http.StatusConflict, "OPcache is not enabled or its API is restricted")
+		case ResetRealpath:
+			fmt.Fprintf(w, `{"reset":%q}`, reset)
+		default:
+			fail(http.StatusBadRequest, "unknown reset")
+		}
+		return
+	}
+	if s.status == "" {
+		// PHP died before the script could answer
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	fmt.Fprint(w, s.status)
+}
+
+func TestStatus(t *testing.T) {
+	s := &standIn{domain: "example.com", token: "s3cret", status: statusJSON}
+	c := newStandIn(t, s)
+
+	st, err := c.Status("example.com", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PHPVersion != "8.3.6" || st.SAPI != "fpm-fcgi" || st.PID != 4242 || st.Memory.Limit != "256M" {
+		t.Errorf("Status = %+v", st)
+	}
+	if st.OPcache == nil || !st.OPcache.Enabled || st.OPcache.Stats.Hits != 990000 || st.OPcache.Stats.HitRate != 99.85 || st.OPcache.Memory.Wasted != 217728 {
+		t.Errorf("OPcache = %+v", st.OPcache)
+	}
+	if st.OPcache.JIT == nil || !st.OPcache.JIT.On || st.OPcache.JIT.BufferFree != 66000000 {
+		t.Errorf("JIT = %+v", st.OPcache.JIT)
+	}
+	if st.RealpathCache != (RealpathCache{Used: 81920, Limit: "4096K", Entries: 312, TTL: 120}) {
+		t.Errorf("RealpathCache = %+v", st.RealpathCache)
+	}
+	if got := strings.Join(s.requests, "\n"); got != "GET example.com /" {
+		t.Errorf("requests:\n%s", got)
+	}
+
+	// Without OPcache the script reports null
+	s.status = `{"php_version": "8.1.2", "sapi": "fpm-fcgi", "pid": 1, "memory": {}, "opcache": null, "realpath_cache": {}}`
+	if st, err := c.Status("example.com", "s3cret"); err != nil || st.OPcache != nil {
+		t.Errorf("Status without OPcache = %+v, %v", st, err)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		domain, token string
+		status        string
+		err           string
+	}{
+		{"wrong token", "example.com", "guess", statusJSON, "PHP status of example.com: 403 Forbidden: forbidden"},
+		{"unknown site", "other.example.net", "s3cret", statusJSON, "PHP status of other.example.net: 404 Not Found: "},
+		{"plain text error", "example.com", "s3cret", "", "PHP status of example.com: 502 Bad Gateway: upstream error"},
+		{"not JSON", "example.com", "s3cret", "<br />\n<b>Fatal error</b>", "PHP status of example.com: invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newStandIn(t, &standIn{domain: "example.com", token: "s3cret", status: tt.status})
+			st, err := c.Status(tt.domain, tt.token)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Status = %+v, %v; want error %q", st, err, tt.err)
+			}
+		})
+	}
+
+	c := New(0, runner.NewFake())
+	c.Addr = "127.0.0.1:1"
+	if _, err := c.Status("example.com", "s3cret"); err == nil || !strings.Contains(err.Error(), "PHP status of example.com unreachable") {
+		t.Errorf("Status of a closed port = %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := &standIn{domain: "example.com", token: "s3cret"}
+	c := newStandIn(t, s)
+
+	if err := c.Reset("example.com", "s3cret", ResetRealpath); err != nil {
+		t.Errorf("Reset(realpath) = %v", err)
+	}
+	// The script's JSON error is shown rather than the raw body
+	err := c.Reset("example.com", "s3cret", ResetOPcache)
+	if err == nil || err.Error() != "PHP status of example.com: 409 Conflict: OPcache is not enabled or its API is restricted" {
+		t.Errorf("Reset(opcache) = %v", err)
+	}
+	if err := c.Reset("example.com", "s3cret", "everything"); err == nil || !strings.HasSuffix(err.Error(), ": 400 Bad Request: unknown reset") {
+		t.Errorf("Reset(everything) = %v", err)
+	}
+	if err := c.Reset("example.com", "guess", ResetRealpath); err == nil || !strings.HasSuffix(err.Error(), ": 403 Forbidden: forbidden") {
+		t.Errorf("Reset with the wrong token = %v", err)
+	}
+	want := []string{
+		"POST example.com /?reset=realpath",
+		"POST example.com /?reset=opcache",
+		"POST example.com /?reset=everything",
+		"POST example.com /?reset=realpath",
+	}
+	if got := strings.Join(s.requests, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("requests:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestResetDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	c := New(2019, runner.NewDryRun(&buf))
+	if err := c.Reset("example.com", "s3cret", ResetOPcache); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if !strings.Contains(got, "http://127.0.0.1:2019/?reset=opcache") || !strings.Contains(got, "example.com status_token") || strings.Contains(got, "s3cret") {
+		t.Errorf("dry run printed %q", got)
+	}
+}
+
+func TestScript(t *testing.T) {
+	got := string(Script(`to'k\en`))
+	if !strings.Contains(got, `$token = 'to\'k\\en';`) || strings.Contains(got, "IRONSTACK_STATUS_TOKEN") {
+		t.Errorf("token not substituted:\n%s", got)
+	}
+}
@@ -0,0 +1,214 @@
+package purge
+
+import (
+	"fmt"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// PluginFile is the name of the mu-plugin in wp-content/mu-plugins
+const PluginFile = "ironstack-purge.php"
+
+// Constants returns the wp-config.php constants the mu-plugin reads: the
+// endpoint URL on port, the site's token and its page cache backend
+func Constants(port int, token string, backend cache.Backend) []wpconfig.Constant {
+	return []wpconfig.Constant{
+		{Name: "IRONSTACK_PURGE_URL", Expr: wpconfig.Quote(fmt.Sprintf("http://127.0.0.1:%d/purge", port))},
+		{Name: "IRONSTACK_PURGE_TOKEN", Expr: wpconfig.Quote(token)},
+		{Name: "IRONSTACK_PAGE_CACHE", Expr: wpconfig.Quote(string(backend))},
+	}
+}
+
+// Plugin is the mu-plugin. It tags pages with surrogate keys, as an xkey
+// header for Varnish or a Surrogate-Key header for Caddy, collects the URLs
+// and keys affected by post and comment changes during a request and sends
+// them to the endpoint once at shutdown.
+const Plugin = `<?php
+/**
+ * Plugin Name: IronStack Cache Purge
+ * Description: Tags pages with cache keys and purges changed posts, their archives and the home page from the page cache. Installed by IronStack; local changes are overwritten.
+ */
+
+if (!defined('ABSPATH') || !defined('IRONSTACK_PURGE_URL') || !defined('IRONSTACK_PURGE_TOKEN')) {
+	return;
+}
+
+final class IronStack_Purge {
+	private static $urls = array();
+	private static $tags = array();
+
+	public static function init() {
+		add_action('template_redirect', array(__CLASS__, 'tag_response'));
+
+		// Old URLs before an update, new URLs after it
+		add_action('pre_post_update', array(__CLASS__, 'post_id'));
+		add_action('transition_post_status', array(__CLASS__, 'transition'), 10, 3);
+		add_action('wp_trash_post', array(__CLASS__, 'post_id'));
+		add_action('before_delete_post', array(__CLASS__, 'post_id'));
+
+		add_action('transition_comment_status', array(__CLASS__, 'comment_transition'), 10, 3);
+		add_action('comment_post', array(__CLASS__, 'new_comment'), 10, 2);
+		add_action('edit_comment', array(__CLASS__, 'comment'));
+
+		add_action('woocommerce_product_set_stock', array(__CLASS__, 'product'));
+		add_action('woocommerce_variation_set_stock', array(__CLASS__, 'product'));
+
+		add_action('shutdown', array(__CLASS__, 'send'));
+	}
+
+	// tag_response sends the cache keys: post-<id> (and product-<id>) for
+	// every post shown, term-<id> and author-<id> on their archives and
+	// type-<post type> on listings, which new posts can appear on
+	public static function tag_response() {
+		global $wp_query;
+		if (headers_sent() || is_user_logged_in()) {
+			return;
+		}
+		$tags = array();
+		foreach ($wp_query->posts as $post) {
+			$tags = array_merge($tags, self::post_keys($post));
+		}
+		if (is_category() || is_tag() || is_tax()) {
+			$tags[] = 'term-' . get_queried_object_id();
+		} elseif (is_author()) {
+			$tags[] = 'author-' . get_queried_object_id();
+		}
+		if (!is_singular()) {
+			$types = get_query_var('post_type');
+			foreach ((array) ($types ? $types : 'post') as $type) {
+				$tags[] = 'type-' . $type;
+			}
+		}
+		if (!$tags) {
+			return;
+		}
+		$tags = array_unique($tags);
+		if (defined('IRONSTACK_PAGE_CACHE') && 'caddy' === IRONSTACK_PAGE_CACHE) {
+			// Caddy's cache is shared by all sites, so the keys carry the
+			// domain, as Varnish adds it to xkey
+			$domain = wp_parse_url(home_url(), PHP_URL_HOST);
+			foreach ($tags as $i => $tag) {
+				$tags[$i] = $domain . ':' . $tag;
+			}
+			header('Surrogate-Key: ' . implode(', ', $tags));
+		} else {
+			header('xkey: ' . implode(' ', $tags));
+		}
+	}
+
+	public static function product($product) {
+		$post_id = $product->get_parent_id() ? $product->get_parent_id() : $product->get_id();
+		self::$tags['product-' . $post_id] = true;
+	}
+
+	public static function post_id($post_id) {
+		$post = get_post($post_id);
+		if ($post && 'publish' === $post->post_status) {
+			self::add_post($post);
+		}
+	}
+
+	public static function transition($new_status, $old_status, $post) {
+		if ('publish' === $new_status || 'publish' === $old_status) {
+			self::add_post($post);
+		}
+	}
+
+	public static function comment_transition($new_status, $old_status, $comment) {
+		if ('approved' === $new_status || 'approved' === $old_status) {
+			self::post_id($comment->comment_post_ID);
+		}
+	}
+
+	public static function new_comment($comment_id, $approved) {
+		if (1 === $approved) {
+			self::comment($comment_id);
+		}
+	}
+
+	public static function comment($comment_id) {
+		$comment = get_comment($comment_id);
+		if ($comment && '1' === $comment->comment_approved) {
+			self::post_id($comment->comment_post_ID);
+		}
+	}
+
+	private static function add_post($post) {
+		if (wp_is_post_revision($post) || wp_is_post_autosave($post) || !is_post_type_viewable($post->post_type)) {
+			return;
+		}
+		$tags = array_merge(self::post_keys($post), array(
+			'author-' . $post->post_author,
+			'type-' . $post->post_type,
+		));
+		$urls = array(
+			get_permalink($post),
+			home_url('/'),
+			get_feed_link(),
+			get_post_comments_feed_link($post->ID),
+			get_author_posts_url($post->post_author),
+		);
+		$archive = get_post_type_archive_link($post->post_type);
+		if ($archive) {
+			$urls[] = $archive;
+		}
+		foreach (get_object_taxonomies($post->post_type, 'objects') as $taxonomy) {
+			if (!$taxonomy->public) {
+				continue;
+			}
+			$terms = get_the_terms($post, $taxonomy->name);
+			if (is_array($terms)) {
+				foreach ($terms as $term) {
+					$urls[] = get_term_link($term);
+					$tags[] = 'term-' . $term->term_id;
+				}
+			}
+		}
+		if ('post' === $post->post_type) {
+			$time = strtotime($post->post_date);
+			$urls[] = get_year_link(date('Y', $time));
+			$urls[] = get_month_link(date('Y', $time), date('m', $time));
+			$urls[] = get_day_link(date('Y', $time), date('m', $time), date('d', $time));
+		}
+		foreach ($urls as $url) {
+			if (is_string($url) && '' !== $url) {
+				self::$urls[$url] = true;
+			}
+		}
+		foreach ($tags as $tag) {
+			self::$tags[$tag] = true;
+		}
+	}
+
+	private static function post_keys($post) {
+		$keys = array('post-' . $post->ID);
+		if ('product' === $post->post_type) {
+			$keys[] = 'product-' . $post->ID;
+		}
+		return $keys;
+	}
+
+	public static function send() {
+		if (!self::$urls && !self::$tags) {
+			return;
+		}
+		wp_remote_post(IRONSTACK_PURGE_URL, array(
+			'timeout' => 3,
+			'headers' => array(
+				'Content-Type'      => 'application/json',
+				'X-IronStack-Token' => IRONSTACK_PURGE_TOKEN,
+			),
+			'body'    => wp_json_encode(array(
+				'host' => wp_parse_url(home_url(), PHP_URL_HOST),
+				'urls' => array_keys(self::$urls),
+				'tags' => array_keys(self::$tags),
+			)),
+		));
+		self::$urls = array();
+		self::$tags = array();
+	}
+}
+
+IronStack_Purge::init();
+`
@@ -0,0 +1,202 @@
+// Package purge is the local endpoint the IronStack mu-plugin notifies when
+// WordPress content changes. It removes the affected pages from the site's
+// page cache, Varnish or Caddy, by URL and by the surrogate keys they were
+// tagged with.
+package purge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// TokenHeader carries a site's purge token
+const TokenHeader = "X-IronStack-Token"
+
+// Limits on a single notification
+const (
+	maxBody = 64 << 10
+	maxURLs = 200
+	maxTags = 200
+)
+
+// cacheTag matches the surrogate keys the mu-plugin sends, e.g. "post-12"
+var cacheTag = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ErrUnknownSite is returned by a Lookup for hosts that are not registered
+// or do not have automatic purging enabled
+var ErrUnknownSite = errors.New("unknown site")
+
+// Site is what the endpoint needs to know about a site
+type Site struct {
+	cache.Site
+	Token string
+}
+
+// Request is a notification from the mu-plugin
+type Request struct {
+	Host string   `json:"host"`
+	URLs []string `json:"urls"`
+	Tags []string `json:"tags"` // surrogate keys, unscoped
+}
+
+// Server receives notifications on a loopback address
+type Server struct {
+	Addr   string // host:port
+	Lookup func(host string) (*Site, error)
+	Cache  *cache.Manager
+	Log    io.Writer
+}
+
+// ListenAndServe serves notifications until the listener fails
+func (s *Server) ListenAndServe() error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("purge endpoint must listen on a loopback address, got %s", s.Addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/purge", s.handlePurge)
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	s.logf("listening on %s", s.Addr)
+	return srv.ListenAndServe()
+}
+
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fromLoopback(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	site, err := s.Lookup(strings.ToLower(req.Host))
+	if err != nil && !errors.Is(err, ErrUnknownSite) {
+		s.logf("%s: %v", req.Host, err)
+		http.Error(w, "lookup failed", http.StatusInternalServerError)
+		return
+	}
+	// Unknown hosts and wrong tokens get the same answer
+	token := r.Header.Get(TokenHeader)
+	if site == nil || site.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(site.Token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	paths, err := Paths(site.Hosts, req.URLs)
+	if err == nil {
+		err = checkTags(req.Tags)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Pages cached before the plugin tagged them are only found by URL
+	var errs runner.Errors
+	errs.Add("purge URLs", s.Cache.PurgePages(site.Site, paths))
+	errs.Add("purge tags", s.Cache.PurgeTags(site.Site, req.Tags...))
+	if err := errs.Err(); err != nil {
+		s.logf("%s: purge failed: %v", site.Domain, err)
+		http.Error(w, "purge failed", http.StatusBadGateway)
+		return
+	}
+	s.logf("%s: purged %s %s", site.Domain, strings.Join(paths, " "), strings.Join(req.Tags, " "))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"urls": len(paths), "tags": len(req.Tags)})
+}
+
+// Paths returns the distinct paths (with query string) of urls. URLs on
+// other hosts than the site's are skipped.
+func Paths(hosts, urls []string) ([]string, error) {
+	if len(urls) > maxURLs {
+		return nil, fmt.Errorf("too many URLs: %d (at most %d)", len(urls), maxURLs)
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid URL %q", raw)
+		}
+		if !hasHost(hosts, u.Hostname()) {
+			continue
+		}
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// checkTags validates surrogate keys before they are sent to Varnish
+func checkTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("too many tags: %d (at most %d)", len(tags), maxTags)
+	}
+	for _, tag := range tags {
+		if !cacheTag.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+func hasHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromLoopback reports whether a request came from this machine
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, format+"\n", args...)
+	}
+}
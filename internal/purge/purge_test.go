@@ -0,0 +1,180 @@
+package purge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// testSite is the only site the test endpoint knows
+var testSite = &Site{
+	Site:  cache.Site{Domain: "example.com", Hosts: []string{"example.com", "www.example.com"}, Backend: cache.BackendCaddy},
+	Token: "s3cret-token",
+}
+
+// newTestServer starts the endpoint with purges going to a dry run, whose
+// commands are written to the returned buffer
+func newTestServer(t *testing.T) (*httptest.Server, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	s := &Server{
+		Lookup: func(host string) (*Site, error) {
+			switch host {
+			case "example.com", "www.example.com":
+				return testSite, nil
+			case "broken.example.com":
+				return nil, errors.New("registry unreadable")
+			}
+			return nil, ErrUnknownSite
+		},
+		Cache: cache.New(config.Default(), runner.NewDryRun(&buf)),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.handlePurge))
+	t.Cleanup(srv.Close)
+	return srv, &buf
+}
+
+func TestHandlePurge(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+		answer string
+	}{
+		{"purged", "POST", testSite.Token, `{"host": "Example.com", "urls": ["https://example.com/blog/", "https://www.example.com/?p=1", "https://example.com/blog/"], "tags": ["post-1", "term_2"]}`, 200, `{"tags":2,"urls":2}`},
+		{"URLs of another host", "POST", testSite.Token, `{"host": "example.com", "urls": ["https://other.example.net/", "https://example.com.evil.net/"]}`, 200, `{"tags":0,"urls":0}`},
+		{"wrong token", "POST", "guess", `{"host": "example.com", "urls": ["https://example.com/"]}`, 403, "forbidden"},
+		{"missing token", "POST", "", `{"host": "example.com", "urls": ["https://example.com/"]}`, 403, "forbidden"},
+		{"unknown host", "POST", testSite.Token, `{"host": "other.example.net", "urls": ["https://other.example.net/"]}`, 403, "forbidden"},
+		{"lookup failure", "POST", testSite.Token, `{"host": "broken.example.com"}`, 500, "lookup failed"},
+		{"malformed tag", "POST", testSite.Token, `{"host": "example.com", "tags": ["post-1", "a|b"]}`, 400, `invalid tag "a|b"`},
+		{"relative URL", "POST", testSite.Token, `{"host": "example.com", "urls": ["/blog/"]}`, 400, `invalid URL "/blog/"`},
+		{"too many tags", "POST", testSite.Token, `{"host": "example.com", "tags": [` + strings.Repeat(`"t",`, maxTags) + `"t"]}`, 400, "too many tags"},
+		{"invalid JSON", "POST", testSite.Token, `{"host": `, 400, "invalid request"},
+		{"wrong method", "GET", testSite.Token, "", 405, "method not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, buf := newTestServer(t)
+			req, err := http.NewRequest(tt.method, srv.URL+"/purge", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set(TokenHeader, tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.answer) {
+				t.Errorf("answer = %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.answer)
+			}
+			if tt.status != http.StatusOK && buf.Len() > 0 {
+				t.Errorf("rejected request purged:\n%s", buf)
+			}
+		})
+	}
+}
+
+func TestHandlePurgeCommands(t *testing.T) {
+	srv, buf := newTestServer(t)
+	req, _ := http.NewRequest("POST", srv.URL+"/purge", strings.NewReader(`{"host": "example.com", "urls": ["https://example.com/blog/"], "tags": ["post-1"]}`))
+	req.Header.Set(TokenHeader, testSite.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// One purge by URL and one by surrogate key, scoped to the site
+	if got := buf.String(); strings.Count(got, "curl -s -X PURGE") != 2 || !strings.Contains(got, "Surrogate-Key: example.com:post-1") {
+		t.Errorf("commands:\n%s", got)
+	}
+}
+
+func TestHandlePurgeFailure(t *testing.T) {
+	cfg := config.Default()
+	cfg.Caddy.Admin = "127.0.0.1:1"
+	var log bytes.Buffer
+	s := &Server{
+		Lookup: func(string) (*Site, error) { return testSite, nil },
+		Cache:  cache.New(cfg, runner.NewFake()),
+		Log:    &log,
+	}
+	req := httptest.NewRequest("POST", "/purge", strings.NewReader(`{"host": "example.com", "urls": ["https://example.com/"]}`))
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set(TokenHeader, testSite.Token)
+	w := httptest.NewRecorder()
+	s.handlePurge(w, req)
+	if w.Code != http.StatusBadGateway || !strings.Contains(log.String(), "example.com: purge failed") {
+		t.Errorf("answer = %d %q, log %q", w.Code, w.Body, log.String())
+	}
+}
+
+func TestHandlePurgeRemote(t *testing.T) {
+	s := &Server{Lookup: func(string) (*Site, error) { return testSite, nil }}
+	req := httptest.NewRequest("POST", "/purge", strings.NewReader(`{"host": "example.com"}`))
+	req.RemoteAddr = "192.0.2.10:40000"
+	req.Header.Set(TokenHeader, testSite.Token)
+	w := httptest.NewRecorder()
+	s.handlePurge(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("remote request answered %d", w.Code)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	hosts := []string{"example.com", "www.example.com"}
+	tests := []struct {
+		urls []string
+		want []string
+		err  string
+	}{
+		{[]string{"https://example.com"}, []string{"/"}, ""},
+		{[]string{"https://WWW.Example.com/a%20b/?x=1&y=2", "http://example.com:8080/c/"}, []string{"/a%20b/?x=1&y=2", "/c/"}, ""},
+		{[]string{"https://example.com/a/", "https://example.com/a/#comments"}, []string{"/a/"}, ""},
+		{[]string{"https://other.example.net/", "https://example.com.evil.net/x"}, nil, ""},
+		{[]string{"example.com/a/"}, nil, `invalid URL "example.com/a/"`},
+		{[]string{"https://example.com/%zz"}, nil, "invalid URL"},
+		{make([]string, maxURLs+1), nil, fmt.Sprintf("too many URLs: %d", maxURLs+1)},
+	}
+	for _, tt := range tests {
+		got, err := Paths(hosts, tt.urls)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Paths(%.60q) error = %v, want %q", tt.urls, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Paths(%q) = %q, %v; want %q", tt.urls, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	for _, tags := range [][]string{nil, {"post-1", "term_2", "type.page", "A-Z"}} {
+		if err := checkTags(tags); err != nil {
+			t.Errorf("checkTags(%q) = %v", tags, err)
+		}
+	}
+	for _, tag := range []string{"", "post 1", "a|b", "post-1,post-2", "ü", "a\nb", "(.*)"} {
+		if err := checkTags([]string{"post-1", tag}); err == nil || !strings.Contains(err.Error(), "invalid tag") {
+			t.Errorf("checkTags(%q) = %v, want an invalid tag", tag, err)
+		}
+	}
+}
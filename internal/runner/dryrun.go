@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DryRun prints what would be executed or written without touching the system.
+// Every command succeeds and produces no output.
+type DryRun struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewDryRun creates a Runner that describes its actions on w
+func NewDryRun(w io.Writer) *DryRun {
+	return &DryRun{w: w}
+}
+
+func (d *DryRun) printf(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "[dry-run] "+format+"\n", args...)
+}
+
+// Run implements Runner
+func (d *DryRun) Run(name string, args ...string) error {
+	return d.RunCmd(Command(name, args...))
+}
+
+// Output implements Runner
+func (d *DryRun) Output(name string, args ...string) ([]byte, error) {
+	return nil, d.RunCmd(Command(name, args...))
+}
+
+// RunCmd implements Runner
+func (d *DryRun) RunCmd(c *Cmd) error {
+	line := c.Redacted()
+	if c.Stdin != nil {
+		// Input is usually SQL or a password
+		line += " < (input)"
+	}
+	if len(c.Env) > 0 {
+		// Only show variable names; values are usually credentials
+		var names []string
+		for _, kv := range c.Env {
+			name, _, _ := strings.Cut(kv, "=")
+			names = append(names, name+"=***")
+		}
+		line = strings.Join(names, " ") + " " + line
+	}
+	if c.Dir != "" {
+		line = fmt.Sprintf("(cd %s) %s", Quote(c.Dir), line)
+	}
+	d.printf("$ %s", line)
+	return nil
+}
+
+// WriteFile implements Runner
+func (d *DryRun) WriteFile(path string, data []byte, perm os.FileMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.w, "[dry-run] write %s (%d bytes, mode %04o)\n", path, len(data), perm)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		fmt.Fprintf(d.w, "    | %s\n", line)
+	}
+	return nil
+}
+
+// MkdirAll implements Runner
+func (d *DryRun) MkdirAll(path string, perm os.FileMode) error {
+	d.printf("mkdir -p %s (mode %04o)", path, perm)
+	return nil
+}
+
+// Remove implements Runner
+func (d *DryRun) Remove(path string) error {
+	d.printf("rm %s", path)
+	return nil
+}
+
+// RemoveAll implements Runner
+func (d *DryRun) RemoveAll(path string) error {
+	d.printf("rm -rf %s", path)
+	return nil
+}
+
+// Rename implements Runner
+func (d *DryRun) Rename(oldpath, newpath string) error {
+	d.printf("mv %s %s", oldpath, newpath)
+	return nil
+}
+
+// Symlink implements Runner
+func (d *DryRun) Symlink(oldname, newname string) error {
+	d.printf("ln -s %s %s", oldname, newname)
+	return nil
+}
+
+// IsDryRun reports whether r only describes actions. Callers use it to
+// tolerate files that a real run would have created earlier.
+func IsDryRun(r Runner) bool {
+	_, ok := r.(*DryRun)
+	return ok
+}
@@ -0,0 +1,128 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// stderrTailLines is how many lines of standard error a CommandError keeps
+const stderrTailLines = 5
+
+// CommandError reports a command that could not be started or exited non-zero
+type CommandError struct {
+	Command  string // command line as shown by Cmd.Redacted
+	ExitCode int    // -1 if the command did not start
+	Stderr   string // last lines of standard error
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	var msg string
+	if e.ExitCode >= 0 {
+		msg = fmt.Sprintf("%s exited with code %d", e.Command, e.ExitCode)
+	} else {
+		msg = fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	if e.Stderr != "" {
+		lines := strings.Split(e.Stderr, "\n")
+		msg += ": " + lines[len(lines)-1]
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// newCommandError wraps the error returned by exec.Cmd.Run
+func newCommandError(c *Cmd, err error, stderr []byte) *CommandError {
+	ce := &CommandError{Command: c.Redacted(), ExitCode: -1, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		ce.ExitCode = exitErr.ExitCode()
+	}
+	ce.Stderr = tailLines(stderr, stderrTailLines)
+	return ce
+}
+
+func tailLines(b []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf bytes.Buffer
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf.Write(p)
+	if extra := t.buf.Len() - t.max; extra > 0 {
+		t.buf.Next(extra)
+	}
+	return len(p), nil
+}
+
+// StepError attaches the name of an operation step to its error
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string { return e.Step + ": " + e.Err.Error() }
+
+func (e *StepError) Unwrap() error { return e.Err }
+
+// Step wraps err with the step name. It returns nil if err is nil.
+func Step(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StepError{Step: name, Err: err}
+}
+
+// Errors collects the failed steps of an operation that continues past
+// failures, such as purging several caches
+type Errors struct {
+	Steps []*StepError
+}
+
+// Add records err under the step name if it is not nil
+func (e *Errors) Add(step string, err error) {
+	if err != nil {
+		e.Steps = append(e.Steps, &StepError{Step: step, Err: err})
+	}
+}
+
+// Err returns the collected failures, or nil if every step succeeded
+func (e *Errors) Err() error {
+	if len(e.Steps) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *Errors) Error() string {
+	if len(e.Steps) == 1 {
+		return e.Steps[0].Error()
+	}
+	msgs := make([]string, len(e.Steps))
+	for i, s := range e.Steps {
+		msgs[i] = s.Error()
+	}
+	return fmt.Sprintf("%d steps failed: %s", len(e.Steps), strings.Join(msgs, "; "))
+}
+
+// Unwrap allows errors.Is and errors.As to match any collected failure
+func (e *Errors) Unwrap() []error {
+	errs := make([]error, len(e.Steps))
+	for i, s := range e.Steps {
+		errs[i] = s
+	}
+	return errs
+}
@@ -0,0 +1,184 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Fake records every action for inspection in unit tests. Commands succeed
+// with empty output unless a response is registered with On or Handle.
+type Fake struct {
+	mu        sync.Mutex
+	Calls     []string          // command lines and file operations, in order
+	Files     map[string][]byte // contents written with WriteFile
+	responses []fakeResponse
+
+	// Disk makes file operations also change the local file system, for
+	// managers that read back what they wrote. Tests using it point every
+	// path at a temporary directory.
+	Disk bool
+}
+
+type fakeResponse struct {
+	prefix string
+	output []byte
+	err    error
+	fn     func(c *Cmd) error
+}
+
+// NewFake creates an empty Fake runner
+func NewFake() *Fake {
+	return &Fake{Files: make(map[string][]byte)}
+}
+
+// On registers the output and error returned for commands whose command
+// line starts with prefix. Later registrations take precedence.
+func (f *Fake) On(prefix string, output string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{prefix: prefix, output: []byte(output), err: err})
+}
+
+// Handle registers fn to run for commands whose command line starts with
+// prefix, e.g. to read their input or create the files a real command would.
+// Its error is returned as the command's.
+func (f *Fake) Handle(prefix string, fn func(c *Cmd) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{prefix: prefix, fn: fn})
+}
+
+// Ran reports whether a command line starting with prefix was executed
+func (f *Fake) Ran(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.Calls {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fake) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, call)
+}
+
+func (f *Fake) respond(c *Cmd) ([]byte, error) {
+	line := c.String()
+	f.mu.Lock()
+	var resp *fakeResponse
+	for i := len(f.responses) - 1; i >= 0; i-- {
+		if strings.HasPrefix(line, f.responses[i].prefix) {
+			resp = &f.responses[i]
+			break
+		}
+	}
+	f.mu.Unlock()
+	switch {
+	case resp == nil:
+		return nil, nil
+	case resp.fn != nil:
+		return nil, resp.fn(c)
+	}
+	return resp.output, resp.err
+}
+
+// Run implements Runner
+func (f *Fake) Run(name string, args ...string) error {
+	return f.RunCmd(Command(name, args...))
+}
+
+// Output implements Runner
+func (f *Fake) Output(name string, args ...string) ([]byte, error) {
+	c := Command(name, args...)
+	f.record(c.String())
+	return f.respond(c)
+}
+
+// RunCmd implements Runner
+func (f *Fake) RunCmd(c *Cmd) error {
+	f.record(c.String())
+	out, err := f.respond(c)
+	if c.Stdout != nil && len(out) > 0 {
+		c.Stdout.Write(out)
+	}
+	return err
+}
+
+// WriteFile implements Runner
+func (f *Fake) WriteFile(path string, data []byte, perm os.FileMode) error {
+	f.record(fmt.Sprintf("write %s", path))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Files[path] = append([]byte(nil), data...)
+	if f.Disk {
+		return os.WriteFile(path, data, perm)
+	}
+	return nil
+}
+
+// MkdirAll implements Runner
+func (f *Fake) MkdirAll(path string, perm os.FileMode) error {
+	f.record("mkdir -p " + path)
+	if f.Disk {
+		return os.MkdirAll(path, perm)
+	}
+	return nil
+}
+
+// Remove implements Runner
+func (f *Fake) Remove(path string) error {
+	f.record("rm " + path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.Files, path)
+	if f.Disk {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// RemoveAll implements Runner
+func (f *Fake) RemoveAll(path string) error {
+	f.record("rm -rf " + path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for p := range f.Files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(f.Files, p)
+		}
+	}
+	if f.Disk {
+		return os.RemoveAll(path)
+	}
+	return nil
+}
+
+// Rename implements Runner
+func (f *Fake) Rename(oldpath, newpath string) error {
+	f.record("mv " + oldpath + " " + newpath)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if data, ok := f.Files[oldpath]; ok {
+		f.Files[newpath] = data
+		delete(f.Files, oldpath)
+	}
+	if f.Disk {
+		return os.Rename(oldpath, newpath)
+	}
+	return nil
+}
+
+// Symlink implements Runner
+func (f *Fake) Symlink(oldname, newname string) error {
+	f.record("ln -s " + oldname + " " + newname)
+	if f.Disk {
+		return os.Symlink(oldname, newname)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package runner
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Runner performs every side effect IronStack has on a server: running
+// commands and changing files. Managers receive a Runner instead of calling
+// os/exec directly so that operations can be previewed (DryRun) or
+// recorded (Fake).
+type Runner interface {
+	// Run executes a command and waits for it to finish
+	Run(name string, args ...string) error
+	// Output executes a command and returns its standard output
+	Output(name string, args ...string) ([]byte, error)
+	// RunCmd executes a command with extra environment, input or output streams
+	RunCmd(c *Cmd) error
+
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Symlink(oldname, newname string) error
+}
+
+// Cmd describes a command for RunCmd
+type Cmd struct {
+	Name   string
+	Args   []string
+	Env    []string // added to the current environment
+	Dir    string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Command returns a Cmd for name and args
+func Command(name string, args ...string) *Cmd {
+	return &Cmd{Name: name, Args: args}
+}
+
+// Shell returns a Cmd running script with sh -c
+func Shell(script string) *Cmd {
+	return Command("sh", "-c", script)
+}
+
+// String returns the command line with shell quoting
+func (c *Cmd) String() string {
+	parts := make([]string, 0, len(c.Args)+1)
+	parts = append(parts, Quote(c.Name))
+	for _, a := range c.Args {
+		parts = append(parts, Quote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// secretOptions are the option names whose values Redacted masks
+var secretOptions = []string{"pass", "secret", "token"}
+
+// Redacted returns the command line like String with the values of password,
+// secret and token options masked, e.g. --dbpass=***. It is used wherever a
+// command line is shown.
+func (c *Cmd) Redacted() string {
+	parts := make([]string, 0, len(c.Args)+1)
+	parts = append(parts, Quote(c.Name))
+	maskNext := false
+	for _, a := range c.Args {
+		if maskNext {
+			parts = append(parts, "***")
+			maskNext = false
+			continue
+		}
+		if name, _, hasValue := strings.Cut(a, "="); strings.HasPrefix(a, "-") && isSecretOption(name) {
+			if hasValue {
+				parts = append(parts, Quote(name)+"=***")
+				continue
+			}
+			maskNext = true
+		}
+		parts = append(parts, Quote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+func isSecretOption(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretOptions {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Quote quotes s for display in a POSIX shell command line
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./=:,@+%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Exec runs commands and changes files for real
+type Exec struct{}
+
+// NewExec creates a Runner that executes everything on the local system
+func NewExec() *Exec {
+	return &Exec{}
+}
+
+// Run implements Runner
+func (e *Exec) Run(name string, args ...string) error {
+	return e.RunCmd(Command(name, args...))
+}
+
+// Output implements Runner
+func (e *Exec) Output(name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	c := Command(name, args...)
+	c.Stdout = &stdout
+	err := e.RunCmd(c)
+	return stdout.Bytes(), err
+}
+
+// RunCmd implements Runner. Failures are returned as *CommandError.
+func (e *Exec) RunCmd(c *Cmd) error {
+	cmd := exec.Command(c.Name, c.Args...)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+
+	// Keep the end of stderr for error reports while still passing it on
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(c.Stderr, stderr)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return newCommandError(c, err, stderr.buf.Bytes())
+	}
+	return nil
+}
+
+// WriteFile implements Runner
+func (e *Exec) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+
+// MkdirAll implements Runner
+func (e *Exec) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Remove implements Runner
+func (e *Exec) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// RemoveAll implements Runner
+func (e *Exec) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Rename implements Runner
+func (e *Exec) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Symlink implements Runner
+func (e *Exec) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	tests := []struct {
+		cmd  *Cmd
+		want string
+	}{
+		{Command("wp", "config", "create", "--dbname=x", "--dbpass=s3cret"), "wp config create --dbname=x --dbpass=***"},
+		{Command("wp", "core", "install", "--admin_password=it's"), "wp core install --admin_password=***"},
+		{Command("tool", "--password", "s3cret", "next"), "tool --password *** next"},
+		{Command("curl", "-H", "X-IronStack-Token: <token>", "--token=abc"), "curl -H 'X-IronStack-Token: <token>' --token=***"},
+		{Command("caddy", "validate", "--config", "/etc/caddy/Caddyfile"), "caddy validate --config /etc/caddy/Caddyfile"},
+	}
+	for _, tt := range tests {
+		if got := tt.cmd.Redacted(); got != tt.want {
+			t.Errorf("Redacted() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestCommandErrorRedacted(t *testing.T) {
+	err := NewExec().Run("sh", "-c", "echo failed >&2; exit 3", "sh", "--dbpass=s3cret")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Run error = %v, want *CommandError", err)
+	}
+	if cmdErr.ExitCode != 3 || cmdErr.Stderr != "failed" {
+		t.Errorf("CommandError = %+v", cmdErr)
+	}
+	if strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), "--dbpass=***") {
+		t.Errorf("error shows the password: %v", err)
+	}
+}
+
+func TestDryRunRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	d := NewDryRun(&buf)
+	cmd := Command("mysql", "-h", "localhost")
+	cmd.Env = []string{"MYSQL_PWD=s3cret"}
+	cmd.Stdin = strings.NewReader("ALTER USER 'x'@'localhost' IDENTIFIED BY 's3cret';")
+	d.RunCmd(cmd)
+	d.Run("wp", "config", "create", "--dbpass=s3cret")
+
+	want := "[dry-run] $ MYSQL_PWD=*** mysql -h localhost < (input)\n" +
+		"[dry-run] $ wp config create --dbpass=***\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%swant:\n%s", got, want)
+	}
+}
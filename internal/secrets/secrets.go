@@ -0,0 +1,316 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// Well-known secret names
+const (
+	DBPassword    = "db_password"
+	AdminPassword = "admin_password"
+	PurgeToken    = "purge_token"  // authenticates the mu-plugin at the purge endpoint
+	StatusToken   = "status_token" // authenticates IronStack at the site's PHP status script
+)
+
+// vaultVersion is the format version of secrets.json
+const vaultVersion = 1
+
+// passwordChars are safe inside SQL and PHP single-quoted strings
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.,:;!@#%^*+="
+
+// ErrNotFound is returned when a secret does not exist
+var ErrNotFound = errors.New("secret not found")
+
+// Vault stores per-site secrets encrypted with AES-256-GCM. The key lives in
+// a separate file readable only by root.
+type Vault struct {
+	Path    string
+	KeyPath string
+	Runner  runner.Runner
+
+	mu  sync.Mutex
+	key []byte
+}
+
+// vaultFile is the on-disk layout of secrets.json. Values are base64 of
+// nonce followed by ciphertext.
+type vaultFile struct {
+	Version int                          `json:"version"`
+	Sites   map[string]map[string]string `json:"sites"`
+}
+
+// New creates a vault stored under the configured state directory
+func New(cfg *config.Settings, r runner.Runner) *Vault {
+	return &Vault{
+		Path:    filepath.Join(cfg.StateDir, "secrets.json"),
+		KeyPath: filepath.Join(cfg.StateDir, "secrets.key"),
+		Runner:  r,
+	}
+}
+
+// GeneratePassword returns a random password of n characters
+func GeneratePassword(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(passwordChars)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+		b[i] = passwordChars[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// Get decrypts a secret of a site
+func (v *Vault) Get(site, name string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	file, err := v.load()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := file.Sites[site][name]
+	if !ok {
+		return "", fmt.Errorf("%s %s: %w", site, name, ErrNotFound)
+	}
+	return v.open(site, name, sealed)
+}
+
+// List decrypts all secrets of a site
+func (v *Vault) List(site string) (map[string]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	file, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for name, sealed := range file.Sites[site] {
+		value, err := v.open(site, name, sealed)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Names returns the names of a site's secrets without decrypting them
+func (v *Vault) Names(site string) ([]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	file, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range file.Sites[site] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Set encrypts and stores a secret
+func (v *Vault) Set(site, name, value string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	unlock, err := v.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := v.load()
+	if err != nil {
+		return err
+	}
+	sealed, err := v.seal(site, name, value)
+	if err != nil {
+		return err
+	}
+	if file.Sites[site] == nil {
+		file.Sites[site] = make(map[string]string)
+	}
+	file.Sites[site][name] = sealed
+	return v.save(file)
+}
+
+// Delete removes all secrets of a site
+func (v *Vault) Delete(site string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	unlock, err := v.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := v.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := file.Sites[site]; !ok {
+		return nil
+	}
+	delete(file.Sites, site)
+	return v.save(file)
+}
+
+// lockFile takes an exclusive lock on secrets.json.lock, so read-modify-write
+// updates of concurrent ironstack processes do not overwrite each other and
+// only one of them creates the key. Dry runs never change the vault and take
+// no lock.
+func (v *Vault) lockFile() (unlock func(), err error) {
+	if runner.IsDryRun(v.Runner) {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(v.Path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(v.Path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock vault: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock vault: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (v *Vault) load() (*vaultFile, error) {
+	file := &vaultFile{Version: vaultVersion, Sites: make(map[string]map[string]string)}
+	data, err := os.ReadFile(v.Path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault: %w", err)
+	}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("%s: %w", v.Path, err)
+	}
+	if file.Version > vaultVersion {
+		return nil, fmt.Errorf("%s: unsupported vault version %d", v.Path, file.Version)
+	}
+	if file.Sites == nil {
+		file.Sites = make(map[string]map[string]string)
+	}
+	return file, nil
+}
+
+func (v *Vault) save(file *vaultFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := v.Runner.MkdirAll(filepath.Dir(v.Path), 0700); err != nil {
+		return err
+	}
+	tmp := v.Path + ".tmp"
+	if err := v.Runner.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return v.Runner.Rename(tmp, v.Path)
+}
+
+// gcm returns the cipher. With create set, the key file is created on first
+// use, which needs the vault lock.
+func (v *Vault) gcm(create bool) (cipher.AEAD, error) {
+	if v.key == nil {
+		key, err := os.ReadFile(v.KeyPath)
+		if os.IsNotExist(err) && create {
+			key, err = v.createKey()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load vault key: %w", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("vault key %s must be 32 bytes, got %d", v.KeyPath, len(key))
+		}
+		v.key = key
+	}
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// createKey writes a new random key. The file is created exclusively, so a
+// key written by another process in the meantime is used, not replaced.
+func (v *Vault) createKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if runner.IsDryRun(v.Runner) {
+		return key, v.Runner.WriteFile(v.KeyPath, key, 0600)
+	}
+	if err := os.MkdirAll(filepath.Dir(v.KeyPath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(v.KeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return os.ReadFile(v.KeyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		os.Remove(v.KeyPath)
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// seal encrypts value. The site and name are authenticated so a ciphertext
+// cannot be moved to another entry. Callers hold the vault lock.
+func (v *Vault) seal(site, name, value string) (string, error) {
+	aead, err := v.gcm(true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(site+"/"+name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (v *Vault) open(site, name, encoded string) (string, error) {
+	aead, err := v.gcm(false)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%s %s: corrupt secret", site, name)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(site+"/"+name))
+	if err != nil {
+		return "", fmt.Errorf("%s %s: failed to decrypt (wrong key?)", site, name)
+	}
+	return string(plain), nil
+}
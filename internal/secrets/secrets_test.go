@@ -0,0 +1,164 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// newTestVault returns a vault stored in a temporary directory
+func newTestVault(t *testing.T) *Vault {
+	t.Helper()
+	cfg := config.Default()
+	cfg.StateDir = t.TempDir()
+	fake := runner.NewFake()
+	fake.Disk = true
+	return New(cfg, fake)
+}
+
+func TestRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+	if err := v.Set("example.com", DBPassword, "s3cret'\"\\"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("example.com", AdminPassword, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh vault reads the key and secrets back from disk
+	v = &Vault{Path: v.Path, KeyPath: v.KeyPath, Runner: v.Runner}
+	if got, err := v.Get("example.com", DBPassword); err != nil || got != "s3cret'\"\\" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	if _, err := v.Get("example.com", PurgeToken); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing secret = %v, want ErrNotFound", err)
+	}
+	values, err := v.List("example.com")
+	if err != nil || len(values) != 2 || values[AdminPassword] != "admin" {
+		t.Errorf("List = %v, %v", values, err)
+	}
+
+	data, err := os.ReadFile(v.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("secrets.json holds a plain text secret:\n%s", data)
+	}
+	for _, path := range []string{v.Path, v.KeyPath} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: %v, %v", filepath.Base(path), info.Mode(), err)
+		}
+	}
+
+	if err := v.Delete("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := v.Names("example.com"); err != nil || len(names) != 0 {
+		t.Errorf("Names after Delete = %v, %v", names, err)
+	}
+}
+
+func TestWrongAAD(t *testing.T) {
+	v := newTestVault(t)
+	if err := v.Set("example.com", DBPassword, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("other.example.com", DBPassword, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving a ciphertext to another site or name must not decrypt
+	var file vaultFile
+	data, _ := os.ReadFile(v.Path)
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	sealed := file.Sites["example.com"][DBPassword]
+	file.Sites["other.example.com"][DBPassword] = sealed
+	file.Sites["example.com"][AdminPassword] = sealed
+	data, _ = json.Marshal(file)
+	if err := os.WriteFile(v.Path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range [][2]string{{"other.example.com", DBPassword}, {"example.com", AdminPassword}} {
+		if got, err := v.Get(entry[0], entry[1]); err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+			t.Errorf("Get(%s, %s) = %q, %v; want a decryption error", entry[0], entry[1], got, err)
+		}
+	}
+	if got, err := v.Get("example.com", DBPassword); err != nil || got != "secret" {
+		t.Errorf("Get of the original entry = %q, %v", got, err)
+	}
+}
+
+func TestCorruptFile(t *testing.T) {
+	v := newTestVault(t)
+	if err := v.Set("example.com", DBPassword, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, data, want string
+	}{
+		{"truncated", `{"version": 1, "sites": {`, v.Path + ": "},
+		{"future version", `{"version": 2, "sites": {}}`, "unsupported vault version 2"},
+		{"bad base64", `{"version": 1, "sites": {"example.com": {"db_password": "!!"}}}`, "corrupt secret"},
+		{"short value", `{"version": 1, "sites": {"example.com": {"db_password": "AAAA"}}}`, "corrupt secret"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(v.Path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.Get("example.com", DBPassword); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Get error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Set refuses to overwrite a vault it cannot read
+	os.WriteFile(v.Path, []byte("not json"), 0600)
+	if err := v.Set("example.com", AdminPassword, "admin"); err == nil {
+		t.Error("Set over a corrupt vault succeeded")
+	}
+	if data, _ := os.ReadFile(v.Path); string(data) != "not json" {
+		t.Errorf("corrupt vault was overwritten with %q", data)
+	}
+}
+
+func TestKeyCreatedOnce(t *testing.T) {
+	cfg := config.Default()
+	cfg.StateDir = t.TempDir()
+
+	// Vaults of separate processes race to create the key
+	var wg sync.WaitGroup
+	vaults := make([]*Vault, 8)
+	for i := range vaults {
+		fake := runner.NewFake()
+		fake.Disk = true
+		vaults[i] = New(cfg, fake)
+		wg.Add(1)
+		go func(v *Vault, site string) {
+			defer wg.Done()
+			if err := v.Set(site, DBPassword, site); err != nil {
+				t.Error(err)
+			}
+		}(vaults[i], string(rune('a'+i))+".example.com")
+	}
+	wg.Wait()
+
+	// Every secret decrypts with the key on disk
+	v := New(cfg, vaults[0].Runner)
+	for i := range vaults {
+		site := string(rune('a'+i)) + ".example.com"
+		if got, err := v.Get(site, DBPassword); err != nil || got != site {
+			t.Errorf("Get(%s) = %q, %v", site, got, err)
+		}
+	}
+}
@@ -3,16 +3,19 @@ package security
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // CSF manages ConfigServer Firewall
-type CSF struct{}
+type CSF struct {
+	Runner runner.Runner
+}
 
 // NewCSF creates a CSF manager
-func NewCSF() *CSF {
-	return &CSF{}
+func NewCSF(r runner.Runner) *CSF {
+	return &CSF{Runner: r}
 }
 
 // Install installs CSF firewall
@@ -23,7 +26,7 @@ func (c *CSF) Install() error {
 		"cd /usr/src/csf && sh install.sh",
 	}
 	for _, cmd := range commands {
-		if err := exec.Command("sh", "-c", cmd).Run(); err != nil {
+		if err := c.Runner.Run("sh", "-c", cmd); err != nil {
 			return fmt.Errorf("install failed: %w", err)
 		}
 	}
@@ -33,67 +36,77 @@ func (c *CSF) Install() error {
 // Enable enables and starts CSF
 func (c *CSF) Enable() error {
 	// Disable testing mode
-	c.SetConfig("TESTING", "0")
-	return exec.Command("csf", "-e").Run()
+	if err := c.SetConfig("TESTING", "0"); err != nil {
+		return runner.Step("disable testing mode", err)
+	}
+	return c.Runner.Run("csf", "-e")
 }
 
 // Disable disables CSF
 func (c *CSF) Disable() error {
-	return exec.Command("csf", "-x").Run()
+	return c.Runner.Run("csf", "-x")
 }
 
 // Restart restarts CSF
 func (c *CSF) Restart() error {
-	return exec.Command("csf", "-r").Run()
+	return c.Runner.Run("csf", "-r")
 }
 
 // Status returns CSF status
 func (c *CSF) Status() (bool, error) {
-	err := exec.Command("csf", "-l").Run()
+	err := c.Runner.Run("csf", "-l")
 	return err == nil, nil
 }
 
 // AllowIP adds an IP to whitelist
 func (c *CSF) AllowIP(ip, comment string) error {
-	return exec.Command("csf", "-a", ip, comment).Run()
+	return c.Runner.Run("csf", "-a", ip, comment)
 }
 
 // DenyIP adds an IP to blacklist
 func (c *CSF) DenyIP(ip, comment string) error {
-	return exec.Command("csf", "-d", ip, comment).Run()
+	return c.Runner.Run("csf", "-d", ip, comment)
 }
 
-// RemoveIP removes an IP from both lists
+// RemoveIP removes an IP from both lists. CSF exits non-zero when the IP is
+// not on a list, so this only fails if it could be removed from neither.
 func (c *CSF) RemoveIP(ip string) error {
-	exec.Command("csf", "-ar", ip).Run()
-	exec.Command("csf", "-dr", ip).Run()
+	allowErr := c.Runner.Run("csf", "-ar", ip)
+	denyErr := c.Runner.Run("csf", "-dr", ip)
+	if allowErr != nil && denyErr != nil {
+		return denyErr
+	}
 	return nil
 }
 
 // TempBlockIP temporarily blocks an IP
 func (c *CSF) TempBlockIP(ip string, seconds int, comment string) error {
-	return exec.Command("csf", "-td", ip, fmt.Sprintf("%d", seconds), comment).Run()
+	return c.Runner.Run("csf", "-td", ip, fmt.Sprintf("%d", seconds), comment)
 }
 
 // OpenPort opens a TCP port
 func (c *CSF) OpenPort(port int) error {
 	// Add to TCP_IN and TCP_OUT
-	c.AddToConfig("TCP_IN", fmt.Sprintf("%d", port))
-	c.AddToConfig("TCP_OUT", fmt.Sprintf("%d", port))
-	return c.Restart()
+	return c.updatePorts(c.AddToConfig, "TCP_IN", "TCP_OUT", port)
 }
 
 // ClosePort closes a TCP port
 func (c *CSF) ClosePort(port int) error {
-	c.RemoveFromConfig("TCP_IN", fmt.Sprintf("%d", port))
-	c.RemoveFromConfig("TCP_OUT", fmt.Sprintf("%d", port))
-	return c.Restart()
+	return c.updatePorts(c.RemoveFromConfig, "TCP_IN", "TCP_OUT", port)
 }
 
 // OpenUDPPort opens a UDP port
 func (c *CSF) OpenUDPPort(port int) error {
-	c.AddToConfig("UDP_IN", fmt.Sprintf("%d", port))
-	c.AddToConfig("UDP_OUT", fmt.Sprintf("%d", port))
+	return c.updatePorts(c.AddToConfig, "UDP_IN", "UDP_OUT", port)
+}
+
+// updatePorts applies change to both port lists and restarts CSF
+func (c *CSF) updatePorts(change func(key, value string) error, in, out string, port int) error {
+	for _, key := range []string{in, out} {
+		if err := change(key, fmt.Sprintf("%d", port)); err != nil {
+			return runner.Step("update "+key, err)
+		}
+	}
 	return c.Restart()
 }
 
@@ -139,13 +152,13 @@ func (c *CSF) GetAllowedIPs() ([]string, error) {
 
 // SetConfig sets a configuration value
 func (c *CSF) SetConfig(key, value string) error {
-	return exec.Command("sed", "-i", fmt.Sprintf(`s/^%s = .*/%s = "%s"/`, key, key, value), "/etc/csf/csf.conf").Run()
+	return c.Runner.Run("sed", "-i", fmt.Sprintf(`s/^%s = .*/%s = "%s"/`, key, key, value), "/etc/csf/csf.conf")
 }
 
 // AddToConfig adds a value to a comma-separated config
 func (c *CSF) AddToConfig(key, value string) error {
 	// Read current config
-	out, err := exec.Command("grep", fmt.Sprintf("^%s =", key), "/etc/csf/csf.conf").Output()
+	out, err := c.Runner.Output("grep", fmt.Sprintf("^%s =", key), "/etc/csf/csf.conf")
 	if err != nil {
 		return err
 	}
@@ -166,7 +179,7 @@ func (c *CSF) AddToConfig(key, value string) error {
 
 // RemoveFromConfig removes a value from comma-separated config
 func (c *CSF) RemoveFromConfig(key, value string) error {
-	out, err := exec.Command("grep", fmt.Sprintf("^%s =", key), "/etc/csf/csf.conf").Output()
+	out, err := c.Runner.Output("grep", fmt.Sprintf("^%s =", key), "/etc/csf/csf.conf")
 	if err != nil {
 		return err
 	}
@@ -191,19 +204,26 @@ func (c *CSF) ConfigureForWordPress() error {
 	// Essential ports for WordPress
 	essentialPorts := "80,443,22,25,53,587,993,995"
 	
-	c.SetConfig("TCP_IN", essentialPorts)
-	c.SetConfig("TCP_OUT", "1:65535")
-	c.SetConfig("UDP_IN", "53")
-	c.SetConfig("UDP_OUT", "53,123,6277,6672")
-	
-	// Security settings
-	c.SetConfig("SYNFLOOD", "1")
-	c.SetConfig("SYNFLOOD_RATE", "75/s")
-	c.SetConfig("SYNFLOOD_BURST", "25")
-	c.SetConfig("PORTFLOOD", "22;tcp;5;300,80;tcp;20;5,443;tcp;20;5")
-	c.SetConfig("CONNLIMIT", "22;5,80;50,443;50")
-	c.SetConfig("CT_LIMIT", "200")
-	c.SetConfig("LF_TRIGGER", "0")
+	settings := [][2]string{
+		{"TCP_IN", essentialPorts},
+		{"TCP_OUT", "1:65535"},
+		{"UDP_IN", "53"},
+		{"UDP_OUT", "53,123,6277,6672"},
+
+		// Security settings
+		{"SYNFLOOD", "1"},
+		{"SYNFLOOD_RATE", "75/s"},
+		{"SYNFLOOD_BURST", "25"},
+		{"PORTFLOOD", "22;tcp;5;300,80;tcp;20;5,443;tcp;20;5"},
+		{"CONNLIMIT", "22;5,80;50,443;50"},
+		{"CT_LIMIT", "200"},
+		{"LF_TRIGGER", "0"},
+	}
+	for _, kv := range settings {
+		if err := c.SetConfig(kv[0], kv[1]); err != nil {
+			return runner.Step("set "+kv[0], err)
+		}
+	}
 	
 	return c.Restart()
 }
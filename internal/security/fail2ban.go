@@ -2,64 +2,65 @@ package security
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Fail2ban manages Fail2ban service
 type Fail2ban struct {
 	JailDir string
+	Runner  runner.Runner
 }
 
 // NewFail2ban creates a Fail2ban manager
-func NewFail2ban() *Fail2ban {
-	return &Fail2ban{JailDir: "/etc/fail2ban/jail.d"}
+func NewFail2ban(r runner.Runner) *Fail2ban {
+	return &Fail2ban{JailDir: "/etc/fail2ban/jail.d", Runner: r}
 }
 
 // Install installs Fail2ban
 func (f *Fail2ban) Install() error {
-	if err := exec.Command("apt-get", "install", "-y", "fail2ban").Run(); err != nil {
+	if err := f.Runner.Run("apt-get", "install", "-y", "fail2ban"); err != nil {
 		return err
 	}
-	return exec.Command("systemctl", "enable", "fail2ban").Run()
+	return f.Runner.Run("systemctl", "enable", "fail2ban")
 }
 
 // Start starts Fail2ban
 func (f *Fail2ban) Start() error {
-	return exec.Command("systemctl", "start", "fail2ban").Run()
+	return f.Runner.Run("systemctl", "start", "fail2ban")
 }
 
 // Stop stops Fail2ban
 func (f *Fail2ban) Stop() error {
-	return exec.Command("systemctl", "stop", "fail2ban").Run()
+	return f.Runner.Run("systemctl", "stop", "fail2ban")
 }
 
 // Restart restarts Fail2ban
 func (f *Fail2ban) Restart() error {
-	return exec.Command("systemctl", "restart", "fail2ban").Run()
+	return f.Runner.Run("systemctl", "restart", "fail2ban")
 }
 
 // Status returns Fail2ban status
 func (f *Fail2ban) Status() (bool, error) {
-	err := exec.Command("systemctl", "is-active", "--quiet", "fail2ban").Run()
+	err := f.Runner.Run("systemctl", "is-active", "--quiet", "fail2ban")
 	return err == nil, nil
 }
 
 // BanIP manually bans an IP in a jail
 func (f *Fail2ban) BanIP(jail, ip string) error {
-	return exec.Command("fail2ban-client", "set", jail, "banip", ip).Run()
+	return f.Runner.Run("fail2ban-client", "set", jail, "banip", ip)
 }
 
 // UnbanIP unbans an IP from a jail
 func (f *Fail2ban) UnbanIP(jail, ip string) error {
-	return exec.Command("fail2ban-client", "set", jail, "unbanip", ip).Run()
+	return f.Runner.Run("fail2ban-client", "set", jail, "unbanip", ip)
 }
 
 // GetBannedIPs returns banned IPs for a jail
 func (f *Fail2ban) GetBannedIPs(jail string) ([]string, error) {
-	out, err := exec.Command("fail2ban-client", "status", jail).Output()
+	out, err := f.Runner.Output("fail2ban-client", "status", jail)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +80,7 @@ func (f *Fail2ban) GetBannedIPs(jail string) ([]string, error) {
 
 // GetJails returns list of active jails
 func (f *Fail2ban) GetJails() ([]string, error) {
-	out, err := exec.Command("fail2ban-client", "status").Output()
+	out, err := f.Runner.Output("fail2ban-client", "status")
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +102,9 @@ func (f *Fail2ban) GetJails() ([]string, error) {
 
 // CreateWordPressJails creates WordPress-specific jails
 func (f *Fail2ban) CreateWordPressJails() error {
-	os.MkdirAll(f.JailDir, 0755)
+	if err := f.Runner.MkdirAll(f.JailDir, 0755); err != nil {
+		return err
+	}
 	
 	// WordPress auth jail
 	wpAuth := `[wordpress-auth]
@@ -113,7 +116,7 @@ maxretry = 5
 bantime = 3600
 findtime = 600
 `
-	if err := os.WriteFile(filepath.Join(f.JailDir, "wordpress.conf"), []byte(wpAuth), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(f.JailDir, "wordpress.conf"), []byte(wpAuth), 0644); err != nil {
 		return err
 	}
 	
@@ -124,7 +127,7 @@ failregex = ^<HOST> .* "POST /wp-login.php
             ^<HOST> .* "POST /xmlrpc.php
 ignoreregex =
 `
-	if err := os.WriteFile(filepath.Join(filterDir, "wordpress-auth.conf"), []byte(wpFilter), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(filterDir, "wordpress-auth.conf"), []byte(wpFilter), 0644); err != nil {
 		return err
 	}
 	
@@ -142,7 +145,7 @@ maxretry = 10
 bantime = 1800
 findtime = 300
 `
-	if err := os.WriteFile(filepath.Join(f.JailDir, "woocommerce.conf"), []byte(wooJail), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(f.JailDir, "woocommerce.conf"), []byte(wooJail), 0644); err != nil {
 		return err
 	}
 	
@@ -152,7 +155,7 @@ failregex = ^<HOST> .* "POST /wp-admin/admin-ajax.php.*wc-ajax
             ^<HOST> .* "POST /.*add-to-cart
 ignoreregex =
 `
-	if err := os.WriteFile(filepath.Join(filterDir, "woocommerce.conf"), []byte(wooFilter), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(filterDir, "woocommerce.conf"), []byte(wooFilter), 0644); err != nil {
 		return err
 	}
 	
@@ -170,7 +173,7 @@ maxretry = 30
 bantime = 600
 findtime = 60
 `
-	if err := os.WriteFile(filepath.Join(f.JailDir, "http-brute.conf"), []byte(bruteJail), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(f.JailDir, "http-brute.conf"), []byte(bruteJail), 0644); err != nil {
 		return err
 	}
 	
@@ -179,7 +182,7 @@ findtime = 60
 failregex = ^<HOST> .* "(GET|POST|HEAD)
 ignoreregex = \.(css|js|jpg|jpeg|png|gif|ico|svg|woff|woff2)
 `
-	if err := os.WriteFile(filepath.Join(filterDir, "http-brute.conf"), []byte(bruteFilter), 0644); err != nil {
+	if err := f.Runner.WriteFile(filepath.Join(filterDir, "http-brute.conf"), []byte(bruteFilter), 0644); err != nil {
 		return err
 	}
 	
@@ -197,12 +200,12 @@ maxretry = 3
 bantime = 86400
 findtime = 600
 `
-	return os.WriteFile(filepath.Join(f.JailDir, "sshd.conf"), []byte(sshJail), 0644)
+	return f.Runner.WriteFile(filepath.Join(f.JailDir, "sshd.conf"), []byte(sshJail), 0644)
 }
 
 // GetJailStatus returns status of a specific jail
 func (f *Fail2ban) GetJailStatus(jail string) (map[string]string, error) {
-	out, err := exec.Command("fail2ban-client", "status", jail).Output()
+	out, err := f.Runner.Output("fail2ban-client", "status", jail)
 	if err != nil {
 		return nil, err
 	}
@@ -223,10 +226,10 @@ func (f *Fail2ban) GetJailStatus(jail string) (map[string]string, error) {
 
 // SetBanTime sets ban time for a jail
 func (f *Fail2ban) SetBanTime(jail string, seconds int) error {
-	return exec.Command("fail2ban-client", "set", jail, "bantime", fmt.Sprintf("%d", seconds)).Run()
+	return f.Runner.Run("fail2ban-client", "set", jail, "bantime", fmt.Sprintf("%d", seconds))
 }
 
 // SetMaxRetry sets max retries for a jail
 func (f *Fail2ban) SetMaxRetry(jail string, count int) error {
-	return exec.Command("fail2ban-client", "set", jail, "maxretry", fmt.Sprintf("%d", count)).Run()
+	return f.Runner.Run("fail2ban-client", "set", jail, "maxretry", fmt.Sprintf("%d", count))
 }
@@ -1,21 +1,24 @@
 package security
 
 import (
-	"os"
-	"os/exec"
+	"fmt"
+
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // Security provides unified security management
 type Security struct {
 	CSF      *CSF
 	Fail2ban *Fail2ban
+	Runner   runner.Runner
 }
 
 // New creates a unified security manager
-func New() *Security {
+func New(r runner.Runner) *Security {
 	return &Security{
-		CSF:      NewCSF(),
-		Fail2ban: NewFail2ban(),
+		CSF:      NewCSF(r),
+		Fail2ban: NewFail2ban(r),
+		Runner:   r,
 	}
 }
 
@@ -30,76 +33,93 @@ func (s *Security) InstallAll() error {
 	return nil
 }
 
-// ConfigureForWordPress applies WordPress security settings
+// ConfigureForWordPress applies WordPress security settings. Every step
+// is attempted; failures are returned together as *runner.Errors.
 func (s *Security) ConfigureForWordPress() error {
+	var errs runner.Errors
+
 	// Configure CSF
-	s.CSF.ConfigureForWordPress()
-	s.CSF.Enable()
+	errs.Add("configure CSF", s.CSF.ConfigureForWordPress())
+	errs.Add("enable CSF", s.CSF.Enable())
 	
 	// Configure Fail2ban
-	s.Fail2ban.CreateWordPressJails()
-	s.Fail2ban.ConfigureSSH()
-	s.Fail2ban.Start()
+	errs.Add("create WordPress jails", s.Fail2ban.CreateWordPressJails())
+	errs.Add("configure SSH jail", s.Fail2ban.ConfigureSSH())
+	errs.Add("start Fail2ban", s.Fail2ban.Start())
 	
-	return nil
+	return errs.Err()
 }
 
 // HardenServer applies security hardening
 func (s *Security) HardenServer() error {
+	var errs runner.Errors
+
 	// Disable root SSH login
-	exec.Command("sed", "-i", "s/PermitRootLogin yes/PermitRootLogin no/", "/etc/ssh/sshd_config").Run()
+	errs.Add("disable root SSH login", s.Runner.Run("sed", "-i", "s/PermitRootLogin yes/PermitRootLogin no/", "/etc/ssh/sshd_config"))
 	
 	// Disable password authentication (use keys only)
-	// exec.Command("sed", "-i", "s/PasswordAuthentication yes/PasswordAuthentication no/", "/etc/ssh/sshd_config").Run()
+	// s.Runner.Run("sed", "-i", "s/PasswordAuthentication yes/PasswordAuthentication no/", "/etc/ssh/sshd_config")
 	
 	// Enable automatic security updates
-	exec.Command("apt-get", "install", "-y", "unattended-upgrades").Run()
-	exec.Command("dpkg-reconfigure", "-plow", "unattended-upgrades").Run()
+	errs.Add("install unattended-upgrades", s.Runner.Run("apt-get", "install", "-y", "unattended-upgrades"))
+	errs.Add("configure unattended-upgrades", s.Runner.Run("dpkg-reconfigure", "-plow", "unattended-upgrades"))
 	
-	// Disable unused services
+	// Disable unused services. They are often not installed at all, so
+	// failures here are not reported.
 	services := []string{"cups", "avahi-daemon", "bluetooth"}
 	for _, svc := range services {
-		exec.Command("systemctl", "disable", svc).Run()
-		exec.Command("systemctl", "stop", svc).Run()
+		s.Runner.Run("systemctl", "disable", svc)
+		s.Runner.Run("systemctl", "stop", svc)
 	}
 	
 	// Set secure permissions on sensitive files
-	exec.Command("chmod", "600", "/etc/shadow").Run()
-	exec.Command("chmod", "600", "/etc/gshadow").Run()
+	errs.Add("protect /etc/shadow", s.Runner.Run("chmod", "600", "/etc/shadow"))
+	errs.Add("protect /etc/gshadow", s.Runner.Run("chmod", "600", "/etc/gshadow"))
 	
-	return nil
+	return errs.Err()
 }
 
 // BlockCountries blocks traffic from specific countries
 func (s *Security) BlockCountries(countryCodes []string) error {
 	for _, code := range countryCodes {
-		s.CSF.AddToConfig("CC_DENY", code)
+		if err := s.CSF.AddToConfig("CC_DENY", code); err != nil {
+			return runner.Step("deny "+code, err)
+		}
 	}
 	return s.CSF.Restart()
 }
 
 // AllowCountries allows traffic only from specific countries
 func (s *Security) AllowCountries(countryCodes []string) error {
-	s.CSF.SetConfig("CC_DENY", "")
+	if err := s.CSF.SetConfig("CC_DENY", ""); err != nil {
+		return runner.Step("clear CC_DENY", err)
+	}
 	for _, code := range countryCodes {
-		s.CSF.AddToConfig("CC_ALLOW", code)
+		if err := s.CSF.AddToConfig("CC_ALLOW", code); err != nil {
+			return runner.Step("allow "+code, err)
+		}
+	}
+	if err := s.CSF.SetConfig("CC_ALLOW_FILTER", "1"); err != nil {
+		return runner.Step("enable CC_ALLOW_FILTER", err)
 	}
-	s.CSF.SetConfig("CC_ALLOW_FILTER", "1")
 	return s.CSF.Restart()
 }
 
-// BlockIP blocks an IP in both CSF and Fail2ban
+// BlockIP blocks an IP in both CSF and Fail2ban. Both are attempted;
+// failures are returned together as *runner.Errors.
 func (s *Security) BlockIP(ip, reason string) error {
-	s.CSF.DenyIP(ip, reason)
-	s.Fail2ban.BanIP("sshd", ip)
-	return nil
+	var errs runner.Errors
+	errs.Add("CSF deny", s.CSF.DenyIP(ip, reason))
+	errs.Add("Fail2ban ban", s.Fail2ban.BanIP("sshd", ip))
+	return errs.Err()
 }
 
 // UnblockIP unblocks an IP from both CSF and Fail2ban
 func (s *Security) UnblockIP(ip string) error {
-	s.CSF.RemoveIP(ip)
-	s.Fail2ban.UnbanIP("sshd", ip)
-	return nil
+	var errs runner.Errors
+	errs.Add("CSF remove", s.CSF.RemoveIP(ip))
+	errs.Add("Fail2ban unban", s.Fail2ban.UnbanIP("sshd", ip))
+	return errs.Err()
 }
 
 // Status returns security service status
@@ -110,35 +130,50 @@ func (s *Security) Status() map[string]bool {
 	return status
 }
 
+// Summary contains the security state of the server
+type Summary struct {
+	CSFActive      bool     `json:"csf_active"`
+	Fail2banActive bool     `json:"fail2ban_active"`
+	BlockedIPs     []string `json:"blocked_ips"`
+	Jails          []string `json:"jails"`
+}
+
+// GetSummary collects firewall and Fail2ban state
+func (s *Security) GetSummary() *Summary {
+	summary := &Summary{}
+	summary.CSFActive, _ = s.CSF.Status()
+	summary.Fail2banActive, _ = s.Fail2ban.Status()
+	summary.BlockedIPs, _ = s.CSF.GetBlockedIPs()
+	summary.Jails, _ = s.Fail2ban.GetJails()
+	return summary
+}
+
 // GenerateSecurityReport generates a security report
 func (s *Security) GenerateSecurityReport() string {
+	summary := s.GetSummary()
 	report := "=== Security Report ===\n\n"
 	
 	// CSF Status
-	csfActive, _ := s.CSF.Status()
 	report += "CSF Firewall: "
-	if csfActive {
+	if summary.CSFActive {
 		report += "ACTIVE ✓\n"
 	} else {
 		report += "INACTIVE ✗\n"
 	}
 	
 	// Fail2ban Status
-	f2bActive, _ := s.Fail2ban.Status()
 	report += "Fail2ban: "
-	if f2bActive {
+	if summary.Fail2banActive {
 		report += "ACTIVE ✓\n"
 	} else {
 		report += "INACTIVE ✗\n"
 	}
 	
 	// Blocked IPs
-	blockedIPs, _ := s.CSF.GetBlockedIPs()
-	report += fmt.Sprintf("Blocked IPs: %d\n", len(blockedIPs))
+	report += fmt.Sprintf("Blocked IPs: %d\n", len(summary.BlockedIPs))
 	
 	// Active jails
-	jails, _ := s.Fail2ban.GetJails()
-	report += fmt.Sprintf("Active Jails: %d\n", len(jails))
+	report += fmt.Sprintf("Active Jails: %d\n", len(summary.Jails))
 	
 	return report
 }
@@ -183,5 +218,5 @@ Options -Indexes
     php_value max_input_time 300
 </IfModule>
 `
-	return os.WriteFile(sitePath+"/public/.htaccess-security", []byte(htaccess), 0644)
+	return s.Runner.WriteFile(sitePath+"/public/.htaccess-security", []byte(htaccess), 0644)
 }
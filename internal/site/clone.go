@@ -1,145 +1,247 @@
 package site
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"time"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
 )
 
-// Clone creates a copy of a site
+// Clone creates a copy of a site. If a step fails, the copied files,
+// database and Caddy config are removed again unless KeepOnFailure is set.
 func (m *Manager) Clone(sourceDomain, targetDomain string) error {
-	sourcePath := filepath.Join(m.WebRoot, sourceDomain)
-	targetPath := filepath.Join(m.WebRoot, targetDomain)
+	return m.clone(sourceDomain, targetDomain, "")
+}
 
-	// Copy files
-	if err := exec.Command("cp", "-r", sourcePath, targetPath).Run(); err != nil {
-		return fmt.Errorf("copy failed: %w", err)
+// clone copies sourceDomain to targetDomain. stagingOf is recorded in the
+// registry for staging copies.
+func (m *Manager) clone(sourceDomain, targetDomain, stagingOf string) error {
+	if err := config.CheckDomain(targetDomain); err != nil {
+		return err
+	}
+	source, err := m.Registry.Get(sourceDomain)
+	if err != nil {
+		return err
+	}
+	sourcePath := source.Path
+	targetPath := filepath.Join(m.WebRoot, targetDomain)
+	if err := m.checkNew(targetDomain, targetPath); err != nil {
+		return err
 	}
 
-	// Create new database
 	targetSite := &Site{
 		Domain:     targetDomain,
 		Path:       targetPath,
-		UseVarnish: true,
+		EnableSSL:  source.EnableSSL,
+		UseVarnish: source.UseVarnish,
+		StagingOf:  stagingOf,
+		PHP:        source.PHP,
+		Caddy:      source.Caddy,
+		Varnish:    source.Varnish,
+		Created:    time.Now().UTC(),
 	}
-	
-	dbPass, err := m.createDatabase(targetSite)
+	targetSite.record("cloned", "from "+sourceDomain)
+	tempSQL, err := m.dumpFile("clone_" + sourceDomain)
 	if err != nil {
-		return fmt.Errorf("database creation failed: %w", err)
+		return err
 	}
+	defer m.Runner.Remove(tempSQL)
 
-	// Export source database
-	tempSQL := "/tmp/clone_" + sourceDomain + ".sql"
-	exec.Command("wp", "db", "export", tempSQL, "--path="+sourcePath+"/public").Run()
-
-	// Import to target database
-	exec.Command("wp", "db", "import", tempSQL, "--path="+targetPath+"/public").Run()
-	os.Remove(tempSQL)
-
-	// Update wp-config with new database credentials
-	wpConfigPath := filepath.Join(targetPath, "public", "wp-config.php")
-	content, _ := os.ReadFile(wpConfigPath)
-	
-	newContent := string(content)
-	newContent = replaceConfigValue(newContent, "DB_NAME", targetSite.DBName)
-	newContent = replaceConfigValue(newContent, "DB_USER", targetSite.DBUser)
-	newContent = replaceConfigValue(newContent, "DB_PASSWORD", dbPass)
-	
-	os.WriteFile(wpConfigPath, []byte(newContent), 0644)
+	steps := []step{
+		m.reserveStep(targetSite),
+		{
+			name: "copy files",
+			do: func() error {
+				if err := m.Runner.Run("cp", "-r", sourcePath, targetPath); err != nil {
+					// Don't leave a partial copy behind
+					m.Runner.RemoveAll(targetPath)
+					return err
+				}
+				return nil
+			},
+			undo: func() error { return m.Runner.RemoveAll(targetPath) },
+		},
+		m.createDatabaseStep(targetSite),
+		m.createDatabaseUserStep(targetSite),
+		{name: "export database", do: func() error {
+			return m.Runner.Run("wp", "db", "export", tempSQL, "--path="+sourcePath+"/public")
+		}},
+		{name: "import database", do: func() error {
+			return m.Runner.Run("wp", "db", "import", tempSQL, "--path="+targetPath+"/public")
+		}},
+		{name: "update wp-config.php", do: func() error { return m.updateCloneConfig(targetSite) }},
+	}
 
 	// Search-replace URLs in database
-	exec.Command("wp", "search-replace", 
-		"https://"+sourceDomain, 
-		"https://"+targetDomain, 
-		"--all-tables",
-		"--path="+targetPath+"/public",
-	).Run()
-
-	exec.Command("wp", "search-replace", 
-		"http://"+sourceDomain, 
-		"https://"+targetDomain, 
-		"--all-tables",
-		"--path="+targetPath+"/public",
-	).Run()
-
-	// Generate Caddy config for new domain
-	m.CaddyConf.AddSite(targetDomain, true)
-
-	// Set permissions
-	exec.Command("chown", "-R", "www-data:www-data", targetPath).Run()
+	for _, from := range []string{"https://" + sourceDomain, "http://" + sourceDomain} {
+		from := from
+		steps = append(steps, step{name: "search-replace " + from, do: func() error {
+			return m.Runner.Run("wp", "search-replace",
+				from,
+				"https://"+targetDomain,
+				"--all-tables",
+				"--path="+targetPath+"/public",
+			)
+		}})
+	}
 
-	// Reload Caddy
-	exec.Command("systemctl", "reload", "caddy").Run()
+	steps = append(steps,
+		m.autoPurgeStep(targetSite),
+		m.phpStatusStep(targetSite),
+		m.varnishConfigStep(targetSite),
+		m.caddyConfigStep(targetSite),
+		step{name: "set permissions", do: func() error {
+			return m.Runner.Run("chown", "-R", "www-data:www-data", targetPath)
+		}},
+		m.registerStep(targetSite),
+	)
+	if err := m.runSteps(steps); err != nil {
+		return err
+	}
+	return m.Registry.Record(sourceDomain, "cloned", "to "+targetDomain)
+}
 
-	return nil
+// updateCloneConfig points a cloned wp-config.php at the clone's database
+// and object cache
+func (m *Manager) updateCloneConfig(s *Site) error {
+	_, err := m.editWPConfig(s.Path, func(f *wpconfig.File) error {
+		for name, value := range map[string]string{
+			"DB_NAME":     s.DBName,
+			"DB_USER":     s.DBUser,
+			"DB_PASSWORD": s.DBPass,
+		} {
+			if err := f.Set(name, value); err != nil {
+				return err
+			}
+		}
+		return f.SetAll(m.WPConf.ForSite(s.ObjectCache).ObjectCacheConstants())
+	})
+	return err
 }
 
 // CreateStaging creates a staging environment
 func (m *Manager) CreateStaging(domain string) error {
 	stagingDomain := "staging." + domain
-	return m.Clone(domain, stagingDomain)
+	return m.clone(domain, stagingDomain, domain)
 }
 
-// PushToProduction pushes staging to production
+// PushToProduction pushes staging to production. The files and database
+// of production are backed up first; the push stops at the first failing
+// step.
 func (m *Manager) PushToProduction(domain string) error {
 	stagingDomain := "staging." + domain
-	stagingPath := filepath.Join(m.WebRoot, stagingDomain)
-	prodPath := filepath.Join(m.WebRoot, domain)
+	staging, err := m.Registry.Get(stagingDomain)
+	if err != nil {
+		return err
+	}
+	prod, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	stagingPath := staging.Path
+	prodPath := prod.Path
 
 	// Backup production first
-	backupPath := fmt.Sprintf("/backups/%s/pre-push_%s.tar.gz", domain, time.Now().Format("2006-01-02_15-04-05"))
-	os.MkdirAll(filepath.Dir(backupPath), 0755)
-	exec.Command("tar", "-czf", backupPath, "-C", m.WebRoot, domain).Run()
+	backupName := filepath.Join(m.BackupDir, domain, "pre-push_"+time.Now().Format("2006-01-02_15-04-05"))
+	backupPath := backupName + ".tar.gz"
+	backupSQL := backupName + ".sql"
+	if err := m.Runner.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return runner.Step("back up production", err)
+	}
+	if err := m.Runner.Run("tar", "-czf", backupPath, "-C", filepath.Dir(prodPath), filepath.Base(prodPath)); err != nil {
+		return runner.Step("back up production", err)
+	}
+	if err := m.Runner.Run("wp", "db", "export", backupSQL, "--path="+prodPath+"/public"); err != nil {
+		return runner.Step("back up production database", err)
+	}
+	backups := fmt.Sprintf("(production backup: %s, %s)", backupPath, backupSQL)
 
 	// Export staging database
-	tempSQL := "/tmp/staging_" + domain + ".sql"
-	exec.Command("wp", "db", "export", tempSQL, "--path="+stagingPath+"/public").Run()
+	tempSQL, err := m.dumpFile("staging_" + domain)
+	if err != nil {
+		return runner.Step("export staging database", err)
+	}
+	defer m.Runner.Remove(tempSQL)
+	if err := m.Runner.Run("wp", "db", "export", tempSQL, "--path="+stagingPath+"/public"); err != nil {
+		return runner.Step("export staging database", err)
+	}
 
 	// Sync files (excluding wp-config.php)
-	exec.Command("rsync", "-av", "--delete",
+	err = m.Runner.Run("rsync", "-av", "--delete",
 		"--exclude=wp-config.php",
 		"--exclude=.htaccess",
 		stagingPath+"/public/",
 		prodPath+"/public/",
-	).Run()
+	)
+	if err != nil {
+		return runner.Step("sync files", fmt.Errorf("%w %s", err, backups))
+	}
 
 	// Import database to production
-	exec.Command("wp", "db", "import", tempSQL, "--path="+prodPath+"/public").Run()
-	os.Remove(tempSQL)
+	if err := m.Runner.Run("wp", "db", "import", tempSQL, "--path="+prodPath+"/public"); err != nil {
+		return runner.Step("import database", fmt.Errorf("%w %s", err, backups))
+	}
 
 	// Search-replace URLs
-	exec.Command("wp", "search-replace",
+	err = m.Runner.Run("wp", "search-replace",
 		"https://"+stagingDomain,
 		"https://"+domain,
 		"--all-tables",
 		"--path="+prodPath+"/public",
-	).Run()
+	)
+	if err != nil {
+		return runner.Step("search-replace", fmt.Errorf("%w %s", err, backups))
+	}
 
-	// Flush caches
-	exec.Command("wp", "cache", "flush", "--path="+prodPath+"/public").Run()
+	// Flush caches, including the pages Varnish or Caddy cached before the push
+	if err := m.Runner.Run("wp", "cache", "flush", "--path="+prodPath+"/public"); err != nil {
+		return runner.Step("flush cache", err)
+	}
+	if err := m.Cache.PurgePageCache(prod.CacheSite()); err != nil {
+		return runner.Step("purge page cache", err)
+	}
 
-	return nil
+	return m.Registry.Record(domain, "pushed", "from "+stagingDomain+", backup "+backupPath+", "+backupSQL)
 }
 
-// ListDomains returns all domains with their status
+// dumpFile creates an empty file for a database dump in the state
+// directory, which only root can read. The caller removes it.
+func (m *Manager) dumpFile(name string) (string, error) {
+	if runner.IsDryRun(m.Runner) {
+		return filepath.Join(m.StateDir, name+".sql"), nil
+	}
+	if err := m.Runner.MkdirAll(m.StateDir, 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(m.StateDir, name+"_*.sql")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// ListDomains returns all registered sites with their status
 func (m *Manager) ListDomains() ([]DomainInfo, error) {
-	entries, err := os.ReadDir(m.WebRoot)
+	sites, err := m.Registry.List()
 	if err != nil {
 		return nil, err
 	}
 
 	var domains []DomainInfo
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-		
+	for _, s := range sites {
 		info := DomainInfo{
-			Domain: e.Name(),
-			Path:   filepath.Join(m.WebRoot, e.Name()),
+			Domain:     s.Domain,
+			Path:       s.Path,
+			DBName:     s.DBName,
+			UseVarnish: s.UseVarnish,
+			Aliases:    s.Aliases,
+			StagingOf:  s.StagingOf,
+			IsStaging:  s.StagingOf != "",
 		}
 		
 		// Check if WordPress is installed
@@ -149,10 +251,7 @@ func (m *Manager) ListDomains() ([]DomainInfo, error) {
 		}
 		
 		// Check SSL status
-		info.HasSSL = m.checkSSL(e.Name())
-		
-		// Check if staging
-		info.IsStaging = strings.HasPrefix(e.Name(), "staging.")
+		info.HasSSL = m.checkSSL(s.Domain)
 		
 		domains = append(domains, info)
 	}
@@ -162,64 +261,104 @@ func (m *Manager) ListDomains() ([]DomainInfo, error) {
 
 // DomainInfo contains domain information
 type DomainInfo struct {
-	Domain       string
-	Path         string
-	HasWordPress bool
-	HasSSL       bool
-	IsStaging    bool
+	Domain       string   `json:"domain"`
+	Path         string   `json:"path"`
+	HasWordPress bool     `json:"has_wordpress"`
+	HasSSL       bool     `json:"has_ssl"`
+	IsStaging    bool     `json:"is_staging"`
+	StagingOf    string   `json:"staging_of,omitempty"`
+	DBName       string   `json:"db_name"`
+	UseVarnish   bool     `json:"use_varnish"`
+	Aliases      []string `json:"aliases,omitempty"`
 }
 
 // checkSSL checks if domain has valid SSL
 func (m *Manager) checkSSL(domain string) bool {
-	err := exec.Command("curl", "-s", "-o", "/dev/null", "-w", "%{http_code}", 
-		"--connect-timeout", "5", "https://"+domain).Run()
+	err := m.Runner.Run("curl", "-s", "-o", "/dev/null", "-w", "%{http_code}", 
+		"--connect-timeout", "5", "https://"+domain)
 	return err == nil
 }
 
-// AddDomain adds a new domain (alias) to existing site
+// AddDomain adds a new domain (alias) to existing site. The alias is served
+// by the site's own Caddy config.
 func (m *Manager) AddDomain(siteDomain, newDomain string) error {
-	sitePath := filepath.Join(m.WebRoot, siteDomain)
-	
-	// Create symlink
-	linkPath := filepath.Join(m.WebRoot, newDomain)
-	if err := os.Symlink(sitePath, linkPath); err != nil {
-		return fmt.Errorf("failed to create symlink: %w", err)
+	if err := config.CheckDomain(newDomain); err != nil {
+		return err
 	}
-	
-	// Generate Caddy config
-	m.CaddyConf.AddSite(newDomain, true)
-	
-	// Reload Caddy
-	exec.Command("systemctl", "reload", "caddy").Run()
-	
-	return nil
+	s, err := m.Registry.Get(siteDomain)
+	if err != nil {
+		return err
+	}
+	if err := m.checkNew(newDomain, filepath.Join(m.WebRoot, newDomain)); err != nil {
+		return err
+	}
+	s.Aliases = append(s.Aliases, newDomain)
+	return m.updateAliases(s, "alias added", newDomain)
 }
 
-// RemoveDomain removes a domain alias
+// RemoveDomain removes a domain alias, or the site itself if domain is not
+// an alias
 func (m *Manager) RemoveDomain(domain string) error {
-	linkPath := filepath.Join(m.WebRoot, domain)
-	
-	// Check if it's a symlink (alias) or real site
-	fi, err := os.Lstat(linkPath)
-	if err != nil {
+	s, err := m.Registry.Get(domain)
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
 		return err
 	}
-	
-	if fi.Mode()&os.ModeSymlink != 0 {
-		// It's a symlink, safe to remove
-		os.Remove(linkPath)
-	} else {
-		// It's a real directory, delete completely
-		os.RemoveAll(linkPath)
+	if err == nil && s.Domain != domain {
+		// Older versions gave aliases a symlink to the site directory
+		linkPath := filepath.Join(m.WebRoot, domain)
+		if fi, err := os.Lstat(linkPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := m.Runner.Remove(linkPath); err != nil {
+				return err
+			}
+		}
+
+		s.Aliases = removeString(s.Aliases, domain)
+		return m.updateAliases(s, "alias removed", domain)
+	}
+
+	var errs runner.Errors
+	if s != nil {
+		errs.Add("remove site directory", m.Runner.RemoveAll(s.Path))
 	}
 	
 	// Remove Caddy config
-	os.Remove(filepath.Join("/etc/caddy/sites", domain+".conf"))
-	
-	// Reload Caddy
-	exec.Command("systemctl", "reload", "caddy").Run()
-	
-	return nil
+	errs.Add("remove Caddy config", m.CaddyConf.RemoveSite(domain))
+	if s != nil && s.UseVarnish {
+		errs.Add("update Varnish config", m.removeFromVCL(domain))
+	}
+	if s != nil {
+		errs.Add("flush object cache", m.flushObjectCache(s))
+	}
+	if err := errs.Err(); err != nil {
+		// The site stays registered so the removal can be retried
+		return err
+	}
+	return m.unregister(domain)
+}
+
+// updateAliases regenerates the Varnish and Caddy configs of s after its
+// aliases changed and saves them to the registry
+func (m *Manager) updateAliases(s *Site, action, alias string) error {
+	data, err := m.CaddyConf.RenderSite(caddySiteConfig(s))
+	if err != nil {
+		return err
+	}
+	// Older versions gave aliases their own Caddy config, which would clash
+	// with the site's. Both are replaced in one reload.
+	sites := map[string][]byte{s.Domain: data, alias: nil}
+	if s.UseVarnish {
+		if err := m.applyVCL(s); err != nil {
+			return runner.Step("update Varnish config", err)
+		}
+	}
+	if err := m.CaddyConf.Apply(sites); err != nil {
+		return runner.Step("update Caddy config", err)
+	}
+	return m.Registry.Update(s.Domain, func(r *Site) error {
+		r.Aliases = s.Aliases
+		r.record(action, alias)
+		return nil
+	})
 }
 
 // SetMaintenanceMode enables/disables maintenance mode
@@ -228,15 +367,18 @@ func (m *Manager) SetMaintenanceMode(domain string, enabled bool) error {
 	
 	if enabled {
 		content := `<?php $upgrading = time(); ?>`
-		return os.WriteFile(maintenanceFile, []byte(content), 0644)
+		return m.Runner.WriteFile(maintenanceFile, []byte(content), 0644)
 	}
 	
-	return os.Remove(maintenanceFile)
+	return m.Runner.Remove(maintenanceFile)
 }
 
-func replaceConfigValue(content, key, value string) string {
-	// Replace define('KEY', 'old_value') with define('KEY', 'new_value')
-	pattern := fmt.Sprintf(`define\s*\(\s*'%s'\s*,\s*'[^']*'\s*\)`, key)
-	replacement := fmt.Sprintf("define('%s', '%s')", key, value)
-	return strings.ReplaceAll(content, pattern, replacement)
+func removeString(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
 }
@@ -0,0 +1,89 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/secrets"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// Secrets returns the decrypted secrets of a registered site
+func (m *Manager) Secrets(domain string) (map[string]string, error) {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return nil, err
+	}
+	return m.Vault.List(s.Domain)
+}
+
+// RotateDBPassword gives the site's database user a new random password.
+// The password is changed in MariaDB, written to wp-config.php and checked by
+// loading WordPress through WP-CLI. If any step fails, the old password is
+// restored everywhere.
+func (m *Manager) RotateDBPassword(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+
+	// wp-config.php is what the site actually uses; the vault is a fallback
+	oldPass := ""
+	if f, err := readWPConfig(s.Path); err == nil {
+		oldPass, _ = f.Get("DB_PASSWORD")
+	}
+	if oldPass == "" {
+		oldPass, err = m.Vault.Get(s.Domain, secrets.DBPassword)
+		if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+			return err
+		}
+	}
+	if oldPass == "" && !runner.IsDryRun(m.Runner) {
+		return fmt.Errorf("current database password of %s is unknown; it is needed to roll back a failed rotation", s.Domain)
+	}
+
+	newPass, err := secrets.GeneratePassword(passwordLength)
+	if err != nil {
+		return err
+	}
+	alterUser := func(password string) error {
+		return m.mysql(fmt.Sprintf("ALTER USER '%s'@'localhost' IDENTIFIED BY '%s';", s.DBUser, password))
+	}
+
+	var originalConfig []byte
+	steps := []step{
+		{
+			name: "change database password",
+			do:   func() error { return alterUser(newPass) },
+			undo: func() error { return alterUser(oldPass) },
+		},
+		{
+			name: "update wp-config.php",
+			do: func() error {
+				var err error
+				originalConfig, err = m.editWPConfig(s.Path, func(f *wpconfig.File) error {
+					return f.Set("DB_PASSWORD", newPass)
+				})
+				return err
+			},
+			undo: func() error { return m.writeWPConfig(s.Path, originalConfig) },
+		},
+		{
+			name: "verify database connection",
+			do: func() error {
+				return m.Runner.Run("wp", "option", "get", "siteurl",
+					"--skip-plugins", "--skip-themes", "--path="+filepath.Join(s.Path, "public"))
+			},
+		},
+		{
+			name: "store password",
+			do:   func() error { return m.Vault.Set(s.Domain, secrets.DBPassword, newPass) },
+		},
+	}
+	if err := m.runSteps(steps); err != nil {
+		return err
+	}
+	return m.Registry.Record(s.Domain, "rotated", secrets.DBPassword)
+}
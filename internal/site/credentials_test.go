@@ -0,0 +1,86 @@
+package site
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/secrets"
+)
+
+// newRotateSite registers a site whose wp-config.php has oldPass
+func newRotateSite(t *testing.T, m *testManager, oldPass string) *Site {
+	t.Helper()
+	s := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com"), DBName: "example_com_db", DBUser: "example_com_user"}
+	if err := os.MkdirAll(filepath.Join(s.Path, "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "<?php\ndefine( 'DB_PASSWORD', '" + oldPass + "' ); // keep\n"
+	if err := os.WriteFile(wpConfigPath(s.Path), []byte(config), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Registry.Put(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Vault.Set(s.Domain, secrets.DBPassword, oldPass); err != nil {
+		t.Fatal(err)
+	}
+	m.fake.Calls = nil
+	return s
+}
+
+func TestRotateDBPassword(t *testing.T) {
+	m := newTestManager(t)
+	s := newRotateSite(t, m, "old-pass")
+	if err := m.RotateDBPassword("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	newPass, err := m.Vault.Get("example.com", secrets.DBPassword)
+	if err != nil || newPass == "old-pass" || len(newPass) != passwordLength {
+		t.Fatalf("stored password = %q, %v", newPass, err)
+	}
+	m.checkSQL(t, "ALTER USER 'example_com_user'@'localhost' IDENTIFIED BY '"+newPass+"';")
+	f, err := readWPConfig(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Get("DB_PASSWORD"); got != newPass {
+		t.Errorf("DB_PASSWORD = %q, want the new password", got)
+	}
+	if !strings.Contains(string(f.Bytes()), "// keep") {
+		t.Errorf("comment lost:\n%s", f.Bytes())
+	}
+	for _, call := range m.fake.Calls {
+		if strings.Contains(call, newPass) || strings.Contains(call, "old-pass") {
+			t.Errorf("password on the command line: %s", call)
+		}
+	}
+	registered, _ := m.Registry.Get("example.com")
+	if h := registered.History; len(h) == 0 || h[len(h)-1].Action != "rotated" {
+		t.Errorf("history = %+v", h)
+	}
+}
+
+func TestRotateDBPasswordRollback(t *testing.T) {
+	m := newTestManager(t)
+	s := newRotateSite(t, m, "old-pass")
+	original, _ := os.ReadFile(wpConfigPath(s.Path))
+	m.fake.On("wp option get siteurl", "", errors.New("exit status 1"))
+
+	err := m.RotateDBPassword("example.com")
+	if err == nil || !strings.HasPrefix(err.Error(), "verify database connection: ") {
+		t.Fatalf("RotateDBPassword error = %v", err)
+	}
+	if len(m.sql) != 2 || !strings.Contains(m.sql[1], "IDENTIFIED BY 'old-pass';") {
+		t.Errorf("mysql input = %q, want the old password restored", m.sql)
+	}
+	if data, _ := os.ReadFile(wpConfigPath(s.Path)); string(data) != string(original) {
+		t.Errorf("wp-config.php not restored:\n%s", data)
+	}
+	if got, _ := m.Vault.Get("example.com", secrets.DBPassword); got != "old-pass" {
+		t.Errorf("stored password = %q, want old-pass", got)
+	}
+}
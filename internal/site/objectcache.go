@@ -0,0 +1,43 @@
+package site
+
+import (
+	"fmt"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// IsolateObjectCache gives a site that shares database 0 without a key
+// prefix, e.g. one created before isolation, an object cache of its own and
+// points its wp-config.php at it. Its old keys stay in database 0, since they
+// cannot be told apart from other sites'; they are no longer read.
+func (m *Manager) IsolateObjectCache(domain string) (config.ObjectCache, error) {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return config.ObjectCache{}, err
+	}
+	if !s.ObjectCache.Shared() {
+		return config.ObjectCache{}, fmt.Errorf("site %s already has an object cache of its own (database %d, prefix %q)", s.Domain, s.ObjectCache.Database, s.ObjectCache.Prefix)
+	}
+
+	oc, err := m.Registry.IsolateObjectCache(s.Domain, m.RedisDatabases)
+	if err != nil {
+		return config.ObjectCache{}, err
+	}
+	_, err = m.editWPConfig(s.Path, func(f *wpconfig.File) error {
+		return f.SetAll(m.WPConf.ForSite(oc).ObjectCacheConstants())
+	})
+	if err != nil {
+		// Keep the registry in line with wp-config.php
+		restore := m.Registry.Update(s.Domain, func(r *Site) error {
+			r.ObjectCache = s.ObjectCache
+			return nil
+		})
+		if restore != nil {
+			return config.ObjectCache{}, fmt.Errorf("%w; restoring the registry failed: %w", runner.Step("update wp-config.php", err), restore)
+		}
+		return config.ObjectCache{}, runner.Step("update wp-config.php", err)
+	}
+	return oc, m.Registry.Record(s.Domain, "object cache isolated", fmt.Sprintf("database %d, prefix %s", oc.Database, oc.Prefix))
+}
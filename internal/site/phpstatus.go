@@ -0,0 +1,119 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/maxaatest/ironstack/internal/phpstatus"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/secrets"
+)
+
+// statusTokenLength is the length of the token IronStack authenticates with
+// at a site's PHP status script
+const statusTokenLength = 32
+
+// statusScript returns the PHP status script of a site directory. It is
+// outside the document root, so the site itself never serves it.
+func statusScript(sitePath string) string {
+	return filepath.Join(sitePath, "status", phpstatus.ScriptFile)
+}
+
+// phpStatusStep installs the PHP status script with a new token. Clones get
+// their own token instead of the copied one.
+func (m *Manager) phpStatusStep(s *Site) step {
+	return step{
+		name: "install PHP status script",
+		do:   func() error { return m.installStatusScript(s) },
+		undo: func() error { return m.Runner.RemoveAll(filepath.Dir(statusScript(s.Path))) },
+	}
+}
+
+// installStatusScript gives a site a new status token and writes the status
+// script. It is readable by the web server only, since it holds the token.
+func (m *Manager) installStatusScript(s *Site) error {
+	token, err := secrets.GeneratePassword(statusTokenLength)
+	if err != nil {
+		return err
+	}
+	if err := m.Vault.Set(s.Domain, secrets.StatusToken, token); err != nil {
+		return err
+	}
+	path := statusScript(s.Path)
+	if err := m.Runner.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return m.Runner.WriteFile(path, phpstatus.Script(token), 0640)
+}
+
+// EnablePHPStatus installs or replaces the PHP status script of a
+// registered site, e.g. one added with Import, and serves it
+func (m *Manager) EnablePHPStatus(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	if err := m.installStatusScript(s); err != nil {
+		return err
+	}
+	if err := m.Runner.Run("chown", "-R", "www-data:www-data", filepath.Dir(statusScript(s.Path))); err != nil {
+		return err
+	}
+	if err := m.writeCaddyConfig(s); err != nil {
+		return runner.Step("update Caddy config", err)
+	}
+	return m.Registry.Record(domain, "php status", "enabled")
+}
+
+// statusToken returns the token of a site's status script
+func (m *Manager) statusToken(domain string) (string, error) {
+	token, err := m.Vault.Get(domain, secrets.StatusToken)
+	if errors.Is(err, secrets.ErrNotFound) {
+		return "", fmt.Errorf("site %s has no PHP status script; run 'ironstack php enable %s'", domain, domain)
+	}
+	return token, err
+}
+
+// PHPStatus returns the status of the PHP processes serving a registered
+// site, including their OPcache and realpath cache
+func (m *Manager) PHPStatus(domain string) (*phpstatus.Status, error) {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return nil, err
+	}
+	token, err := m.statusToken(s.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return m.Cache.PHP.Status(s.Domain, token)
+}
+
+// PurgeCaches purges every cache of a registered site: its pages, its
+// object cache and the OPcache of the PHP processes serving it
+func (m *Manager) PurgeCaches(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	cs := s.CacheSite()
+	cs.StatusToken, err = m.Vault.Get(s.Domain, secrets.StatusToken)
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		return err
+	}
+	return m.Cache.PurgeAll(cs, s.ObjectCache)
+}
+
+// ResetPHPCache clears phpstatus.ResetOPcache or phpstatus.ResetRealpath
+// in the PHP processes serving a registered site
+func (m *Manager) ResetPHPCache(domain, cache string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	token, err := m.statusToken(s.Domain)
+	if err != nil {
+		return err
+	}
+	return m.Cache.PHP.Reset(s.Domain, token, cache)
+}
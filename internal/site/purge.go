@@ -0,0 +1,124 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/cache"
+	"github.com/maxaatest/ironstack/internal/purge"
+	"github.com/maxaatest/ironstack/internal/secrets"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// purgeTokenLength is the length of the token the mu-plugin authenticates with
+const purgeTokenLength = 32
+
+// pluginPath returns the purge mu-plugin of a site directory
+func pluginPath(sitePath string) string {
+	return filepath.Join(sitePath, "public", "wp-content", "mu-plugins", purge.PluginFile)
+}
+
+// autoPurgeStep installs the purge mu-plugin. Sites without a page cache
+// have nothing to purge and are skipped.
+func (m *Manager) autoPurgeStep(s *Site) step {
+	return step{
+		name: "install purge plugin",
+		do: func() error {
+			if s.PageCache() == cache.BackendNone {
+				return nil
+			}
+			return m.installPurgePlugin(s)
+		},
+		undo: func() error {
+			if s.PageCache() == cache.BackendNone {
+				return nil
+			}
+			return m.Runner.Remove(pluginPath(s.Path))
+		},
+	}
+}
+
+// installPurgePlugin gives a site a new purge token and writes the
+// mu-plugin and its wp-config.php constants
+func (m *Manager) installPurgePlugin(s *Site) error {
+	token, err := secrets.GeneratePassword(purgeTokenLength)
+	if err != nil {
+		return err
+	}
+	if err := m.Vault.Set(s.Domain, secrets.PurgeToken, token); err != nil {
+		return err
+	}
+	path := pluginPath(s.Path)
+	if err := m.Runner.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := m.Runner.WriteFile(path, []byte(purge.Plugin), 0644); err != nil {
+		return err
+	}
+	_, err = m.editWPConfig(s.Path, func(f *wpconfig.File) error {
+		return f.SetAll(purge.Constants(m.PurgePort, token, s.PageCache()))
+	})
+	return err
+}
+
+// EnableAutoPurge installs or updates the purge mu-plugin of a registered
+// site, e.g. one added with Import or one whose page cache changed
+func (m *Manager) EnableAutoPurge(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	if s.PageCache() == cache.BackendNone {
+		return fmt.Errorf("site %s has no page cache", domain)
+	}
+	if err := m.installPurgePlugin(s); err != nil {
+		return err
+	}
+	return m.Registry.Record(domain, "autopurge", "enabled")
+}
+
+// DisableAutoPurge removes the purge mu-plugin of a registered site
+func (m *Manager) DisableAutoPurge(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	if err := m.Runner.Remove(pluginPath(s.Path)); err != nil {
+		return err
+	}
+	return m.Registry.Record(domain, "autopurge", "disabled")
+}
+
+// PurgeSite returns the purge endpoint's view of the site serving host
+func (m *Manager) PurgeSite(host string) (*purge.Site, error) {
+	sites, err := m.Registry.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sites {
+		page := s.CacheSite()
+		if page.Backend == cache.BackendNone || !containsFold(page.Hosts, host) {
+			continue
+		}
+		token, err := m.Vault.Get(s.Domain, secrets.PurgeToken)
+		if errors.Is(err, secrets.ErrNotFound) {
+			return nil, purge.ErrUnknownSite
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &purge.Site{Site: page, Token: token}, nil
+	}
+	return nil, purge.ErrUnknownSite
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package site
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// registryVersion is the format version of sites.json
+const registryVersion = 1
+
+// ErrNotRegistered is returned when a domain is not in the registry
+var ErrNotRegistered = errors.New("site not registered")
+
+// HistoryEntry records one operation performed on a site
+type HistoryEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Registry stores the metadata of every site in a JSON file under the
+// state directory. It is the source of truth for which sites exist.
+type Registry struct {
+	Path   string
+	Runner runner.Runner
+
+	mu sync.Mutex
+}
+
+// registryFile is the on-disk layout of sites.json
+type registryFile struct {
+	Version int     `json:"version"`
+	Sites   []*Site `json:"sites"`
+}
+
+// NewRegistry creates a registry stored in stateDir/sites.json
+func NewRegistry(stateDir string, r runner.Runner) *Registry {
+	return &Registry{Path: filepath.Join(stateDir, "sites.json"), Runner: r}
+}
+
+// List returns all registered sites sorted by domain
+func (r *Registry) List() ([]*Site, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sites, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Site, 0, len(sites))
+	for _, s := range sites {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list, nil
+}
+
+// Get returns the site serving domain, either as its primary domain or as
+// an alias
+func (r *Registry) Get(domain string) (*Site, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sites, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := sites[domain]; ok {
+		return s, nil
+	}
+	for _, s := range sites {
+		for _, alias := range s.Aliases {
+			if alias == domain {
+				return s, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", domain, ErrNotRegistered)
+}
+
+// Put adds or replaces a site
+func (r *Registry) Put(s *Site) error {
+	return r.update(func(sites map[string]*Site) error {
+		sites[s.Domain] = s
+		return nil
+	})
+}
+
+// Remove deletes a site from the registry
+func (r *Registry) Remove(domain string) error {
+	return r.update(func(sites map[string]*Site) error {
+		delete(sites, domain)
+		return nil
+	})
+}
+
+// Update loads a registered site, applies fn to it and saves the result
+func (r *Registry) Update(domain string, fn func(s *Site) error) error {
+	return r.update(func(sites map[string]*Site) error {
+		s, ok := sites[domain]
+		if !ok {
+			return fmt.Errorf("%s: %w", domain, ErrNotRegistered)
+		}
+		return fn(s)
+	})
+}
+
+// Record appends an entry to a site's history
+func (r *Registry) Record(domain, action, detail string) error {
+	return r.Update(domain, func(s *Site) error {
+		s.record(action, detail)
+		return nil
+	})
+}
+
+func (r *Registry) update(fn func(sites map[string]*Site) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unlock, err := r.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sites, err := r.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(sites); err != nil {
+		return err
+	}
+	return r.save(sites)
+}
+
+// lockFile takes an exclusive lock on sites.json.lock, so read-modify-write
+// updates of concurrent ironstack processes do not overwrite each other.
+// Dry runs never change the registry and take no lock.
+func (r *Registry) lockFile() (unlock func(), err error) {
+	if runner.IsDryRun(r.Runner) {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(r.Path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock site registry: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock site registry: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (r *Registry) load() (map[string]*Site, error) {
+	sites := make(map[string]*Site)
+	data, err := os.ReadFile(r.Path)
+	if os.IsNotExist(err) {
+		return sites, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read site registry: %w", err)
+	}
+
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.Path, err)
+	}
+	if file.Version > registryVersion {
+		return nil, fmt.Errorf("%s: unsupported registry version %d", r.Path, file.Version)
+	}
+	for _, s := range file.Sites {
+		sites[s.Domain] = s
+	}
+	return sites, nil
+}
+
+// save writes the registry to a temporary file and renames it into place
+// so a crash never leaves a truncated registry
+func (r *Registry) save(sites map[string]*Site) error {
+	file := registryFile{Version: registryVersion, Sites: make([]*Site, 0, len(sites))}
+	for _, s := range sites {
+		file.Sites = append(file.Sites, s)
+	}
+	sort.Slice(file.Sites, func(i, j int) bool { return file.Sites[i].Domain < file.Sites[j].Domain })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := r.Runner.MkdirAll(filepath.Dir(r.Path), 0700); err != nil {
+		return err
+	}
+	tmp := r.Path + ".tmp"
+	if err := r.Runner.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return r.Runner.Rename(tmp, r.Path)
+}
+
+// Reserve registers a new site and gives it an object cache in one locked
+// update, so concurrent creates never pick the same database. It fails if
+// the domain is already registered. The entry is completed with Put once
+// the site is set up.
+func (r *Registry) Reserve(s *Site, databases int) error {
+	return r.update(func(sites map[string]*Site) error {
+		if _, ok := sites[s.Domain]; ok {
+			return fmt.Errorf("site %s is already registered", s.Domain)
+		}
+		s.ObjectCache = allocateObjectCache(sites, s.Domain, databases)
+		sites[s.Domain] = s
+		return nil
+	})
+}
+
+// IsolateObjectCache gives a registered site an object cache location of
+// its own, allocated like Reserve does for new sites, and returns it
+func (r *Registry) IsolateObjectCache(domain string, databases int) (config.ObjectCache, error) {
+	var oc config.ObjectCache
+	err := r.update(func(sites map[string]*Site) error {
+		s, ok := sites[domain]
+		if !ok {
+			return fmt.Errorf("%s: %w", domain, ErrNotRegistered)
+		}
+		oc = allocateObjectCache(sites, domain, databases)
+		s.ObjectCache = oc
+		return nil
+	})
+	return oc, err
+}
+
+// allocateObjectCache picks the object cache location of domain: the lowest
+// database above 0 no other site uses, or database 0 once all databases are
+// taken. The key prefix is unique either way.
+func allocateObjectCache(sites map[string]*Site, domain string, databases int) config.ObjectCache {
+	usedDBs := make(map[int]bool)
+	usedPrefixes := make(map[string]bool)
+	for _, s := range sites {
+		if s.Domain == domain {
+			continue
+		}
+		usedDBs[s.ObjectCache.Database] = true
+		usedPrefixes[s.ObjectCache.Prefix] = true
+	}
+
+	var oc config.ObjectCache
+	for db := 1; db < databases; db++ {
+		if !usedDBs[db] {
+			oc.Database = db
+			break
+		}
+	}
+	base := sanitizeName(domain)
+	oc.Prefix = base + ":"
+	for i := 2; usedPrefixes[oc.Prefix]; i++ {
+		oc.Prefix = fmt.Sprintf("%s_%d:", base, i)
+	}
+	return oc
+}
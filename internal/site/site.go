@@ -1,175 +1,513 @@
 package site
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/maxaatest/ironstack/internal/cache"
 	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/secrets"
 )
 
-// Site represents a WordPress site
+// passwordLength is the length of generated database passwords
+const passwordLength = 24
+
+// Site represents a WordPress site. It is stored in the Registry.
 type Site struct {
-	Domain      string
-	Path        string
-	DBName      string
-	DBUser      string
-	DBPass      string
-	EnableSSL   bool
-	UseVarnish  bool
+	Domain      string             `json:"domain"`
+	Path        string             `json:"path"`
+	DBName      string             `json:"db_name"`
+	DBUser      string             `json:"db_user"`
+	DBPass      string             `json:"-"` // only known right after creation; never written to the registry
+	EnableSSL   bool               `json:"enable_ssl"`
+	UseVarnish  bool               `json:"use_varnish"`
+	Aliases     []string           `json:"aliases,omitempty"`
+	StagingOf   string             `json:"staging_of,omitempty"` // production domain of a staging site
+	PHP         PHPSettings        `json:"php"`
+	Caddy       config.SiteOptions `json:"caddy"`
+	Varnish     config.VCLOptions  `json:"varnish"`
+	ObjectCache config.ObjectCache `json:"object_cache"`
+	Created     time.Time          `json:"created"`
+	History     []HistoryEntry     `json:"history,omitempty"`
+}
+
+// PHPSettings contains per-site PHP limits
+type PHPSettings struct {
+	MemoryLimit      string `json:"memory_limit"`
+	UploadMaxSize    string `json:"upload_max_size"`
+	MaxExecutionTime int    `json:"max_execution_time"`
+}
+
+// DefaultPHPSettings returns the PHP limits new sites start with
+func DefaultPHPSettings() PHPSettings {
+	return PHPSettings{MemoryLimit: "256M", UploadMaxSize: "64M", MaxExecutionTime: 300}
+}
+
+// PageCache returns the full-page cache the site is served through
+func (s *Site) PageCache() cache.Backend {
+	switch {
+	case s.UseVarnish:
+		return cache.BackendVarnish
+	case s.Caddy.PageCache != nil:
+		return cache.BackendCaddy
+	}
+	return cache.BackendNone
+}
+
+// CacheSite returns the site as the page cache purge methods see it
+func (s *Site) CacheSite() cache.Site {
+	return cache.Site{
+		Domain:  s.Domain,
+		Hosts:   append([]string{s.Domain}, s.Aliases...),
+		Backend: s.PageCache(),
+	}
+}
+
+// record appends an entry to the site's history
+func (s *Site) record(action, detail string) {
+	s.History = append(s.History, HistoryEntry{Time: time.Now().UTC(), Action: action, Detail: detail})
 }
 
 // Manager handles site operations
 type Manager struct {
-	WebRoot   string
-	CaddyConf *config.Caddy
+	WebRoot     string
+	BackupDir   string
+	StateDir    string
+	DB          config.DatabaseSettings
+	CaddyConf   *config.Caddy
+	VarnishConf *config.Varnish
+	WPConf      *config.WordPress
+	Registry    *Registry
+	Vault       *secrets.Vault
+	Cache       *cache.Manager
+	Runner      runner.Runner
+
+	// RedisDatabases is the number of DragonflyDB databases available for
+	// per-site object caches
+	RedisDatabases int
+
+	// PurgePort is the port of the purge endpoint the mu-plugin notifies
+	PurgePort int
+
+	// KeepOnFailure leaves the artefacts of a failed Create or Clone in
+	// place for debugging instead of rolling them back
+	KeepOnFailure bool
+
+	// KeepDatabase makes Delete leave the site's database and user in place
+	KeepDatabase bool
 }
 
 // NewManager creates a new site manager
-func NewManager() *Manager {
+func NewManager(cfg *config.Settings, r runner.Runner) *Manager {
 	return &Manager{
-		WebRoot:   "/var/www",
-		CaddyConf: config.NewCaddy(),
+		WebRoot:     cfg.WebRoot,
+		BackupDir:   cfg.BackupDir,
+		StateDir:    cfg.StateDir,
+		DB:          cfg.Database,
+		CaddyConf:   config.NewCaddy(cfg, r),
+		VarnishConf: config.NewVarnish(cfg, r),
+		WPConf:      config.NewWordPress(cfg),
+		Registry:    NewRegistry(cfg.StateDir, r),
+		Vault:       secrets.New(cfg, r),
+		Cache:       cache.New(cfg, r),
+		Runner:      r,
+
+		RedisDatabases: cfg.Redis.Databases,
+		PurgePort:      cfg.Ports.Purge,
 	}
 }
 
-// Create sets up a new WordPress site
+// Create sets up a new WordPress site. If a step fails, everything created
+// so far is removed again unless KeepOnFailure is set.
 func (m *Manager) Create(s *Site) error {
-	s.Path = filepath.Join(m.WebRoot, s.Domain)
-	
-	// Create directory structure
-	dirs := []string{
-		s.Path,
-		filepath.Join(s.Path, "public"),
-		filepath.Join(s.Path, "logs"),
-		filepath.Join(s.Path, "backups"),
+	if err := config.CheckDomain(s.Domain); err != nil {
+		return err
 	}
-	
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", dir, err)
-		}
+	s.Path = filepath.Join(m.WebRoot, s.Domain)
+	if err := m.checkNew(s.Domain, s.Path); err != nil {
+		return err
 	}
-	
-	// Create database
-	dbPass, err := m.createDatabase(s)
-	if err != nil {
-		return fmt.Errorf("failed to create database: %w", err)
+	if s.PHP == (PHPSettings{}) {
+		s.PHP = DefaultPHPSettings()
 	}
-	s.DBPass = dbPass
-	
-	// Download WordPress
-	if err := m.downloadWordPress(s); err != nil {
-		return fmt.Errorf("failed to download WordPress: %w", err)
+	s.Created = time.Now().UTC()
+	s.record("created", "")
+
+	steps := []step{
+		m.reserveStep(s),
+		m.createDirsStep(s),
+		m.createDatabaseStep(s),
+		m.createDatabaseUserStep(s),
+		{name: "download WordPress", do: func() error { return m.downloadWordPress(s) }},
+		{name: "create wp-config.php", do: func() error { return m.createConfig(s) }},
+		m.autoPurgeStep(s),
+		m.phpStatusStep(s),
+		m.varnishConfigStep(s),
+		m.caddyConfigStep(s),
+		{name: "set permissions", do: func() error {
+			return m.Runner.Run("chown", "-R", "www-data:www-data", s.Path)
+		}},
+		m.registerStep(s),
 	}
-	
-	// Create wp-config.php
-	if err := m.createConfig(s); err != nil {
-		return fmt.Errorf("failed to create wp-config: %w", err)
+	return m.runSteps(steps)
+}
+
+// checkNew refuses to touch an existing site, since rolling back a failed
+// operation would delete it
+func (m *Manager) checkNew(domain, path string) error {
+	if _, err := m.Registry.Get(domain); err == nil {
+		return fmt.Errorf("site %s is already registered", domain)
+	} else if !errors.Is(err, ErrNotRegistered) {
+		return err
 	}
-	
-	// Generate Caddy config
-	if err := m.CaddyConf.AddSite(s.Domain, s.UseVarnish); err != nil {
-		return fmt.Errorf("failed to create Caddy config: %w", err)
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
 	}
-	
-	// Reload Caddy
-	exec.Command("systemctl", "reload", "caddy").Run()
-	
-	// Set permissions
-	exec.Command("chown", "-R", "www-data:www-data", s.Path).Run()
-	
 	return nil
 }
 
-func (m *Manager) createDatabase(s *Site) (string, error) {
+// reserveStep registers a new site and allocates its object cache before
+// anything else is created. A concurrent create of the same domain fails
+// here without touching the other one's files.
+func (m *Manager) reserveStep(s *Site) step {
+	return step{
+		name: "reserve site",
+		do:   func() error { return m.Registry.Reserve(s, m.RedisDatabases) },
+		undo: func() error { return m.Registry.Remove(s.Domain) },
+	}
+}
+
+// registerStep saves the completed registry entry of a new site
+func (m *Manager) registerStep(s *Site) step {
+	return step{
+		name: "register site",
+		do:   func() error { return m.Registry.Put(s) },
+	}
+}
+
+func (m *Manager) createDirsStep(s *Site) step {
+	return step{
+		name: "create directories",
+		do: func() error {
+			dirs := []string{
+				s.Path,
+				filepath.Join(s.Path, "public"),
+				filepath.Join(s.Path, "logs"),
+				filepath.Join(s.Path, "backups"),
+			}
+			for _, dir := range dirs {
+				if err := m.Runner.MkdirAll(dir, 0755); err != nil {
+					m.Runner.RemoveAll(s.Path)
+					return err
+				}
+			}
+			return nil
+		},
+		undo: func() error { return m.Runner.RemoveAll(s.Path) },
+	}
+}
+
+// createDatabaseStep creates the site database. CREATE DATABASE fails if
+// it already exists, so rollback never drops a database it did not create.
+func (m *Manager) createDatabaseStep(s *Site) step {
 	s.DBName = sanitizeName(s.Domain) + "_db"
+	return step{
+		name: "create database",
+		do:   func() error { return m.mysql(fmt.Sprintf("CREATE DATABASE %s;", s.DBName)) },
+		undo: func() error { return m.mysql(fmt.Sprintf("DROP DATABASE IF EXISTS %s;", s.DBName)) },
+	}
+}
+
+// createDatabaseUserStep creates the site's database user with a random
+// password and stores the password in the vault
+func (m *Manager) createDatabaseUserStep(s *Site) step {
 	s.DBUser = sanitizeName(s.Domain) + "_user"
-	password := generatePassword()
-	
-	sql := fmt.Sprintf(`
-		CREATE DATABASE IF NOT EXISTS %s;
-		CREATE USER IF NOT EXISTS '%s'@'localhost' IDENTIFIED BY '%s';
+	return step{
+		name: "create database user",
+		do: func() error {
+			password, err := secrets.GeneratePassword(passwordLength)
+			if err != nil {
+				return err
+			}
+			s.DBPass = password
+			err = m.mysql(fmt.Sprintf(`
+		CREATE USER '%s'@'localhost' IDENTIFIED BY '%s';
 		GRANT ALL PRIVILEGES ON %s.* TO '%s'@'localhost';
 		FLUSH PRIVILEGES;
-	`, s.DBName, s.DBUser, password, s.DBName, s.DBUser)
-	
-	cmd := exec.Command("mysql", "-e", sql)
-	if err := cmd.Run(); err != nil {
-		return "", err
+	`, s.DBUser, s.DBPass, s.DBName, s.DBUser))
+			if err != nil {
+				return err
+			}
+			if err := m.Vault.Set(s.Domain, secrets.DBPassword, s.DBPass); err != nil {
+				m.mysql(fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost';", s.DBUser))
+				return err
+			}
+			return nil
+		},
+		undo: func() error {
+			var errs runner.Errors
+			errs.Add("drop user", m.mysql(fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost';", s.DBUser)))
+			errs.Add("delete secrets", m.Vault.Delete(s.Domain))
+			return errs.Err()
+		},
 	}
-	
-	return password, nil
+}
+
+// caddyConfigStep installs the Caddy site config and reloads Caddy. Undoing
+// it removes the config again.
+func (m *Manager) caddyConfigStep(s *Site) step {
+	return step{
+		name: "install Caddy config",
+		do:   func() error { return m.writeCaddyConfig(s) },
+		undo: func() error { return m.CaddyConf.RemoveSite(s.Domain) },
+	}
+}
+
+// caddySiteConfig returns the Caddy template input of a site
+func caddySiteConfig(s *Site) *config.SiteConfig {
+	return &config.SiteConfig{
+		Domain:      s.Domain,
+		Aliases:     s.Aliases,
+		Root:        filepath.Join(s.Path, "public"),
+		UseVarnish:  s.UseVarnish,
+		SiteOptions: s.Caddy,
+
+		// Caddy's page cache is bypassed like Varnish
+		BypassPaths:   s.Varnish.BypassPaths,
+		BypassCookies: s.Varnish.BypassCookies,
+
+		StatusScript: statusScript(s.Path),
+	}
+}
+
+// writeCaddyConfig generates the Caddy config of a site from its registry
+// entry and applies it
+func (m *Manager) writeCaddyConfig(s *Site) error {
+	return m.CaddyConf.AddSite(caddySiteConfig(s))
+}
+
+// CaddyConfig renders the Caddy config of a registered site
+func (m *Manager) CaddyConfig(domain string) ([]byte, error) {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return nil, err
+	}
+	return m.CaddyConf.RenderSite(caddySiteConfig(s))
+}
+
+// UpdateCaddyConfig regenerates the Caddy config of a registered site, e.g.
+// after its options were changed in the registry, and reloads Caddy
+func (m *Manager) UpdateCaddyConfig(domain string) error {
+	s, err := m.Registry.Get(domain)
+	if err != nil {
+		return err
+	}
+	return m.writeCaddyConfig(s)
+}
+
+// mysql runs SQL as the configured MariaDB administrative user. The SQL is
+// passed on standard input since it may contain passwords, which other
+// users could read from the process list.
+func (m *Manager) mysql(sql string) error {
+	args := []string{"-h", m.DB.Host}
+	if m.DB.User != "" {
+		args = append(args, "-u", m.DB.User)
+	}
+
+	cmd := runner.Command("mysql", args...)
+	cmd.Stdin = strings.NewReader(sql)
+	if m.DB.Password != "" {
+		cmd.Env = []string{"MYSQL_PWD=" + m.DB.Password}
+	}
+	return m.Runner.RunCmd(cmd)
 }
 
 func (m *Manager) downloadWordPress(s *Site) error {
 	publicDir := filepath.Join(s.Path, "public")
-	return exec.Command("wp", "core", "download", "--path="+publicDir).Run()
+	return m.Runner.Run("wp", "core", "download", "--path="+publicDir)
 }
 
+// createConfig creates wp-config.php with WP-CLI, which also checks the
+// database credentials. The password is answered on standard input to keep
+// it out of the process list.
 func (m *Manager) createConfig(s *Site) error {
 	publicDir := filepath.Join(s.Path, "public")
 	
 	// Create wp-config using WP-CLI
-	cmd := exec.Command("wp", "config", "create",
+	cmd := runner.Command("wp", "config", "create",
 		"--path="+publicDir,
 		"--dbname="+s.DBName,
 		"--dbuser="+s.DBUser,
-		"--dbpass="+s.DBPass,
 		"--dbhost=localhost",
+		"--prompt=dbpass",
 	)
-	if err := cmd.Run(); err != nil {
+	cmd.Stdin = strings.NewReader(s.DBPass + "\n")
+	if err := m.Runner.RunCmd(cmd); err != nil {
 		return err
 	}
 	
-	// Add optimizations
-	wp := config.NewWordPress()
-	optimizations := wp.OptimizeConfig()
-	
-	configPath := filepath.Join(publicDir, "wp-config.php")
-	content, _ := os.ReadFile(configPath)
-	
-	// Insert before "That's all, stop editing!"
-	newContent := string(content)
-	marker := "/* That's all, stop editing!"
-	if idx := len(newContent) - 100; idx > 0 {
-		newContent = newContent[:idx] + optimizations + newContent[idx:]
-	}
-	
-	return os.WriteFile(configPath, []byte(newContent), 0644)
+	// Add optimizations above "That's all, stop editing!"
+	_, err := m.editWPConfig(s.Path, m.WPConf.ForSite(s.ObjectCache).OptimizeConfig)
+	return err
 }
 
-// Delete removes a site
+// Delete removes a site, including its database and database user unless
+// KeepDatabase is set. Every step is attempted; failures are returned
+// together as *runner.Errors. The site is unregistered and its secrets are
+// deleted only once everything else is gone, so a failed delete can be
+// retried.
 func (m *Manager) Delete(domain string) error {
-	// Remove directory
-	os.RemoveAll(filepath.Join(m.WebRoot, domain))
+	s, err := m.Registry.Get(domain)
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
+		return err
+	}
+
+	var errs runner.Errors
+	if s != nil {
+		errs.Add("remove site directory", m.Runner.RemoveAll(s.Path))
+	}
 	
 	// Remove Caddy config
-	os.Remove(filepath.Join("/etc/caddy/sites", domain+".conf"))
-	
-	// Reload Caddy
-	exec.Command("systemctl", "reload", "caddy").Run()
-	
-	return nil
+	errs.Add("remove Caddy config", m.CaddyConf.RemoveSite(domain))
+	if s != nil && s.UseVarnish {
+		errs.Add("update Varnish config", m.removeFromVCL(domain))
+	}
+	if s != nil {
+		errs.Add("flush object cache", m.flushObjectCache(s))
+	}
+	if s != nil && !m.KeepDatabase {
+		errs.Add("drop database", m.dropDatabase(s))
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	return m.unregister(domain)
+}
+
+// unregister removes a site from the registry and deletes its secrets
+func (m *Manager) unregister(domain string) error {
+	var errs runner.Errors
+	errs.Add("unregister site", m.Registry.Remove(domain))
+	errs.Add("delete secrets", m.Vault.Delete(domain))
+	return errs.Err()
+}
+
+// dropDatabase removes a deleted site's database and database user. Either
+// is kept if another registered site still uses it, e.g. one imported with
+// the same wp-config.php credentials.
+func (m *Manager) dropDatabase(s *Site) error {
+	registered, err := m.Registry.List()
+	if err != nil {
+		return err
+	}
+	dbShared, userShared := false, false
+	for _, other := range registered {
+		if other.Domain == s.Domain {
+			continue
+		}
+		dbShared = dbShared || other.DBName == s.DBName
+		userShared = userShared || other.DBUser == s.DBUser
+	}
+
+	var sql strings.Builder
+	if s.DBName != "" && !dbShared {
+		fmt.Fprintf(&sql, "DROP DATABASE IF EXISTS `%s`;\n", strings.ReplaceAll(s.DBName, "`", "``"))
+	}
+	if s.DBUser != "" && !userShared {
+		fmt.Fprintf(&sql, "DROP USER IF EXISTS '%s'@'localhost';\n", strings.ReplaceAll(s.DBUser, "'", "''"))
+	}
+	if sql.Len() == 0 {
+		return nil
+	}
+	return m.mysql(sql.String())
 }
 
-// List returns all sites
+// flushObjectCache removes a site's object cache so the next site given its
+// database starts empty. Sites created before isolation share database 0
+// with other sites and are left alone.
+func (m *Manager) flushObjectCache(s *Site) error {
+	if s.ObjectCache.Shared() {
+		return nil
+	}
+	return m.Cache.FlushObjectCache(s.ObjectCache)
+}
+
+// List returns the domains of all registered sites
 func (m *Manager) List() ([]string, error) {
-	entries, err := os.ReadDir(m.WebRoot)
+	registered, err := m.Registry.List()
 	if err != nil {
 		return nil, err
 	}
 	
 	var sites []string
-	for _, e := range entries {
-		if e.IsDir() {
-			sites = append(sites, e.Name())
-		}
+	for _, s := range registered {
+		sites = append(sites, s.Domain)
 	}
 	return sites, nil
 }
 
+// Get returns the registered site serving domain
+func (m *Manager) Get(domain string) (*Site, error) {
+	return m.Registry.Get(domain)
+}
+
+// Import registers a site created before the registry existed. Database
+// names are read from its wp-config.php with WP-CLI.
+func (m *Manager) Import(domain string) (*Site, error) {
+	if _, err := m.Registry.Get(domain); err == nil {
+		return nil, fmt.Errorf("site %s is already registered", domain)
+	}
+	path := filepath.Join(m.WebRoot, domain)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("site %s not found in %s", domain, m.WebRoot)
+	}
+
+	s := &Site{
+		Domain:     domain,
+		Path:       path,
+		EnableSSL:  true,
+		UseVarnish: true,
+		PHP:        DefaultPHPSettings(),
+		Created:    time.Now().UTC(),
+	}
+	if strings.HasPrefix(domain, "staging.") {
+		s.StagingOf = strings.TrimPrefix(domain, "staging.")
+	}
+	for key, dst := range map[string]*string{"DB_NAME": &s.DBName, "DB_USER": &s.DBUser, "DB_PASSWORD": &s.DBPass} {
+		out, err := m.Runner.Output("wp", "config", "get", key, "--path="+filepath.Join(path, "public"))
+		if err != nil {
+			return nil, runner.Step("read "+key, err)
+		}
+		*dst = strings.TrimSpace(string(out))
+	}
+	if f, err := readWPConfig(path); err == nil {
+		if raw, ok := f.Raw("WP_REDIS_DATABASE"); ok {
+			s.ObjectCache.Database, _ = strconv.Atoi(strings.Trim(raw, `'"`))
+		}
+		for _, name := range []string{"WP_REDIS_PREFIX", "WP_CACHE_KEY_SALT"} {
+			if prefix, err := f.Get(name); err == nil && prefix != "" {
+				s.ObjectCache.Prefix = prefix
+				break
+			}
+		}
+	}
+	s.record("imported", "")
+
+	if err := m.Vault.Set(s.Domain, secrets.DBPassword, s.DBPass); err != nil {
+		return nil, err
+	}
+	if err := m.Registry.Put(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 func sanitizeName(domain string) string {
 	// Replace dots and hyphens with underscores
 	result := ""
@@ -182,12 +520,3 @@ func sanitizeName(domain string) string {
 	}
 	return result
 }
-
-func generatePassword() string {
-	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%"
-	b := make([]byte, 24)
-	for i := range b {
-		b[i] = chars[i%len(chars)]
-	}
-	return string(b)
-}
@@ -0,0 +1,459 @@
+package site
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/secrets"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// testManager is a site manager whose state, web root and configs live in a
+// temporary directory. Commands are recorded by a Fake: wp config create
+// writes a minimal wp-config.php with the password it reads from standard
+// input like WP-CLI would, and the SQL sent to mysql is collected.
+type testManager struct {
+	*Manager
+	fake *runner.Fake
+	sql  []string // input of each mysql command
+	fail string   // mysql fails for input containing it
+}
+
+func newTestManager(t *testing.T) *testManager {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.WebRoot = filepath.Join(dir, "www")
+	cfg.BackupDir = filepath.Join(dir, "backups")
+	cfg.StateDir = filepath.Join(dir, "state")
+	cfg.Caddy.Caddyfile = filepath.Join(dir, "caddy", "Caddyfile")
+	cfg.Caddy.SitesDir = filepath.Join(dir, "caddy", "sites")
+	cfg.Caddy.Admin = "127.0.0.1:1"
+	cfg.Varnish.VCL = filepath.Join(dir, "varnish", "default.vcl")
+	cfg.Varnish.Admin = "127.0.0.1:1"
+	cfg.Database = config.DatabaseSettings{Host: "localhost", User: "root", Password: "admin-secret"}
+
+	fake := runner.NewFake()
+	fake.Disk = true
+	tm := &testManager{Manager: NewManager(cfg, fake), fake: fake}
+	fake.Handle("wp config create", func(c *runner.Cmd) error {
+		if c.Stdin == nil {
+			return errors.New("wp config create without input")
+		}
+		password, err := bufio.NewReader(c.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		for _, arg := range c.Args {
+			if path, ok := strings.CutPrefix(arg, "--path="); ok {
+				data := fmt.Sprintf(wpConfigSample, wpconfig.Quote(strings.TrimSuffix(password, "\n")))
+				return os.WriteFile(filepath.Join(path, "wp-config.php"), []byte(data), 0640)
+			}
+		}
+		return errors.New("wp config create without --path")
+	})
+	fake.Handle("mysql ", func(c *runner.Cmd) error {
+		if c.Stdin == nil {
+			return errors.New("mysql without input")
+		}
+		data, err := io.ReadAll(c.Stdin)
+		if err != nil {
+			return err
+		}
+		tm.sql = append(tm.sql, string(data))
+		if tm.fail != "" && strings.Contains(string(data), tm.fail) {
+			return errors.New("exit status 1")
+		}
+		return nil
+	})
+	return tm
+}
+
+// wpConfigSample is the wp-config.php the fake wp config create writes,
+// with the password it was given
+const wpConfigSample = `<?php
+define( 'DB_NAME', 'example_com_db' );
+define( 'DB_PASSWORD', %s );
+
+/* That's all, stop editing! Happy publishing. */
+require_once ABSPATH . 'wp-settings.php';
+`
+
+// checkSQL verifies that mysql ran the given statements in order
+func (tm *testManager) checkSQL(t *testing.T, want ...string) {
+	t.Helper()
+	if len(tm.sql) != len(want) {
+		t.Fatalf("mysql ran %d times, want %d:\n%s", len(tm.sql), len(want), strings.Join(tm.sql, "\n"))
+	}
+	for i, stmt := range want {
+		if !strings.Contains(tm.sql[i], stmt) {
+			t.Errorf("mysql input %d = %s, want %s", i, tm.sql[i], stmt)
+		}
+	}
+}
+
+func TestCreateRollback(t *testing.T) {
+	m := newTestManager(t)
+	m.fake.On("caddy validate", "", errors.New("exit status 1"))
+
+	s := &Site{Domain: "example.com"}
+	err := m.Create(s)
+	var stepErr *runner.StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "install Caddy config" {
+		t.Fatalf("Create error = %v, want a failed Caddy step", err)
+	}
+
+	m.checkSQL(t,
+		"CREATE DATABASE example_com_db;",
+		"CREATE USER",
+		"DROP USER IF EXISTS",
+		"DROP DATABASE IF EXISTS example_com_db;",
+	)
+	if _, err := m.Registry.Get("example.com"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("site still registered after rollback: %v", err)
+	}
+	if names, _ := m.Vault.Names("example.com"); len(names) != 0 {
+		t.Errorf("secrets left after rollback: %v", names)
+	}
+	for _, path := range []string{s.Path, m.CaddyConf.ConfPath("example.com"), m.CaddyConf.ConfPath("example.com") + ".ironstack-new"} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left after rollback", path)
+		}
+	}
+	if m.fake.Ran("systemctl") || m.fake.Ran("varnishd") {
+		t.Errorf("unexpected commands:\n%s", strings.Join(m.fake.Calls, "\n"))
+	}
+}
+
+func TestCreateKeepOnFailure(t *testing.T) {
+	m := newTestManager(t)
+	m.KeepOnFailure = true
+	m.fake.On("caddy validate", "", errors.New("exit status 1"))
+
+	s := &Site{Domain: "example.com"}
+	if err := m.Create(s); err == nil || !strings.Contains(err.Error(), "partial changes kept") {
+		t.Fatalf("Create error = %v", err)
+	}
+	m.checkSQL(t, "CREATE DATABASE", "CREATE USER")
+	if _, err := m.Registry.Get("example.com"); err != nil {
+		t.Errorf("reserved site removed: %v", err)
+	}
+	if _, err := os.Stat(wpConfigPath(s.Path)); err != nil {
+		t.Errorf("wp-config.php removed: %v", err)
+	}
+}
+
+func TestCreateEarlyFailure(t *testing.T) {
+	m := newTestManager(t)
+	m.fail = "CREATE DATABASE"
+
+	s := &Site{Domain: "example.com"}
+	err := m.Create(s)
+	var stepErr *runner.StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "create database" {
+		t.Fatalf("Create error = %v, want a failed database step", err)
+	}
+	// The database was never created, so nothing is dropped
+	m.checkSQL(t, "CREATE DATABASE")
+	if m.fake.Ran("wp ") || m.fake.Ran("caddy") {
+		t.Errorf("steps after the failure ran:\n%s", strings.Join(m.fake.Calls, "\n"))
+	}
+	if _, err := os.Lstat(s.Path); !os.IsNotExist(err) {
+		t.Errorf("%s left after rollback", s.Path)
+	}
+	if _, err := m.Registry.Get("example.com"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("site still registered after rollback: %v", err)
+	}
+}
+
+func TestCreateExisting(t *testing.T) {
+	m := newTestManager(t)
+	existing := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com"), DBName: "example_com_db"}
+	if err := m.Registry.Put(existing); err != nil {
+		t.Fatal(err)
+	}
+	m.fake.Calls = nil
+
+	if err := m.Create(&Site{Domain: "example.com"}); err == nil {
+		t.Fatal("Create of a registered site succeeded")
+	}
+	if len(m.fake.Calls) != 0 {
+		t.Errorf("Create touched the existing site:\n%s", strings.Join(m.fake.Calls, "\n"))
+	}
+	if s, err := m.Registry.Get("example.com"); err != nil || s.DBName != "example_com_db" {
+		t.Errorf("registered site changed: %+v, %v", s, err)
+	}
+}
+
+func TestInvalidDomain(t *testing.T) {
+	m := newTestManager(t)
+	source := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com")}
+	if err := m.Registry.Put(source); err != nil {
+		t.Fatal(err)
+	}
+	m.fake.Calls = nil
+
+	for _, domain := range []string{"../etc", "example.com/../../x", "*.example.com", "", "exa mple.com"} {
+		if err := m.Create(&Site{Domain: domain}); err == nil || !strings.Contains(err.Error(), "invalid domain") {
+			t.Errorf("Create(%q) error = %v", domain, err)
+		}
+		if err := m.Clone("example.com", domain); err == nil || !strings.Contains(err.Error(), "invalid domain") {
+			t.Errorf("Clone(%q) error = %v", domain, err)
+		}
+	}
+	if len(m.fake.Calls) != 0 {
+		t.Errorf("invalid domains ran:\n%s", strings.Join(m.fake.Calls, "\n"))
+	}
+	if sites, err := m.Registry.List(); err != nil || len(sites) != 1 {
+		t.Errorf("registry = %v, %v", sites, err)
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	m := newTestManager(t)
+	s := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com"), DBName: "example_com_db", DBUser: "example_com_user", DBPass: "db-secret"}
+	s.ObjectCache = config.ObjectCache{Database: 3, Prefix: "example_com:"}
+	if err := os.MkdirAll(filepath.Join(s.Path, "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.createConfig(s); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readWPConfig(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"WP_REDIS_DATABASE": "3", "WP_CACHE_KEY_SALT": "'example_com:'", "WP_CACHE": "true"} {
+		if got, _ := f.Raw(name); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCreatePasswordsOffCommandLine(t *testing.T) {
+	m := newTestManager(t)
+	m.KeepOnFailure = true
+	m.fake.On("caddy validate", "", errors.New("exit status 1"))
+
+	s := &Site{Domain: "example.com"}
+	if err := m.Create(s); err == nil {
+		t.Fatal("Create succeeded")
+	}
+	password, err := m.Vault.Get("example.com", secrets.DBPassword)
+	if err != nil || password == "" {
+		t.Fatalf("stored password = %q, %v", password, err)
+	}
+	for _, call := range m.fake.Calls {
+		if strings.Contains(call, password) || strings.Contains(call, "admin-secret") {
+			t.Errorf("password on the command line: %s", call)
+		}
+	}
+	if !strings.Contains(m.sql[1], "IDENTIFIED BY '"+password+"'") {
+		t.Errorf("CREATE USER input = %s", m.sql[1])
+	}
+	// wp config create was given the password on standard input
+	f, err := readWPConfig(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Get("DB_PASSWORD"); got != password {
+		t.Errorf("DB_PASSWORD = %q, want the stored password", got)
+	}
+}
+
+// writeCaddyfile writes a main Caddyfile that already imports the sites, so
+// removing one that has no config needs no reload
+func writeCaddyfile(t *testing.T, m *testManager) {
+	t.Helper()
+	if err := os.MkdirAll(m.CaddyConf.ConfigDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(m.CaddyConf.Caddyfile, []byte("import "+filepath.Join(m.CaddyConf.ConfigDir, "*.conf")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name  string
+		other *Site // another registered site
+		keep  bool
+		want  []string
+	}{
+		{"own database", nil, false, []string{"DROP DATABASE IF EXISTS `example_com_db`;\nDROP USER IF EXISTS 'example_com_user'@'localhost';\n"}},
+		{"keep database", nil, true, nil},
+		{"shared database", &Site{Domain: "copy.example.com", DBName: "example_com_db", DBUser: "copy_user"}, false, []string{"DROP USER IF EXISTS 'example_com_user'@'localhost';\n"}},
+		{"shared database and user", &Site{Domain: "copy.example.com", DBName: "example_com_db", DBUser: "example_com_user"}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.KeepDatabase = tt.keep
+			writeCaddyfile(t, m)
+			s := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com"), DBName: "example_com_db", DBUser: "example_com_user"}
+			for _, site := range []*Site{s, tt.other} {
+				if site == nil {
+					continue
+				}
+				if err := m.Registry.Put(site); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(s.Path, "public"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.Delete("example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(m.sql, "") != strings.Join(tt.want, "") {
+				t.Errorf("mysql input = %q, want %q", m.sql, tt.want)
+			}
+			if _, err := os.Stat(s.Path); !os.IsNotExist(err) {
+				t.Errorf("%s not removed", s.Path)
+			}
+			if _, err := m.Registry.Get("example.com"); !errors.Is(err, ErrNotRegistered) {
+				t.Errorf("site still registered: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteKeepsRegistrationOnFailure(t *testing.T) {
+	m := newTestManager(t)
+	writeCaddyfile(t, m)
+	// An imported site lives outside the web root
+	s := &Site{Domain: "example.com", Path: filepath.Join(t.TempDir(), "example"), DBName: "example_com_db", DBUser: "example_com_user"}
+	if err := m.Registry.Put(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Vault.Set(s.Domain, "db_password", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(m.WebRoot, "example.com")
+	for _, dir := range []string{s.Path, other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.fail = "DROP DATABASE"
+	if err := m.Delete("example.com"); err == nil || !strings.Contains(err.Error(), "drop database") {
+		t.Fatalf("Delete error = %v", err)
+	}
+	if _, err := m.Registry.Get("example.com"); err != nil {
+		t.Errorf("site unregistered after a failed delete: %v", err)
+	}
+	if _, err := m.Vault.Get("example.com", "db_password"); err != nil {
+		t.Errorf("secrets deleted after a failed delete: %v", err)
+	}
+
+	// A retry finishes the job
+	m.fail = ""
+	if err := m.Delete("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Registry.Get("example.com"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("site still registered: %v", err)
+	}
+	if names, err := m.Vault.Names("example.com"); err != nil || len(names) != 0 {
+		t.Errorf("secrets left behind: %v, %v", names, err)
+	}
+	if _, err := os.Stat(s.Path); !os.IsNotExist(err) {
+		t.Errorf("%s not removed", s.Path)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("directory that is not the site's removed: %v", err)
+	}
+}
+
+func TestPushToProduction(t *testing.T) {
+	m := newTestManager(t)
+	prod := &Site{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com")}
+	staging := &Site{Domain: "staging.example.com", Path: filepath.Join(m.WebRoot, "staging.example.com"), StagingOf: "example.com"}
+	for _, s := range []*Site{prod, staging} {
+		if err := m.Registry.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dump string
+	m.fake.Handle("wp db export", func(c *runner.Cmd) error {
+		if c.Args[3] == "--path="+staging.Path+"/public" {
+			dump = c.Args[2]
+			if _, err := os.Stat(dump); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := m.PushToProduction("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// The staging dump is a fresh file of the state directory, removed after the push
+	if filepath.Dir(dump) != m.StateDir || !strings.HasPrefix(filepath.Base(dump), "staging_example.com_") {
+		t.Errorf("staging dump = %s", dump)
+	}
+	if _, err := os.Stat(dump); !os.IsNotExist(err) {
+		t.Errorf("%s left after the push", dump)
+	}
+	backup := filepath.Join(m.BackupDir, "example.com", "pre-push_")
+	want := []string{
+		"tar -czf " + backup,
+		"wp db export " + backup,
+		"wp db export " + dump + " --path=" + staging.Path + "/public",
+		"rsync -av --delete",
+		"wp db import " + dump + " --path=" + prod.Path + "/public",
+		"wp search-replace https://staging.example.com https://example.com",
+		"wp cache flush",
+	}
+	var calls []string
+	for _, call := range m.fake.Calls {
+		if cmd, _, _ := strings.Cut(call, " "); cmd == "tar" || cmd == "wp" || cmd == "rsync" {
+			calls = append(calls, call)
+		}
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("commands:\n%s", strings.Join(calls, "\n"))
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(calls[i], prefix) {
+			t.Errorf("command %d = %s, want %s...", i, calls[i], prefix)
+		}
+	}
+	if !strings.HasSuffix(strings.Fields(calls[1])[3], ".sql") || !strings.Contains(calls[1], "--path="+prod.Path+"/public") {
+		t.Errorf("production database backup = %s", calls[1])
+	}
+	if s, _ := m.Registry.Get("example.com"); len(s.History) == 0 || s.History[len(s.History)-1].Action != "pushed" {
+		t.Errorf("history = %+v", s.History)
+	}
+}
+
+func TestPushToProductionPurgesPageCache(t *testing.T) {
+	m := newTestManager(t)
+	for _, s := range []*Site{
+		{Domain: "example.com", Path: filepath.Join(m.WebRoot, "example.com"), UseVarnish: true},
+		{Domain: "staging.example.com", Path: filepath.Join(m.WebRoot, "staging.example.com"), StagingOf: "example.com"},
+	} {
+		if err := m.Registry.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Varnish is not running, so the ban fails after the push
+	err := m.PushToProduction("example.com")
+	var stepErr *runner.StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "purge page cache" {
+		t.Fatalf("PushToProduction error = %v, want a failed purge", err)
+	}
+	if !m.fake.Ran("wp cache flush") {
+		t.Errorf("purge ran before the push finished:\n%s", strings.Join(m.fake.Calls, "\n"))
+	}
+}
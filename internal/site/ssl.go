@@ -1,100 +1,154 @@
 package site
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"os/exec"
+	"net"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/maxaatest/ironstack/internal/caddyadmin"
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
 )
 
 // SSL manages SSL certificates via Caddy
-type SSL struct{}
+type SSL struct {
+	DataDir string // Caddy's data directory, where it stores certificates
+	Admin   *caddyadmin.Client
+	Caddy   *config.Caddy
+	Runner  runner.Runner
+}
 
 // NewSSL creates an SSL manager
-func NewSSL() *SSL {
-	return &SSL{}
+func NewSSL(cfg *config.Settings, r runner.Runner) *SSL {
+	return &SSL{
+		DataDir: cfg.Caddy.DataDir,
+		Admin:   caddyadmin.New(cfg.Caddy.Admin),
+		Caddy:   config.NewCaddy(cfg, r),
+		Runner:  r,
+	}
 }
 
 // CertInfo contains SSL certificate information
 type CertInfo struct {
-	Domain     string
-	Issuer     string
-	ValidFrom  time.Time
-	ValidUntil time.Time
-	DaysLeft   int
-	AutoRenew  bool
+	Domain     string    `json:"domain"`
+	Issuer     string    `json:"issuer"`
+	ValidFrom  time.Time `json:"valid_from"`
+	ValidUntil time.Time `json:"valid_until"`
+	DaysLeft   int       `json:"days_left"`
+	AutoRenew  bool      `json:"auto_renew"`
 }
 
-// GetCertInfo returns SSL certificate information for a domain
+// GetCertInfo returns the certificate Caddy serves for a domain. It is
+// read from the local listener, so DNS does not need to point here yet.
 func (s *SSL) GetCertInfo(domain string) (*CertInfo, error) {
-	// Use openssl to check certificate
-	out, err := exec.Command("sh", "-c", 
-		fmt.Sprintf("echo | openssl s_client -servername %s -connect %s:443 2>/dev/null | openssl x509 -noout -dates -issuer", domain, domain),
-	).Output()
-	
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", "127.0.0.1:443", &tls.Config{
+		ServerName: domain,
+		// Only inspecting the certificate; validity is reported, not enforced
+		InsecureSkipVerify: true,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cert info: %w", err)
 	}
-	
-	info := &CertInfo{Domain: domain, AutoRenew: true}
-	
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "notBefore=") {
-			dateStr := strings.TrimPrefix(line, "notBefore=")
-			if t, err := time.Parse("Jan  2 15:04:05 2006 GMT", dateStr); err == nil {
-				info.ValidFrom = t
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificate presented", domain)
+	}
+	leaf := certs[0]
+	issuer := leaf.Issuer.CommonName
+	if len(leaf.Issuer.Organization) > 0 {
+		issuer = leaf.Issuer.Organization[0] + " " + issuer
+	}
+	return &CertInfo{
+		Domain:     domain,
+		Issuer:     strings.TrimSpace(issuer),
+		ValidFrom:  leaf.NotBefore,
+		ValidUntil: leaf.NotAfter,
+		DaysLeft:   int(time.Until(leaf.NotAfter).Hours() / 24),
+		AutoRenew:  true,
+	}, nil
+}
+
+// ForceCertRenewal replaces the certificate of a domain. The site's routes
+// are removed from the running config by @id, which makes Caddy drop the
+// certificate from its cache, the certificate is deleted from Caddy's
+// storage and the routes are put back, so Caddy obtains a new one. The site
+// does not answer until the new certificate is issued.
+func (s *SSL) ForceCertRenewal(domain string) error {
+	// Each issuer keeps its certificates in a directory of its own
+	dirs, err := filepath.Glob(filepath.Join(s.DataDir, "certificates", "*", strings.ToLower(domain)))
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no certificate for %s in %s", domain, s.DataDir)
+	}
+
+	if runner.IsDryRun(s.Runner) {
+		routes, err := s.Caddy.SiteRoutes(domain)
+		if err != nil {
+			return err
+		}
+		// Show the equivalent commands instead of calling the API
+		for _, server := range routes {
+			for _, r := range server {
+				s.Runner.Run("curl", "-s", "-X", "DELETE", s.Admin.BaseURL+"/id/"+r.ID)
 			}
-		} else if strings.HasPrefix(line, "notAfter=") {
-			dateStr := strings.TrimPrefix(line, "notAfter=")
-			if t, err := time.Parse("Jan  2 15:04:05 2006 GMT", dateStr); err == nil {
-				info.ValidUntil = t
-				info.DaysLeft = int(time.Until(t).Hours() / 24)
+		}
+		for _, dir := range dirs {
+			s.Runner.RemoveAll(dir)
+		}
+		for name, server := range routes {
+			for _, r := range server {
+				s.Runner.Run("curl", "-s", "-X", "PUT", s.Admin.BaseURL+"/config/apps/http/servers/"+name+"/routes/0", "-d", "<"+r.ID+">")
 			}
-		} else if strings.HasPrefix(line, "issuer=") {
-			info.Issuer = strings.TrimPrefix(line, "issuer=")
 		}
+		return nil
 	}
-	
-	return info, nil
-}
 
-// ForceCertRenewal forces certificate renewal
-func (s *SSL) ForceCertRenewal(domain string) error {
-	// Caddy handles auto-renewal, but we can force it
-	return exec.Command("caddy", "reload", "--config", "/etc/caddy/Caddyfile").Run()
+	routes, err := s.Caddy.RemoveSiteRoutes(domain)
+	if err != nil {
+		// Loading the config on disk puts back routes already removed
+		s.Caddy.Reload()
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("%s is missing from the config Caddy is running", domain)
+	}
+	var errs runner.Errors
+	for _, dir := range dirs {
+		errs.Add("delete "+dir, s.Runner.RemoveAll(dir))
+	}
+	if err := s.Caddy.AddRoutes(routes); err != nil {
+		errs.Add("restore routes", err)
+		errs.Add("reload Caddy", s.Caddy.Reload())
+	}
+	return errs.Err()
 }
 
-// ListCertificates lists all SSL certificates
+// ListCertificates returns the certificates of every hostname in the config
+// Caddy is running. Hostnames without a certificate yet are skipped.
 func (s *SSL) ListCertificates() ([]CertInfo, error) {
-	// Get certificates from Caddy's data directory
-	out, err := exec.Command("find", "/var/lib/caddy/.local/share/caddy/certificates", 
-		"-name", "*.crt", "-type", "f").Output()
-	
+	hosts, err := s.Admin.Hosts()
 	if err != nil {
 		return nil, err
 	}
-	
+
 	var certs []CertInfo
-	files := strings.Split(strings.TrimSpace(string(out)), "\n")
-	
-	for _, file := range files {
-		if file == "" {
+	for _, host := range hosts {
+		if strings.HasPrefix(host, "*") || net.ParseIP(host) != nil || host == "localhost" {
 			continue
 		}
-		
-		// Extract domain from path
-		parts := strings.Split(file, "/")
-		if len(parts) > 0 {
-			domain := strings.TrimSuffix(parts[len(parts)-1], ".crt")
-			if info, err := s.GetCertInfo(domain); err == nil {
-				certs = append(certs, *info)
-			}
+		if info, err := s.GetCertInfo(host); err == nil {
+			certs = append(certs, *info)
 		}
 	}
-	
 	return certs, nil
 }
 
@@ -120,23 +174,23 @@ func (s *SSL) TestSSL(domain string) (*SSLTestResult, error) {
 	result := &SSLTestResult{Domain: domain}
 	
 	// Check HTTPS accessibility
-	out, _ := exec.Command("curl", "-s", "-o", "/dev/null", "-w", "%{http_code}",
-		"--connect-timeout", "10", "https://"+domain).Output()
+	out, _ := s.Runner.Output("curl", "-s", "-o", "/dev/null", "-w", "%{http_code}",
+		"--connect-timeout", "10", "https://"+domain)
 	result.HTTPSAccessible = strings.TrimSpace(string(out)) == "200"
 	
 	// Check HTTP to HTTPS redirect
-	out, _ = exec.Command("curl", "-s", "-o", "/dev/null", "-w", "%{redirect_url}",
-		"--connect-timeout", "10", "-L", "http://"+domain).Output()
+	out, _ = s.Runner.Output("curl", "-s", "-o", "/dev/null", "-w", "%{redirect_url}",
+		"--connect-timeout", "10", "-L", "http://"+domain)
 	result.HTTPRedirect = strings.HasPrefix(strings.TrimSpace(string(out)), "https://")
 	
 	// Check certificate validity
-	err := exec.Command("sh", "-c",
+	err := s.Runner.Run("sh", "-c",
 		fmt.Sprintf("echo | openssl s_client -servername %s -connect %s:443 2>/dev/null | openssl x509 -noout -checkend 0", domain, domain),
-	).Run()
+	)
 	result.ValidCert = err == nil
 	
 	// Check HSTS header
-	out, _ = exec.Command("curl", "-s", "-I", "https://"+domain).Output()
+	out, _ = s.Runner.Output("curl", "-s", "-I", "https://"+domain)
 	result.HSTS = strings.Contains(string(out), "strict-transport-security")
 	
 	return result, nil
@@ -144,11 +198,11 @@ func (s *SSL) TestSSL(domain string) (*SSLTestResult, error) {
 
 // SSLTestResult contains SSL test results
 type SSLTestResult struct {
-	Domain          string
-	HTTPSAccessible bool
-	HTTPRedirect    bool
-	ValidCert       bool
-	HSTS            bool
+	Domain          string `json:"domain"`
+	HTTPSAccessible bool   `json:"https_accessible"`
+	HTTPRedirect    bool   `json:"http_redirect"`
+	ValidCert       bool   `json:"valid_cert"`
+	HSTS            bool   `json:"hsts"`
 }
 
 // Score returns SSL quality score
@@ -0,0 +1,77 @@
+package site
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+func TestForceCertRenewal(t *testing.T) {
+	const servers = `{"srv0": {"listen": [":443"], "routes": [
+		{"@id": "ironstack:example.com:443", "match": [{"host": ["example.com"]}], "terminal": true},
+		{"@id": "ironstack:other.example.com:443", "match": [{"host": ["other.example.com"]}]}
+	]}}`
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		if r.Method == "GET" {
+			io.WriteString(w, servers)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Caddy.DataDir = dir
+	cfg.Caddy.Admin = srv.Listener.Addr().String()
+	certs := []string{
+		filepath.Join(dir, "certificates", "acme-v02.api.letsencrypt.org-directory", "example.com"),
+		filepath.Join(dir, "certificates", "acme.zerossl.com-v2-dv90", "example.com"),
+	}
+	other := filepath.Join(dir, "certificates", "acme-v02.api.letsencrypt.org-directory", "other.example.com")
+	for _, d := range append(certs, other) {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := runner.NewFake()
+	fake.Disk = true
+	s := NewSSL(cfg, fake)
+
+	if err := s.ForceCertRenewal("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /config/apps/http/servers ",
+		"DELETE /id/ironstack:example.com:443 ",
+		`PUT /config/apps/http/servers/srv0/routes/0 {"@id":"ironstack:example.com:443","match":[{"host":["example.com"]}],"terminal":true}`,
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+	for _, d := range certs {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", d)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("another site's certificate was touched: %v", err)
+	}
+
+	// Without a stored certificate there is nothing to replace
+	requests = nil
+	if err := s.ForceCertRenewal("missing.example.com"); err == nil {
+		t.Error("ForceCertRenewal of a domain without a certificate succeeded")
+	}
+	if len(requests) != 0 {
+		t.Errorf("requests = %q, want none", requests)
+	}
+}
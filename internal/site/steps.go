@@ -0,0 +1,44 @@
+package site
+
+import (
+	"fmt"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// step is one part of a site operation that can be reversed
+type step struct {
+	name string
+	do   func() error
+	undo func() error // nil if the step leaves nothing behind
+}
+
+// runSteps executes steps in order. When a step fails, the steps that
+// completed are undone in reverse order unless KeepOnFailure is set. The
+// returned error is a *runner.StepError for the failed step; failures while
+// undoing are joined to it.
+func (m *Manager) runSteps(steps []step) error {
+	for i, s := range steps {
+		err := s.do()
+		if err == nil {
+			continue
+		}
+		stepErr := runner.Step(s.name, err)
+
+		if m.KeepOnFailure {
+			return fmt.Errorf("%w (partial changes kept for inspection)", stepErr)
+		}
+
+		var undoErrs runner.Errors
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].undo != nil {
+				undoErrs.Add("undo "+steps[j].name, steps[j].undo())
+			}
+		}
+		if err := undoErrs.Err(); err != nil {
+			return fmt.Errorf("%w; rollback incomplete: %w", stepErr, err)
+		}
+		return stepErr
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package site
+
+import "github.com/maxaatest/ironstack/internal/config"
+
+// varnishConfigStep adds a site to the Varnish VCL. Undoing it regenerates
+// the VCL without the site. Sites not using Varnish leave it untouched.
+func (m *Manager) varnishConfigStep(s *Site) step {
+	return step{
+		name: "update Varnish config",
+		do: func() error {
+			if !s.UseVarnish {
+				return nil
+			}
+			return m.applyVCL(s)
+		},
+		undo: func() error {
+			if !s.UseVarnish {
+				return nil
+			}
+			return m.removeFromVCL(s.Domain)
+		},
+	}
+}
+
+// vclSites returns the VCL template input of all registered sites using
+// Varnish. If s is not nil, it replaces the registered entry of its domain.
+// The site named removed is left out.
+func (m *Manager) vclSites(s *Site, removed string) ([]config.VCLSite, error) {
+	registered, err := m.Registry.List()
+	if err != nil {
+		return nil, err
+	}
+	var sites []config.VCLSite
+	for _, r := range registered {
+		if r.Domain == removed || s != nil && r.Domain == s.Domain || !r.UseVarnish {
+			continue
+		}
+		sites = append(sites, vclSite(r))
+	}
+	if s != nil && s.UseVarnish {
+		sites = append(sites, vclSite(s))
+	}
+	return sites, nil
+}
+
+// vclSite returns the VCL template input of a site
+func vclSite(s *Site) config.VCLSite {
+	return config.VCLSite{Domain: s.Domain, Aliases: s.Aliases, VCLOptions: s.Varnish}
+}
+
+// applyVCL regenerates the VCL with s as given and loads it
+func (m *Manager) applyVCL(s *Site) error {
+	sites, err := m.vclSites(s, "")
+	if err != nil {
+		return err
+	}
+	return m.VarnishConf.Apply(sites)
+}
+
+// removeFromVCL regenerates the VCL without domain and loads it
+func (m *Manager) removeFromVCL(domain string) error {
+	sites, err := m.vclSites(nil, domain)
+	if err != nil {
+		return err
+	}
+	return m.VarnishConf.Apply(sites)
+}
+
+// VCL renders the VCL for all registered sites
+func (m *Manager) VCL() ([]byte, error) {
+	sites, err := m.vclSites(nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return m.VarnishConf.RenderVCL(sites)
+}
+
+// UpdateVCL regenerates the VCL from the registry, e.g. after Varnish
+// options of a site were changed, and loads it into Varnish
+func (m *Manager) UpdateVCL() error {
+	sites, err := m.vclSites(nil, "")
+	if err != nil {
+		return err
+	}
+	return m.VarnishConf.Apply(sites)
+}
@@ -0,0 +1,28 @@
+package site
+
+import (
+	"path/filepath"
+
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+// wpConfigPath returns the wp-config.php of a site directory
+func wpConfigPath(sitePath string) string {
+	return filepath.Join(sitePath, "public", "wp-config.php")
+}
+
+// editWPConfig applies edit to a site's wp-config.php. It returns the
+// original contents for rollback.
+func (m *Manager) editWPConfig(sitePath string, edit func(f *wpconfig.File) error) ([]byte, error) {
+	return wpconfig.Edit(m.Runner, wpConfigPath(sitePath), edit)
+}
+
+// writeWPConfig replaces a site's wp-config.php, e.g. to roll back an edit
+func (m *Manager) writeWPConfig(sitePath string, data []byte) error {
+	return wpconfig.Write(m.Runner, wpConfigPath(sitePath), data)
+}
+
+// readWPConfig parses a site's wp-config.php
+func readWPConfig(sitePath string) (*wpconfig.File, error) {
+	return wpconfig.Load(wpConfigPath(sitePath))
+}
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/spinner"
@@ -78,13 +79,13 @@ func (d ItemDelegate) Render(w interface{ WriteString(string) (int, error) }, m
 
 	fn := lipgloss.NewStyle().PaddingLeft(2).Render
 	if index == m.Index() {
-		fn = func(s string) string {
+		fn = func(s ...string) string {
 			return lipgloss.NewStyle().
 				PaddingLeft(2).
 				Foreground(White).
 				Background(Purple).
 				Bold(true).
-				Render("> " + s)
+				Render("> " + strings.Join(s, " "))
 		}
 	}
 
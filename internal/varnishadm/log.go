@@ -0,0 +1,77 @@
+package varnishadm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// logFormat is the varnishncsa format ReadLog asks for: host, method, URL,
+// status, body bytes, how Varnish handled the request and why it passed
+const logFormat = `%{Host}i\t%m\t%U%q\t%s\t%b\t%{Varnish:handling}x\t%{VCL_Log:pass}x`
+
+// Handling values of a request
+const (
+	HandlingHit  = "hit"
+	HandlingMiss = "miss"
+	HandlingPass = "pass"
+	HandlingPipe = "pipe"
+)
+
+// LogEntry is a client request from the Varnish shared memory log
+type LogEntry struct {
+	Host       string
+	Method     string
+	URL        string // path and query string
+	Status     int
+	Bytes      int64  // response body
+	Handling   string // hit, miss, pass, pipe or synth
+	PassReason string // set by the VCL with std.log("pass:<reason>")
+}
+
+// ReadLog returns the client requests still in the shared memory log, using
+// `varnishncsa -d`, which prints them and exits
+func ReadLog(r runner.Runner) ([]LogEntry, error) {
+	out, err := r.Output("varnishncsa", "-d", "-F", logFormat)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLog(string(out)), nil
+}
+
+// ParseLog parses varnishncsa output in the format ReadLog uses. Malformed
+// lines are skipped.
+func ParseLog(text string) []LogEntry {
+	var entries []LogEntry
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		status, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		bytes, _ := strconv.ParseInt(fields[4], 10, 64)
+		host, _, _ := strings.Cut(strings.ToLower(logValue(fields[0])), ":")
+		entries = append(entries, LogEntry{
+			Host:       host,
+			Method:     fields[1],
+			URL:        fields[2],
+			Status:     status,
+			Bytes:      bytes,
+			Handling:   fields[5],
+			PassReason: logValue(fields[6]),
+		})
+	}
+	return entries
+}
+
+// logValue returns a varnishncsa field, which is "-" when empty
+func logValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,32 @@
+package varnishadm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLog(t *testing.T) {
+	// varnishncsa -F output: host, method, URL, status, bytes, handling and
+	// pass reason separated by tabs
+	const log = "example.com\tGET\t/\t200\t5120\thit\t-\n" +
+		"Example.COM:443\tGET\t/shop/?add-to-cart=12\t302\t-\tpass\twoocommerce\r\n" +
+		"blog.example.org\tPOST\t/wp-login.php\t200\t1200\tpass\tmethod\n" +
+		"-\tGET\t/server-status\t404\t0\tsynth\t-\n" +
+		"\n" +
+		"example.com\tGET\t/broken\n" +
+		"example.com\tGET\t/bad-status\tOK\t10\tmiss\t-\n" +
+		"example.com\tGET\t/feed/\t200\t880\tmiss\t-"
+	want := []LogEntry{
+		{Host: "example.com", Method: "GET", URL: "/", Status: 200, Bytes: 5120, Handling: HandlingHit},
+		{Host: "example.com", Method: "GET", URL: "/shop/?add-to-cart=12", Status: 302, Handling: HandlingPass, PassReason: "woocommerce"},
+		{Host: "blog.example.org", Method: "POST", URL: "/wp-login.php", Status: 200, Bytes: 1200, Handling: HandlingPass, PassReason: "method"},
+		{Method: "GET", URL: "/server-status", Status: 404, Handling: "synth"},
+		{Host: "example.com", Method: "GET", URL: "/feed/", Status: 200, Bytes: 880, Handling: HandlingMiss},
+	}
+	if got := ParseLog(log); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseLog =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := ParseLog(""); len(got) != 0 {
+		t.Errorf("ParseLog of an empty log = %+v", got)
+	}
+}
@@ -0,0 +1,101 @@
+package varnishadm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// Counter is a varnishstat counter
+type Counter struct {
+	Description string `json:"description"`
+	Flag        string `json:"flag"`   // c: counter, g: gauge, b: bitmap
+	Format      string `json:"format"` // i: integer, B: bytes, d: duration
+	Value       uint64 `json:"value"`
+}
+
+// Stats are the counters of `varnishstat -j` by name, e.g. "MAIN.cache_hit"
+type Stats map[string]Counter
+
+// Main are the MAIN counters IronStack reports
+type Main struct {
+	Uptime      uint64 `json:"uptime"` // seconds
+	ClientReq   uint64 `json:"client_req"`
+	CacheHit    uint64 `json:"cache_hit"`
+	CacheGrace  uint64 `json:"cache_hit_grace"` // hits on stale objects
+	CacheMiss   uint64 `json:"cache_miss"`
+	Pass        uint64 `json:"pass"`
+	BackendReq  uint64 `json:"backend_req"`
+	BackendFail uint64 `json:"backend_fail"`
+	Objects     uint64 `json:"objects"`
+	LRUNuked    uint64 `json:"lru_nuked"` // objects evicted for space
+	Bans        uint64 `json:"bans"`
+}
+
+// ReadStats runs `varnishstat -j` and parses its output
+func ReadStats(r runner.Runner) (Stats, error) {
+	out, err := r.Output("varnishstat", "-j")
+	if err != nil {
+		return nil, err
+	}
+	return ParseStats(out)
+}
+
+// ParseStats parses `varnishstat -j` output. Varnish 6.5 and later nest the
+// counters under "counters"; older versions list them at the top level.
+func ParseStats(data []byte) (Stats, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("varnishstat: %w", err)
+	}
+	if nested, ok := doc["counters"]; ok {
+		doc = nil
+		if err := json.Unmarshal(nested, &doc); err != nil {
+			return nil, fmt.Errorf("varnishstat: %w", err)
+		}
+	}
+	stats := make(Stats)
+	for name, raw := range doc {
+		var c Counter
+		// Skip non-counter fields such as "timestamp" and "version"
+		if json.Unmarshal(raw, &c) != nil || c.Flag == "" {
+			continue
+		}
+		stats[name] = c
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("varnishstat: no counters in output")
+	}
+	return stats, nil
+}
+
+// Value returns the value of a counter, or 0 if it does not exist
+func (s Stats) Value(name string) uint64 {
+	return s[name].Value
+}
+
+// Main returns the main counters
+func (s Stats) Main() Main {
+	return Main{
+		Uptime:      s.Value("MAIN.uptime"),
+		ClientReq:   s.Value("MAIN.client_req"),
+		CacheHit:    s.Value("MAIN.cache_hit"),
+		CacheGrace:  s.Value("MAIN.cache_hit_grace"),
+		CacheMiss:   s.Value("MAIN.cache_miss"),
+		Pass:        s.Value("MAIN.s_pass"),
+		BackendReq:  s.Value("MAIN.backend_req"),
+		BackendFail: s.Value("MAIN.backend_fail"),
+		Objects:     s.Value("MAIN.n_object"),
+		LRUNuked:    s.Value("MAIN.n_lru_nuked"),
+		Bans:        s.Value("MAIN.bans"),
+	}
+}
+
+// HitRate returns cache hits as a percentage of hits and misses
+func (m Main) HitRate() float64 {
+	if m.CacheHit+m.CacheMiss == 0 {
+		return 0
+	}
+	return float64(m.CacheHit) / float64(m.CacheHit+m.CacheMiss) * 100
+}
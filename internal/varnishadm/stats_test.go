@@ -0,0 +1,78 @@
+package varnishadm
+
+import (
+	"strings"
+	"testing"
+)
+
+// counters are varnishstat -j counters as Varnish prints them
+const counters = `
+    "MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 86400},
+    "MAIN.client_req": {"description": "Good client requests received", "flag": "c", "format": "i", "value": 1000},
+    "MAIN.cache_hit": {"description": "Cache hits", "flag": "c", "format": "i", "value": 750},
+    "MAIN.cache_hit_grace": {"description": "Cache grace hits", "flag": "c", "format": "i", "value": 12},
+    "MAIN.cache_miss": {"description": "Cache misses", "flag": "c", "format": "i", "value": 250},
+    "MAIN.s_pass": {"description": "Total pass-ed requests seen", "flag": "c", "format": "i", "value": 40},
+    "MAIN.backend_req": {"description": "Backend requests made", "flag": "c", "format": "i", "value": 290},
+    "MAIN.backend_fail": {"description": "Backend conn. failures", "flag": "c", "format": "i", "value": 2},
+    "MAIN.n_object": {"description": "object structs made", "flag": "g", "format": "i", "value": 5000},
+    "MAIN.n_lru_nuked": {"description": "Number of LRU nuked objects", "flag": "c", "format": "i", "value": 7},
+    "MAIN.bans": {"description": "Count of bans", "flag": "g", "format": "i", "value": 3},
+    "SMA.s0.g_bytes": {"description": "Bytes outstanding", "flag": "g", "format": "B", "value": 1048576}`
+
+func TestParseStats(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		// Varnish 6.5 and later
+		{"nested", `{"version": 1, "timestamp": "2026-10-17T10:00:00", "counters": {` + counters + `}}`},
+		// Earlier versions
+		{"flat", `{"timestamp": "2026-10-17T10:00:00",` + counters + `}`},
+	}
+	want := Main{
+		Uptime: 86400, ClientReq: 1000, CacheHit: 750, CacheGrace: 12, CacheMiss: 250, Pass: 40,
+		BackendReq: 290, BackendFail: 2, Objects: 5000, LRUNuked: 7, Bans: 3,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := ParseStats([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != 12 {
+				t.Errorf("parsed %d counters, want 12: %v", len(stats), stats)
+			}
+			if got := stats.Main(); got != want {
+				t.Errorf("Main() = %+v, want %+v", got, want)
+			}
+			if c := stats["SMA.s0.g_bytes"]; c.Format != "B" || c.Flag != "g" || c.Value != 1048576 {
+				t.Errorf("SMA.s0.g_bytes = %+v", c)
+			}
+			if got := stats.Main().HitRate(); got != 75 {
+				t.Errorf("HitRate() = %v, want 75", got)
+			}
+			if got := stats.Value("MAIN.missing"); got != 0 {
+				t.Errorf("Value of a missing counter = %d", got)
+			}
+		})
+	}
+}
+
+func TestParseStatsErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"not JSON", "varnishstat: Could not get hold of varnishd", "varnishstat: "},
+		{"no counters", `{"version": 1, "timestamp": "2026-10-17T10:00:00", "counters": {}}`, "no counters"},
+		{"malformed nested", `{"version": 1, "counters": []}`, "varnishstat: "},
+	}
+	for _, tt := range tests {
+		if _, err := ParseStats([]byte(tt.data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if got := (Main{}).HitRate(); got != 0 {
+		t.Errorf("HitRate without requests = %v", got)
+	}
+}
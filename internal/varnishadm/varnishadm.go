@@ -0,0 +1,276 @@
+// Package varnishadm is a client for the Varnish CLI protocol that varnishd
+// serves on its management port (-T)
+package varnishadm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLI status codes
+const (
+	StatusSyntax    = 100
+	StatusUnknown   = 101
+	StatusUnimpl    = 102
+	StatusTooFew    = 104
+	StatusTooMany   = 105
+	StatusParam     = 106
+	StatusAuth      = 107
+	StatusOK        = 200
+	StatusTruncated = 201
+	StatusCant      = 300
+	StatusComms     = 400
+	StatusClose     = 500
+)
+
+// challengeLength is the length of the authentication challenge
+const challengeLength = 32
+
+// Client talks to the management port of a running varnishd. Every call
+// opens its own connection.
+type Client struct {
+	Addr       string // host:port of varnishd -T, e.g. localhost:6082
+	SecretFile string // varnishd -S, e.g. /etc/varnish/secret
+	Timeout    time.Duration
+}
+
+// New creates a client for the management port at addr, authenticating
+// with the shared secret in secretFile
+func New(addr, secretFile string) *Client {
+	return &Client{Addr: addr, SecretFile: secretFile, Timeout: 30 * time.Second}
+}
+
+// Error is a CLI response with a status other than 200
+type Error struct {
+	Command string
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("varnish %s: %d %s", e.Command, e.Status, e.Message)
+}
+
+// VCL is an entry of vcl.list
+type VCL struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`      // active or available
+	State       string `json:"state"`       // auto, cold or warm
+	Temperature string `json:"temperature"` // cold, warm, busy or cooling
+	Busy        int    `json:"busy"`
+}
+
+// Run executes a CLI command and returns its response text. Arguments are
+// quoted, so a regex or path containing spaces stays one argument.
+func (c *Client) Run(args ...string) (string, error) {
+	cn, err := c.dial()
+	if err != nil {
+		return "", err
+	}
+	defer cn.Close()
+	return cn.run(args...)
+}
+
+// Ping checks that varnishd answers
+func (c *Client) Ping() error {
+	_, err := c.Run("ping")
+	return err
+}
+
+// Status returns the state of the child process, e.g. "Child in state running"
+func (c *Client) Status() (string, error) {
+	out, err := c.Run("status")
+	return strings.TrimSpace(out), err
+}
+
+// Ban invalidates cached objects matching a ban expression given as
+// field, operator and argument triples joined by "&&",
+// e.g. Ban("req.http.host", "==", "example.com", "&&", "req.url", "~", "^/shop")
+func (c *Client) Ban(expr ...string) error {
+	if len(expr) == 0 {
+		return fmt.Errorf("empty ban expression")
+	}
+	_, err := c.Run(append([]string{"ban"}, expr...)...)
+	return err
+}
+
+// VCLLoad compiles the VCL file at path and loads it as name
+func (c *Client) VCLLoad(name, path string) error {
+	_, err := c.Run("vcl.load", name, path)
+	return err
+}
+
+// VCLUse makes the loaded VCL name handle new requests
+func (c *Client) VCLUse(name string) error {
+	_, err := c.Run("vcl.use", name)
+	return err
+}
+
+// VCLDiscard unloads an inactive VCL
+func (c *Client) VCLDiscard(name string) error {
+	_, err := c.Run("vcl.discard", name)
+	return err
+}
+
+// VCLList returns the loaded VCLs
+func (c *Client) VCLList() ([]VCL, error) {
+	out, err := c.Run("vcl.list", "-j")
+	if err != nil {
+		return nil, err
+	}
+	// JSON responses are [version, [command...], timestamp, item...]
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(out), &items); err != nil {
+		return nil, fmt.Errorf("varnish vcl.list: %w", err)
+	}
+	var vcls []VCL
+	for i := 3; i < len(items); i++ {
+		var v VCL
+		if err := json.Unmarshal(items[i], &v); err != nil {
+			return nil, fmt.Errorf("varnish vcl.list: %w", err)
+		}
+		vcls = append(vcls, v)
+	}
+	return vcls, nil
+}
+
+// Quote returns s as a single CLI argument
+func Quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\r\"\\{}") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// conn is an authenticated CLI connection
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects and answers the authentication challenge if varnishd
+// sends one
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("varnish management port unreachable: %w", err)
+	}
+	nc.SetDeadline(time.Now().Add(c.Timeout))
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	status, body, err := cn.read()
+	if err == nil && status == StatusAuth {
+		status, body, err = cn.auth(c.SecretFile, body)
+	}
+	if err == nil && status != StatusOK {
+		err = &Error{Command: "connect", Status: status, Message: strings.TrimSpace(body)}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// auth answers a challenge with SHA-256(challenge "\n" secret challenge "\n")
+func (cn *conn) auth(secretFile, body string) (int, string, error) {
+	if len(body) < challengeLength {
+		return 0, "", fmt.Errorf("varnish: malformed authentication challenge")
+	}
+	challenge := body[:challengeLength]
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return 0, "", fmt.Errorf("varnish secret: %w", err)
+	}
+	h := sha256.New()
+	io.WriteString(h, challenge+"\n")
+	h.Write(secret)
+	io.WriteString(h, challenge+"\n")
+	if err := cn.send("auth", hex.EncodeToString(h.Sum(nil))); err != nil {
+		return 0, "", err
+	}
+	status, body, err := cn.read()
+	if err == nil && status == StatusAuth {
+		err = fmt.Errorf("varnish: authentication failed, check %s", secretFile)
+	}
+	return status, body, err
+}
+
+// run sends a command and reads its response
+func (cn *conn) run(args ...string) (string, error) {
+	if err := cn.send(args...); err != nil {
+		return "", err
+	}
+	status, body, err := cn.read()
+	if err != nil {
+		return "", err
+	}
+	if status != StatusOK {
+		return "", &Error{Command: args[0], Status: status, Message: strings.TrimSpace(body)}
+	}
+	return body, nil
+}
+
+func (cn *conn) send(args ...string) error {
+	var line bytes.Buffer
+	for i, a := range args {
+		if i > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(Quote(a))
+	}
+	line.WriteByte('\n')
+	_, err := cn.Write(line.Bytes())
+	return err
+}
+
+// read reads a response: a "status length" header line, length bytes of
+// body and a newline
+func (cn *conn) read() (int, string, error) {
+	header, err := cn.r.ReadString('\n')
+	if err != nil {
+		return 0, "", fmt.Errorf("varnish: reading response: %w", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("varnish: malformed response header %q", header)
+	}
+	status, err1 := strconv.Atoi(fields[0])
+	length, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || length < 0 {
+		return 0, "", fmt.Errorf("varnish: malformed response header %q", header)
+	}
+	body := make([]byte, length+1)
+	if _, err := io.ReadFull(cn.r, body); err != nil {
+		return 0, "", fmt.Errorf("varnish: reading response: %w", err)
+	}
+	return status, string(body[:length]), nil
+}
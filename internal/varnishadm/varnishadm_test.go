@@ -0,0 +1,237 @@
+package varnishadm
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// challenge is the authentication challenge the stand-in sends
+const challenge = "abcdefghijklmnopqrstuvwxyzabcdef"
+
+// standIn is a varnishd management port. With a secret it sends an
+// authentication challenge first, like varnishd -S does. Every command line
+// it receives is recorded and answered by respond.
+type standIn struct {
+	secret  string
+	respond func(line string) (int, string)
+
+	mu    sync.Mutex
+	lines []string
+}
+
+// newStandIn starts a stand-in and returns a client for it that uses
+// clientSecret
+func newStandIn(t *testing.T, secret, clientSecret string, respond func(line string) (int, string)) (*Client, *standIn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &standIn{secret: secret, respond: respond}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte(clientSecret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := New(ln.Addr().String(), secretFile)
+	c.Timeout = 5 * time.Second
+	return c, s
+}
+
+func (s *standIn) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if s.secret != "" {
+		writeResponse(c, StatusAuth, challenge+"\n\nAuthentication required.")
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		h := sha256.New()
+		io.WriteString(h, challenge+"\n"+s.secret+challenge+"\n")
+		if line != "auth "+hex.EncodeToString(h.Sum(nil))+"\n" {
+			writeResponse(c, StatusAuth, challenge+"\n\nAuthentication required.")
+			return
+		}
+	}
+	writeResponse(c, StatusOK, "-----------------------------\nVarnish Cache CLI 1.0\n-----------------------------\n\nType 'help' for command list.\nType 'quit' to close CLI session.")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.lines = append(s.lines, strings.TrimSuffix(line, "\n"))
+		s.mu.Unlock()
+		status, body := s.respond(strings.TrimSuffix(line, "\n"))
+		writeResponse(c, status, body)
+	}
+}
+
+// writeResponse writes a response the way varnishd does: a header padded
+// to 12 characters, the body and a newline
+func writeResponse(w io.Writer, status int, body string) {
+	fmt.Fprintf(w, "%-3d %-8d\n%s\n", status, len(body), body)
+}
+
+func (s *standIn) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func TestAuth(t *testing.T) {
+	ok := func(string) (int, string) { return StatusOK, "PONG 1700000000 1.0" }
+
+	c, s := newStandIn(t, "s3cret\n", "s3cret\n", ok)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.received(); len(got) != 1 || got[0] != "ping" {
+		t.Errorf("received %q", got)
+	}
+
+	c, s = newStandIn(t, "s3cret\n", "wrong\n", ok)
+	if err := c.Ping(); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Ping with the wrong secret = %v", err)
+	}
+	if got := s.received(); len(got) != 0 {
+		t.Errorf("command sent after failed authentication: %q", got)
+	}
+
+	// Without -S varnishd sends no challenge
+	c, _ = newStandIn(t, "", "", ok)
+	c.SecretFile = filepath.Join(t.TempDir(), "missing")
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping without authentication = %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	c, s := newStandIn(t, "s3cret\n", "s3cret\n", func(line string) (int, string) {
+		switch {
+		case strings.HasPrefix(line, "status"):
+			// The body has newlines and ends in one
+			return StatusOK, "Child in state running\n"
+		case strings.HasPrefix(line, "vcl.use"):
+			return StatusCant, "No VCL named missing known."
+		case strings.HasPrefix(line, "vcl.list"):
+			return StatusOK, `[ 2, ["vcl.list", "-j"], 1700000000.000,
+  {"status": "active", "state": "auto", "temperature": "warm", "busy": 3, "name": "boot"},
+  {"status": "available", "state": "cold", "temperature": "cold", "busy": 0, "name": "ironstack_1"}
+]`
+		}
+		return StatusOK, ""
+	})
+
+	if got, err := c.Status(); err != nil || got != "Child in state running" {
+		t.Errorf("Status() = %q, %v", got, err)
+	}
+	if err := c.Ban("req.http.host", "==", "example.com", "&&", "req.url", "~", `^/a b"c\d`); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.VCLLoad("ironstack_1", "/etc/varnish/my site.vcl"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.VCLUse("missing")
+	var cliErr *Error
+	if !errors.As(err, &cliErr) || cliErr.Status != StatusCant || cliErr.Command != "vcl.use" || cliErr.Message != "No VCL named missing known." {
+		t.Errorf("VCLUse error = %v", err)
+	}
+	vcls, err := c.VCLList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vcls) != 2 || vcls[0] != (VCL{Name: "boot", Status: "active", State: "auto", Temperature: "warm", Busy: 3}) || vcls[1].Name != "ironstack_1" {
+		t.Errorf("VCLList() = %+v", vcls)
+	}
+	if err := c.Ban(); err == nil {
+		t.Error("empty ban succeeded")
+	}
+
+	want := []string{
+		"status",
+		`ban req.http.host == example.com && req.url ~ "^/a b\"c\\d"`,
+		`vcl.load ironstack_1 "/etc/varnish/my site.vcl"`,
+		"vcl.use missing",
+		"vcl.list -j",
+	}
+	if got := s.received(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("received:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		status int
+		body   string
+		err    string
+	}{
+		{"padded header", "200 5       \nhello\n", StatusOK, "hello", ""},
+		{"empty body", "200 0       \n\n", StatusOK, "", ""},
+		{"newlines in body", "300 6       \na\nb\n\nc\n", StatusCant, "a\nb\n\nc", ""},
+		{"body longer than a line", "200 3       \nabcdef\n", StatusOK, "abc", ""},
+		{"malformed header", "200\nhello\n", 0, "", "malformed response header"},
+		{"negative length", "200 -1\n\n", 0, "", "malformed response header"},
+		{"short body", "200 10      \nhello\n", 0, "", "reading response"},
+		{"no header", "", 0, "", "reading response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cn := &conn{r: bufio.NewReader(strings.NewReader(tt.data))}
+			status, body, err := cn.read()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("read error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || status != tt.status || body != tt.body {
+				t.Errorf("read = %d, %q, %v; want %d, %q", status, body, err, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"ping", "ping"},
+		{"req.url", "req.url"},
+		{"^/shop/(cart|checkout)", "^/shop/(cart|checkout)"},
+		{"", `""`},
+		{"a b", `"a b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\path`, `"C:\\path"`},
+		{"line\nbreak\r\ttab", `"line\nbreak\r\ttab"`},
+		{"{ inline }", `"{ inline }"`},
+		{"ünïcode", "ünïcode"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -3,19 +3,26 @@ package wordpress
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
 )
 
 // WordPress manages WordPress installations via WP-CLI
 type WordPress struct {
-	Path string
+	Path        string
+	RedisHost   string
+	RedisPort   int
+	ObjectCache config.ObjectCache // the site's object cache location from the registry
+	Runner      runner.Runner
 }
 
 // New creates a WordPress manager for a site
-func New(path string) *WordPress {
-	return &WordPress{Path: path}
+func New(path string, cfg *config.Settings, r runner.Runner) *WordPress {
+	return &WordPress{Path: path, RedisHost: cfg.Redis.Host, RedisPort: cfg.Ports.Redis, Runner: r}
 }
 
 // Install downloads and installs WordPress
@@ -25,65 +32,44 @@ func (wp *WordPress) Install(url, title, adminUser, adminEmail, adminPass string
 		return fmt.Errorf("download failed: %w", err)
 	}
 
-	// Install WordPress
+	// Install WordPress. The password is answered on standard input to keep
+	// it out of the process list.
 	args := []string{
 		"core", "install",
 		"--url=" + url,
 		"--title=" + title,
 		"--admin_user=" + adminUser,
 		"--admin_email=" + adminEmail,
-		"--admin_password=" + adminPass,
 		"--skip-email",
+		"--prompt=admin_password",
 	}
-	if err := wp.run(args...); err != nil {
+	if err := wp.runInput(adminPass+"\n", args...); err != nil {
 		return fmt.Errorf("install failed: %w", err)
 	}
 
 	return nil
 }
 
-// CreateConfig creates wp-config.php
+// CreateConfig creates wp-config.php. The password is answered on standard
+// input to keep it out of the process list.
 func (wp *WordPress) CreateConfig(dbName, dbUser, dbPass, dbHost string) error {
 	args := []string{
 		"config", "create",
 		"--dbname=" + dbName,
 		"--dbuser=" + dbUser,
-		"--dbpass=" + dbPass,
 		"--dbhost=" + dbHost,
+		"--prompt=dbpass",
 	}
-	return wp.run(args...)
+	return wp.runInput(dbPass+"\n", args...)
 }
 
-// AutoTune applies performance optimizations
+// AutoTune applies performance optimizations. The constants are written
+// directly into wp-config.php, so re-running it is safe.
 func (wp *WordPress) AutoTune() error {
-	configs := map[string]string{
-		"WP_MEMORY_LIMIT":     "'256M'",
-		"WP_MAX_MEMORY_LIMIT": "'512M'",
-		"WP_POST_REVISIONS":   "5",
-		"AUTOSAVE_INTERVAL":   "120",
-		"EMPTY_TRASH_DAYS":    "7",
-		"DISABLE_WP_CRON":     "true",
-		"WP_CACHE":            "true",
-		"DISALLOW_FILE_EDIT":  "true",
-		"FORCE_SSL_ADMIN":     "true",
-	}
-
-	for key, value := range configs {
-		wp.run("config", "set", key, value, "--raw")
-	}
-
-	// DragonflyDB/Redis settings
-	redisConfigs := map[string]string{
-		"WP_REDIS_HOST":     "'127.0.0.1'",
-		"WP_REDIS_PORT":     "6379",
-		"WP_REDIS_DATABASE": "0",
-	}
-
-	for key, value := range redisConfigs {
-		wp.run("config", "set", key, value, "--raw")
-	}
-
-	return nil
+	conf := &config.WordPress{RedisHost: wp.RedisHost, RedisPort: wp.RedisPort, ObjectCache: wp.ObjectCache}
+	path := filepath.Join(wp.Path, "public", "wp-config.php")
+	_, err := wpconfig.Edit(wp.Runner, path, conf.OptimizeConfig)
+	return err
 }
 
 // InstallPlugin installs and activates a plugin
@@ -125,34 +111,37 @@ func (wp *WordPress) UpdateThemes() error {
 	return wp.run("theme", "update", "--all")
 }
 
-// UpdateAll updates core, plugins, and themes
+// UpdateAll updates core, plugins, and themes. Each update is attempted;
+// failures are returned together as *runner.Errors.
 func (wp *WordPress) UpdateAll() error {
-	wp.UpdateCore()
-	wp.UpdatePlugins()
-	wp.UpdateThemes()
-	return nil
+	var errs runner.Errors
+	errs.Add("update core", wp.UpdateCore())
+	errs.Add("update plugins", wp.UpdatePlugins())
+	errs.Add("update themes", wp.UpdateThemes())
+	return errs.Err()
 }
 
 // Harden applies security hardening
 func (wp *WordPress) Harden() error {
-	// Remove default themes
+	// Remove default themes and Hello Dolly and Akismet. They may already
+	// be gone, so failures are not reported.
 	wp.run("theme", "delete", "twentytwentytwo")
 	wp.run("theme", "delete", "twentytwentythree")
-
-	// Remove Hello Dolly and Akismet if not activated
 	wp.run("plugin", "delete", "hello")
 	wp.run("plugin", "delete", "akismet")
 
+	var errs runner.Errors
+
 	// Disable XML-RPC
-	wp.run("config", "set", "XMLRPC_REQUEST", "false", "--raw")
+	errs.Add("disable XML-RPC", wp.run("config", "set", "XMLRPC_REQUEST", "false", "--raw"))
 
 	// Set secure file permissions
 	publicDir := filepath.Join(wp.Path, "public")
-	exec.Command("find", publicDir, "-type", "d", "-exec", "chmod", "755", "{}", ";").Run()
-	exec.Command("find", publicDir, "-type", "f", "-exec", "chmod", "644", "{}", ";").Run()
-	exec.Command("chmod", "400", filepath.Join(publicDir, "wp-config.php")).Run()
+	errs.Add("set directory permissions", wp.Runner.Run("find", publicDir, "-type", "d", "-exec", "chmod", "755", "{}", ";"))
+	errs.Add("set file permissions", wp.Runner.Run("find", publicDir, "-type", "f", "-exec", "chmod", "644", "{}", ";"))
+	errs.Add("protect wp-config.php", wp.Runner.Run("chmod", "400", filepath.Join(publicDir, "wp-config.php")))
 
-	return nil
+	return errs.Err()
 }
 
 // EnableMultisite enables WordPress Multisite
@@ -204,24 +193,38 @@ func (wp *WordPress) OptimizeDB() error {
 
 // FlushCache flushes all caches
 func (wp *WordPress) FlushCache() error {
-	wp.run("cache", "flush")
-	wp.run("redis", "flush")
-	return nil
+	var errs runner.Errors
+	errs.Add("flush object cache", wp.run("cache", "flush"))
+	errs.Add("flush Redis", wp.run("redis", "flush"))
+	return errs.Err()
 }
 
 // run executes a WP-CLI command
 func (wp *WordPress) run(args ...string) error {
+	return wp.Runner.RunCmd(wp.command(args...))
+}
+
+// runInput executes a WP-CLI command that reads input, e.g. the answers to
+// its --prompt questions
+func (wp *WordPress) runInput(input string, args ...string) error {
+	cmd := wp.command(args...)
+	cmd.Stdin = strings.NewReader(input)
+	return wp.Runner.RunCmd(cmd)
+}
+
+// command returns a WP-CLI command for the site, printing to the terminal
+func (wp *WordPress) command(args ...string) *runner.Cmd {
 	args = append(args, "--path="+filepath.Join(wp.Path, "public"))
-	cmd := exec.Command("wp", args...)
+	cmd := runner.Command("wp", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return cmd
 }
 
 // output runs a command and returns output
 func (wp *WordPress) output(args ...string) (string, error) {
 	args = append(args, "--path="+filepath.Join(wp.Path, "public"))
-	out, err := exec.Command("wp", args...).Output()
+	out, err := wp.Runner.Output("wp", args...)
 	return string(out), err
 }
 
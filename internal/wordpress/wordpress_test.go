@@ -0,0 +1,125 @@
+package wordpress
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxaatest/ironstack/internal/config"
+	"github.com/maxaatest/ironstack/internal/runner"
+	"github.com/maxaatest/ironstack/internal/wpconfig"
+)
+
+func TestUpdateAll(t *testing.T) {
+	fake := runner.NewFake()
+	fake.On("wp plugin update", "", errors.New("exit status 1"))
+	wp := New("/var/www/example.com", config.Default(), fake)
+
+	err := wp.UpdateAll()
+	var errs *runner.Errors
+	if !errors.As(err, &errs) || len(errs.Steps) != 1 || errs.Steps[0].Step != "update plugins" {
+		t.Fatalf("UpdateAll error = %v", err)
+	}
+	// Themes are still updated after the plugins failed
+	want := []string{
+		"wp core update --path=/var/www/example.com/public",
+		"wp plugin update --all --path=/var/www/example.com/public",
+		"wp theme update --all --path=/var/www/example.com/public",
+	}
+	if !reflect.DeepEqual(fake.Calls, want) {
+		t.Errorf("calls:\n%s\nwant:\n%s", strings.Join(fake.Calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestListPlugins(t *testing.T) {
+	fake := runner.NewFake()
+	fake.On("wp plugin list", "name,status,version\nredis-cache,active,2.5.4\nakismet,inactive,5.3\n", nil)
+	wp := New("/var/www/example.com", config.Default(), fake)
+
+	plugins, err := wp.ListPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Plugin{{"redis-cache", "active", "2.5.4"}, {"akismet", "inactive", "5.3"}}
+	if !reflect.DeepEqual(plugins, want) {
+		t.Errorf("ListPlugins() = %+v, want %+v", plugins, want)
+	}
+	if !fake.Ran("wp plugin list --format=csv --fields=name,status,version --path=/var/www/example.com/public") {
+		t.Errorf("calls: %v", fake.Calls)
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "public", "wp-config.php")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "<?php\ndefine( 'DB_NAME', 'x' );\n/* That's all, stop editing! Happy publishing. */\n"
+	if err := os.WriteFile(path, []byte(src), 0640); err != nil {
+		t.Fatal(err)
+	}
+	fake := runner.NewFake()
+	fake.Disk = true
+	wp := New(dir, config.Default(), fake)
+	wp.ObjectCache = config.ObjectCache{Database: 5, Prefix: "example_com:"}
+
+	if err := wp.AutoTune(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := wpconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"WP_REDIS_DATABASE": "5", "WP_CACHE_KEY_SALT": "'example_com:'", "DISABLE_WP_CRON": "true"} {
+		if got, _ := f.Raw(name); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+	// A second run leaves the file alone
+	if err := wp.AutoTune(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(f.Bytes()) {
+		t.Errorf("second AutoTune changed wp-config.php:\n%s", data)
+	}
+}
+
+func TestPasswordsOnStdin(t *testing.T) {
+	fake := runner.NewFake()
+	inputs := make(map[string]string)
+	fake.Handle("wp ", func(c *runner.Cmd) error {
+		if c.Stdin != nil {
+			data, err := io.ReadAll(c.Stdin)
+			if err != nil {
+				return err
+			}
+			inputs[c.Args[0]+" "+c.Args[1]] = string(data)
+		}
+		return nil
+	})
+	wp := New("/var/www/example.com", config.Default(), fake)
+
+	if err := wp.CreateConfig("example_com_db", "example_com_user", "db-s3cret", "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wp.Install("https://example.com", "Example", "admin", "admin@example.com", "admin-s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"config create": "db-s3cret\n", "core install": "admin-s3cret\n"}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("inputs = %q, want %q", inputs, want)
+	}
+	for _, call := range fake.Calls {
+		if strings.Contains(call, "s3cret") {
+			t.Errorf("password on the command line: %s", call)
+		}
+	}
+	if !fake.Ran("wp config create --dbname=example_com_db --dbuser=example_com_user --dbhost=localhost --prompt=dbpass") {
+		t.Errorf("calls:\n%s", strings.Join(fake.Calls, "\n"))
+	}
+}
@@ -0,0 +1,247 @@
+package wpconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// span delimits a value expression in the source
+type span struct {
+	start, end int
+}
+
+// scan finds the define() calls and the $table_prefix assignment in f.src.
+// It understands enough PHP to skip strings and comments, so commented-out
+// definitions are ignored.
+func (f *File) scan() error {
+	f.defines = nil
+	f.prefix = nil
+	s := f.src
+	for i := 0; i < len(s); {
+		switch {
+		case isCommentStart(s, i):
+			end, err := skipComment(s, i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case s[i] == '\'' || s[i] == '"':
+			end, err := skipString(s, i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case s[i] == '$':
+			j := i + 1
+			for j < len(s) && isIdent(s[j]) {
+				j++
+			}
+			if s[i+1:j] == "table_prefix" && f.prefix == nil {
+				value, next, err := parseAssignment(s, j)
+				if err != nil {
+					return err
+				}
+				if value != nil {
+					f.prefix = value
+					j = next
+				}
+			}
+			i = j
+		case isIdentStart(s[i]):
+			j := i
+			for j < len(s) && isIdent(s[j]) {
+				j++
+			}
+			if strings.EqualFold(s[i:j], "define") && !isMember(s, i) {
+				d, next, err := parseDefine(s, j)
+				if err != nil {
+					return err
+				}
+				if d != nil {
+					f.defines = append(f.defines, *d)
+					j = next
+				}
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+// parseDefine parses the arguments of a define call starting after the
+// keyword. It returns nil if the call's name is not a string literal.
+func parseDefine(s string, pos int) (*define, int, error) {
+	i, err := skipSpace(s, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i >= len(s) || s[i] != '(' {
+		return nil, pos, nil
+	}
+	if i, err = skipSpace(s, i+1); err != nil {
+		return nil, 0, err
+	}
+	if i >= len(s) || (s[i] != '\'' && s[i] != '"') {
+		return nil, pos, nil
+	}
+	end, err := skipString(s, i)
+	if err != nil {
+		return nil, 0, err
+	}
+	name, ok := unquote(s[i:end])
+	if !ok {
+		return nil, pos, nil
+	}
+	if i, err = skipSpace(s, end); err != nil {
+		return nil, 0, err
+	}
+	if i >= len(s) || s[i] != ',' {
+		return nil, 0, fmt.Errorf("line %d: define('%s') has no value", lineOf(s, i), name)
+	}
+	if i, err = skipSpace(s, i+1); err != nil {
+		return nil, 0, err
+	}
+
+	// The value runs to the next top-level comma or the closing parenthesis
+	value, next, err := scanExpr(s, i, ",)")
+	if err != nil {
+		return nil, 0, fmt.Errorf("define('%s'): %w", name, err)
+	}
+	return &define{name: name, span: value}, next, nil
+}
+
+// parseAssignment parses "= expr;" starting after a variable name
+func parseAssignment(s string, pos int) (*span, int, error) {
+	i, err := skipSpace(s, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i >= len(s) || s[i] != '=' || strings.HasPrefix(s[i:], "==") {
+		return nil, pos, nil
+	}
+	if i, err = skipSpace(s, i+1); err != nil {
+		return nil, 0, err
+	}
+	value, next, err := scanExpr(s, i, ";")
+	if err != nil {
+		return nil, 0, fmt.Errorf("$table_prefix: %w", err)
+	}
+	return &value, next, nil
+}
+
+// scanExpr scans an expression starting at i up to the first top-level
+// character in stop. It returns the expression without trailing whitespace
+// and the position of the stop character.
+func scanExpr(s string, i int, stop string) (span, int, error) {
+	start := i
+	depth := 0
+	var err error
+	for i < len(s) {
+		switch c := s[i]; {
+		case isCommentStart(s, i):
+			if i, err = skipComment(s, i); err != nil {
+				return span{}, 0, err
+			}
+			continue
+		case c == '\'' || c == '"':
+			if i, err = skipString(s, i); err != nil {
+				return span{}, 0, err
+			}
+			continue
+		case depth == 0 && strings.IndexByte(stop, c) >= 0:
+			end := start + len(strings.TrimRight(s[start:i], " \t\r\n"))
+			return span{start: start, end: end}, i, nil
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		}
+		i++
+	}
+	return span{}, 0, fmt.Errorf("line %d: unterminated expression", lineOf(s, start))
+}
+
+// skipSpace skips whitespace and comments
+func skipSpace(s string, i int) (int, error) {
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\r' || s[i] == '\n':
+			i++
+		case isCommentStart(s, i):
+			end, err := skipComment(s, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		default:
+			return i, nil
+		}
+	}
+	return i, nil
+}
+
+func isCommentStart(s string, i int) bool {
+	return s[i] == '#' || strings.HasPrefix(s[i:], "//") || strings.HasPrefix(s[i:], "/*")
+}
+
+// skipComment returns the position after the comment starting at i. Line
+// comments end before the newline or a closing ?> tag.
+func skipComment(s string, i int) (int, error) {
+	if strings.HasPrefix(s[i:], "/*") {
+		end := strings.Index(s[i+2:], "*/")
+		if end < 0 {
+			return 0, fmt.Errorf("line %d: unterminated comment", lineOf(s, i))
+		}
+		return i + 2 + end + 2, nil
+	}
+	for j := i; j < len(s); j++ {
+		if s[j] == '\n' || strings.HasPrefix(s[j:], "?>") {
+			return j, nil
+		}
+	}
+	return len(s), nil
+}
+
+// skipString returns the position after the string literal starting at i
+func skipString(s string, i int) (int, error) {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("line %d: unterminated string", lineOf(s, i))
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// isMember reports whether the identifier at i is preceded by ->, :: or $
+// or is part of a longer identifier, i.e. is not a call to define()
+func isMember(s string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	prev := s[i-1]
+	if isIdent(prev) || prev == '$' {
+		return true
+	}
+	return strings.HasSuffix(s[:i], "->") || strings.HasSuffix(s[:i], "::")
+}
+
+func lineOf(s string, i int) int {
+	if i > len(s) {
+		i = len(s)
+	}
+	return strings.Count(s[:i], "\n") + 1
+}
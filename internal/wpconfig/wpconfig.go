@@ -0,0 +1,278 @@
+package wpconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maxaatest/ironstack/internal/runner"
+)
+
+// ErrNotDefined is returned when a constant is not defined in the file
+var ErrNotDefined = errors.New("constant not defined")
+
+// stopEditingMarker starts the comment new constants are inserted above:
+// /* That's all, stop editing! Happy publishing. */
+const stopEditingMarker = "stop editing"
+
+// File is a parsed wp-config.php. Edits only touch the affected value or
+// insert a line, so comments and formatting are kept byte for byte.
+type File struct {
+	src     string
+	defines []define
+	prefix  *span // value of $table_prefix
+}
+
+// define is a define('NAME', value) call
+type define struct {
+	name string
+	span
+}
+
+// Constant is a constant name with its PHP value expression
+type Constant struct {
+	Name string
+	Expr string // e.g. '256M', true or 120
+}
+
+// Parse reads the define() calls and $table_prefix of a wp-config.php
+func Parse(data []byte) (*File, error) {
+	f := &File{src: string(data)}
+	if err := f.scan(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load reads and parses a wp-config.php
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Bytes returns the file contents including any edits
+func (f *File) Bytes() []byte {
+	return []byte(f.src)
+}
+
+// Names returns the defined constants in file order
+func (f *File) Names() []string {
+	names := make([]string, len(f.defines))
+	for i, d := range f.defines {
+		names[i] = d.name
+	}
+	return names
+}
+
+// Raw returns the PHP expression a constant is defined as, e.g. 'secret' or true
+func (f *File) Raw(name string) (string, bool) {
+	d := f.find(name)
+	if d == nil {
+		return "", false
+	}
+	return f.src[d.start:d.end], true
+}
+
+// Get returns the value of a constant defined as a string literal
+func (f *File) Get(name string) (string, error) {
+	raw, ok := f.Raw(name)
+	if !ok {
+		return "", fmt.Errorf("%s: %w", name, ErrNotDefined)
+	}
+	value, ok := unquote(raw)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string literal: %s", name, raw)
+	}
+	return value, nil
+}
+
+// Set defines a constant as a string literal
+func (f *File) Set(name, value string) error {
+	return f.SetRaw(name, Quote(value))
+}
+
+// SetRaw defines a constant as a PHP expression. An existing definition is
+// replaced in place; otherwise a define() line is inserted above the "stop
+// editing" comment. Setting the current value leaves the file unchanged.
+func (f *File) SetRaw(name, expr string) error {
+	if d := f.find(name); d != nil {
+		return f.replace(d.span, expr)
+	}
+	line := fmt.Sprintf("define( %s, %s );\n", Quote(name), expr)
+	return f.insert(line)
+}
+
+// SetAll applies SetRaw to each constant in order
+func (f *File) SetAll(constants []Constant) error {
+	for _, c := range constants {
+		if err := f.SetRaw(c.Name, c.Expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TablePrefix returns the value of $table_prefix
+func (f *File) TablePrefix() (string, error) {
+	if f.prefix == nil {
+		return "", errors.New("$table_prefix is not set")
+	}
+	raw := f.src[f.prefix.start:f.prefix.end]
+	value, ok := unquote(raw)
+	if !ok {
+		return "", fmt.Errorf("$table_prefix is not a string literal: %s", raw)
+	}
+	return value, nil
+}
+
+// SetTablePrefix sets $table_prefix, adding the assignment if it is missing
+func (f *File) SetTablePrefix(prefix string) error {
+	if f.prefix != nil {
+		return f.replace(*f.prefix, Quote(prefix))
+	}
+	return f.insert(fmt.Sprintf("$table_prefix = %s;\n", Quote(prefix)))
+}
+
+func (f *File) find(name string) *define {
+	// PHP keeps the first definition of a constant, so edit that one
+	for i := range f.defines {
+		if f.defines[i].name == name {
+			return &f.defines[i]
+		}
+	}
+	return nil
+}
+
+func (f *File) replace(sp span, expr string) error {
+	f.src = f.src[:sp.start] + expr + f.src[sp.end:]
+	return f.scan()
+}
+
+// insert adds a line above the "stop editing" comment, or before the
+// wp-settings.php bootstrap or a closing ?> if the marker was removed
+func (f *File) insert(line string) error {
+	pos := f.insertPos()
+	if pos > 0 && f.src[pos-1] != '\n' {
+		line = "\n" + line
+	}
+	f.src = f.src[:pos] + line + f.src[pos:]
+	return f.scan()
+}
+
+func (f *File) insertPos() int {
+	// The sample config's "custom values" comment also mentions the marker,
+	// so use the last occurrence
+	lower := strings.ToLower(f.src)
+	i := strings.LastIndex(lower, stopEditingMarker)
+	if i < 0 {
+		i = strings.Index(lower, "wp-settings.php")
+	}
+	if i >= 0 {
+		return strings.LastIndexByte(f.src[:i], '\n') + 1
+	}
+	if i = strings.LastIndex(f.src, "?>"); i >= 0 && strings.TrimSpace(f.src[i+2:]) == "" {
+		return i
+	}
+	return len(f.src)
+}
+
+// Quote returns s as a single-quoted PHP string literal
+func Quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// Edit loads path, applies edit and writes the result back with Write. It
+// returns the original contents so callers can roll back. In dry-run mode a
+// missing file is treated as empty.
+func Edit(r runner.Runner, path string, edit func(f *File) error) ([]byte, error) {
+	original, err := os.ReadFile(path)
+	if err != nil && !runner.IsDryRun(r) {
+		return nil, err
+	}
+	f, err := Parse(original)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := edit(f); err != nil {
+		return nil, err
+	}
+	return original, Write(r, path, f.Bytes())
+}
+
+// Write replaces path through a temporary file so PHP never reads a
+// half-written config. Owner and mode of the existing file are kept.
+func Write(r runner.Runner, path string, data []byte) error {
+	mode := os.FileMode(0640)
+	fi, statErr := os.Stat(path)
+	if statErr == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := path + ".ironstack-tmp"
+	if err := r.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if statErr == nil {
+		if err := r.Run("chown", "--reference="+path, tmp); err != nil {
+			r.Remove(tmp)
+			return err
+		}
+	}
+	return r.Rename(tmp, path)
+}
+
+// unquote decodes a PHP string literal. Double-quoted strings containing
+// variables are rejected.
+func unquote(raw string) (string, bool) {
+	if len(raw) < 2 || raw[0] != raw[len(raw)-1] {
+		return "", false
+	}
+	body := raw[1 : len(raw)-1]
+	switch raw[0] {
+	case '\'':
+		var b strings.Builder
+		for i := 0; i < len(body); i++ {
+			if body[i] == '\\' && i+1 < len(body) && (body[i+1] == '\\' || body[i+1] == '\'') {
+				i++
+			}
+			b.WriteByte(body[i])
+		}
+		return b.String(), true
+	case '"':
+		if strings.ContainsRune(body, '$') {
+			return "", false
+		}
+		var b strings.Builder
+		for i := 0; i < len(body); i++ {
+			if body[i] == '\\' && i+1 < len(body) {
+				i++
+				switch body[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case '\\', '"', '$':
+					b.WriteByte(body[i])
+				default:
+					b.WriteByte('\\')
+					b.WriteByte(body[i])
+				}
+				continue
+			}
+			b.WriteByte(body[i])
+		}
+		return b.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,231 @@
+package wpconfig
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sample is a wp-config.php as WP-CLI writes it, with comments and unusual
+// spacing the parser must keep
+const sample = `<?php
+/**
+ * The base configuration for WordPress
+ *
+ * define( 'DB_NAME', 'not_this_one' ); inside a comment is ignored
+ */
+
+// ** Database settings ** //
+define( 'DB_NAME', 'example_db' );
+define('DB_USER',   "example_user"); // trailing comment
+define( 'DB_PASSWORD', 'p\'ass\\word' );
+define( 'DB_HOST', 'localhost' );
+
+/* Custom values go between this line and the "stop editing" line. */
+define( 'WP_DEBUG', false );
+
+$table_prefix = 'wp_';
+
+/* That's all, stop editing! Happy publishing. */
+
+/** Absolute path to the WordPress directory. */
+if ( ! defined( 'ABSPATH' ) ) {
+	define( 'ABSPATH', __DIR__ . '/' );
+}
+
+require_once ABSPATH . 'wp-settings.php';
+`
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"sample", sample},
+		{"empty", ""},
+		{"no marker", "<?php\ndefine('DB_NAME', 'x');\n"},
+		{"closing tag", "<?php\ndefine( 'A', 1 );\n?>\n"},
+		{"crlf", strings.ReplaceAll(sample, "\n", "\r\n")},
+		{"expression value", "<?php\ndefine( 'WP_HOME', 'https://' . $_SERVER['HTTP_HOST'] );\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := string(f.Bytes()); got != tt.src {
+				t.Errorf("Bytes() changed the file:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	f, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, want string
+		err        error
+	}{
+		{"DB_NAME", "example_db", nil},
+		{"DB_USER", "example_user", nil},
+		{"DB_PASSWORD", `p'ass\word`, nil},
+		{"WP_CACHE", "", ErrNotDefined},
+	}
+	for _, tt := range tests {
+		got, err := f.Get(tt.name)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Get(%s) = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := f.Get("WP_DEBUG"); err == nil {
+		t.Error("Get(WP_DEBUG) accepted a non-string value")
+	}
+	if prefix, err := f.TablePrefix(); err != nil || prefix != "wp_" {
+		t.Errorf("TablePrefix() = %q, %v", prefix, err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		edit func(f *File) error
+		want string
+	}{
+		{
+			name: "replace in place",
+			src:  "<?php\ndefine('DB_USER',   \"old\"); // trailing comment\n",
+			edit: func(f *File) error { return f.Set("DB_USER", "new") },
+			want: "<?php\ndefine('DB_USER',   'new'); // trailing comment\n",
+		},
+		{
+			name: "replace first definition only",
+			src:  "<?php\ndefine('A', 1);\ndefine('A', 2);\n",
+			edit: func(f *File) error { return f.SetRaw("A", "3") },
+			want: "<?php\ndefine('A', 3);\ndefine('A', 2);\n",
+		},
+		{
+			name: "insert above marker",
+			src:  "<?php\ndefine('A', 1);\n\n/* That's all, stop editing! Happy publishing. */\nrequire_once ABSPATH . 'wp-settings.php';\n",
+			edit: func(f *File) error { return f.SetRaw("WP_CACHE", "true") },
+			want: "<?php\ndefine('A', 1);\n\ndefine( 'WP_CACHE', true );\n/* That's all, stop editing! Happy publishing. */\nrequire_once ABSPATH . 'wp-settings.php';\n",
+		},
+		{
+			name: "insert before wp-settings.php without marker",
+			src:  "<?php\ndefine('A', 1);\nrequire_once ABSPATH . 'wp-settings.php';\n",
+			edit: func(f *File) error { return f.SetRaw("WP_CACHE", "true") },
+			want: "<?php\ndefine('A', 1);\ndefine( 'WP_CACHE', true );\nrequire_once ABSPATH . 'wp-settings.php';\n",
+		},
+		{
+			name: "insert before closing tag",
+			src:  "<?php\ndefine('A', 1);\n?>\n",
+			edit: func(f *File) error { return f.SetRaw("B", "2") },
+			want: "<?php\ndefine('A', 1);\ndefine( 'B', 2 );\n?>\n",
+		},
+		{
+			name: "append without marker or bootstrap",
+			src:  "<?php\ndefine('A', 1);",
+			edit: func(f *File) error { return f.SetRaw("B", "2") },
+			want: "<?php\ndefine('A', 1);\ndefine( 'B', 2 );\n",
+		},
+		{
+			name: "quote special characters",
+			src:  "<?php\n",
+			edit: func(f *File) error { return f.Set("DB_PASSWORD", `it's\`) },
+			want: "<?php\ndefine( 'DB_PASSWORD', 'it\\'s\\\\' );\n",
+		},
+		{
+			name: "set table prefix",
+			src:  "<?php\n$table_prefix  = 'wp_'; // keep\n",
+			edit: func(f *File) error { return f.SetTablePrefix("wp2_") },
+			want: "<?php\n$table_prefix  = 'wp2_'; // keep\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if err := tt.edit(f); err != nil {
+				t.Fatalf("edit: %v", err)
+			}
+			if got := string(f.Bytes()); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetKeepsComments(t *testing.T) {
+	f, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("DB_USER", "other_user"); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(sample, `define('DB_USER',   "example_user"); // trailing comment`, `define('DB_USER',   'other_user'); // trailing comment`, 1)
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("Set changed more than the value:\n%s", got)
+	}
+	// The define() in the header comment is not a definition
+	if got, _ := f.Get("DB_NAME"); got != "example_db" {
+		t.Errorf("DB_NAME = %q, want example_db", got)
+	}
+}
+
+func TestSetAllIdempotent(t *testing.T) {
+	constants := []Constant{
+		{Name: "WP_MEMORY_LIMIT", Expr: "'256M'"},
+		{Name: "WP_DEBUG", Expr: "false"},
+		{Name: "DISABLE_WP_CRON", Expr: "true"},
+	}
+	for name, src := range map[string]string{
+		"marker":    sample,
+		"no marker": "<?php\ndefine('DB_NAME', 'x');\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := Parse([]byte(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.SetAll(constants); err != nil {
+				t.Fatal(err)
+			}
+			first := string(f.Bytes())
+			if err := f.SetAll(constants); err != nil {
+				t.Fatal(err)
+			}
+			if second := string(f.Bytes()); second != first {
+				t.Errorf("second SetAll changed the file:\n%s\nfirst:\n%s", second, first)
+			}
+			for _, c := range constants {
+				if raw, _ := f.Raw(c.Name); raw != c.Expr {
+					t.Errorf("%s = %s, want %s", c.Name, raw, c.Expr)
+				}
+			}
+			if name == "marker" {
+				marker := strings.Index(first, "That's all, stop editing!")
+				if i := strings.Index(first, "'WP_MEMORY_LIMIT'"); i < 0 || i > marker {
+					t.Errorf("WP_MEMORY_LIMIT inserted below the stop editing marker:\n%s", first)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"<?php\ndefine( 'A', 'unterminated );\n",
+		"<?php\n/* unterminated comment\n",
+	} {
+		if _, err := Parse([]byte(src)); err == nil {
+			t.Errorf("Parse(%q) succeeded", src)
+		}
+	}
+}